@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/addrbook"
+	"github.com/udit2303/p2p-client/pkg/audit"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// auditFlags holds the audit trail flags of receivers
+type auditFlags struct {
+	enabled *bool
+	syslog  *string
+}
+
+// addAuditFlags registers -audit and -audit-syslog on fs
+func addAuditFlags(fs *flag.FlagSet) *auditFlags {
+	return &auditFlags{
+		enabled: fs.Bool("audit", false, "Record every incoming connection (peer, bytes, outcome) in ~/.p2p-client/audit.jsonl, for the audit command"),
+		syslog:  fs.String("audit-syslog", "", "Also send audit records to syslog: local, udp://host:port or tcp://host:port (implies -audit)"),
+	}
+}
+
+// open returns the audit log the flags ask for, or nil
+func (f *auditFlags) open() (*audit.Log, error) {
+	if !*f.enabled && *f.syslog == "" {
+		return nil, nil
+	}
+	path, err := audit.Path()
+	if err != nil {
+		return nil, err
+	}
+	l, err := audit.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if *f.syslog != "" {
+		if err := l.ForwardToSyslog(*f.syslog); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	log.Info("Auditing incoming connections", "path", path, "syslog", *f.syslog)
+	return l, nil
+}
+
+// runAudit implements `audit [flags]`: sums up the audit trail per peer
+func runAudit(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	since := fs.Duration("since", 0, "Only count connections from this long ago on, e.g. 24h (default everything kept)")
+	peer := fs.String("peer", "", "Only this peer: a key fingerprint or prefix of one, a saved peer name, or an IP")
+	records := fs.Bool("log", false, "List the connections one by one instead of summing them up")
+	jsonOut := fs.Bool("json", false, "Print JSON")
+	defaultPath, _ := audit.Path()
+	path := fs.String("file", defaultPath, "Audit log to read")
+	fs.Parse(args)
+
+	var from time.Time
+	if *since > 0 {
+		from = time.Now().Add(-*since)
+	}
+	list, err := audit.Read(*path, from)
+	if err != nil {
+		log.Error("Cannot read audit log", "error", err)
+		return 1
+	}
+	book, err := addrbook.Open()
+	if err != nil {
+		log.Warn("Cannot open address book; peers are shown by key only", "error", err)
+	}
+	if *peer != "" {
+		match := *peer
+		if book != nil {
+			if e, err := book.Get(*peer); err == nil && e.Fingerprint != "" {
+				match = e.Fingerprint
+			}
+		}
+		kept := list[:0]
+		for _, r := range list {
+			if audit.Matches(r, match) {
+				kept = append(kept, r)
+			}
+		}
+		list = kept
+	}
+	name := func(fingerprint string) string {
+		if book != nil {
+			if e := book.BySender(fingerprint); e != nil {
+				return e.Name
+			}
+		}
+		return "-"
+	}
+
+	if *records {
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			for _, r := range list {
+				enc.Encode(r)
+			}
+			return 0
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tREMOTE\tSENDER\tOUTCOME\tFILE\tIN\tOUT\tERROR")
+		for _, r := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Local().Format("2006-01-02 15:04:05"), r.Remote,
+				orDash(shortKey(r.Sender)), r.Outcome, orDash(r.File), util.FormatSize(r.BytesIn), util.FormatSize(r.BytesOut), orDash(r.Error))
+		}
+		tw.Flush()
+		return 0
+	}
+
+	stats := audit.Summarize(list)
+	if *jsonOut {
+		json.NewEncoder(os.Stdout).Encode(stats)
+		return 0
+	}
+	if len(stats) == 0 {
+		fmt.Println("No connections recorded")
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tNAME\tADDRESSES\tCONNS\tOK\tFAILED\tAUTH FAILED\tIN\tOUT\tLAST SEEN")
+	for _, s := range stats {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", shortKey(s.Peer), name(s.Peer), strings.Join(s.Addresses, ","),
+			s.Connections, s.Transfers, s.Failures, s.AuthFailures+s.LockedOut, util.FormatSize(s.BytesIn), util.FormatSize(s.BytesOut),
+			s.LastSeen.Local().Format("2006-01-02 15:04"))
+	}
+	tw.Flush()
+	return 0
+}
+
+// shortKey abbreviates a key fingerprint for tables, leaving IPs alone
+func shortKey(peer string) string {
+	if len(peer) == 64 && !strings.ContainsAny(peer, ".:") {
+		return peer[:16]
+	}
+	return peer
+}
+
+// orDash shows an empty table cell as "-"
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,7 @@
+//go:build !debug
+
+package main
+
+// debugBuild is set in builds made with -tags debug, which may announce
+// under the public default discovery code
+const debugBuild = false
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// consoleChat returns a chat for the CLI: each line typed on the console is
+// sent to the peer, and the peer's messages are printed. Input comes from
+// the terminal when stdin carries data.
+func consoleChat() *transfer.Chat {
+	chat := transfer.NewChat(func(text string) {
+		if !util.JSONEvents() {
+			fmt.Fprintf(util.ConsoleOutput(), "\npeer> %s\n", text)
+		}
+	})
+	go func() {
+		in, err := util.PromptInput()
+		if err != nil {
+			log.Warn("Chat input unavailable", "error", err)
+			return
+		}
+		defer in.Close()
+		lines := bufio.NewScanner(in)
+		for lines.Scan() {
+			text := strings.TrimSpace(lines.Text())
+			if text == "" {
+				continue
+			}
+			if err := chat.Send(text); err != nil {
+				log.Warn("Chat message not sent", "error", err)
+			}
+		}
+	}()
+	return chat
+}
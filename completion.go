@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/addrbook"
+)
+
+// Completion: `p2p completion <shell>` prints a script with which the shell
+// asks `p2p __complete <words>` for the candidates for the last word.
+// Commands come from the commands registry; a command's subcommands and
+// flags are read from its own -h output, so they can't go stale. Peer names
+// come from the address book, and where nothing is offered the shell falls
+// back to file names.
+
+func init() {
+	// Registered here, as they list the other commands
+	commands["help"] = command{runHelp, "Show the commands, or a command's flags"}
+	commands["completion"] = command{runCompletion, "Print a shell completion script: bash, zsh, fish or powershell"}
+	commands["__complete"] = command{run: runComplete}
+}
+
+// printCommands lists the commands that have a summary
+func printCommands(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name, cmd := range commands {
+		if cmd.summary != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Usage: p2p <command> [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "p2p help <command>" for a command's flags.`)
+}
+
+// runHelp implements `help [command [subcommand]]`
+func runHelp(args []string) int {
+	if len(args) == 0 {
+		printCommands(os.Stdout)
+		fmt.Println(`Without a command, p2p runs a classic node; run "p2p -h" for its flags.`)
+		return 0
+	}
+	cmd, ok := commands[args[0]]
+	if !ok || cmd.summary == "" {
+		fmt.Fprintf(os.Stderr, "Unknown command %q; run \"p2p help\" for the list\n", args[0])
+		return 2
+	}
+	// Every command prints its usage and flags for -h
+	return cmd.run(append(args[1:], "-h"))
+}
+
+// runCompletion implements `completion bash|zsh|fish|powershell`
+func runCompletion(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: p2p completion bash|zsh|fish|powershell")
+		return 2
+	}
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown shell %q, expected bash, zsh, fish or powershell\n", args[0])
+		return 2
+	}
+	fmt.Print(script)
+	return 0
+}
+
+// completionScripts are the completion scripts by shell. Each passes the
+// words after p2p, the one being completed last, to `p2p __complete`.
+var completionScripts = map[string]string{
+	"bash": `# p2p completion for bash; add to ~/.bashrc:
+#   source <(p2p completion bash)
+_p2p() {
+    local IFS=$'\n'
+    COMPREPLY=($(p2p __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _p2p p2p
+`,
+	"zsh": `#compdef p2p
+# p2p completion for zsh; add to ~/.zshrc:
+#   source <(p2p completion zsh)
+_p2p() {
+    local -a candidates
+    candidates=("${(@f)$(p2p __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    if [[ -n ${candidates[1]} ]]; then
+        compadd -a candidates
+    else
+        _files
+    fi
+}
+compdef _p2p p2p
+`,
+	"fish": `# p2p completion for fish; save as ~/.config/fish/completions/p2p.fish:
+#   p2p completion fish > ~/.config/fish/completions/p2p.fish
+function __p2p_complete
+    p2p __complete (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null
+end
+complete -c p2p -a '(__p2p_complete)'
+`,
+	"powershell": `# p2p completion for PowerShell; add to $PROFILE:
+#   p2p completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName p2p -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements | Select-Object -Skip 1 | ForEach-Object { $_.ToString() })
+    if ($wordToComplete -eq '') { $words += '""' }
+    p2p __complete @words 2>$null | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`,
+}
+
+// flagValues are the values offered for flags that take one of a few
+var flagValues = map[string][]string{
+	"cipher":     {"aes", "chacha", "auto"},
+	"chunk-size": {"auto"},
+	"discovery":  {"mdns", "static:", "tracker:"},
+	"mode":       {"receive-only", "send-only"},
+	"transport":  {addrbook.TransportTCP, addrbook.TransportLibp2p},
+}
+
+// peerArgs are the commands whose arguments are saved peers
+var peerArgs = map[string]bool{"bench": true, "peer set": true, "peer rm": true, "peer remove": true, "peer exchange": true, "peer pex": true}
+
+// runComplete implements the hidden `__complete <words>`, printing the
+// candidates for the last word, one per line
+func runComplete(args []string) int {
+	cur := ""
+	if len(args) > 0 {
+		cur = args[len(args)-1]
+		args = args[:len(args)-1]
+	}
+	if cur == `""` {
+		// PowerShell drops empty arguments, so it passes this instead
+		cur = ""
+	}
+	for _, c := range completions(args, cur) {
+		if strings.HasPrefix(c, cur) {
+			fmt.Println(c)
+		}
+	}
+	return 0
+}
+
+// completions returns the candidates for cur following words
+func completions(words []string, cur string) []string {
+	var path []string
+	if len(words) > 0 {
+		if _, ok := commands[words[0]]; ok {
+			path, words = words[:1], words[1:]
+		}
+	} else if !strings.HasPrefix(cur, "-") {
+		names := make([]string, 0, len(commands))
+		for name, cmd := range commands {
+			if cmd.summary != "" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	if len(path) > 0 && path[0] == "help" {
+		return completions(words, cur)
+	}
+
+	usage := readUsage(path)
+	for len(words) > 0 && slices.Contains(usage.subcommands, words[0]) {
+		path = append(path, words[0])
+		words = words[1:]
+		usage = readUsage(path)
+	}
+	if len(words) == 0 && len(usage.subcommands) > 0 && !strings.HasPrefix(cur, "-") {
+		return usage.subcommands
+	}
+	// The value of the flag before cur
+	if len(words) > 0 {
+		prev := words[len(words)-1]
+		if name := strings.TrimLeft(prev, "-"); strings.HasPrefix(prev, "-") && usage.flags[name] {
+			if name == "to" {
+				return peerNames()
+			}
+			return flagValues[name]
+		}
+	}
+	if strings.HasPrefix(cur, "-") {
+		flags := make([]string, 0, len(usage.flags))
+		for name := range usage.flags {
+			flags = append(flags, "-"+name)
+		}
+		sort.Strings(flags)
+		return flags
+	}
+	if peerArgs[strings.Join(path, " ")] {
+		return peerNames()
+	}
+	return nil
+}
+
+// usage is what a command's -h output says about it
+type usage struct {
+	subcommands []string
+	flags       map[string]bool // Whether each flag takes a value
+}
+
+// readUsage runs this program with the command path and -h, and reads the
+// subcommands from its usage lines ("Usage: p2p peer add ...") and the
+// flags from its flag list. An empty path is the classic node.
+func readUsage(path []string) usage {
+	u := usage{flags: map[string]bool{}}
+	self, err := os.Executable()
+	if err != nil {
+		return u
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	out, _ := exec.CommandContext(ctx, self, append(slices.Clone(path), "-h")...).CombinedOutput()
+
+	prefix := "p2p " + strings.Join(path, " ") + " "
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if rest, ok := strings.CutPrefix(line, "  -"); ok {
+			name, value, _ := strings.Cut(rest, " ")
+			u.flags[name] = value != ""
+			continue
+		}
+		_, rest, ok := strings.Cut(line, prefix)
+		if !ok || len(path) == 0 {
+			continue
+		}
+		word, _, _ := strings.Cut(rest, " ")
+		for _, sub := range strings.Split(word, "|") {
+			if sub != "" && !strings.ContainsAny(sub[:1], "[<-") && !slices.Contains(u.subcommands, sub) {
+				u.subcommands = append(u.subcommands, sub)
+			}
+		}
+	}
+	return u
+}
+
+// peerNames returns the names in the address book
+func peerNames() []string {
+	book, err := addrbook.Open()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range book.List() {
+		names = append(names, e.Name)
+	}
+	return names
+}
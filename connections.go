@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/daemon"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// daemonAPI calls the REST API of a running daemon and decodes the JSON
+// reply into out
+func daemonAPI(method, uiAddr, path string, out any) error {
+	req, err := http.NewRequest(method, "http://"+uiAddr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-P2P-Client", "cli")
+	token, err := daemon.APIToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach daemon at %s: %w", uiAddr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("daemon returned %s: %s", resp.Status, apiErr.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// runConnections implements `connections [flags]`: lists the daemon's open
+// connections
+func runConnections(args []string) int {
+	fs := flag.NewFlagSet("connections", flag.ExitOnError)
+	uiAddr := fs.String("ui", "127.0.0.1:7070", "Address of the daemon's web UI and API")
+	jsonOut := fs.Bool("json", false, "Print the list as JSON")
+	fs.Parse(args)
+
+	var conns []netconn.ConnInfo
+	if err := daemonAPI(http.MethodGet, *uiAddr, "/api/connections", &conns); err != nil {
+		log.Error("Cannot list connections", "error", err)
+		return 1
+	}
+	if *jsonOut {
+		json.NewEncoder(os.Stdout).Encode(conns)
+		return 0
+	}
+	if len(conns) == 0 {
+		fmt.Println("No active connections")
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tDIRECTION\tREMOTE\tTRANSFER\tIN\tOUT\tDURATION")
+	for _, c := range conns {
+		file := c.File
+		if file == "" {
+			file = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.ID, c.Direction, c.Remote, file,
+			util.FormatSize(c.BytesIn), util.FormatSize(c.BytesOut), time.Since(c.Started).Round(time.Second))
+	}
+	tw.Flush()
+	return 0
+}
+
+// runDisconnect implements `disconnect [flags] <peer>`: closes daemon
+// connections by ID, remote ip:port or remote IP
+func runDisconnect(args []string) int {
+	fs := flag.NewFlagSet("disconnect", flag.ExitOnError)
+	uiAddr := fs.String("ui", "127.0.0.1:7070", "Address of the daemon's web UI and API")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: p2p disconnect [flags] <id|ip:port|ip>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var res struct {
+		Closed int `json:"closed"`
+	}
+	path := "/api/connections/" + url.PathEscape(fs.Arg(0)) + "/disconnect"
+	if err := daemonAPI(http.MethodPost, *uiAddr, path, &res); err != nil {
+		log.Error("Disconnect failed", "error", err)
+		return 1
+	}
+	fmt.Printf("Closed %d connection(s)\n", res.Closed)
+	return 0
+}
+
+// runLockouts implements `lockouts [flags]`: lists the IPs the daemon
+// locked out for failing the handshake, or lifts a lockout
+func runLockouts(args []string) int {
+	fs := flag.NewFlagSet("lockouts", flag.ExitOnError)
+	uiAddr := fs.String("ui", "127.0.0.1:7070", "Address of the daemon's web UI and API")
+	jsonOut := fs.Bool("json", false, "Print the list as JSON")
+	unlock := fs.String("unlock", "", "Lift the lockout of this IP instead")
+	fs.Parse(args)
+
+	if *unlock != "" {
+		var res struct {
+			Unlocked string `json:"unlocked"`
+		}
+		if err := daemonAPI(http.MethodDelete, *uiAddr, "/api/lockouts/"+url.PathEscape(*unlock), &res); err != nil {
+			log.Error("Unlock failed", "error", err)
+			return 1
+		}
+		fmt.Printf("Unlocked %s\n", res.Unlocked)
+		return 0
+	}
+
+	var locked []netconn.Lockout
+	if err := daemonAPI(http.MethodGet, *uiAddr, "/api/lockouts", &locked); err != nil {
+		log.Error("Cannot list lockouts", "error", err)
+		return 1
+	}
+	if *jsonOut {
+		json.NewEncoder(os.Stdout).Encode(locked)
+		return 0
+	}
+	if len(locked) == 0 {
+		fmt.Println("No IPs locked out")
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tFAILURES\tLOCKOUTS\tLAST FAILURE\tREMAINING")
+	for _, l := range locked {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", l.IP, l.Failures, l.Lockouts,
+			l.LastFailure.Local().Format(time.DateTime), time.Until(l.Until).Round(time.Second))
+	}
+	tw.Flush()
+	return 0
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/udit2303/p2p-client/pkg/daemon"
+)
+
+// daemonSettings are the daemon flags that take effect again when the
+// daemon reloads its configuration
+type daemonSettings struct {
+	autoAccept *bool
+	quota      *string
+	allowFrom  *string
+	hooks      *hookFlags
+}
+
+// addDaemonSettings registers -auto-accept, -quota, -allow-from, -hook and
+// -quarantine on fs
+func addDaemonSettings(fs *flag.FlagSet) daemonSettings {
+	return daemonSettings{
+		autoAccept: fs.Bool("auto-accept", false, "Accept incoming transfers without approval"),
+		quota:      fs.String("quota", "", "Maximum bytes accepted from each sender, e.g. 10G (default unlimited)"),
+		allowFrom:  fs.String("allow-from", os.Getenv(allowFromEnv), "Only accept transfers from these senders: comma-separated key fingerprints, saved peer names, or \"trusted\" for every peer saved with a fingerprint (default $"+allowFromEnv+", else anyone)"),
+		hooks:      addHookFlags(fs),
+	}
+}
+
+// config returns the daemon configuration the settings describe. Saved
+// peer names in -allow-from are looked up in the address book as it is now.
+func (s daemonSettings) config() (daemon.Config, error) {
+	quota, err := parseQuota(*s.quota)
+	if err != nil {
+		return daemon.Config{}, fmt.Errorf("invalid -quota %q: %w", *s.quota, err)
+	}
+	allowFrom, err := parseAllowFrom(*s.allowFrom)
+	if err != nil {
+		return daemon.Config{}, fmt.Errorf("invalid -allow-from %q: %w", *s.allowFrom, err)
+	}
+	hooks, err := s.hooks.hooks()
+	if err != nil {
+		return daemon.Config{}, fmt.Errorf("invalid -hook: %w", err)
+	}
+	return daemon.Config{
+		AutoAccept: *s.autoAccept,
+		Quota:      quota,
+		AllowFrom:  allowFrom,
+		Hooks:      hooks,
+		Quarantine: *s.hooks.quarantine,
+	}, nil
+}
+
+// readConfigFile reads a daemon configuration file as flags. Each line
+// holds one flag, with or without its dashes, and its value after a space
+// or "=", e.g. "quota 10G" or "-auto-accept"; blank lines and lines
+// starting with # are skipped.
+func readConfigFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+	var args []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimLeft(line, "-")
+		i := strings.IndexAny(line, " \t=")
+		if i == 0 {
+			return nil, fmt.Errorf("%s:%d: missing flag name", path, n)
+		}
+		if i < 0 {
+			args = append(args, "-"+line)
+			continue
+		}
+		name := line[:i]
+		value := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[i:]), "="))
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value", path, n)
+			}
+		}
+		args = append(args, "-"+name+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return args, nil
+}
+
+// ignoredFlag takes the value of a flag that only applies at startup
+type ignoredFlag struct{ boolean bool }
+
+func (f ignoredFlag) String() string   { return "" }
+func (f ignoredFlag) Set(string) error { return nil }
+func (f ignoredFlag) IsBoolFlag() bool { return f.boolean }
+
+// reloadDaemonSettings reads the daemon's settings again from the config
+// file at path, if any, and the command line args, which win as they do at
+// startup. The other flags of like are accepted but take a restart to
+// change.
+func reloadDaemonSettings(like *flag.FlagSet, path string, args []string) (daemon.Config, error) {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	s := addDaemonSettings(fs)
+	like.VisitAll(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) == nil {
+			b, ok := f.Value.(interface{ IsBoolFlag() bool })
+			fs.Var(ignoredFlag{ok && b.IsBoolFlag()}, f.Name, "")
+		}
+	})
+	if path != "" {
+		fileArgs, err := readConfigFile(path)
+		if err != nil {
+			return daemon.Config{}, err
+		}
+		args = append(fileArgs, args...)
+	}
+	if err := fs.Parse(args); err != nil {
+		return daemon.Config{}, err
+	}
+	return s.config()
+}
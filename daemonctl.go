@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/daemon"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// sendViaDaemon hands a file send to the daemon running on this machine, if
+// any, and waits for it to finish. A send scheduled for startAt is only
+// queued; it would be a long wait. handled is false when there is no daemon
+// to ask, in which case the caller sends by itself.
+func sendViaDaemon(r sendRoute, src string, startAt time.Time) (handled bool, err error) {
+	path, err := daemon.SocketPath()
+	if err != nil {
+		return false, nil
+	}
+	ctl, err := daemon.ConnectControl(path)
+	if errors.Is(err, daemon.ErrNoDaemon) {
+		return false, nil
+	}
+	if err != nil {
+		log.Debug("Not using the daemon", "error", err)
+		return false, nil
+	}
+	// The daemon may run in another directory
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return true, err
+	}
+
+	t, err := ctl.Send(r.Address, r.Fingerprint, abs, 0, startAt)
+	if err != nil {
+		return true, err
+	}
+	if t.Status == daemon.StatusScheduled {
+		log.Info("Scheduled on the running daemon", "id", t.ID, "file", t.FileName, "start", t.StartAt.Local().Format(time.DateTime))
+		util.Emit(util.EventTransferStatus, "id", t.ID, "direction", t.Direction, "status", t.Status, "start_at", t.StartAt)
+		return true, nil
+	}
+	log.Info("Queued on the running daemon", "id", t.ID, "socket", path)
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	t, err = ctl.Wait(ctx, t.ID, func(t *daemon.Transfer) {
+		percent := 0.0
+		if t.FileSize > 0 {
+			percent = float64(t.Transferred) / float64(t.FileSize) * 100
+		}
+		util.Emit(util.EventProgress, "direction", "sending", "file", t.FileName, "transferred", t.Transferred, "size", t.FileSize, "percent", percent, "status", t.Status)
+		if !util.JSONEvents() {
+			fmt.Fprintf(util.ConsoleOutput(), "\rSending via daemon: %s %s %.1f%%   ", t.FileName, t.Status, percent)
+		}
+	})
+	if !util.JSONEvents() {
+		fmt.Fprintln(util.ConsoleOutput())
+	}
+	if errors.Is(err, context.Canceled) {
+		return true, fmt.Errorf("%w: stopped waiting; the daemon carries on with transfer %s", errCancelled, t.ID)
+	}
+	if err != nil {
+		return true, err
+	}
+	if t.Status != daemon.StatusDone {
+		return true, fmt.Errorf("daemon send %s: %w", t.Status, t.Err())
+	}
+	log.Info("Sent by the daemon", "file", t.FileName, "peer", t.Peer)
+	return true, nil
+}
+
+// runShare implements `share <file> [-expires d]`: asks the running daemon
+// for a one-time HTTPS link to file, for a recipient without the client
+func runShare(args []string) int {
+	fs := flag.NewFlagSet("share", flag.ExitOnError)
+	expires := fs.Duration("expires", daemon.DefaultShareExpiry, "How long the link stays valid")
+	jsonOut := fs.Bool("json", false, "Print the link as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: p2p share [flags] <file>")
+		fs.PrintDefaults()
+	}
+	pos := parseInterspersed(fs, args)
+	if len(pos) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	path, err := daemon.SocketPath()
+	if err != nil {
+		log.Error("Cannot find the daemon", "error", err)
+		return 1
+	}
+	ctl, err := daemon.ConnectControl(path)
+	if err != nil {
+		log.Error("Sharing needs a running daemon started with -share", "error", err)
+		return 1
+	}
+	abs, err := filepath.Abs(pos[0])
+	if err != nil {
+		log.Error("Invalid path", "path", pos[0], "error", err)
+		return 1
+	}
+	s, err := ctl.Share(abs, *expires)
+	if err != nil {
+		log.Error("Cannot share file", "file", abs, "error", err)
+		return 1
+	}
+	if *jsonOut {
+		json.NewEncoder(os.Stdout).Encode(s)
+		return 0
+	}
+	fmt.Println(s.URL)
+	fmt.Fprintf(os.Stderr, "One download of %s (%s), valid until %s.\nThe browser will warn about the certificate; its SHA-256 fingerprint is\n%s\n",
+		s.FileName, util.FormatSize(s.FileSize), s.Expires.Format(time.Kitchen), s.Fingerprint)
+	return 0
+}
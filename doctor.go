@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// doctorResult is one measurement of `doctor`
+type doctorResult struct {
+	Test      string  `json:"test"`
+	Name      string  `json:"name"`
+	Speed     float64 `json:"bytes_per_second"`
+	Preferred bool    `json:"preferred,omitempty"` // what transfers use on this machine
+	Error     string  `json:"error,omitempty"`
+}
+
+// runDoctor implements `doctor [flags]`: measures how fast this machine
+// encrypts, hashes and writes to disk, to tell which limits a slow transfer
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	dir := fs.String("out", "public", "Directory whose disk to test, normally where received files go")
+	duration := fs.Duration("duration", time.Second, "How long to run each cipher and hash test")
+	sizeFlag := fs.String("size", "256M", "Bytes to write in the disk test")
+	jsonOut := fs.Bool("json", false, "Print the results as JSON")
+	fs.Parse(args)
+
+	size, err := util.ParseSize(*sizeFlag)
+	if err != nil || size <= 0 {
+		log.Error("Invalid -size", "value", *sizeFlag, "error", err)
+		return 2
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		log.Error("Cannot create output directory", "dir", *dir, "error", err)
+		return 1
+	}
+
+	var results []doctorResult
+	add := func(test, name string, preferred bool, speed float64, err error) {
+		r := doctorResult{Test: test, Name: name, Speed: speed, Preferred: preferred}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		results = append(results, r)
+	}
+	for i, suite := range transfer.PreferredCiphers() {
+		speed, err := transfer.CipherSpeed(suite, transfer.DefaultChunkSize, *duration)
+		add("cipher", suite, i == 0, speed, err)
+	}
+	for i, alg := range transfer.PreferredHashes() {
+		speed, err := transfer.HashSpeed(alg, *duration)
+		add("hash", alg, i == 0, speed, err)
+	}
+	write, read, err := transfer.DiskSpeed(*dir, size)
+	add("disk", "write "+*dir, true, write, err)
+	add("disk", "read "+*dir, false, read, err)
+
+	if *jsonOut {
+		json.NewEncoder(os.Stdout).Encode(map[string]any{
+			"os":           runtime.GOOS,
+			"arch":         runtime.GOARCH,
+			"cpus":         runtime.NumCPU(),
+			"aes_hardware": transfer.HasAESHardware(),
+			"results":      results,
+		})
+		return 0
+	}
+
+	accel := "no, ChaCha20-Poly1305 is preferred"
+	if transfer.HasAESHardware() {
+		accel = "yes"
+	}
+	fmt.Printf("CPU: %s/%s, %d cores, AES acceleration: %s\n\n", runtime.GOOS, runtime.GOARCH, runtime.NumCPU(), accel)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TEST\tNAME\tSPEED\t")
+	slowest := -1
+	for i, r := range results {
+		speed := util.FormatSize(int64(r.Speed)) + "/s"
+		if r.Error != "" {
+			speed = "failed: " + r.Error
+		}
+		mark := ""
+		if r.Preferred {
+			mark = "*"
+			if r.Error == "" && (slowest < 0 || r.Speed < results[slowest].Speed) {
+				slowest = i
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Test, r.Name, speed, mark)
+	}
+	tw.Flush()
+	fmt.Println("\n* used by transfers on this machine")
+	if slowest >= 0 {
+		r := results[slowest]
+		fmt.Printf("Transfers here can't go faster than about %s/s (%.0f Mbit/s), set by the %s %s. Compare with the network throughput from `p2p bench`.\n",
+			util.FormatSize(int64(r.Speed)), r.Speed*8/1e6, r.Test, r.Name)
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
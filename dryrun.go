@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// sendPlan is what `send -dry-run` prints instead of sending
+type sendPlan struct {
+	Peer     string             `json:"peer,omitempty"` // name given to -to
+	Routes   []sendRoute        `json:"routes"`         // tried in order until one connects
+	Manifest *transfer.Manifest `json:"manifest"`
+}
+
+// previewSend builds the manifest a send of src would use, hashing the file.
+// Stdin is not read, so its size and hash are unknown.
+func previewSend(src, name string) (*transfer.Manifest, error) {
+	switch {
+	case src == "-":
+		if name == "" {
+			name = "stdin"
+		}
+		return transfer.PreviewStream(name, -1), nil
+	case name != "":
+		info, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("%s is a directory; only single files can be sent", src)
+		}
+		m := transfer.PreviewStream(filepath.Base(name), info.Size())
+		if m.Hash, err = transfer.HashFile(src, transfer.HashBLAKE3); err != nil {
+			return nil, err
+		}
+		m.HashAlg = transfer.HashBLAKE3
+		return m, nil
+	default:
+		return transfer.PreviewManifest(src)
+	}
+}
+
+// dryRunSend prints the plan for a send as indented JSON on stdout: a
+// single object, or an array with one plan per peer for a group send
+func dryRunSend(plans []sendPlan, src, name string) int {
+	m, err := previewSend(src, name)
+	if err != nil {
+		log.Error("Cannot build manifest", "error", err)
+		return 1
+	}
+	for i := range plans {
+		plans[i].Manifest = m
+	}
+	var out any = plans
+	if len(plans) == 1 {
+		out = plans[0]
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		log.Error("Cannot print plan", "error", err)
+		return 1
+	}
+	size := "unknown"
+	if m.FileSize >= 0 {
+		size = util.FormatSize(m.FileSize)
+	}
+	for _, plan := range plans {
+		log.Info("Dry run, nothing sent", "file", m.FileName, "size", size, "transport", plan.Routes[0].Transport, "address", plan.Routes[0].Address)
+	}
+	return 0
+}
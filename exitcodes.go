@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/udit2303/p2p-client/pkg/addrbook"
+	"github.com/udit2303/p2p-client/pkg/daemon"
+	"github.com/udit2303/p2p-client/pkg/discovery"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/rendezvous"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Exit codes, so scripts can tell failures apart without reading the logs.
+// Failures not listed exit with exitFailure.
+const (
+	exitOK           = 0
+	exitFailure      = 1 // Any other failure
+	exitUsage        = 2 // Invalid flags or arguments
+	exitAuthFailed   = 3 // Passcode or transfer code rejected, the peer's key didn't match, or the session binding didn't
+	exitPeerNotFound = 4 // No such peer, or it couldn't be reached
+	exitHashMismatch = 5 // The data failed its integrity check
+	exitCancelled    = 6 // Interrupted before the transfer finished
+	exitDiskFull     = 7 // The receiver ran out of disk space
+	exitRefused      = 8 // The receiver declined: rejected, not allowed, over quota, send-only or turned down by a hook
+	exitFileChanged  = 9 // The file was modified while it was sent
+)
+
+// errCancelled reports a transfer interrupted on this side
+var errCancelled = errors.New("cancelled")
+
+// exitCode returns the exit code for a command that failed with err
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errCancelled):
+		return exitCancelled
+	case errors.Is(err, netconn.ErrAuthFailed), errors.Is(err, netconn.ErrKeyMismatch), errors.Is(err, transfer.ErrSessionBinding),
+		errors.Is(err, rendezvous.ErrWrongCode):
+		return exitAuthFailed
+	case errors.Is(err, addrbook.ErrNotFound), errors.Is(err, discovery.ErrNoPeers), errors.Is(err, netconn.ErrPeerUnreachable):
+		return exitPeerNotFound
+	case errors.Is(err, transfer.ErrChecksumMismatch), errors.Is(err, transfer.ErrInvalidReceipt):
+		return exitHashMismatch
+	case errors.Is(err, transfer.ErrInsufficientSpace), errors.Is(err, syscall.ENOSPC):
+		return exitDiskFull
+	case errors.Is(err, transfer.ErrRejected), errors.Is(err, transfer.ErrSenderNotAllowed), errors.Is(err, transfer.ErrQuotaExceeded),
+		errors.Is(err, transfer.ErrModeRefused), errors.Is(err, daemon.ErrRejected),
+		errors.Is(err, transfer.ErrQuarantined), errors.Is(err, transfer.ErrHookRejected):
+		return exitRefused
+	case errors.Is(err, transfer.ErrFileChanged):
+		return exitFileChanged
+	}
+	return exitFailure
+}
+
+// exitOnInterrupt ends the process with exitCancelled on SIGINT or SIGTERM,
+// for commands that have no shutdown of their own to run
+func exitOnInterrupt() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Warn("Transfer cancelled", "signal", sig)
+		util.Emit(util.EventError, "stage", "send", "error", errCancelled)
+		os.Exit(exitCancelled)
+	}()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/addrbook"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// sendRoute is one way of reaching the target of a send
+type sendRoute struct {
+	Transport   string `json:"transport"` // addrbook.TransportTCP or addrbook.TransportLibp2p
+	Address     string `json:"address"`
+	Fingerprint string `json:"fingerprint,omitempty"` // empty if the peer's key isn't known yet
+}
+
+// dialer connects to a tcp route, giving up after timeout
+func (r sendRoute) dialer(timeout time.Duration) netconn.Dialer {
+	host, portStr, _ := net.SplitHostPort(r.Address)
+	port, _ := strconv.Atoi(portStr)
+	if netconn.TorEnabled() || netconn.IsOnion(host) {
+		timeout = max(timeout, netconn.TorDialTimeout)
+	}
+	return netconn.DialTimeout(netconn.TCPDialer(context.Background(), host, port), timeout)
+}
+
+// sendRoutes lists the ways to reach the target of a send, in the order they
+// are tried: LAN TCP first, then libp2p, which itself tries direct
+// connections, hole punching and relays. WebRTC needs signaling by hand or
+// through a rendezvous code, so it stays a separate mode. A stream (stdin
+// or -as) can only go over TCP.
+// size is what is sent, or negative if unknown.
+func sendRoutes(connect, search, to, p2pAddr string, stream bool, size int64) ([]sendRoute, error) {
+	var entry *addrbook.Entry
+	if to != "" {
+		if book, err := addrbook.Open(); err == nil {
+			entry, _ = book.Get(to)
+		}
+	}
+	libp2pAddr := p2pAddr
+	if entry != nil && libp2pAddr == "" {
+		libp2pAddr = entry.Libp2p
+		if entry.Transport == addrbook.TransportLibp2p {
+			libp2pAddr = entry.Address
+		}
+	}
+	if libp2pAddr != "" && netconn.TorEnabled() {
+		// libp2p dials directly, which would give this node's address away
+		log.Warn("Not trying libp2p: it can't go through Tor")
+		libp2pAddr = ""
+	}
+
+	var routes []sendRoute
+	var tcpErr error
+	if connect != "" || search != "" || (to != "" && (entry == nil || entry.Transport == addrbook.TransportTCP)) {
+		var host, fingerprint string
+		var port int
+		if to != "" {
+			code := search
+			if code == "" {
+				code = defaultCode()
+			}
+			host, port, fingerprint, tcpErr = resolveTarget(to, code, size)
+		} else {
+			host, port, fingerprint, tcpErr = resolvePeer(connect, search, size)
+		}
+		if tcpErr == nil {
+			routes = append(routes, sendRoute{
+				Transport:   addrbook.TransportTCP,
+				Address:     net.JoinHostPort(host, strconv.Itoa(port)),
+				Fingerprint: fingerprint,
+			})
+		}
+	}
+
+	if libp2pAddr != "" {
+		switch {
+		case !stream:
+			routes = append(routes, sendRoute{Transport: addrbook.TransportLibp2p, Address: libp2pAddr})
+		case len(routes) == 0 && tcpErr == nil:
+			return nil, errors.New("libp2p only supports sending a named file")
+		default:
+			log.Warn("Not falling back to libp2p: it only supports sending a named file")
+		}
+	}
+
+	if len(routes) == 0 {
+		if tcpErr != nil {
+			return nil, tcpErr
+		}
+		return nil, errors.New("one of -connect, -search, -to or -peer is required")
+	}
+	if tcpErr != nil {
+		log.Warn("No LAN route to the peer, trying libp2p", "error", tcpErr)
+	}
+	return routes, nil
+}
+
+// sendFallback runs send over each route in turn until one connects. Only
+// an unreachable peer moves on to the next route: other failures, such as a
+// rejected passcode or a refused transfer, would repeat on every path.
+func sendFallback(routes []sendRoute, send func(r sendRoute) error) (sendRoute, error) {
+	var err error
+	for i, r := range routes {
+		if len(routes) > 1 {
+			log.Info("Trying transport", "transport", r.Transport, "address", r.Address)
+		}
+		if err = send(r); err == nil {
+			log.Info("Transfer sent", "transport", r.Transport, "address", r.Address)
+			return r, nil
+		}
+		if !errors.Is(err, netconn.ErrPeerUnreachable) || i == len(routes)-1 {
+			break
+		}
+		log.Warn("Transport failed, falling back", "transport", r.Transport, "error", err, "next", routes[i+1].Transport)
+	}
+	return sendRoute{}, err
+}
+
+// sendRetrying is sendFallback, trying again up to retries times when the
+// connection drops mid-transfer, e.g. as a laptop moves between networks.
+// Each retry resolves the peer again with resolve, as its address may have
+// changed, keeping the old routes if that fails, and the receiver resumes
+// from what it already holds.
+func sendRetrying(routes []sendRoute, retries int, resolve func() ([]sendRoute, error), send func(r sendRoute) error) (sendRoute, error) {
+	if retries == 0 {
+		return sendFallback(routes, send)
+	}
+	policy := util.DefaultRetryPolicy()
+	policy.MaxAttempts = retries + 1
+	attempt := 0
+	// A peer that can't be reached at first isn't waited for, but after
+	// a drop it may take a while to reappear
+	policy.RetryOn = func(err error) bool {
+		return netconn.IsConnectionLost(err) || (attempt > 1 && errors.Is(err, netconn.ErrPeerUnreachable))
+	}
+	var used sendRoute
+	err := util.Retry(context.Background(), policy, func() error {
+		attempt++
+		if attempt > 1 {
+			log.Warn("Connection lost, reconnecting to resume", "attempt", attempt, "of", policy.MaxAttempts)
+			if fresh, err := resolve(); err == nil {
+				routes = fresh
+			} else {
+				log.Warn("Cannot resolve peer again, trying its last address", "error", err)
+			}
+		}
+		var err error
+		used, err = sendFallback(routes, send)
+		return err
+	})
+	return used, err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/addrbook"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// groupTarget is one destination of a group send
+type groupTarget struct {
+	name    string
+	routes  []sendRoute
+	used    sendRoute
+	err     error
+	sent    atomic.Int64 // bytes the send has taken from the shared source
+	elapsed time.Duration
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// groupSend sends src to every named peer at once. The source is read a
+// single time and fanned out to one encrypted stream per peer reachable
+// over TCP. Peers only reachable over libp2p, and peers whose LAN address
+// turned out unreachable, are sent to one at a time afterwards, provided
+// src is a file that can be read again.
+func groupSend(names []string, search, src, name string, timeout time.Duration, dryRun bool) int {
+	stream := src == "-" || name != ""
+	size := transferSize(src)
+	targets := make([]*groupTarget, 0, len(names))
+	for _, n := range names {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		t := &groupTarget{name: n}
+		t.routes, t.err = sendRoutes("", search, n, "", stream, size)
+		if t.err != nil {
+			log.Error("Cannot resolve peer", "peer", n, "error", t.err)
+			util.Emit(util.EventError, "stage", "discovery", "peer", n, "error", t.err)
+		}
+		targets = append(targets, t)
+	}
+
+	if dryRun {
+		var plans []sendPlan
+		for _, t := range targets {
+			if t.err == nil {
+				plans = append(plans, sendPlan{Peer: t.name, Routes: t.routes})
+			}
+		}
+		if len(plans) == 0 {
+			return 1
+		}
+		return dryRunSend(plans, src, name)
+	}
+
+	// Ask for the passcode once rather than once per peer
+	code, err := netconn.PasscodeSource()
+	if err != nil {
+		log.Error("Cannot read passcode", "error", err)
+		return 1
+	}
+	netconn.PasscodeSource = func() (string, error) { return code, nil }
+
+	var manifest *transfer.Manifest
+	var source io.Reader
+	switch {
+	case src == "-":
+		util.ReserveStdin()
+		if name == "" {
+			name = "stdin"
+		}
+		manifest, source = transfer.PreviewStream(name, -1), os.Stdin
+	default:
+		f, err := os.Open(src)
+		if err != nil {
+			log.Error("Send failed", "error", err)
+			return 1
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			log.Error("Send failed", "error", err)
+			return 1
+		}
+		if info.IsDir() {
+			log.Error("Send failed", "error", fmt.Errorf("%s is a directory; only single files can be sent", src))
+			return 1
+		}
+		if name != "" {
+			manifest = transfer.PreviewStream(filepath.Base(name), info.Size())
+		} else if manifest, err = transfer.CreateManifest(src); err != nil {
+			log.Error("Send failed", "error", err)
+			return 1
+		} else if err = manifest.HashContent(src); err != nil {
+			log.Error("Send failed", "error", err)
+			return 1
+		}
+		source = f
+	}
+
+	// Fan the source out to every peer whose first route is TCP
+	var fanned []*groupTarget
+	for _, t := range targets {
+		if t.err == nil && t.routes[0].Transport == addrbook.TransportTCP {
+			fanned = append(fanned, t)
+		}
+	}
+	netconn.MaxOutgoing = max(len(fanned), 1)
+	transfer.DefaultSendOptions.HideProgress = true
+	if len(fanned) > 0 {
+		log.Info("Sending to peers", "file", manifest.FileName, "peers", len(fanned))
+		fan := transfer.NewFanout(source, len(fanned))
+		var wg sync.WaitGroup
+		for i, t := range fanned {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := fan.Reader(i)
+				defer r.Close()
+				started := time.Now()
+				t.used = t.routes[0]
+				t.err = netconn.SendManifestVia(t.used.dialer(timeout), t.used.Fingerprint, manifest, countingReader{r, &t.sent})
+				t.elapsed = time.Since(started)
+			}()
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		go func() {
+			if err := fan.Run(); err != nil {
+				log.Error("Failed to read source", "error", err)
+			}
+		}()
+		showGroupProgress(fanned, manifest.FileSize, done)
+	}
+	transfer.DefaultSendOptions.HideProgress = false
+	netconn.MaxOutgoing = 1
+
+	// Send to everyone else one at a time, re-reading the file
+	for _, t := range targets {
+		if t.err == nil && t.used.Transport != "" {
+			continue
+		}
+		routes := t.routes
+		if t.err != nil {
+			// Retry over the remaining routes only if the LAN address was unreachable
+			if t.used.Transport == "" || !errors.Is(t.err, netconn.ErrPeerUnreachable) || len(routes) < 2 {
+				continue
+			}
+			routes = routes[1:]
+		}
+		started := time.Now()
+		t.used, t.err = sendFallback(routes, func(r sendRoute) error {
+			if r.Transport == addrbook.TransportLibp2p {
+				return sendLibp2p(r.Address, src, timeout)
+			}
+			return netconn.SendFileVia(r.dialer(timeout), src, r.Fingerprint)
+		})
+		t.elapsed = time.Since(started)
+	}
+
+	return groupSummary(targets)
+}
+
+// showGroupProgress reports how far each fanned-out send has got until done
+// is closed
+func showGroupProgress(targets []*groupTarget, size int64, done <-chan struct{}) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			if !util.JSONEvents() {
+				fmt.Fprintln(util.ConsoleOutput())
+			}
+			return
+		case <-ticker.C:
+		}
+		parts := make([]string, 0, len(targets))
+		for _, t := range targets {
+			sent := t.sent.Load()
+			percent := 0.0
+			if size > 0 {
+				percent = float64(sent) / float64(size) * 100
+			}
+			util.Emit(util.EventProgress, "direction", "sending", "peer", t.name, "transferred", sent, "size", size, "percent", percent)
+			if size > 0 {
+				parts = append(parts, fmt.Sprintf("%s %.0f%%", t.name, percent))
+			} else {
+				parts = append(parts, fmt.Sprintf("%s %s", t.name, util.FormatSize(sent)))
+			}
+		}
+		if !util.JSONEvents() {
+			fmt.Fprintf(util.ConsoleOutput(), "\rSending: %s", strings.Join(parts, " | "))
+		}
+	}
+}
+
+// groupSummary reports the outcome for each peer, records the successful
+// ones in the address book, and returns the exit code
+func groupSummary(targets []*groupTarget) int {
+	failed, code := 0, exitOK
+	tw := tabwriter.NewWriter(util.ConsoleOutput(), 0, 0, 2, ' ', 0)
+	if !util.JSONEvents() {
+		fmt.Fprintln(tw, "PEER\tSTATUS\tTRANSPORT\tTIME\tERROR")
+	}
+	for _, t := range targets {
+		status, errText := "sent", "-"
+		if t.err != nil {
+			failed++
+			status, errText = "failed", t.err.Error()
+			// Peers failing for different reasons leave no single reason
+			if c := exitCode(t.err); code == exitOK || c == code {
+				code = c
+			} else {
+				code = exitFailure
+			}
+			util.Emit(util.EventError, "stage", "send", "peer", t.name, "error", t.err)
+		} else {
+			// Only a tcp address replaces the saved one
+			address := ""
+			if t.used.Transport == addrbook.TransportTCP {
+				address = t.used.Address
+			}
+			markSeen(t.name, address)
+		}
+		transport := t.used.Transport
+		if transport == "" {
+			transport = "-"
+		}
+		util.Emit(util.EventTransferStatus, "peer", t.name, "status", status, "transport", transport, "duration_ms", t.elapsed.Milliseconds())
+		if !util.JSONEvents() {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", t.name, status, transport, t.elapsed.Round(time.Millisecond), errText)
+		}
+	}
+	tw.Flush()
+	if failed > 0 {
+		log.Error("Group send incomplete", "failed", failed, "peers", len(targets))
+		return code
+	}
+	log.Info("Sent to every peer", "peers", len(targets))
+	return 0
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/udit2303/p2p-client/pkg/discovery"
+)
+
+// runGroup implements `group add|list|rm`: managing the named groups this
+// node is announced in, each with its own secret code
+func runGroup(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: p2p group add <name> [-secret code]")
+		fmt.Fprintln(os.Stderr, "       p2p group list [-json]")
+		fmt.Fprintln(os.Stderr, "       p2p group rm <name>")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	groups, err := discovery.OpenGroups()
+	if err != nil {
+		log.Error("Cannot open groups", "error", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("group add", flag.ExitOnError)
+		secret := fs.String("secret", "", "Secret code shared by the group's members (default: a new random one to give to the others)")
+		pos := parseInterspersed(fs, args[1:])
+		if len(pos) != 1 {
+			usage()
+			return 2
+		}
+		group := &discovery.Group{Name: pos[0], Secret: *secret}
+		if group.Secret == "" {
+			group.Secret = discovery.NewSecret()
+			fmt.Printf("Created group %s; members join with:\n  p2p group add %s -secret %s\n", group.Name, group.Name, group.Secret)
+		}
+		if err := groups.Put(group); err != nil {
+			log.Error("Cannot add group", "error", err)
+			return 2
+		}
+	case "list", "ls":
+		fs := flag.NewFlagSet("group list", flag.ExitOnError)
+		jsonOut := fs.Bool("json", false, "Print the groups as JSON")
+		fs.Parse(args[1:])
+		if *jsonOut {
+			json.NewEncoder(os.Stdout).Encode(groups.List())
+			return 0
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSECRET\tHASH")
+		for _, g := range groups.List() {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", g.Name, g.Secret, discovery.HashedCode(g.Secret))
+		}
+		tw.Flush()
+		return 0
+	case "rm", "remove":
+		if len(args) != 2 {
+			usage()
+			return 2
+		}
+		if err := groups.Remove(args[1]); err != nil {
+			log.Error("Cannot remove group", "error", err)
+			return 1
+		}
+	default:
+		usage()
+		return 2
+	}
+
+	if err := groups.Save(); err != nil {
+		log.Error("Cannot save groups", "error", err)
+		return 1
+	}
+	return 0
+}
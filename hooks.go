@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/udit2303/p2p-client/pkg/transfer"
+)
+
+// stringsFlag collects the values of a flag given more than once
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ", ") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// hookFlags holds the receive hook flags of receive and daemon
+type hookFlags struct {
+	commands   stringsFlag
+	quarantine *string
+}
+
+// addHookFlags registers -hook and -quarantine on fs
+func addHookFlags(fs *flag.FlagSet) *hookFlags {
+	h := &hookFlags{}
+	fs.Var(&h.commands, "hook", "Command run on each received file before it is kept, e.g. \"clamscan --no-summary\"; the file's path is appended (or replaces {}) and a non-zero exit rejects it. May be repeated")
+	h.quarantine = fs.String("quarantine", "", "Move files rejected by a -hook here instead of deleting them")
+	return h
+}
+
+// hooks returns the hooks for the -hook commands
+func (h *hookFlags) hooks() ([]transfer.Hook, error) {
+	var hooks []transfer.Hook
+	for _, c := range h.commands {
+		hook, err := transfer.CommandHook(c)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
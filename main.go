@@ -2,16 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/udit2303/p2p-client/pkg/addrbook"
 	"github.com/udit2303/p2p-client/pkg/discovery"
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"github.com/udit2303/p2p-client/pkg/nat"
 	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/rendezvous"
+	"github.com/udit2303/p2p-client/pkg/transfer"
 	"github.com/udit2303/p2p-client/pkg/util"
 )
 
@@ -35,44 +48,675 @@ func GetLocalIP() (string, error) {
 	return "", fmt.Errorf("no non-loopback address found")
 }
 
-func main() {
-	// Set up context for graceful shutdown
+// shutdownSignals and reloadSignals carry the signals asking a long-running
+// command to stop and the daemon to reload its configuration. The Windows
+// service manager's requests are delivered on them too.
+var (
+	shutdownSignals = make(chan os.Signal, 1)
+	reloadSignals   = make(chan os.Signal, 1)
+)
+
+// shutdownContext returns a context cancelled on SIGINT or SIGTERM
+func shutdownContext() (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 
 	// Handle OS signals for graceful shutdown
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(shutdownSignals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		sig := <-sigCh
-		log.Info("Received signal, shutting down...", "signal", sig)
-		cancel()
+		select {
+		case sig := <-shutdownSignals:
+			log.Info("Received signal, shutting down...", "signal", sig)
+			cancel()
+		case <-ctx.Done():
+		}
 	}()
+	return ctx, cancel
+}
+
+// logFlags holds the output flags shared by every command
+type logFlags struct {
+	debug       *bool
+	jsonOut     *bool
+	noColor     *bool
+	sessionLogs *bool
+	notify      *bool
+}
+
+// addLogFlags registers -debug, -json, -no-color, -session-log and -notify
+// on fs
+func addLogFlags(fs *flag.FlagSet) *logFlags {
+	return &logFlags{
+		debug:       fs.Bool("debug", false, "Enable debug logging"),
+		jsonOut:     fs.Bool("json", false, "Emit machine-readable JSON events on stdout instead of logs and progress bars"),
+		noColor:     fs.Bool("no-color", false, "Disable colored output (also honors NO_COLOR)"),
+		sessionLogs: fs.Bool("session-log", false, "Write a JSON debug log of each transfer to ~/.p2p-client/logs/<id>.json"),
+		notify:      fs.Bool("notify", false, notifyUsage),
+	}
+}
+
+// apply configures logging from the flags. When stdout carries data,
+// human-readable logs are moved to stderr.
+func (f *logFlags) apply(stdoutData bool) {
+	level := util.InfoLevel
+	if *f.debug {
+		level = util.DebugLevel
+	}
+	if *f.noColor {
+		util.DisableColor()
+	}
+	transfer.SessionLogs = *f.sessionLogs
+	switch {
+	case *f.jsonOut:
+		// Keep stdout clean for events; logs go to stderr as JSON
+		util.EnableJSONEvents(os.Stdout)
+		util.SetDefaultLogger(util.NewJSONLogger(os.Stderr, level))
+	case stdoutData:
+		util.ReserveStdout()
+		util.SetDefaultLogger(util.NewLogger(os.Stderr, level))
+	default:
+		util.SetDefaultLogger(util.NewLogger(os.Stdout, level))
+	}
+	if *f.notify {
+		enableNotifications()
+	}
+}
+
+// timeoutFlags holds the transfer timeouts shared by the commands that
+// send or receive over TCP
+type timeoutFlags struct {
+	transfer *time.Duration
+	idle     *time.Duration
+}
+
+// addTimeoutFlags registers -transfer-timeout and -idle-timeout on fs
+func addTimeoutFlags(fs *flag.FlagSet) *timeoutFlags {
+	return &timeoutFlags{
+		transfer: fs.Duration("transfer-timeout", 0, "Give up on a transfer that isn't done after this long (default no limit)"),
+		idle:     fs.Duration("idle-timeout", netconn.DefaultIdleTimeout, "Give up when the peer sends or takes nothing for this long, 0 to wait forever"),
+	}
+}
+
+// apply sets the timeouts from the flags
+func (f *timeoutFlags) apply() error {
+	if *f.transfer < 0 || *f.idle < 0 {
+		return errors.New("-transfer-timeout and -idle-timeout can't be negative")
+	}
+	netconn.TransferTimeout = *f.transfer
+	netconn.IdleTimeout = *f.idle
+	return nil
+}
+
+// bindFlags holds the network binding shared by the commands that discover
+// peers or send or receive over TCP
+type bindFlags struct {
+	iface *string
+	addr  *string
+}
+
+// addBindFlags registers -iface and -bind on fs
+func addBindFlags(fs *flag.FlagSet) *bindFlags {
+	return &bindFlags{
+		iface: fs.String("iface", os.Getenv(util.IfaceEnv), "Network interface to discover peers, listen and connect on, e.g. eth0 (default $"+util.IfaceEnv+", else all)"),
+		addr:  fs.String("bind", os.Getenv(util.BindEnv), "Local address to listen and connect on, or a subnet like 192.168.1.0/24 to pick it from (default $"+util.BindEnv+")"),
+	}
+}
+
+// apply binds the network as the flags say
+func (f *bindFlags) apply() error {
+	return util.Bind(*f.iface, *f.addr)
+}
+
+// tcpFlags holds the TCP socket options shared by the commands that send
+// or receive over TCP
+type tcpFlags struct {
+	noDelay   *bool
+	sendBuf   *string
+	recvBuf   *string
+	keepAlive *time.Duration
+	interval  *time.Duration
+	count     *int
+}
+
+// addTCPFlags registers -nodelay, -sndbuf, -rcvbuf and the -keepalive flags
+// on fs
+func addTCPFlags(fs *flag.FlagSet) *tcpFlags {
+	d := netconn.DefaultTCPTuning
+	return &tcpFlags{
+		noDelay:   fs.Bool("nodelay", d.NoDelay, "Send small writes at once rather than coalescing them (TCP_NODELAY)"),
+		sendBuf:   fs.String("sndbuf", "", "TCP send buffer size, e.g. 4M; raise it for fast links with a long round trip (default: the system's)"),
+		recvBuf:   fs.String("rcvbuf", "", "TCP receive buffer size, e.g. 4M (default: the system's)"),
+		keepAlive: fs.Duration("keepalive", d.KeepAlive, "Idle time before TCP keepalive probes start, negative to disable them"),
+		interval:  fs.Duration("keepalive-interval", d.KeepAliveInterval, "Time between unanswered TCP keepalive probes"),
+		count:     fs.Int("keepalive-count", d.KeepAliveCount, "Unanswered TCP keepalive probes before the connection is dropped"),
+	}
+}
+
+// apply sets the TCP socket options from the flags
+func (f *tcpFlags) apply() error {
+	t := netconn.TCPTuning{NoDelay: *f.noDelay, KeepAlive: *f.keepAlive, KeepAliveInterval: *f.interval, KeepAliveCount: *f.count}
+	for _, b := range []struct {
+		name, value string
+		size        *int
+	}{{"-sndbuf", *f.sendBuf, &t.SendBuffer}, {"-rcvbuf", *f.recvBuf, &t.RecvBuffer}} {
+		if b.value == "" {
+			continue
+		}
+		n, err := util.ParseSize(b.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", b.name, err)
+		}
+		if n <= 0 || n > math.MaxInt32 {
+			return fmt.Errorf("%s must be between 1 byte and 2G", b.name)
+		}
+		*b.size = int(n)
+	}
+	if t.KeepAliveInterval < 0 || t.KeepAliveCount < 0 {
+		return errors.New("-keepalive-interval and -keepalive-count can't be negative")
+	}
+	netconn.DefaultTCPTuning = t
+	return nil
+}
+
+// applyChunkSize configures the sender chunk size from a -chunk-size value:
+// empty for the default, "auto" for adaptive sizing, or a size like "1M"
+func applyChunkSize(v string) error {
+	switch v {
+	case "":
+		return nil
+	case "auto":
+		transfer.DefaultSendOptions.AdaptiveChunks = true
+		return nil
+	}
+	n, err := util.ParseSize(v)
+	if err != nil {
+		return err
+	}
+	if n < transfer.MinChunkSize || n > transfer.MaxChunkSize {
+		return fmt.Errorf("chunk size must be between %d and %d bytes", transfer.MinChunkSize, transfer.MaxChunkSize)
+	}
+	transfer.DefaultSendOptions.ChunkSize = int(n)
+	return nil
+}
+
+// searchUsage describes the -search flag of commands that look a peer up by
+// name
+const searchUsage = "Discovery code, or saved group, used to find a peer given by name"
+
+// codeEnv supplies the discovery code when -discovery-code isn't given
+const codeEnv = "P2P_DISCOVERY_CODE"
+
+// codeUsage describes the -discovery-code flag
+const codeUsage = "Secret code this node is discovered under, also the passcode senders must give (default $" + codeEnv + ")"
+
+// defaultCode returns the discovery code from the environment, or the
+// default one
+func defaultCode() string {
+	if code := os.Getenv(codeEnv); code != "" {
+		return code
+	}
+	return discovery.DefaultCode
+}
+
+// checkCode validates the discovery code a node listens with. The default
+// code is known to everyone, so only debug builds may use it.
+func checkCode(code string) error {
+	if code == "" {
+		return errors.New("empty discovery code")
+	}
+	if code == discovery.DefaultCode && !debugBuild {
+		return fmt.Errorf("the default discovery code %q is public; set -discovery-code or $%s to a secret of your own (e.g. from `p2p group add`), or build with -tags debug", code, codeEnv)
+	}
+	return nil
+}
+
+// codePasscode returns the passcode that goes with a discovery code: the
+// code itself, so discovery and authentication share one secret, or ""
+// (the built-in passcode) for the default code
+func codePasscode(code string) string {
+	if code == discovery.DefaultCode {
+		return ""
+	}
+	return code
+}
+
+// usePasscodeOf makes outgoing connections authenticate with search, a
+// discovery code, or when it is empty or names a saved group with
+// $P2P_DISCOVERY_CODE, unless $P2P_PASSCODE is set. A group's secret only
+// finds its members; each still wants its own passcode.
+func usePasscodeOf(search string) {
+	if search == "" || isGroup(search) {
+		search = defaultCode()
+	}
+	if _, ok := os.LookupEnv(netconn.PasscodeEnv); ok {
+		return
+	}
+	if passcode := codePasscode(search); passcode != "" {
+		netconn.PasscodeSource = func() (string, error) { return passcode, nil }
+	}
+}
+
+// isGroup reports whether name is a saved group
+func isGroup(name string) bool {
+	groups, err := discovery.OpenGroups()
+	if err != nil {
+		return false
+	}
+	_, err = groups.Get(name)
+	return err == nil
+}
+
+// announceCodes returns the codes this node announces under: code and the
+// secret of every saved group
+func announceCodes(code string) []string {
+	groups, err := discovery.OpenGroups()
+	if err != nil {
+		log.Warn("Cannot read groups; announcing under the discovery code only", "error", err)
+		return []string{code}
+	}
+	return groups.Codes(code)
+}
+
+// discoveryUsage describes the -discovery flag
+const discoveryUsage = "How to find peers: comma-separated mdns, static:<peers.json>, tracker:<url> and broadcast[:<host>] (default $" + discovery.Env + ", else mdns)"
+
+// applyDiscovery selects the discovery backends from a -discovery value
+// such as "mdns,tracker:http://tracker.lan:4600"; empty keeps mDNS
+func applyDiscovery(v string) error {
+	if v == "" {
+		return nil
+	}
+	d, err := discovery.Parse(v)
+	if err != nil {
+		return err
+	}
+	discovery.Default = d
+	return nil
+}
+
+// modeEnv names the environment variable holding the default -mode
+const modeEnv = "P2P_MODE"
+
+// modeUsage describes the -mode flag
+const modeUsage = "Operating mode: receive-only never sends, send-only refuses incoming transfers (default $" + modeEnv + ", else both)"
+
+// applyMode sets the operating mode from a -mode value
+func applyMode(v string) error {
+	mode, err := transfer.ParseMode(v)
+	if err != nil {
+		return err
+	}
+	transfer.OperatingMode = mode
+	if mode != transfer.ModeNormal {
+		log.Info("Operating mode", "mode", mode)
+	}
+	return nil
+}
+
+// applyCipher restricts the cipher suites offered when sending: "aes",
+// "chacha" or "auto" (pick by hardware)
+func applyCipher(v string) error {
+	switch v {
+	case "", "auto":
+		transfer.DefaultSendOptions.Cipher = ""
+	case "aes", transfer.CipherAESGCM:
+		transfer.DefaultSendOptions.Cipher = transfer.CipherAESGCM
+	case "chacha", transfer.CipherChaCha20:
+		transfer.DefaultSendOptions.Cipher = transfer.CipherChaCha20
+	default:
+		return fmt.Errorf("unknown cipher %q, expected aes, chacha or auto", v)
+	}
+	return nil
+}
+
+// logCipher logs the cipher this node prefers and how fast this CPU runs
+// it, from a short measurement
+func logCipher() {
+	suite := transfer.DefaultSendOptions.Cipher
+	if suite == "" {
+		suite = transfer.PreferredCiphers()[0]
+	}
+	speed, err := transfer.CipherSpeed(suite, transfer.DefaultChunkSize, 50*time.Millisecond)
+	if err != nil {
+		log.Warn("Cannot measure cipher speed", "cipher", suite, "error", err)
+		return
+	}
+	log.Info("Encryption", "cipher", suite, "aes_hardware", transfer.HasAESHardware(), "expected", util.FormatSize(int64(speed))+"/s")
+}
+
+// defaultNodeName returns name, or this node's generated name if it is empty
+func defaultNodeName(name string) string {
+	if name != "" {
+		return name
+	}
+	name, err := keys.NodeName()
+	if err != nil {
+		log.Warn("Cannot determine node name, using node1", "error", err)
+		return "node1"
+	}
+	return name
+}
+
+// openDedup opens the content hash index used to spot files received
+// before, or returns nil if deduplication is off or the index is unusable
+func openDedup(disabled bool) *transfer.HashIndex {
+	if disabled {
+		return nil
+	}
+	idx, err := transfer.DefaultHashIndex()
+	if err != nil {
+		log.Warn("Deduplication disabled", "error", err)
+		return nil
+	}
+	return idx
+}
+
+// parseQuota turns a -quota value into a per-sender quota, nil if unset
+func parseQuota(v string) (*transfer.Quota, error) {
+	if v == "" || v == "0" {
+		return nil, nil
+	}
+	n, err := util.ParseSize(v)
+	if err != nil {
+		return nil, err
+	}
+	return transfer.NewQuota(n), nil
+}
+
+// allowFromEnv names the environment variable holding the default
+// -allow-from policy, e.g. "trusted"
+const allowFromEnv = "P2P_ALLOW_FROM"
+
+// parseAllowFrom turns an -allow-from value into an allowlist, nil if unset.
+// Each comma-separated item is a key fingerprint or peer ID, the name of a
+// peer saved with either, or "trusted" for every such peer in the address
+// book.
+func parseAllowFrom(v string) (*transfer.Allowlist, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var book *addrbook.Book
+	var fingerprints []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if isFingerprint(item) {
+			fingerprints = append(fingerprints, item)
+			continue
+		}
+		if book == nil {
+			var err error
+			if book, err = addrbook.Open(); err != nil {
+				return nil, err
+			}
+		}
+		if item == "trusted" {
+			for _, e := range book.List() {
+				fingerprints = append(fingerprints, peerKeys(e)...)
+			}
+			continue
+		}
+		e, err := book.Get(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither a key fingerprint nor a saved peer", item)
+		}
+		if len(peerKeys(e)) == 0 {
+			return nil, fmt.Errorf("peer %q has no saved fingerprint; add one with peer add -fingerprint or -id", item)
+		}
+		fingerprints = append(fingerprints, peerKeys(e)...)
+	}
+	if len(fingerprints) == 0 {
+		return nil, errors.New("no fingerprints to allow; every transfer would be refused")
+	}
+	return transfer.NewAllowlist(fingerprints...), nil
+}
+
+// peerKeys returns the key fingerprint and peer ID saved for e, those it has
+func peerKeys(e *addrbook.Entry) []string {
+	var fps []string
+	for _, fp := range []string{e.Fingerprint, e.ID} {
+		if fp != "" {
+			fps = append(fps, fp)
+		}
+	}
+	return fps
+}
+
+// isFingerprint reports whether s looks like a hex SHA-256 key fingerprint,
+// optionally with colons between the bytes
+func isFingerprint(s string) bool {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	return err == nil && len(b) == sha256.Size
+}
+
+// forwardPort asks the router to forward port to us. Failure is not fatal:
+// the node still works on the local network. The returned func removes the
+// mapping.
+func forwardPort(ctx context.Context, port int) func() {
+	m, err := nat.Forward(ctx, "tcp", port)
+	if err != nil {
+		log.Warn("Automatic port forwarding failed", "error", err)
+		return func() {}
+	}
+	log.Info("Reachable from the internet", "address", m.Address())
+	return func() {
+		if err := m.Close(); err != nil {
+			log.Warn("Failed to remove port mapping", "error", err)
+		}
+	}
+}
+
+// startNode binds a port from ports, or serves ln if it is not nil, starts
+// the TCP server on it with the configuration from config and announces it
+// under code and the saved groups' secrets, returning the port. Failures
+// after startup are reported on the returned channel.
+func startNode(ctx context.Context, nodeName, code string, ports portRange, ln net.Listener, config func() netconn.ServerConfig, advertiseKey bool) (int, <-chan error, error) {
+	errCh := make(chan error, 2)
+
+	// Load our public key so it can be advertised to peers
+	pub, err := keys.LoadPublicKey()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to load public key: %w", err)
+	}
+	id, err := keys.LoadIdentity()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to load identity key: %w", err)
+	}
+	log.Info("Node identity", "fingerprint", keys.PublicKeyFingerprint(pub), "id", keys.IdentityFingerprint(id.Public().(ed25519.PublicKey)))
+	logCipher()
+
+	// Bind before announcing, so peers learn the port actually in use
+	if ln == nil {
+		if ln, err = netconn.ListenTCP(ports.first, ports.last); err != nil {
+			return 0, nil, err
+		}
+		if port := netconn.ListenPort(ln); ports.first != 0 && port != ports.first {
+			log.Warn("Listening on a different port than requested", "requested", ports, "port", port)
+		}
+	}
+	port := netconn.ListenPort(ln)
+	go func() {
+		defer ln.Close()
+		if err := netconn.ServeReloadable(ln, config); err != nil {
+			errCh <- fmt.Errorf("TCP server error: %w", err)
+		}
+	}()
+
+	// Announce service
+	go func() {
+		caps := func() discovery.Capabilities { return config().Capabilities() }
+		if err := discovery.Announce(ctx, nodeName, announceCodes(code), port, x509.MarshalPKCS1PublicKey(pub), advertiseKey, caps); err != nil {
+			errCh <- fmt.Errorf("service announcement error: %w", err)
+		}
+	}()
+	return port, errCh, nil
+}
+
+// portRange is the set of ports a node may listen on
+type portRange struct {
+	first, last int
+}
+
+func (r portRange) String() string {
+	if r.first == r.last {
+		return strconv.Itoa(r.first)
+	}
+	return fmt.Sprintf("%d-%d", r.first, r.last)
+}
+
+// listenPorts combines -port with -port-range ("8000-8010"), which
+// replaces it when set
+func listenPorts(port int, rangeFlag string) (portRange, error) {
+	if rangeFlag == "" {
+		return portRange{port, port}, nil
+	}
+	lo, hi, ok := strings.Cut(rangeFlag, "-")
+	if !ok {
+		return portRange{}, fmt.Errorf("invalid port range %q, expected first-last", rangeFlag)
+	}
+	first, err := strconv.Atoi(lo)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port range %q: %w", rangeFlag, err)
+	}
+	last, err := strconv.Atoi(hi)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port range %q: %w", rangeFlag, err)
+	}
+	if first < 1 || last < first || last > 65535 {
+		return portRange{}, fmt.Errorf("invalid port range %q", rangeFlag)
+	}
+	return portRange{first, last}, nil
+}
+
+// parseHostPort splits an ip:port address
+func parseHostPort(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	var p int
+	if _, err := fmt.Sscanf(portStr, "%d", &p); err != nil {
+		return "", 0, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+	return host, p, nil
+}
+
+func main() {
+	// A profile is chosen before anything reads keys, state or settings
+	profile, args, err := takeProfile(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if profile == "" {
+		profile = os.Getenv(util.ProfileEnv)
+	}
+	if err := useProfile(profile); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot use profile:", err)
+		os.Exit(2)
+	}
+	os.Args = append(os.Args[:1], args...)
+
+	// Dispatch subcommands; without one, run as a classic flag-driven node
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			code := cmd.run(os.Args[2:])
+			flushNotifications()
+			os.Exit(code)
+		}
+	}
+
+	// Set up context for graceful shutdown
+	ctx, cancel := shutdownContext()
+	defer cancel()
 
 	// Define command-line flags
-	port := flag.Int("port", 8000, "Port to listen on")
-	nodeName := flag.String("name", "node1", "Name of this node")
+	port := flag.Int("port", 8000, "Port to listen on (0 picks a free port)")
+	portRangeFlag := flag.String("port-range", "", "Listen on the first free port in this range, e.g. 8000-8010 (overrides -port)")
+	nodeName := flag.String("name", "", "Name of this node (default: generated from the public key, e.g. brave-otter-4f2a)")
 	filePath := flag.String("file", "", "Path to the file to send")
 	search := flag.String("search", "", "Search for a peer")
 	connect := flag.String("connect", "", "Directly connect to peer at ip:port (over internet)")
 	outDir := flag.String("out", "public", "Output directory for received files")
 	webrtcSend := flag.Bool("webrtc-send", false, "Use WebRTC to send a file (manual signaling)")
 	webrtcRecv := flag.Bool("webrtc-recv", false, "Use WebRTC to receive a file (manual signaling)")
-	debug := flag.Bool("debug", false, "Enable debug logging")
+	wormhole := flag.Bool("wormhole", false, "With -webrtc-send, signal through a rendezvous server: print a code for the receiver and trickle ICE candidates")
+	discoveryCode := flag.String("discovery-code", defaultCode(), codeUsage)
+	code := flag.String("code", "", "With -webrtc-recv, signal through a rendezvous server with the code the sender printed")
+	rendezvousAddr := flag.String("rendezvous", "", "Rendezvous server host:port used with -wormhole and -code (default $"+rendezvous.ServerEnv+")")
+	advertiseKey := flag.Bool("advertise-key", true, "Advertise the full public key in mDNS, not only its fingerprint")
+	chunkSize := flag.String("chunk-size", "", "Chunk size for sending, e.g. 256K or 4M, or \"auto\" to adapt to the link")
+	proxyURL := flag.String("proxy", "", "Proxy for outgoing connections: socks5://[user:pass@]host:port or http://host:port (default $ALL_PROXY)")
+	turn := flag.String("turn", "", "Comma-separated TURN servers for WebRTC, e.g. turn:user:pass@host:3478?transport=tcp")
+	stunFlag := flag.String("stun", os.Getenv(util.STUNEnv), "Comma-separated STUN servers (host:port) for finding the public address and for WebRTC (default $"+util.STUNEnv+", or public Google and Cloudflare servers)")
+	discoveryFlag := flag.String("discovery", os.Getenv(discovery.Env), discoveryUsage)
+	modeFlag := flag.String("mode", os.Getenv(modeEnv), modeUsage)
+	lf := addLogFlags(flag.CommandLine)
+	tf := addTimeoutFlags(flag.CommandLine)
+	bf := addBindFlags(flag.CommandLine)
+	tcf := addTCPFlags(flag.CommandLine)
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		printCommands(out)
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "Without a command, p2p runs a classic node that receives, or sends with -file:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	// Configure logger based on debug flag
-	if *debug {
-		log = util.NewLogger(os.Stdout, util.DebugLevel)
+	// Configure logger based on debug and json flags
+	lf.apply(false)
+	if err := tf.apply(); err != nil {
+		log.Error("Invalid timeout", "error", err)
+		os.Exit(2)
+	}
+	if err := bf.apply(); err != nil {
+		log.Error("Invalid -iface or -bind", "error", err)
+		os.Exit(2)
+	}
+	if err := tcf.apply(); err != nil {
+		log.Error("Invalid TCP option", "error", err)
+		os.Exit(2)
+	}
+	if err := netconn.SetProxy(*proxyURL); err != nil {
+		log.Error("Invalid -proxy", "value", *proxyURL, "error", err)
+		os.Exit(2)
+	}
+	if *turn != "" {
+		netconn.TURNServers = strings.Split(*turn, ",")
+	}
+	if err := util.SetSTUNServers(*stunFlag); err != nil {
+		log.Error("Invalid -stun", "value", *stunFlag, "error", err)
+		os.Exit(2)
+	}
+	if err := applyChunkSize(*chunkSize); err != nil {
+		log.Error("Invalid -chunk-size", "value", *chunkSize, "error", err)
+		os.Exit(2)
+	}
+	if err := applyDiscovery(*discoveryFlag); err != nil {
+		log.Error("Invalid -discovery", "value", *discoveryFlag, "error", err)
+		os.Exit(2)
+	}
+	if err := applyMode(*modeFlag); err != nil {
+		log.Error("Invalid -mode", "value", *modeFlag, "error", err)
+		os.Exit(2)
 	}
 
 	// Add node name to all log messages
-	log = log.With("node", *nodeName, "port", *port)
+	*nodeName = defaultNodeName(*nodeName)
+	log = log.With("node", *nodeName)
+	ports, err := listenPorts(*port, *portRangeFlag)
+	if err != nil {
+		log.Error("Invalid -port-range", "value", *portRangeFlag, "error", err)
+		os.Exit(2)
+	}
 
 	// Check if file path is provided if this node is a sender
 	if *filePath != "" {
 		if _, err := os.Stat(*filePath); os.IsNotExist(err) {
 			log.Error("File does not exist", "path", *filePath)
+			util.Emit(util.EventError, "stage", "startup", "error", "file does not exist", "path", *filePath)
 			os.Exit(1)
 		}
 		log.Info("Will send file", "path", *filePath)
@@ -86,17 +730,21 @@ func main() {
 	} else {
 		log.Warn("Unable to get local IPs", "error", err)
 	}
-	if pubIP, pubPort, err := util.GetPublicIP(3 * time.Second); err == nil {
-		log.Info("Public internet address (via STUN)", "ip", pubIP, "port", pubPort)
+	if nat, err := util.DetectNAT(3 * time.Second); err == nil {
+		log.Info("Public internet address (via STUN)", "ip", nat.IP, "port", nat.Port, "nat", nat.Type)
+		// Behind a symmetric NAT the address STUN saw is not the one the
+		// peer would reach, so WebRTC only connects through a relay
+		if nat.Type == util.NATSymmetric && (*webrtcSend || *webrtcRecv) && len(netconn.TURNServers) == 0 {
+			log.Warn("Symmetric NAT detected; a direct WebRTC connection will likely fail unless the peer has a public address. Add a -turn relay")
+		}
 	} else {
 		log.Warn("Unable to determine public IP (STUN)", "error", err)
 	}
 
 	// If using WebRTC modes, run them and exit.
 	if *webrtcRecv {
-		if err := netconn.StartWebRTCReceiver(*outDir); err != nil {
-			log.Error("WebRTC receive failed", "error", err)
-			os.Exit(1)
+		if status := receiveWebRTC(ctx, *outDir, *code, *rendezvousAddr); status != 0 {
+			os.Exit(status)
 		}
 		return
 	}
@@ -105,27 +753,26 @@ func main() {
 			log.Error("-webrtc-send requires -file to be provided")
 			os.Exit(1)
 		}
-		if err := netconn.StartWebRTCSender(*filePath); err != nil {
-			log.Error("WebRTC send failed", "error", err)
-			os.Exit(1)
+		if status := sendWebRTC(ctx, *filePath, *wormhole, *rendezvousAddr); status != 0 {
+			os.Exit(status)
 		}
 		return
 	}
 
-	// Start TCP server in background
-	errCh := make(chan error, 1)
-	go func() {
-		if err := netconn.StartTCPServer(*port); err != nil {
-			errCh <- fmt.Errorf("TCP server error: %w", err)
-		}
-	}()
-
-	// Announce service
-	go func() {
-		if err := discovery.Announce(*nodeName, "123", *port); err != nil {
-			errCh <- fmt.Errorf("service announcement error: %w", err)
-		}
-	}()
+	// Start TCP server and mDNS announcement in background
+	if err := checkCode(*discoveryCode); err != nil {
+		log.Error("Invalid -discovery-code", "error", err)
+		os.Exit(2)
+	}
+	usePasscodeOf(*search)
+	cfg := netconn.ServerConfig{OutputDir: *outDir, Passcode: codePasscode(*discoveryCode), OnPeers: acceptPeerExchange}
+	boundPort, errCh, err := startNode(ctx, *nodeName, *discoveryCode, ports, nil, func() netconn.ServerConfig { return cfg }, *advertiseKey)
+	if err != nil {
+		log.Error("Failed to start services", "error", err)
+		util.Emit(util.EventError, "stage", "startup", "error", err)
+		os.Exit(1)
+	}
+	log = log.With("port", boundPort)
 
 	// Wait a bit for services to start
 	select {
@@ -133,24 +780,20 @@ func main() {
 		log.Debug("Services started successfully")
 	case err := <-errCh:
 		log.Error("Failed to start services", "error", err)
+		util.Emit(util.EventError, "stage", "startup", "error", err)
 		os.Exit(1)
 	}
 
 	// Direct connection if connect flag is provided (ip:port)
 	if *connect != "" {
-		host, cport, err := net.SplitHostPort(*connect)
+		host, p, err := parseHostPort(*connect)
 		if err != nil {
 			log.Error("Invalid -connect address, expected ip:port", "value", *connect, "error", err)
 		} else {
-			// Parse port
-			var p int
-			if _, err := fmt.Sscanf(cport, "%d", &p); err != nil {
-				log.Error("Invalid port in -connect", "port", cport, "error", err)
-			} else {
-				log.Info("Connecting to peer (direct)", "address", *connect)
-				if err := netconn.ConnectTCP(host, p, *filePath); err != nil {
-					log.Error("Direct connect failed", "address", *connect, "error", err)
-				}
+			log.Info("Connecting to peer (direct)", "address", *connect)
+			if err := netconn.ConnectTCP(host, p, *filePath, ""); err != nil {
+				log.Error("Direct connect failed", "address", *connect, "error", err)
+				util.Emit(util.EventError, "stage", "connect", "address", *connect, "error", err)
 			}
 		}
 	}
@@ -161,8 +804,12 @@ func main() {
 		peers, err := discovery.FindPeers(*search, 5*time.Second)
 		if err != nil {
 			log.Error("Error finding peers", "error", err)
+			util.Emit(util.EventError, "stage", "discovery", "error", err)
 		} else {
 			log.Info("Discovered peers", "count", len(peers), "peers", peers)
+			for _, peer := range peers {
+				emitPeer(peer)
+			}
 		}
 
 		for _, peer := range peers {
@@ -171,19 +818,22 @@ func main() {
 				log.Debug("Skipping self", "peer", peer.ID)
 				continue
 			}
+			if size := transferSize(*filePath); !peer.Accepts(size) {
+				log.Info("Skipping peer", "peer", peer.ID, "reason", peerRefusal(peer, size))
+				continue
+			}
 
 			log.Info("Attempting to connect to peer", "peer", peer.ID, "address", fmt.Sprintf("%s:%d", peer.IP, peer.Port))
 
-			// Use retry with backoff for connection attempts
-			err := util.RetryWithBackoff(ctx, 3, time.Second, func() error {
-				return netconn.ConnectTCP(peer.IP, peer.Port, *filePath)
-			})
+			// ConnectTCP redials an unreachable peer itself
+			err := netconn.ConnectTCP(peer.IP, peer.Port, *filePath, peer.Fingerprint)
 
 			if err != nil {
 				log.Error("Failed to connect to peer",
 					"peer", peer.ID,
 					"address", fmt.Sprintf("%s:%d", peer.IP, peer.Port),
 					"error", err)
+				util.Emit(util.EventError, "stage", "connect", "peer", peer.ID, "error", err)
 			} else {
 				log.Info("Successfully connected to peer", "peer", peer.ID)
 			}
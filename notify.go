@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+const notifyUsage = "Show desktop notifications for incoming transfer requests and finished or failed transfers"
+
+// notifyDelay is how long notifications are held to merge a burst of
+// them, e.g. a synced directory's files, into one
+const notifyDelay = time.Second
+
+// failedStages are the stages of error events that mean a transfer failed
+var failedStages = map[string]bool{
+	"send": true, "receive": true, "sync": true, "webrtc_send": true, "webrtc_receive": true,
+}
+
+// notification is one notice shown on the desktop
+type notification struct {
+	title string
+	body  string
+}
+
+// notifyFlush asks the notifier to show what it holds at once, closing the
+// channel it is sent once done; nil if notifications are off
+var notifyFlush chan chan struct{}
+
+// enableNotifications shows events worth a user's attention as desktop
+// notifications: transfer requests awaiting approval, and transfers that
+// finished or failed. Notices of the same kind arriving within notifyDelay
+// are shown as one.
+func enableNotifications() {
+	// Subscribers must not block, so notices queue up here
+	queue := make(chan notification, 64)
+	util.Subscribe(func(ev util.Event) {
+		if n, ok := notice(ev); ok {
+			select {
+			case queue <- n:
+			default:
+			}
+		}
+	})
+	notifyFlush = make(chan chan struct{})
+	go func() {
+		var batch []notification
+		var timer <-chan time.Time
+		available := true
+		show := func() {
+			for _, n := range mergeNotices(batch) {
+				if !available {
+					break
+				}
+				if err := util.Notify(n.title, n.body); errors.Is(err, util.ErrNoNotifier) {
+					log.Warn("Cannot show desktop notifications", "error", err)
+					available = false
+				} else if err != nil {
+					log.Debug("Failed to show desktop notification", "error", err)
+				}
+			}
+			batch, timer = nil, nil
+		}
+		for {
+			select {
+			case n := <-queue:
+				if batch == nil {
+					timer = time.After(notifyDelay)
+				}
+				batch = append(batch, n)
+			case <-timer:
+				show()
+			case done := <-notifyFlush:
+			drain:
+				for {
+					select {
+					case n := <-queue:
+						batch = append(batch, n)
+					default:
+						break drain
+					}
+				}
+				show()
+				close(done)
+			}
+		}
+	}()
+}
+
+// flushNotifications shows pending notifications before the process
+// exits. The notification tools outlive it.
+func flushNotifications() {
+	if notifyFlush == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case notifyFlush <- done:
+		<-done
+	case <-time.After(notifyDelay):
+	}
+}
+
+// notice returns the notification for ev, if it deserves one
+func notice(ev util.Event) (notification, bool) {
+	str := func(key string) string {
+		s, _ := ev.Data[key].(string)
+		return s
+	}
+	switch ev.Type {
+	case util.EventTransferRequest:
+		body := str("file")
+		if size, ok := ev.Data["size"].(int64); ok && size >= 0 {
+			body += " (" + util.FormatSize(size) + ")"
+		}
+		return notification{"Incoming transfer request", body + " from " + str("peer")}, true
+	case util.EventTransferComplete:
+		switch str("direction") {
+		case "receiving":
+			return notification{"Transfer complete", "Received " + str("file")}, true
+		case "sending":
+			return notification{"Transfer complete", "Sent " + str("file")}, true
+		}
+	case util.EventError:
+		if failedStages[str("stage")] {
+			return notification{"Transfer failed", fmt.Sprint(ev.Data["error"])}, true
+		}
+	case util.EventTransferStatus:
+		// The daemon's sends report failure only here
+		if str("status") == "failed" && str("direction") == "send" {
+			return notification{"Transfer failed", str("error")}, true
+		}
+	}
+	return notification{}, false
+}
+
+// mergeNotices folds notices with the same title into one, keeping their
+// order
+func mergeNotices(batch []notification) []notification {
+	var titles []string
+	bodies := map[string][]string{}
+	for _, n := range batch {
+		if _, ok := bodies[n.title]; !ok {
+			titles = append(titles, n.title)
+		}
+		bodies[n.title] = append(bodies[n.title], n.body)
+	}
+	merged := make([]notification, 0, len(titles))
+	for _, title := range titles {
+		b := bodies[title]
+		body := strings.Join(b[:min(len(b), 3)], ", ")
+		if len(b) > 3 {
+			body += fmt.Sprintf(" and %d more", len(b)-3)
+		}
+		merged = append(merged, notification{title, body})
+	}
+	return merged
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/addrbook"
+	"github.com/udit2303/p2p-client/pkg/daemon"
+	"github.com/udit2303/p2p-client/pkg/discovery"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/objstore"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// runPeer implements `peer add|set|list|rm|exchange`: manages the address
+// book
+func runPeer(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: p2p peer add <name> <address> [-fingerprint fp] [-id peer-id] [-transport tcp|libp2p] [-libp2p multiaddr] [settings]")
+		fmt.Fprintln(os.Stderr, "       p2p peer set <name> [-address addr] [-fingerprint fp] [-id peer-id] [-transport tcp|libp2p] [-libp2p multiaddr] [settings]")
+		fmt.Fprintln(os.Stderr, "Settings: [-limit rate] [-compress[=false|default]] [-auto-accept[=false|default]] [-out dir] [-storage url] [-introducer[=false]]")
+		fmt.Fprintln(os.Stderr, "       p2p peer list [-json] [-online [-search code]]")
+		fmt.Fprintln(os.Stderr, "       p2p peer rm <name>")
+		fmt.Fprintln(os.Stderr, "       p2p peer exchange [-timeout d] <name>")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	book, err := addrbook.Open()
+	if err != nil {
+		log.Error("Cannot open address book", "error", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("peer add", flag.ExitOnError)
+		fingerprint := fs.String("fingerprint", "", "Expected key fingerprint of the peer")
+		id := fs.String("id", "", "Peer ID of the peer, recognising its transfers")
+		transport := fs.String("transport", addrbook.TransportTCP, "Transport to reach the peer: tcp (address ip:port) or libp2p (address multiaddr)")
+		fallback := fs.String("libp2p", "", "libp2p multiaddr to fall back to when the tcp address is unreachable")
+		settings := addPeerSettings(fs)
+		pos := parseInterspersed(fs, args[1:])
+		if len(pos) != 2 {
+			usage()
+			return 2
+		}
+		entry := &addrbook.Entry{Name: pos[0], Address: pos[1], Fingerprint: *fingerprint, ID: *id, Transport: *transport, Libp2p: *fallback}
+		if err := settings.apply(entry); err != nil {
+			log.Error("Invalid peer settings", "error", err)
+			return 2
+		}
+		if err := putPeer(book, entry); err != nil {
+			log.Error("Cannot add peer", "error", err)
+			return 2
+		}
+	case "set":
+		if len(args) < 2 {
+			usage()
+			return 2
+		}
+		saved, err := book.Get(args[1])
+		if err != nil {
+			log.Error("Cannot change peer", "error", err)
+			return 1
+		}
+		entry := *saved
+		fs := flag.NewFlagSet("peer set", flag.ExitOnError)
+		fs.StringVar(&entry.Address, "address", entry.Address, "Address of the peer: ip:port, or a multiaddr for libp2p peers")
+		fs.StringVar(&entry.Fingerprint, "fingerprint", entry.Fingerprint, "Expected key fingerprint of the peer")
+		fs.StringVar(&entry.ID, "id", entry.ID, "Peer ID of the peer, recognising its transfers")
+		fs.StringVar(&entry.Transport, "transport", entry.Transport, "Transport to reach the peer: tcp or libp2p")
+		fs.StringVar(&entry.Libp2p, "libp2p", entry.Libp2p, "libp2p multiaddr to fall back to when the tcp address is unreachable")
+		settings := addPeerSettings(fs)
+		if pos := parseInterspersed(fs, args[2:]); len(pos) != 0 {
+			usage()
+			return 2
+		}
+		if err := settings.apply(&entry); err != nil {
+			log.Error("Invalid peer settings", "error", err)
+			return 2
+		}
+		if err := putPeer(book, &entry); err != nil {
+			log.Error("Cannot change peer", "error", err)
+			return 2
+		}
+	case "list", "ls":
+		fs := flag.NewFlagSet("peer list", flag.ExitOnError)
+		jsonOut := fs.Bool("json", false, "Print the address book as JSON")
+		online := fs.Bool("online", false, "Browse the local network and show which peers are online")
+		search := fs.String("search", defaultCode(), "Discovery code, or saved group, peers announce themselves with, for -online")
+		fs.Parse(args[1:])
+		entries := book.List()
+		if *online {
+			return listPeersOnline(entries, *search, *jsonOut)
+		}
+		if *jsonOut {
+			json.NewEncoder(os.Stdout).Encode(entries)
+			return 0
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTRANSPORT\tADDRESS\tFINGERPRINT\tLAST SEEN\tSETTINGS")
+		for _, e := range entries {
+			seen := "-"
+			if !e.LastSeen.IsZero() {
+				seen = e.LastSeen.Local().Format("2006-01-02 15:04")
+			}
+			fp := e.Fingerprint
+			if fp == "" {
+				fp = "-"
+			}
+			transport := e.Transport
+			if e.Libp2p != "" {
+				transport += "+libp2p"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Name, transport, e.Address, fp, seen, describeSettings(book, e))
+		}
+		tw.Flush()
+		return 0
+	case "rm", "remove":
+		if len(args) != 2 {
+			usage()
+			return 2
+		}
+		if err := book.Remove(args[1]); err != nil {
+			log.Error("Cannot remove peer", "error", err)
+			return 1
+		}
+	case "exchange", "pex":
+		fs := flag.NewFlagSet("peer exchange", flag.ExitOnError)
+		timeout := fs.Duration("timeout", 15*time.Second, "How long the peer may take to connect")
+		pos := parseInterspersed(fs, args[1:])
+		if len(pos) != 1 {
+			usage()
+			return 2
+		}
+		if err := exchangePeers(book, pos[0], *timeout); err != nil {
+			log.Error("Peer exchange failed", "peer", pos[0], "error", err)
+			return exitCode(err)
+		}
+	default:
+		usage()
+		return 2
+	}
+
+	if err := book.Save(); err != nil {
+		log.Error("Cannot save address book", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// putPeer checks an entry's address and saves it in book
+func putPeer(book *addrbook.Book, e *addrbook.Entry) error {
+	if e.Transport == "" || e.Transport == addrbook.TransportTCP {
+		if _, _, err := parseHostPort(e.Address); err != nil {
+			return fmt.Errorf("invalid address %q, expected ip:port: %w", e.Address, err)
+		}
+	}
+	if e.ID != "" && !isFingerprint(e.ID) {
+		return fmt.Errorf("invalid peer ID %q, expected the hex SHA-256 logged under \"Node identity\"", e.ID)
+	}
+	return book.Put(e)
+}
+
+// optionalBool is a boolean flag that may be left unset, or reset with
+// "default"
+type optionalBool struct {
+	v   **bool
+	set bool
+}
+
+func (b *optionalBool) String() string {
+	if b.v == nil || *b.v == nil {
+		return "default"
+	}
+	return strconv.FormatBool(**b.v)
+}
+
+func (b *optionalBool) Set(s string) error {
+	b.set = true
+	if s == "default" {
+		*b.v = nil
+		return nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*b.v = &v
+	return nil
+}
+
+func (b *optionalBool) IsBoolFlag() bool { return true }
+
+// peerSettings are the flags setting a peer's overrides
+type peerSettings struct {
+	fs         *flag.FlagSet
+	limit      string
+	compress   *bool
+	autoAccept *bool
+	outDir     string
+	storage    string
+	introducer bool
+}
+
+// addPeerSettings defines the settings flags on fs
+func addPeerSettings(fs *flag.FlagSet) *peerSettings {
+	s := &peerSettings{fs: fs}
+	fs.StringVar(&s.limit, "limit", "", "Send to the peer at most this many bytes per second, e.g. 5M (0 for no limit)")
+	fs.Var(&optionalBool{v: &s.compress}, "compress", "Compress what is sent to the peer (=false never does, =default follows send -compress)")
+	fs.Var(&optionalBool{v: &s.autoAccept}, "auto-accept", "Accept the peer's transfers without asking (=false always asks, =default follows receive -ask and daemon -auto-accept)")
+	fs.StringVar(&s.outDir, "out", "", "Save the peer's files in this directory (empty for the receiver's -out)")
+	fs.StringVar(&s.storage, "storage", "", "Stream the peer's files to this object storage URL, e.g. s3://bucket/prefix (empty for the receiver's -storage)")
+	fs.BoolVar(&s.introducer, "introducer", false, "Exchange peers with this peer, saving the ones it introduces (needs -fingerprint)")
+	return s
+}
+
+// apply copies the settings given on the command line to e
+func (s *peerSettings) apply(e *addrbook.Entry) error {
+	var err error
+	s.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "limit":
+			e.RateLimit = 0
+			if s.limit != "" && s.limit != "0" {
+				n, perr := util.ParseSize(s.limit)
+				if perr != nil {
+					err = fmt.Errorf("invalid -limit %q: %w", s.limit, perr)
+				}
+				e.RateLimit = n
+			}
+		case "compress":
+			e.Compress = s.compress
+		case "auto-accept":
+			e.AutoAccept = s.autoAccept
+		case "out":
+			e.OutputDir = ""
+			if s.outDir != "" {
+				e.OutputDir, _ = filepath.Abs(s.outDir)
+			}
+		case "storage":
+			if s.storage != "" {
+				if _, serr := objstore.Open(s.storage); serr != nil && !errors.Is(serr, objstore.ErrNoCredentials) {
+					err = fmt.Errorf("invalid -storage: %w", serr)
+				}
+			}
+			e.Storage = s.storage
+		case "introducer":
+			e.Introducer = s.introducer
+		}
+	})
+	return err
+}
+
+// describeSettings summarises a peer's ID, overrides and part in peer
+// exchange for `peer list`
+func describeSettings(book *addrbook.Book, e *addrbook.Entry) string {
+	var parts []string
+	if e.ID != "" {
+		parts = append(parts, "id="+e.ID)
+	}
+	if e.RateLimit > 0 {
+		parts = append(parts, "limit="+util.FormatSize(e.RateLimit)+"/s")
+	}
+	if e.Compress != nil {
+		parts = append(parts, "compress="+strconv.FormatBool(*e.Compress))
+	}
+	if e.AutoAccept != nil {
+		parts = append(parts, "auto-accept="+strconv.FormatBool(*e.AutoAccept))
+	}
+	if e.OutputDir != "" {
+		parts = append(parts, "out="+e.OutputDir)
+	}
+	if e.Storage != "" {
+		parts = append(parts, "storage="+e.Storage)
+	}
+	if e.Introducer {
+		parts = append(parts, "introducer")
+	}
+	if e.IntroducedBy != "" {
+		via := e.IntroducedBy
+		if i := book.BySender(via); i != nil {
+			via = i.Name
+		}
+		parts = append(parts, "introduced-by="+via)
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, " ")
+}
+
+// applySendSettings applies the send settings saved for the peer name to
+// DefaultSendOptions, except those given on the command line in fs
+func applySendSettings(fs *flag.FlagSet, name string) {
+	book, err := addrbook.Open()
+	if err != nil {
+		return
+	}
+	e, err := book.Get(name)
+	if err != nil {
+		return
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if e.RateLimit > 0 && !given["limit"] {
+		transfer.DefaultSendOptions.RateLimit = e.RateLimit
+	}
+	if e.Compress != nil && !given["compress"] {
+		transfer.DefaultSendOptions.Compress = *e.Compress
+	}
+	if e.RateLimit > 0 || e.Compress != nil {
+		log.Debug("Using saved peer settings", "peer", name, "rate_limit", transfer.DefaultSendOptions.RateLimit, "compress", transfer.DefaultSendOptions.Compress)
+	}
+}
+
+// savedSender returns the address book entry of the sender of m, known by
+// its key fingerprint or peer ID, or nil
+func savedSender(m *transfer.Manifest) *addrbook.Entry {
+	book, err := addrbook.Open()
+	if err != nil {
+		return nil
+	}
+	return book.BySender(m.Sender, m.SenderID)
+}
+
+// senderDestination chooses where `receive` saves a file: in the sender's
+// saved output directory or outDir, asking first when ask is set unless the
+// sender's auto-accept setting says otherwise
+func senderDestination(outDir string, ask bool) func(remote string, m *transfer.Manifest) (string, error) {
+	return func(remote string, m *transfer.Manifest) (string, error) {
+		dir, prompt := outDir, ask
+		if e := savedSender(m); e != nil {
+			if e.OutputDir != "" {
+				dir = e.OutputDir
+			}
+			if e.AutoAccept != nil {
+				prompt = !*e.AutoAccept
+			}
+		}
+		if dir != outDir {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return "", fmt.Errorf("failed to create output directory: %w", err)
+			}
+		}
+		if !prompt {
+			if dir == outDir {
+				return "", nil
+			}
+			return dir, nil
+		}
+		path, err := netconn.PromptDestination(dir)(remote, m)
+		if err == nil && path == "" && dir != outDir {
+			path = dir
+		}
+		return path, err
+	}
+}
+
+// senderSettings returns the daemon's settings for a sender saved in the
+// address book
+func senderSettings(m *transfer.Manifest) daemon.SenderSettings {
+	e := savedSender(m)
+	if e == nil {
+		return daemon.SenderSettings{}
+	}
+	return daemon.SenderSettings{AutoAccept: e.AutoAccept, OutputDir: e.OutputDir}
+}
+
+// markSeen updates a saved peer's last known address after a successful
+// transfer
+func markSeen(name, address string) {
+	book, err := addrbook.Open()
+	if err != nil {
+		return
+	}
+	if _, err := book.Get(name); err != nil {
+		return
+	}
+	book.Seen(name, address)
+	if err := book.Save(); err != nil {
+		log.Debug("Cannot update address book", "error", err)
+	}
+}
+
+// peerStatus is an address book entry with whether it answered a scan
+type peerStatus struct {
+	*addrbook.Entry
+	Online bool   `json:"online"`
+	Found  string `json:"found,omitempty"` // Address it answered from
+}
+
+// listPeersOnline browses for peers announced with code and prints the
+// address book with each entry's status. Entries are matched by key
+// fingerprint, or by node name when no fingerprint is saved.
+func listPeersOnline(entries []*addrbook.Entry, code string, jsonOut bool) int {
+	found, err := discovery.FindPeers(code, discovery.ScanWindow)
+	if err != nil {
+		log.Error("Cannot browse for peers", "error", err)
+		return 1
+	}
+	list := make([]peerStatus, len(entries))
+	for i, e := range entries {
+		list[i].Entry = e
+		for _, p := range found {
+			if (e.Fingerprint != "" && p.Fingerprint == e.Fingerprint) || (e.Fingerprint == "" && p.ID == e.Name) {
+				list[i].Online = true
+				list[i].Found = net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+				break
+			}
+		}
+	}
+	if jsonOut {
+		json.NewEncoder(os.Stdout).Encode(list)
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATUS\tADDRESS\tFOUND AT")
+	for _, s := range list {
+		status, at := "offline", "-"
+		if s.Online {
+			status, at = "online", s.Found
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Name, status, s.Address, at)
+	}
+	tw.Flush()
+	return 0
+}
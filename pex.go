@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/addrbook"
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+)
+
+// exchangePeers implements `peer exchange <name>`: swaps introductions with
+// the saved peer name, which must be marked as an introducer, and merges
+// the peers it introduces into book
+func exchangePeers(book *addrbook.Book, name string, timeout time.Duration) error {
+	e, err := book.Get(name)
+	if err != nil {
+		return err
+	}
+	if !e.Introducer {
+		return fmt.Errorf("%s is not an introducer; mark it with `p2p peer set %s -introducer` first", name, name)
+	}
+	if e.Transport != addrbook.TransportTCP {
+		return fmt.Errorf("peers are exchanged over tcp, and %s is saved as a %s peer", name, e.Transport)
+	}
+	host, port, err := parseHostPort(e.Address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", e.Address, err)
+	}
+	records, err := introductions(book, e.Fingerprint)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	reply, pub, err := netconn.ExchangePeersVia(netconn.TCPDialer(ctx, host, port), e.Fingerprint, records)
+	if err != nil {
+		return err
+	}
+	return mergeIntroductions(book, e, pub, reply)
+}
+
+// acceptPeerExchange takes a peer exchange on a receiving node: the peers
+// introduced by a sender saved as an introducer are merged into the address
+// book, and it gets this node's introductions in return. Other senders are
+// refused.
+func acceptPeerExchange(remote string, sender *rsa.PublicKey, records []byte) ([]byte, error) {
+	book, err := addrbook.Open()
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := keys.PublicKeyFingerprint(sender)
+	e := book.BySender(fingerprint)
+	if e == nil || !e.Introducer {
+		log.Warn("Refusing peer exchange from a peer not saved as an introducer", "remote", remote, "fingerprint", fingerprint)
+		return nil, fmt.Errorf("%w: not saved as an introducer by the receiver", transfer.ErrRejected)
+	}
+	if err := mergeIntroductions(book, e, sender, records); err != nil {
+		return nil, err
+	}
+	if err := book.Save(); err != nil {
+		return nil, err
+	}
+	return introductions(book, fingerprint)
+}
+
+// introductions returns this node's signed records of the peers in book,
+// as sent to the peer whose key has fingerprint to
+func introductions(book *addrbook.Book, to string) ([]byte, error) {
+	priv, err := keys.LoadPrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %w", err)
+	}
+	records, err := book.Introductions(priv, to)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(records)
+}
+
+// mergeIntroductions merges the peers introduced by the saved peer e, whose
+// key is pub, into book and logs what changed
+func mergeIntroductions(book *addrbook.Book, e *addrbook.Entry, pub *rsa.PublicKey, data []byte) error {
+	var records []addrbook.Record
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &records); err != nil {
+			return fmt.Errorf("invalid peer records from %s: %w", e.Name, err)
+		}
+	}
+	self, err := keys.LoadPublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to load public key: %w", err)
+	}
+	res := book.Merge(e, pub, keys.PublicKeyFingerprint(self), records)
+	log.Info("Peers exchanged", "introducer", e.Name, "offered", len(records), "added", res.Added, "updated", res.Updated, "skipped", res.Skipped)
+	return nil
+}
@@ -0,0 +1,180 @@
+// Package addrbook stores named peers (~/.p2p-client/peers.json) so they can
+// be addressed by a friendly name instead of an IP and port.
+package addrbook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Transports a peer can be reached over
+const (
+	TransportTCP    = "tcp"    // Address is ip:port
+	TransportLibp2p = "libp2p" // Address is a multiaddr ending in /p2p/<peer id>
+)
+
+// ErrNotFound is returned when no peer has the given name
+var ErrNotFound = errors.New("peer not in address book")
+
+// Entry is a saved peer
+type Entry struct {
+	Name        string    `json:"name"`
+	Address     string    `json:"address"`               // Last known address
+	Fingerprint string    `json:"fingerprint,omitempty"` // Expected key fingerprint, checked when connecting
+	ID          string    `json:"id,omitempty"`          // Peer ID, the fingerprint of its identity key
+	Transport   string    `json:"transport,omitempty"`   // Preferred transport (default tcp)
+	Libp2p      string    `json:"libp2p,omitempty"`      // Multiaddr tried when the tcp Address is unreachable
+	LastSeen    time.Time `json:"last_seen,omitempty"`   // Last successful transfer or discovery
+
+	// Settings for this peer, overriding the command line defaults. Sends
+	// to it use RateLimit and Compress; transfers from it, recognised by
+	// Fingerprint or ID, use AutoAccept, and OutputDir or Storage.
+	RateLimit  int64  `json:"rate_limit,omitempty"`  // Bytes per second to send at most
+	Compress   *bool  `json:"compress,omitempty"`    // Whether to compress what is sent
+	AutoAccept *bool  `json:"auto_accept,omitempty"` // Whether its transfers are accepted without asking
+	OutputDir  string `json:"output_dir,omitempty"`  // Where its files are saved
+	Storage    string `json:"storage,omitempty"`     // Object storage URL its files are streamed to instead
+
+	// Peer exchange; see Merge
+	Introducer   bool   `json:"introducer,omitempty"`    // Whether to exchange peers with it, trusting those it introduces
+	IntroducedBy string `json:"introduced_by,omitempty"` // Fingerprint of the introducer this peer was learned from
+}
+
+// Book is the set of saved peers, keyed by name
+type Book struct {
+	path  string
+	peers map[string]*Entry
+}
+
+// Open loads the address book from the data directory; a missing file is an
+// empty book
+func Open() (*Book, error) {
+	dir, err := util.DataDir()
+	if err != nil {
+		return nil, err
+	}
+	return Load(filepath.Join(dir, "peers.json"))
+}
+
+// Load reads an address book from path
+func Load(path string) (*Book, error) {
+	b := &Book{path: path, peers: map[string]*Entry{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read address book: %w", err)
+	}
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse address book %s: %w", path, err)
+	}
+	for _, e := range entries {
+		b.peers[e.Name] = e
+	}
+	return b, nil
+}
+
+// Save writes the address book back to disk
+func (b *Book) Save() error {
+	data, err := json.MarshalIndent(b.List(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode address book: %w", err)
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write address book: %w", err)
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// Get returns the peer saved under name
+func (b *Book) Get(name string) (*Entry, error) {
+	e, ok := b.peers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	return e, nil
+}
+
+// BySender returns the peer whose key fingerprint or peer ID is among
+// fingerprints, or nil
+func (b *Book) BySender(fingerprints ...string) *Entry {
+	for _, fp := range fingerprints {
+		if fp == "" {
+			continue
+		}
+		for _, e := range b.peers {
+			if e.Fingerprint == fp || e.ID == fp {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// Put adds or replaces a peer
+func (b *Book) Put(e *Entry) error {
+	if e.Name == "" || e.Address == "" {
+		return errors.New("a peer needs a name and an address")
+	}
+	switch e.Transport {
+	case "":
+		e.Transport = TransportTCP
+	case TransportTCP, TransportLibp2p:
+	default:
+		return fmt.Errorf("unknown transport %q, expected %s or %s", e.Transport, TransportTCP, TransportLibp2p)
+	}
+	if e.Libp2p != "" && e.Transport != TransportTCP {
+		return errors.New("a libp2p fallback only applies to tcp peers")
+	}
+	if e.RateLimit < 0 {
+		return errors.New("a rate limit can't be negative")
+	}
+	if (e.AutoAccept != nil || e.OutputDir != "" || e.Storage != "") && e.Fingerprint == "" {
+		return errors.New("receive settings need the peer's fingerprint to recognise its transfers")
+	}
+	if e.Introducer && e.Fingerprint == "" {
+		return errors.New("an introducer needs its fingerprint to check the peers it introduces")
+	}
+	b.peers[e.Name] = e
+	return nil
+}
+
+// Remove deletes the peer saved under name
+func (b *Book) Remove(name string) error {
+	if _, ok := b.peers[name]; !ok {
+		return fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	delete(b.peers, name)
+	return nil
+}
+
+// List returns the saved peers sorted by name
+func (b *Book) List() []*Entry {
+	entries := make([]*Entry, 0, len(b.peers))
+	for _, e := range b.peers {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Seen records that the peer was reached at address; an empty address only
+// updates the time
+func (b *Book) Seen(name, address string) {
+	if e, ok := b.peers[name]; ok {
+		if address != "" {
+			e.Address = address
+		}
+		e.LastSeen = time.Now()
+	}
+}
@@ -0,0 +1,164 @@
+package addrbook
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/keys"
+)
+
+// Peer exchange: two nodes that saved each other as introducers swap
+// records of the peers in their address books over a transfer connection,
+// so each can reach the other's peers too, beyond its own network. Every
+// record is signed by the introducer's key, which vouches for the name,
+// addresses and fingerprint it carries. Only peers saved by hand are
+// introduced, never ones learned this way, and a peer's own settings are
+// not shared.
+
+// ErrInvalidRecord is returned for a record not signed by its introducer
+var ErrInvalidRecord = errors.New("invalid peer record")
+
+// Record introduces a saved peer to another node
+type Record struct {
+	Name        string    `json:"name"`
+	Address     string    `json:"address"`
+	Fingerprint string    `json:"fingerprint"`
+	Transport   string    `json:"transport,omitempty"`
+	Libp2p      string    `json:"libp2p,omitempty"`
+	LastSeen    time.Time `json:"last_seen,omitempty"`
+	Introducer  string    `json:"introducer"` // Fingerprint of the key that signed the record
+	SignedAt    time.Time `json:"signed_at"`
+	Signature   []byte    `json:"signature,omitempty"`
+}
+
+// digest hashes the record fields covered by the signature
+func (r *Record) digest() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+	b, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// Sign signs the record with the introducer's private key
+func (r *Record) Sign(priv *rsa.PrivateKey) error {
+	r.Introducer = keys.PublicKeyFingerprint(&priv.PublicKey)
+	r.SignedAt = time.Now()
+	d, err := r.digest()
+	if err != nil {
+		return fmt.Errorf("failed to encode peer record: %w", err)
+	}
+	sig, err := rsa.SignPSS(rand.Reader, priv, crypto.SHA256, d, nil)
+	if err != nil {
+		return fmt.Errorf("failed to sign peer record: %w", err)
+	}
+	r.Signature = sig
+	return nil
+}
+
+// Verify checks the record's signature against the introducer's public key
+func (r *Record) Verify(pub *rsa.PublicKey) error {
+	if r.Introducer != keys.PublicKeyFingerprint(pub) {
+		return fmt.Errorf("%w: signed by unexpected key %s", ErrInvalidRecord, r.Introducer)
+	}
+	d, err := r.digest()
+	if err != nil {
+		return fmt.Errorf("failed to encode peer record: %w", err)
+	}
+	if err := rsa.VerifyPSS(pub, crypto.SHA256, d, r.Signature, nil); err != nil {
+		return fmt.Errorf("%w: bad signature: %w", ErrInvalidRecord, err)
+	}
+	return nil
+}
+
+// Introductions returns signed records of the peers to introduce to the
+// peer whose key has fingerprint to: those saved by hand with a
+// fingerprint, other than that peer itself
+func (b *Book) Introductions(priv *rsa.PrivateKey, to string) ([]Record, error) {
+	records := []Record{}
+	for _, e := range b.List() {
+		if e.Fingerprint == "" || e.Fingerprint == to || e.IntroducedBy != "" {
+			continue
+		}
+		r := Record{
+			Name:        e.Name,
+			Address:     e.Address,
+			Fingerprint: e.Fingerprint,
+			Transport:   e.Transport,
+			Libp2p:      e.Libp2p,
+			LastSeen:    e.LastSeen,
+		}
+		if err := r.Sign(priv); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// MergeResult lists the names of the peers a merge added, updated and
+// skipped
+type MergeResult struct {
+	Added   []string
+	Updated []string
+	Skipped []string // Invalid, or under a name already taken by another peer
+}
+
+// Merge saves the peers introduced by the saved peer introducer, whose key
+// is pub. self is this node's own fingerprint. New peers are added under
+// their name, marked as introduced; a peer known already is only updated
+// if it was learned from the same introducer and the record was seen more
+// recently. Peers saved by hand are never changed.
+func (b *Book) Merge(introducer *Entry, pub *rsa.PublicKey, self string, records []Record) MergeResult {
+	var res MergeResult
+	for _, r := range records {
+		if r.Verify(pub) != nil || r.Fingerprint == "" || r.Address == "" {
+			res.Skipped = append(res.Skipped, r.Name)
+			continue
+		}
+		if r.Fingerprint == self || r.Fingerprint == introducer.Fingerprint {
+			continue
+		}
+		if known := b.BySender(r.Fingerprint); known != nil {
+			if known.IntroducedBy != introducer.Fingerprint || !r.LastSeen.After(known.LastSeen) {
+				continue
+			}
+			updated := *known
+			updated.Address, updated.Transport, updated.Libp2p, updated.LastSeen = r.Address, r.Transport, r.Libp2p, r.LastSeen
+			if b.Put(&updated) != nil {
+				res.Skipped = append(res.Skipped, r.Name)
+				continue
+			}
+			res.Updated = append(res.Updated, known.Name)
+			continue
+		}
+		if _, taken := b.peers[r.Name]; taken {
+			res.Skipped = append(res.Skipped, r.Name)
+			continue
+		}
+		e := &Entry{
+			Name:         r.Name,
+			Address:      r.Address,
+			Fingerprint:  r.Fingerprint,
+			Transport:    r.Transport,
+			Libp2p:       r.Libp2p,
+			LastSeen:     r.LastSeen,
+			IntroducedBy: introducer.Fingerprint,
+		}
+		if b.Put(e) != nil {
+			res.Skipped = append(res.Skipped, r.Name)
+			continue
+		}
+		res.Added = append(res.Added, r.Name)
+	}
+	return res
+}
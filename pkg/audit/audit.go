@@ -0,0 +1,239 @@
+// Package audit keeps a persistent trail of the connections a receiver took
+// (~/.p2p-client/audit.jsonl), for nodes shared by several senders, and
+// sums it up per peer. Records can also be forwarded to syslog.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+var (
+	log = util.DefaultLogger()
+)
+
+// MaxSize is how large the log grows before it is moved to <path>.1,
+// replacing the previous one
+var MaxSize int64 = 64 << 20
+
+// Path returns the default location of the audit log
+func Path() (string, error) {
+	dir, err := util.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "audit.jsonl"), nil
+}
+
+// Log appends audit records to a file, one JSON object per line
+type Log struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	size   int64
+	syslog *syslogWriter // If set, records are forwarded here too
+}
+
+// Open opens the audit log at path for appending
+func Open(path string) (*Log, error) {
+	l := &Log{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// ForwardToSyslog also sends every record to syslog: "local" for the
+// local daemon, or udp://host:port or tcp://host:port for a remote one
+func (l *Log) ForwardToSyslog(target string) error {
+	w, err := dialSyslog(target)
+	if err != nil {
+		return fmt.Errorf("cannot reach syslog at %s: %w", target, err)
+	}
+	l.mu.Lock()
+	l.syslog = w
+	l.mu.Unlock()
+	return nil
+}
+
+// Record appends r to the log and forwards it to syslog. Failures are
+// logged rather than returned, so auditing never stops a transfer.
+func (l *Log) Record(r netconn.AuditRecord) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Error("Failed to encode audit record", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.syslog != nil {
+		if err := l.syslog.write(r); err != nil {
+			log.Warn("Failed to forward audit record to syslog", "error", err)
+		}
+	}
+	if l.f == nil {
+		return
+	}
+	if l.size > 0 && l.size+int64(len(line)) > MaxSize {
+		l.rotate()
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Error("Failed to write audit record", "error", err)
+	}
+}
+
+// rotate moves the full log to <path>.1 and starts a new one
+func (l *Log) rotate() {
+	l.f.Close()
+	l.f = nil
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		log.Error("Failed to rotate audit log", "error", err)
+	}
+	if err := l.open(); err != nil {
+		log.Error("Failed to reopen audit log", "error", err)
+	}
+}
+
+// Close closes the log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.syslog != nil {
+		l.syslog.close()
+		l.syslog = nil
+	}
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Read returns the records in the log at path, and in the rotated one
+// before it, that ended at or after since, oldest first
+func Read(path string, since time.Time) ([]netconn.AuditRecord, error) {
+	var records []netconn.AuditRecord
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() {
+			var r netconn.AuditRecord
+			// A line cut short by a crash is skipped
+			if json.Unmarshal(scanner.Bytes(), &r) != nil || r.Time.Before(since) {
+				continue
+			}
+			records = append(records, r)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+	}
+	return records, nil
+}
+
+// PeerStats sums up the connections of one peer
+type PeerStats struct {
+	Peer         string    `json:"peer"`      // Key fingerprint, or the IP of a peer that never got in
+	Addresses    []string  `json:"addresses"` // IPs it connected from
+	Connections  int       `json:"connections"`
+	Transfers    int       `json:"transfers"` // Connections that received something
+	Failures     int       `json:"failures"`  // Connections that got in but received nothing
+	AuthFailures int       `json:"auth_failures"`
+	LockedOut    int       `json:"locked_out"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// Summarize sums records up per peer, busiest first. A connection counts
+// for its sender's key when one was given, else for its IP.
+func Summarize(records []netconn.AuditRecord) []*PeerStats {
+	byPeer := map[string]*PeerStats{}
+	for _, r := range records {
+		peer := r.Sender
+		if peer == "" {
+			peer = r.Remote
+		}
+		s, ok := byPeer[peer]
+		if !ok {
+			s = &PeerStats{Peer: peer}
+			byPeer[peer] = s
+		}
+		if !slices.Contains(s.Addresses, r.Remote) {
+			s.Addresses = append(s.Addresses, r.Remote)
+		}
+		s.Connections++
+		switch r.Outcome {
+		case netconn.AuditOK:
+			s.Transfers++
+		case netconn.AuditAuthFailed:
+			s.AuthFailures++
+		case netconn.AuditLockedOut:
+			s.LockedOut++
+		default:
+			s.Failures++
+		}
+		s.BytesIn += r.BytesIn
+		s.BytesOut += r.BytesOut
+		if r.Time.After(s.LastSeen) {
+			s.LastSeen = r.Time
+		}
+	}
+	stats := make([]*PeerStats, 0, len(byPeer))
+	for _, s := range byPeer {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].BytesIn != stats[j].BytesIn {
+			return stats[i].BytesIn > stats[j].BytesIn
+		}
+		return stats[i].Peer < stats[j].Peer
+	})
+	return stats
+}
+
+// Matches reports whether record r concerns peer: a key fingerprint or a
+// prefix of one, or an IP
+func Matches(r netconn.AuditRecord, peer string) bool {
+	return r.Remote == peer || (r.Sender != "" && strings.HasPrefix(r.Sender, strings.ToLower(peer)))
+}
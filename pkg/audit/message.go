@@ -0,0 +1,34 @@
+package audit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/udit2303/p2p-client/pkg/netconn"
+)
+
+// syslogMessage renders r as key=value pairs, quoting values with spaces
+func syslogMessage(r netconn.AuditRecord) string {
+	var b strings.Builder
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if strings.ContainsAny(value, " \t\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, value)
+	}
+	b.WriteString("audit")
+	add("outcome", r.Outcome)
+	add("remote", r.Remote)
+	add("sender", r.Sender)
+	add("file", r.File)
+	add("transfer_id", r.TransferID)
+	add("bytes_in", strconv.FormatInt(r.BytesIn, 10))
+	add("bytes_out", strconv.FormatInt(r.BytesOut, 10))
+	add("duration_ms", strconv.FormatInt(r.DurationMS, 10))
+	add("error", r.Error)
+	return b.String()
+}
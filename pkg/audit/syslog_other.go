@@ -0,0 +1,46 @@
+//go:build !windows
+
+package audit
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	"github.com/udit2303/p2p-client/pkg/netconn"
+)
+
+// syslogWriter forwards audit records to syslog
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+// dialSyslog connects to the syslog daemon named by target
+func dialSyslog(target string) (*syslogWriter, error) {
+	var network, addr string
+	if target != "local" {
+		var ok bool
+		network, addr, ok = strings.Cut(target, "://")
+		if !ok || (network != "udp" && network != "tcp") || addr == "" {
+			return nil, fmt.Errorf("expected local, udp://host:port or tcp://host:port")
+		}
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "p2p")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+// write sends r as one message, a warning unless it received a transfer
+func (s *syslogWriter) write(r netconn.AuditRecord) error {
+	msg := syslogMessage(r)
+	if r.Outcome == netconn.AuditOK {
+		return s.w.Info(msg)
+	}
+	return s.w.Warning(msg)
+}
+
+func (s *syslogWriter) close() {
+	s.w.Close()
+}
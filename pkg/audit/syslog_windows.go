@@ -0,0 +1,21 @@
+//go:build windows
+
+package audit
+
+import (
+	"errors"
+
+	"github.com/udit2303/p2p-client/pkg/netconn"
+)
+
+// syslogWriter forwards audit records to syslog
+type syslogWriter struct{}
+
+// dialSyslog fails: there is no syslog on Windows
+func dialSyslog(target string) (*syslogWriter, error) {
+	return nil, errors.New("syslog is not available on Windows")
+}
+
+func (s *syslogWriter) write(r netconn.AuditRecord) error { return nil }
+
+func (s *syslogWriter) close() {}
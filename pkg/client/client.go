@@ -0,0 +1,281 @@
+// Package client lets other Go programs embed the P2P client: discover
+// peers, send files and receive them, without shelling out to the binary.
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/discovery"
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+var (
+	log = util.DefaultLogger()
+)
+
+// RawEvent is a transfer or discovery record delivered to Options.OnEvent,
+// as written in JSON output mode; Events delivers them typed
+type RawEvent = util.Event
+
+// Peer is a node found on the local network
+type Peer = discovery.Peer
+
+// Errors returned by Send and SendToPeer, matched with errors.Is
+var (
+	ErrAuthFailed        = netconn.ErrAuthFailed         // Receiver rejected the passcode
+	ErrPeerUnreachable   = netconn.ErrPeerUnreachable    // No connection could be established
+	ErrKeyMismatch       = netconn.ErrKeyMismatch        // Peer's key doesn't match its advertised fingerprint
+	ErrRejected          = transfer.ErrRejected          // Receiver declined the transfer
+	ErrInsufficientSpace = transfer.ErrInsufficientSpace // Receiver lacks disk space
+	ErrQuotaExceeded     = transfer.ErrQuotaExceeded     // Sender's quota on the receiver is used up
+	ErrSenderNotAllowed  = transfer.ErrSenderNotAllowed  // Sender's key isn't on the receiver's allowlist
+	ErrChecksumMismatch  = transfer.ErrChecksumMismatch  // Data failed its integrity check
+	ErrProtocolVersion   = transfer.ErrProtocolVersion   // Peers share no suitable protocol version
+	ErrReceiverStalled   = transfer.ErrReceiverStalled   // Receiver stopped acknowledging chunks
+	ErrDeliveryFailed    = transfer.ErrDeliveryFailed    // Receiver failed to verify or store the data
+	ErrFileChanged       = transfer.ErrFileChanged       // File was modified while it was sent
+	ErrSessionBinding    = transfer.ErrSessionBinding    // Something on the path changed the session setup
+)
+
+// Options configures a Client. Zero values pick the CLI defaults.
+type Options struct {
+	Name          string   // Node name announced over mDNS (default: generated from the public key)
+	Port          int      // Port Listen accepts transfers on (default 8000; -1 picks a free port)
+	PortRangeEnd  int      // If above Port, Listen falls back to the next free port up to this one
+	OutputDir     string   // Directory received files are written to (default "public")
+	DiscoveryCode string   // Secret code peers use to find each other (default "123")
+	Groups        []string // Further secret codes Listen announces the node under
+	Passcode      string   // Passcode for outgoing transfers; if empty, P2P_PASSCODE or a prompt is used
+	AdvertiseKey  bool     // Advertise the full public key over mDNS, not only its fingerprint
+	NoMetadata    bool     // Don't restore the sender's file mode, mtime and owner on received files
+	Extract       bool     // Unpack received tar, tar.gz and zip archives into OutputDir instead of storing them
+
+	// Accept approves incoming transfers; nil accepts everything
+	Accept func(remote string, m *transfer.Manifest) error
+	// Quota optionally limits the bytes accepted from each sender
+	Quota *transfer.Quota
+	// AllowFrom optionally restricts incoming transfers to these senders' keys
+	AllowFrom *transfer.Allowlist
+	// Dedup optionally links files already held instead of receiving them again
+	Dedup *transfer.HashIndex
+	// Hooks optionally vet each received file, e.g. with a virus scanner,
+	// before it takes its real name; see transfer.Hook
+	Hooks []transfer.Hook
+	// Quarantine is where files turned down by Hooks are kept; if empty
+	// they are deleted
+	Quarantine string
+	// Destination optionally chooses where each accepted file is written: a
+	// file path, or a directory to put it in; "" keeps it in OutputDir
+	Destination func(remote string, m *transfer.Manifest) (string, error)
+	// Storage optionally opens a writer each accepted file is streamed to
+	// instead of OutputDir, e.g. an objstore upload; see
+	// transfer.ReceiveOptions.Storage
+	Storage func(remote string, m *transfer.Manifest) (io.WriteCloser, error)
+	// OnEvent is called for every event: discovery, progress, completion and errors
+	OnEvent func(RawEvent)
+	// OnReceived is called after each incoming transfer attempt
+	OnReceived func(err error)
+}
+
+// Client is an embeddable P2P node
+type Client struct {
+	opts        Options
+	fingerprint string
+	pubKey      []byte
+	unsubscribe func()
+
+	mu     sync.Mutex
+	events chan Event // Typed events, see Events
+	closed bool
+}
+
+// New creates a client, loading (or generating) the key pair in the working
+// directory
+func New(opts Options) (*Client, error) {
+	if opts.Port == 0 {
+		opts.Port = 8000
+	}
+	if opts.OutputDir == "" {
+		opts.OutputDir = "public"
+	}
+	if opts.DiscoveryCode == "" {
+		opts.DiscoveryCode = discovery.DefaultCode
+	}
+
+	pub, err := keys.LoadPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load public key: %w", err)
+	}
+	if opts.Name == "" {
+		if opts.Name, err = keys.NodeName(); err != nil {
+			opts.Name = keys.NameFromKey(pub)
+		}
+	}
+	c := &Client{
+		opts:        opts,
+		fingerprint: keys.PublicKeyFingerprint(pub),
+		pubKey:      x509.MarshalPKCS1PublicKey(pub),
+		events:      make(chan Event, EventBuffer),
+	}
+	if opts.Passcode != "" {
+		passcode := opts.Passcode
+		netconn.PasscodeSource = func() (string, error) { return passcode, nil }
+	}
+	c.unsubscribe = util.Subscribe(c.onEvent)
+	return c, nil
+}
+
+// Close stops event delivery and closes the Events channel
+func (c *Client) Close() error {
+	c.unsubscribe()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.events)
+	}
+	return nil
+}
+
+// Fingerprint returns the fingerprint of this node's public key
+func (c *Client) Fingerprint() string {
+	return c.fingerprint
+}
+
+// FindPeers browses the local network for peers using the discovery code
+func (c *Client) FindPeers(ctx context.Context, timeout time.Duration) ([]Peer, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+	peers, err := discovery.FindPeers(c.opts.DiscoveryCode, timeout)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range peers {
+		util.Emit(util.EventPeerDiscovered, "id", p.ID, "ip", p.IP, "port", p.Port, "fingerprint", p.Fingerprint,
+			"version", p.Version, "transports", p.Transports, "max_size", p.MaxFileSize, "accepting", p.Accepting, "busy", p.Busy)
+		c.publish(PeerFound{Peer: p})
+	}
+	return peers, nil
+}
+
+// Send sends files to target, an ip:port address, one after another.
+// Cancelling ctx aborts the transfer in progress.
+func (c *Client) Send(ctx context.Context, target string, paths ...string) error {
+	host, port, err := splitTarget(target)
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, host, port, "", paths)
+}
+
+// SendStream sends the contents of r, described by m, to target, an ip:port
+// address, without staging it on disk; see transfer.SendStream. Cancelling
+// ctx aborts the transfer.
+func (c *Client) SendStream(ctx context.Context, target string, m *transfer.Manifest, r io.Reader) error {
+	host, port, err := splitTarget(target)
+	if err != nil {
+		return err
+	}
+	return c.sendStream(ctx, host, port, "", m, r)
+}
+
+// SendStreamToPeer is SendStream to a discovered peer, checking that its key
+// matches the advertised fingerprint
+func (c *Client) SendStreamToPeer(ctx context.Context, peer Peer, m *transfer.Manifest, r io.Reader) error {
+	return c.sendStream(ctx, peer.IP, peer.Port, peer.Fingerprint, m, r)
+}
+
+func (c *Client) sendStream(ctx context.Context, host string, port int, fingerprint string, m *transfer.Manifest, r io.Reader) error {
+	if err := netconn.SendManifestVia(netconn.TCPDialer(ctx, host, port), fingerprint, m, r); err != nil {
+		c.sendFailed(net.JoinHostPort(host, strconv.Itoa(port)), m.FileName, err)
+		return fmt.Errorf("sending %s: %w", m.FileName, err)
+	}
+	return nil
+}
+
+// splitTarget splits an ip:port address
+func splitTarget(target string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid target %q, expected ip:port: %w", target, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in %q: %w", target, err)
+	}
+	return host, port, nil
+}
+
+// SendToPeer sends files to a discovered peer, checking that its key matches
+// the advertised fingerprint
+func (c *Client) SendToPeer(ctx context.Context, peer Peer, paths ...string) error {
+	return c.send(ctx, peer.IP, peer.Port, peer.Fingerprint, paths)
+}
+
+func (c *Client) send(ctx context.Context, host string, port int, fingerprint string, paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("no files to send")
+	}
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := netconn.SendFileVia(netconn.TCPDialer(ctx, host, port), path, fingerprint); err != nil {
+			c.sendFailed(net.JoinHostPort(host, strconv.Itoa(port)), path, err)
+			return fmt.Errorf("sending %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Listen accepts incoming transfers and announces the node over mDNS until
+// ctx is cancelled
+func (c *Client) Listen(ctx context.Context) error {
+	first := max(c.opts.Port, 0)
+	ln, err := netconn.ListenTCP(first, max(c.opts.PortRangeEnd, first))
+	if err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, func() { ln.Close() })
+	port := netconn.ListenPort(ln)
+	log.Info("Listening for transfers", "port", port, "fingerprint", c.fingerprint)
+
+	cfg := netconn.ServerConfig{
+		OutputDir:   c.opts.OutputDir,
+		Accept:      c.opts.Accept,
+		OnReceived:  c.opts.OnReceived,
+		Quota:       c.opts.Quota,
+		AllowFrom:   c.opts.AllowFrom,
+		NoMetadata:  c.opts.NoMetadata,
+		Extract:     c.opts.Extract,
+		Dedup:       c.opts.Dedup,
+		Destination: c.opts.Destination,
+		Hooks:       c.opts.Hooks,
+		Quarantine:  c.opts.Quarantine,
+		Storage:     c.opts.Storage,
+	}
+	c.serverHooks(&cfg)
+	go func() {
+		if err := discovery.Announce(ctx, c.opts.Name, append([]string{c.opts.DiscoveryCode}, c.opts.Groups...), port, c.pubKey, c.opts.AdvertiseKey, cfg.Capabilities); err != nil {
+			log.Error("Service announcement failed", "error", err)
+		}
+	}()
+
+	err = netconn.Serve(ln, cfg)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
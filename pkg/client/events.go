@@ -0,0 +1,174 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/discovery"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// EventBuffer is how many typed events Client.Events holds for a slow
+// reader; further events are dropped rather than stall a transfer
+const EventBuffer = 256
+
+// Event is a typed notification delivered on Client.Events: a PeerFound,
+// PeerLost, TransferRequested, TransferProgress, TransferDone or AuthFailed.
+// Like OnEvent, transfer events cover every transfer in the process.
+type Event interface {
+	event()
+}
+
+// PeerFound is a peer seen by FindPeers, or coming online while WatchPeers
+// runs
+type PeerFound struct {
+	Peer Peer
+}
+
+// PeerLost is a peer that stopped answering while WatchPeers runs
+type PeerLost struct {
+	Peer Peer
+}
+
+// TransferRequested is an incoming transfer Listen is about to approve
+type TransferRequested struct {
+	Remote     string            // Sender's address
+	Sender     string            // Fingerprint of the sender's key
+	TransferID string            // ID the sender picked for the transfer
+	File       string            // File name
+	Size       int64             // File size, -1 if not known in advance
+	Meta       map[string]string // Key/value pairs the sender attached
+}
+
+// TransferProgress reports how far a transfer has got
+type TransferProgress struct {
+	Direction   string // "sending" or "receiving"
+	TransferID  string
+	File        string
+	Transferred int64 // Bytes transferred so far
+	Size        int64 // File size, -1 if not known
+	Percent     float64
+	Speed       float64       // Bytes per second, smoothed
+	ETA         time.Duration // Estimated time remaining
+}
+
+// TransferDone ends a transfer: Err is nil if it completed
+type TransferDone struct {
+	Direction  string // "sending" or "receiving"
+	TransferID string // Empty for failures before the transfer was under way
+	File       string
+	Size       int64
+	Duration   time.Duration
+	Err        error // Matched with errors.Is against the Err values of this package
+}
+
+// AuthFailed is a handshake that failed on its passcode, sending or
+// receiving
+type AuthFailed struct {
+	Remote   string // Peer's address
+	Incoming bool   // A sender gave Listen the wrong passcode, rather than a receiver turning ours down
+	Err      error
+}
+
+func (PeerFound) event()         {}
+func (PeerLost) event()          {}
+func (TransferRequested) event() {}
+func (TransferProgress) event()  {}
+func (TransferDone) event()      {}
+func (AuthFailed) event()        {}
+
+// Events returns the channel typed events are delivered on, closed by
+// Close. Events are dropped while EventBuffer of them wait unread.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// publish delivers ev on the events channel unless it is full or closed
+func (c *Client) publish(ev Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.events <- ev:
+	default:
+	}
+}
+
+// onEvent passes an emitted event to Options.OnEvent, and turns progress
+// and completion into typed events
+func (c *Client) onEvent(ev RawEvent) {
+	if c.opts.OnEvent != nil {
+		c.opts.OnEvent(ev)
+	}
+	direction, _ := ev.Data["direction"].(string)
+	id, _ := ev.Data["transfer_id"].(string)
+	file, _ := ev.Data["file"].(string)
+	size, _ := ev.Data["size"].(int64)
+	switch ev.Type {
+	case util.EventProgress:
+		p := TransferProgress{Direction: direction, TransferID: id, File: file, Size: size}
+		p.Transferred, _ = ev.Data["transferred"].(int64)
+		p.Percent, _ = ev.Data["percent"].(float64)
+		p.Speed, _ = ev.Data["speed"].(float64)
+		if eta, ok := ev.Data["eta"].(float64); ok {
+			p.ETA = time.Duration(eta * float64(time.Second))
+		}
+		c.publish(p)
+	case util.EventTransferComplete:
+		ms, _ := ev.Data["duration_ms"].(int64)
+		c.publish(TransferDone{Direction: direction, TransferID: id, File: file, Size: size, Duration: time.Duration(ms) * time.Millisecond})
+	}
+}
+
+// sendFailed publishes the failure of sending file to target
+func (c *Client) sendFailed(target, file string, err error) {
+	if errors.Is(err, ErrAuthFailed) {
+		c.publish(AuthFailed{Remote: target, Err: err})
+	}
+	c.publish(TransferDone{Direction: "sending", File: file, Size: -1, Err: err})
+}
+
+// WatchPeers keeps browsing for peers with the discovery code until ctx is
+// cancelled, delivering PeerFound as each comes online and PeerLost once it
+// hasn't answered for discovery.PeerTTL
+func (c *Client) WatchPeers(ctx context.Context) {
+	w := discovery.NewWatcher(c.opts.DiscoveryCode)
+	w.OnChange = func(s discovery.PeerStatus) {
+		if s.Online {
+			c.publish(PeerFound{Peer: s.Peer})
+		} else {
+			c.publish(PeerLost{Peer: s.Peer})
+		}
+	}
+	w.Run(ctx)
+}
+
+// serverHooks wraps the approval and completion hooks of cfg to publish
+// TransferRequested, failed receives and AuthFailed
+func (c *Client) serverHooks(cfg *netconn.ServerConfig) {
+	accept := cfg.Accept
+	cfg.Accept = func(remote string, m *transfer.Manifest) error {
+		c.publish(TransferRequested{Remote: remote, Sender: m.Sender, TransferID: m.TransferID, File: m.FileName, Size: m.FileSize, Meta: m.Meta})
+		if accept != nil {
+			return accept(remote, m)
+		}
+		return nil
+	}
+	onReceived := cfg.OnReceived
+	cfg.OnReceived = func(err error) {
+		if err != nil {
+			c.publish(TransferDone{Direction: "receiving", Size: -1, Err: err})
+		}
+		if onReceived != nil {
+			onReceived(err)
+		}
+	}
+	cfg.OnAuthFailed = func(remote string, err error) {
+		c.publish(AuthFailed{Remote: remote, Incoming: true, Err: err})
+	}
+}
@@ -0,0 +1,477 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/discovery"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/util"
+	"golang.org/x/net/websocket"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// csrfHeader must be present on state-changing requests. Browsers can't add
+// custom headers cross-origin without a CORS preflight, which we never grant.
+const csrfHeader = "X-P2P-Client"
+
+// apiTokenFile holds the token the web UI and API want, made afresh each
+// time the daemon starts, under the data directory
+const apiTokenFile = "api-token"
+
+// maxUpload bounds a single drag-and-drop upload held in memory before
+// spilling to disk
+const maxUpload = 32 << 20
+
+// splitTarget parses an ip:port target
+func splitTarget(target string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid target %q, expected ip:port: %w", target, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in %q: %w", target, err)
+	}
+	return host, port, nil
+}
+
+// Handler returns the HTTP handler serving the web UI and REST API. The
+// control socket serves it as is, its file mode keeping other users out;
+// ServeHTTPOn adds the API token and Host checks.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	static, _ := fs.Sub(webFiles, "web")
+	mux.Handle("GET /", http.FileServer(http.FS(static)))
+
+	mux.HandleFunc("GET /api/peers", d.handlePeers)
+	mux.HandleFunc("GET /api/transfers", d.handleTransfers)
+	mux.HandleFunc("GET /api/transfers/{id}", d.handleTransfer)
+	mux.HandleFunc("POST /api/send", d.handleSend)
+	mux.HandleFunc("GET /api/queue", d.handleQueue)
+	mux.HandleFunc("POST /api/transfers/{id}/priority", d.handlePriority)
+	mux.HandleFunc("POST /api/transfers/{id}/accept", d.handleDecision(true))
+	mux.HandleFunc("POST /api/transfers/{id}/reject", d.handleDecision(false))
+	mux.HandleFunc("GET /api/connections", d.handleConnections)
+	mux.HandleFunc("POST /api/connections/{peer}/disconnect", d.handleDisconnect)
+	mux.HandleFunc("GET /api/lockouts", d.handleLockouts)
+	mux.HandleFunc("DELETE /api/lockouts/{ip}", d.handleUnlock)
+	mux.HandleFunc("GET /api/shares", d.handleShares)
+	mux.HandleFunc("POST /api/shares", d.handleShare)
+	mux.HandleFunc("DELETE /api/shares/{id}", d.handleUnshare)
+	mux.Handle("GET /api/events", websocket.Server{Handler: d.handleEvents, Handshake: sameOrigin})
+
+	return requireCSRFHeader(mux)
+}
+
+// APIToken returns the token of the daemon running under the data
+// directory, which requests to its web UI and API must carry
+func APIToken() (string, error) {
+	dir, err := util.DataDir()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, apiTokenFile))
+	if err != nil {
+		return "", fmt.Errorf("cannot read the daemon's API token: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// newAPIToken makes the token for this run of the daemon and saves it
+// where only its owner can read it
+func newAPIToken() (string, error) {
+	dir, err := util.DataDir()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	path := filepath.Join(dir, apiTokenFile)
+	os.Remove(path) // WriteFile keeps the mode of a file that exists
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to save API token: %w", err)
+	}
+	log.Info("API token saved", "path", path)
+	return token, nil
+}
+
+// ServeHTTP listens on addr until ctx is cancelled
+func (d *Daemon) ServeHTTP(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("web UI server error: %w", err)
+	}
+	return d.ServeHTTPOn(ctx, ln)
+}
+
+// ServeHTTPOn serves the web UI and API on ln, e.g. a socket passed by the
+// service manager, until ctx is cancelled
+func (d *Daemon) ServeHTTPOn(ctx context.Context, ln net.Listener) error {
+	token, err := newAPIToken()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: requireLocalHost(ln.Addr(), requireToken(token, d.Handler()))}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.Info("Web UI available", "url", "http://"+ln.Addr().String())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("web UI server error: %w", err)
+	}
+	return nil
+}
+
+// sameOrigin rejects WebSocket connections opened by pages from other origins
+func sameOrigin(cfg *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(cfg, r)
+	if err != nil {
+		return err
+	}
+	if origin != nil && origin.Host != r.Host {
+		return fmt.Errorf("cross-origin WebSocket from %s rejected", origin.Host)
+	}
+	return nil
+}
+
+// requireLocalHost rejects requests whose Host isn't this server by a
+// loopback name or its own IP, so a page whose name is rebound to
+// 127.0.0.1 can't talk to the API as if it were the web UI
+func requireLocalHost(addr net.Addr, next http.Handler) http.Handler {
+	port := strconv.Itoa(addr.(*net.TCPAddr).Port)
+	allowed := map[string]bool{}
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if ip := addr.(*net.TCPAddr).IP; !ip.IsUnspecified() {
+		hosts = append(hosts, ip.String())
+	}
+	for _, h := range hosts {
+		allowed[net.JoinHostPort(h, port)] = true
+		if port == "80" {
+			allowed[h] = true
+			allowed["["+h+"]"] = true
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed[strings.ToLower(r.Host)] {
+			http.Error(w, "unexpected Host "+r.Host, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireToken rejects API requests that don't carry token, as an
+// "Authorization: Bearer" header or, for the WebSocket browsers can't add
+// headers to, a "token" query parameter. The web UI's own files are served
+// to anyone who passed requireLocalHost.
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte(token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				got = r.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(got), want) != 1 {
+				http.Error(w, "missing or wrong API token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requireCSRFHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Header.Get(csrfHeader) == "" {
+			http.Error(w, "missing "+csrfHeader+" header", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// handlePeers lists the peers the daemon keeps track of. Another discovery
+// code is browsed on the spot, so only its online peers are listed.
+func (d *Daemon) handlePeers(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+	if code == "" || code == d.cfg.DiscoveryCode {
+		writeJSON(w, http.StatusOK, d.Peers())
+		return
+	}
+	peers, err := discovery.FindPeers(code, 3*time.Second)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	now := time.Now()
+	list := make([]discovery.PeerStatus, len(peers))
+	for i, p := range peers {
+		list[i] = discovery.PeerStatus{Peer: p, LastSeen: now, Online: true}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (d *Daemon) handleConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, netconn.Connections())
+}
+
+// handleDisconnect closes connections by ID, remote ip:port or remote IP
+func (d *Daemon) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	n, err := netconn.Disconnect(r.PathValue("peer"))
+	if errors.Is(err, netconn.ErrNoConnection) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"closed": n})
+}
+
+// handleLockouts lists the IPs locked out for failing the handshake
+func (d *Daemon) handleLockouts(w http.ResponseWriter, r *http.Request) {
+	locked := netconn.Lockouts()
+	if locked == nil {
+		locked = []netconn.Lockout{}
+	}
+	writeJSON(w, http.StatusOK, locked)
+}
+
+// handleUnlock lifts the lockout of an IP
+func (d *Daemon) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+	if err := netconn.Unlock(ip); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"unlocked": ip})
+}
+
+func (d *Daemon) handleTransfers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.Transfers())
+}
+
+func (d *Daemon) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	t, err := d.Transfer(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// sendRequest is the JSON body accepted by POST /api/send
+type sendRequest struct {
+	Target      string    `json:"target"`
+	Fingerprint string    `json:"fingerprint"`
+	Path        string    `json:"path"`
+	Priority    int       `json:"priority"`
+	StartAt     time.Time `json:"start_at,omitzero"` // hold the send until then
+}
+
+// handleSend queues a send, either of a local path (JSON body) or of a file
+// uploaded from the browser (multipart form, whose "schedule" field takes
+// what util.NextSchedule does)
+func (d *Daemon) handleSend(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req sendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		t, err := d.QueueSend(req.Target, req.Fingerprint, req.Path, false, req.Priority, req.StartAt)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, t)
+		return
+	}
+
+	if err := r.ParseMultipartForm(maxUpload); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	var startAt time.Time
+	if spec := r.FormValue("schedule"); spec != "" {
+		var err error
+		if startAt, err = util.NextSchedule(spec, time.Now()); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer file.Close()
+
+	// Keep the original name so the receiver sees it in the manifest
+	dir, err := os.MkdirTemp("", "p2p-upload-")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	path := filepath.Join(dir, filepath.Base(header.Filename))
+	out, err := os.Create(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = io.Copy(out, file)
+	out.Close()
+	if err != nil {
+		os.RemoveAll(dir)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	priority, _ := strconv.Atoi(r.FormValue("priority"))
+	t, err := d.QueueSend(r.FormValue("target"), r.FormValue("fingerprint"), path, true, priority, startAt)
+	if err != nil {
+		os.RemoveAll(dir)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, t)
+}
+
+func (d *Daemon) handleShares(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.Shares())
+}
+
+func (d *Daemon) handleShare(w http.ResponseWriter, r *http.Request) {
+	var req shareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var expires time.Duration
+	if req.Expires != "" {
+		var err error
+		if expires, err = time.ParseDuration(req.Expires); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid expiry: %w", err))
+			return
+		}
+	}
+	s, err := d.Share(req.Path, expires)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, s)
+}
+
+func (d *Daemon) handleUnshare(w http.ResponseWriter, r *http.Request) {
+	if err := d.Unshare(r.PathValue("id")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queueState is the body returned by GET /api/queue
+type queueState struct {
+	Concurrency int        `json:"concurrency"`
+	Running     []Transfer `json:"running"`
+	Queued      []Transfer `json:"queued"` // in the order they will start
+}
+
+func (d *Daemon) handleQueue(w http.ResponseWriter, r *http.Request) {
+	state := queueState{Concurrency: d.cfg.Concurrency, Running: []Transfer{}, Queued: d.Queue()}
+	for _, t := range d.Transfers() {
+		if t.Direction == DirectionSend && t.Status == StatusRunning {
+			state.Running = append(state.Running, t)
+		}
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+func (d *Daemon) handlePriority(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Priority int `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := d.SetPriority(r.PathValue("id"), req.Priority); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) handleDecision(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := d.Decide(r.PathValue("id"), approve); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleEvents streams events to a WebSocket client as JSON messages
+func (d *Daemon) handleEvents(ws *websocket.Conn) {
+	defer ws.Close()
+	events := make(chan util.Event, 64)
+	unsubscribe := util.Subscribe(func(ev util.Event) {
+		select {
+		case events <- ev:
+		default: // slow client; drop rather than stall transfers
+		}
+	})
+	defer unsubscribe()
+
+	// Detect the client going away
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, ws)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case ev := <-events:
+			if err := websocket.JSON.Send(ws, ev); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// The control socket serves the same API as the web UI on a Unix domain
+// socket only the owner can open, so CLI invocations on the same machine can
+// hand their work to a running daemon instead of starting their own node.
+
+// ErrNoDaemon is returned when no daemon is listening on the control socket
+var ErrNoDaemon = errors.New("no daemon running")
+
+// socketName is the control socket's file name
+const socketName = "p2p.sock"
+
+// SocketPath returns where the control socket lives: $XDG_RUNTIME_DIR, or
+// the data directory when that isn't set
+func SocketPath() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		// Each profile runs a daemon of its own
+		if p := util.Profile(); p != "" {
+			return filepath.Join(dir, "p2p-"+p+".sock"), nil
+		}
+		return filepath.Join(dir, socketName), nil
+	}
+	dir, err := util.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, socketName), nil
+}
+
+// ServeControl serves the API on a Unix domain socket at path until ctx is
+// cancelled. A socket left behind by a daemon that died is replaced; one a
+// live daemon is serving is an error.
+func (d *Daemon) ServeControl(ctx context.Context, path string) error {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("another daemon is listening on %s", path)
+	}
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to create control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+	srv := &http.Server{Handler: d.Handler()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.Info("Control socket listening", "path", path)
+	err = srv.Serve(ln)
+	os.Remove(path)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("control socket error: %w", err)
+	}
+	return nil
+}
+
+// Control talks to a running daemon over its control socket
+type Control struct {
+	client *http.Client
+}
+
+// ConnectControl connects to the daemon listening on path. It returns
+// ErrNoDaemon if there is none.
+func ConnectControl(path string) (*Control, error) {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, ErrNoDaemon
+		}
+		return nil, fmt.Errorf("failed to reach daemon on %s: %w", path, err)
+	}
+	conn.Close()
+	return &Control{client: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}}, nil
+}
+
+// do sends a request to the daemon and decodes its JSON answer into out
+func (c *Control) do(method, path string, body, out any) error {
+	var r io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://daemon"+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(csrfHeader, "1")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("daemon request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = resp.Status
+		}
+		return fmt.Errorf("daemon: %s", e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Send queues path, which must be absolute, to be sent to target (ip:port)
+// by the daemon, not before startAt if it is set
+func (c *Control) Send(target, fingerprint, path string, priority int, startAt time.Time) (*Transfer, error) {
+	var t Transfer
+	req := sendRequest{Target: target, Fingerprint: fingerprint, Path: path, Priority: priority, StartAt: startAt}
+	err := c.do(http.MethodPost, "/api/send", req, &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Share asks the daemon for a one-time download link to path, which must
+// be absolute, valid for expires (0 for the default)
+func (c *Control) Share(path string, expires time.Duration) (*Share, error) {
+	req := shareRequest{Path: path}
+	if expires > 0 {
+		req.Expires = expires.String()
+	}
+	var s Share
+	if err := c.do(http.MethodPost, "/api/shares", req, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Transfer returns the daemon's record of the transfer with id
+func (c *Control) Transfer(id string) (*Transfer, error) {
+	var t Transfer
+	if err := c.do(http.MethodGet, "/api/transfers/"+id, nil, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Wait polls the transfer with id until it finishes, calling update with
+// each snapshot, and returns the final one
+func (c *Control) Wait(ctx context.Context, id string, update func(*Transfer)) (*Transfer, error) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		t, err := c.Transfer(id)
+		if err != nil {
+			return nil, err
+		}
+		if update != nil {
+			update(t)
+		}
+		if finished(t.Status) {
+			return t, nil
+		}
+		select {
+		case <-ctx.Done():
+			return t, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,654 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/discovery"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+var (
+	log = util.DefaultLogger()
+)
+
+// Transfer directions
+const (
+	DirectionSend    = "send"
+	DirectionReceive = "receive"
+)
+
+// Transfer states
+const (
+	StatusPending     = "pending"     // waiting for approval
+	StatusQueued      = "queued"      // waiting for the connection to be free
+	StatusScheduled   = "scheduled"   // waiting for its start time
+	StatusRunning     = "running"     // data is flowing
+	StatusDone        = "done"        // completed successfully
+	StatusFailed      = "failed"      // aborted with an error
+	StatusRejected    = "rejected"    // declined by the user or timed out
+	StatusQuarantined = "quarantined" // received, but kept aside by a receive hook
+)
+
+// ErrRejected is returned to the transfer layer when an incoming transfer is declined
+var ErrRejected = errors.New("transfer declined by receiver")
+
+// Config controls a daemon instance
+type Config struct {
+	OutputDir       string                      // Directory incoming files are written to
+	DiscoveryCode   string                      // Secret code used when listing peers
+	AutoAccept      bool                        // Accept incoming transfers without approval
+	ApprovalTimeout time.Duration               // How long an incoming transfer waits for approval
+	Quota           *transfer.Quota             // Optional per-sender byte limit
+	AllowFrom       *transfer.Allowlist         // If set, only senders whose key is listed may send
+	Concurrency     int                         // Sends run in parallel (default 1)
+	SmallestFirst   bool                        // Among equal priorities, send smaller files first
+	NoMetadata      bool                        // Don't restore the sender's file mode, mtime and owner
+	Extract         bool                        // Unpack archives flagged by their senders into OutputDir
+	SyncDelete      bool                        // Let senders prune directories their syncs created
+	Dedup           *transfer.HashIndex         // If set, files already held are linked instead of received
+	Hooks           []transfer.Hook             // Vet each received file before it takes its real name
+	Quarantine      string                      // Where files turned down by Hooks go; "" deletes them
+	Passcode        string                      // Passcode senders must know (default netconn.DefaultPasscode)
+	Audit           func(r netconn.AuditRecord) // Told about every incoming connection once it ends, if set
+	ShareDir        string                      // Only files under it can be shared; see Share
+
+	// Senders, if set, returns the settings for the sender of a transfer,
+	// known by its key fingerprint and peer ID, e.g. from the address book
+	Senders func(m *transfer.Manifest) SenderSettings
+
+	// OnPeers, if set, takes peer exchanges; see netconn.ServerConfig
+	OnPeers func(remote string, sender *rsa.PublicKey, records []byte) ([]byte, error)
+
+	// Expose, if set, lets the peers it allows browse and fetch from a
+	// directory; see netconn.ServerConfig
+	Expose *transfer.Exposed
+
+	// Storage, if set, opens where approved files are streamed instead of
+	// OutputDir; see netconn.ServerConfig
+	Storage func(remote string, m *transfer.Manifest) (io.WriteCloser, error)
+}
+
+// SenderSettings override how one sender's transfers are received
+type SenderSettings struct {
+	AutoAccept *bool  // Whether its transfers skip approval, instead of Config.AutoAccept
+	OutputDir  string // Where its files are saved, instead of Config.OutputDir
+}
+
+// maxQueued bounds the number of sends waiting in the queue
+const maxQueued = 256
+
+// Transfer is the daemon's view of a single send or receive
+type Transfer struct {
+	ID          string            `json:"id"`
+	Direction   string            `json:"direction"`
+	Peer        string            `json:"peer"`
+	FileName    string            `json:"file_name"`
+	FileSize    int64             `json:"file_size"`
+	Transferred int64             `json:"transferred"`
+	Status      string            `json:"status"`
+	Error       string            `json:"error,omitempty"`
+	Code        string            `json:"code,omitempty"` // Why it failed, when known; see Err
+	Started     time.Time         `json:"started"`
+	Priority    int               `json:"priority"`              // Higher runs first; sends only
+	StartAt     time.Time         `json:"start_at,omitzero"`     // Not before this time; sends only
+	TransferID  string            `json:"transfer_id,omitempty"` // ID both peers log the transfer under, once it has started
+	Meta        map[string]string `json:"meta,omitempty"`        // Metadata the sender attached; receives only
+
+	seq      uint64    // queue order among equal priorities
+	path     string    // local file to send
+	fp       string    // expected receiver fingerprint
+	temp     bool      // path is an upload to delete afterwards
+	decision chan bool // approval result for incoming transfers
+}
+
+// Daemon runs a long-lived node with an HTTP API for local control
+type Daemon struct {
+	cfg Config
+
+	mu        sync.Mutex
+	transfers map[string]*Transfer
+	receiving *Transfer            // incoming transfer in progress; one at a time
+	sending   map[string]*Transfer // sends in progress by ID
+	queue     []*Transfer          // sends waiting for a worker
+	seq       uint64
+	wake      chan struct{}
+
+	peers *discovery.Watcher // peers announced with DiscoveryCode
+
+	shares    map[string]*Share // shared links by token
+	shareBase string            // https://host:port of the share server, "" when not serving
+	shareCert string            // fingerprint of its certificate
+}
+
+// New creates a daemon
+func New(cfg Config) *Daemon {
+	if cfg.ApprovalTimeout <= 0 {
+		cfg.ApprovalTimeout = 2 * time.Minute
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	d := &Daemon{
+		cfg:       cfg,
+		transfers: make(map[string]*Transfer),
+		sending:   make(map[string]*Transfer),
+		wake:      make(chan struct{}, 1),
+		peers:     discovery.NewWatcher(cfg.DiscoveryCode),
+		shares:    make(map[string]*Share),
+	}
+	d.peers.OnChange = func(s discovery.PeerStatus) {
+		util.Emit(util.EventPeerStatus, "id", s.ID, "ip", s.IP, "port", s.Port, "fingerprint", s.Fingerprint, "online", s.Online)
+	}
+	return d
+}
+
+// newID returns a short random identifier
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Reload applies the settings of cfg that may change while the daemon
+// runs: AutoAccept, Quota, AllowFrom, Hooks and Quarantine. Transfers in
+// progress keep the settings they started with, and a quota whose limit
+// changed starts counting again.
+func (d *Daemon) Reload(cfg Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cfg.AutoAccept = cfg.AutoAccept
+	if cfg.Quota == nil || d.cfg.Quota == nil || cfg.Quota.Limit() != d.cfg.Quota.Limit() {
+		d.cfg.Quota = cfg.Quota
+	}
+	d.cfg.AllowFrom = cfg.AllowFrom
+	d.cfg.Hooks = cfg.Hooks
+	d.cfg.Quarantine = cfg.Quarantine
+}
+
+// ServerConfig returns the TCP server configuration routing incoming
+// transfers through the daemon's approval flow, with the settings last
+// loaded
+func (d *Daemon) ServerConfig() netconn.ServerConfig {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return netconn.ServerConfig{
+		OutputDir:   d.cfg.OutputDir,
+		Quota:       d.cfg.Quota,
+		AllowFrom:   d.cfg.AllowFrom,
+		Accept:      d.accept,
+		Destination: d.destination,
+		NoMetadata:  d.cfg.NoMetadata,
+		Extract:     d.cfg.Extract,
+		SyncDelete:  d.cfg.SyncDelete,
+		Dedup:       d.cfg.Dedup,
+		Hooks:       d.cfg.Hooks,
+		Quarantine:  d.cfg.Quarantine,
+		Passcode:    d.cfg.Passcode,
+		Audit:       d.cfg.Audit,
+		OnPeers:     d.cfg.OnPeers,
+		Expose:      d.cfg.Expose,
+		Storage:     d.cfg.Storage,
+		OnReceived: func(err error) {
+			d.mu.Lock()
+			t := d.receiving
+			d.receiving = nil
+			d.mu.Unlock()
+			d.finish(t, err)
+		},
+	}
+}
+
+// Run processes queued sends with Config.Concurrency workers and tracks
+// progress until ctx is cancelled
+func (d *Daemon) Run(ctx context.Context) {
+	unsubscribe := util.Subscribe(d.onEvent)
+	defer unsubscribe()
+
+	netconn.MaxOutgoing = d.cfg.Concurrency
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.peers.Run(ctx)
+	}()
+	for range d.cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.worker(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// worker runs queued sends one at a time
+func (d *Daemon) worker(ctx context.Context) {
+	for {
+		t, due := d.next()
+		if t != nil {
+			d.runSend(t)
+			continue
+		}
+		// Sleep until woken or the earliest scheduled send comes due
+		var timer <-chan time.Time
+		if !due.IsZero() {
+			timer = time.After(time.Until(due))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-timer:
+		}
+	}
+}
+
+// signal wakes an idle worker
+func (d *Daemon) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// before reports whether a should be sent before b
+func (d *Daemon) before(a, b *Transfer) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if d.cfg.SmallestFirst && a.FileSize != b.FileSize {
+		return a.FileSize < b.FileSize
+	}
+	return a.seq < b.seq
+}
+
+// next removes and returns the queued send to run next, or nil and when
+// the earliest scheduled send comes due (zero if none is scheduled).
+// Receivers take one transfer at a time, so a peer that is already being
+// sent to is skipped until that send finishes.
+func (d *Daemon) next() (*Transfer, time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	busy := make(map[string]bool, len(d.sending))
+	for _, t := range d.sending {
+		busy[t.Peer] = true
+	}
+	now := time.Now()
+	var due time.Time
+	best := -1
+	for i, t := range d.queue {
+		if t.StartAt.After(now) {
+			if due.IsZero() || t.StartAt.Before(due) {
+				due = t.StartAt
+			}
+			continue
+		}
+		if busy[t.Peer] {
+			continue
+		}
+		if best < 0 || d.before(t, d.queue[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil, due
+	}
+	t := d.queue[best]
+	d.queue = append(d.queue[:best], d.queue[best+1:]...)
+	d.sending[t.ID] = t
+	if len(d.queue) > 0 {
+		// Let another idle worker pick up the rest
+		d.signal()
+	}
+	return t, time.Time{}
+}
+
+// Peers returns the peers seen on the local network, with whether each is
+// still online
+func (d *Daemon) Peers() []discovery.PeerStatus {
+	return d.peers.Peers()
+}
+
+// Queue returns the sends waiting to run, in the order they will start
+func (d *Daemon) Queue() []Transfer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queued := make([]*Transfer, len(d.queue))
+	copy(queued, d.queue)
+	sort.SliceStable(queued, func(i, j int) bool { return d.before(queued[i], queued[j]) })
+	list := make([]Transfer, len(queued))
+	for i, t := range queued {
+		list[i] = *t
+	}
+	return list
+}
+
+// SetPriority changes the priority of a queued send
+func (d *Daemon) SetPriority(id string, priority int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, t := range d.queue {
+		if t.ID == id {
+			t.Priority = priority
+			return nil
+		}
+	}
+	return fmt.Errorf("no queued send %q", id)
+}
+
+// accept records an incoming transfer and waits for approval
+func (d *Daemon) accept(remote string, m *transfer.Manifest) error {
+	t := &Transfer{
+		ID:         newID(),
+		Direction:  DirectionReceive,
+		Peer:       remote,
+		FileName:   m.FileName,
+		FileSize:   m.FileSize,
+		Status:     StatusPending,
+		Started:    time.Now(),
+		TransferID: m.TransferID,
+		Meta:       m.Meta,
+		decision:   make(chan bool, 1),
+	}
+	d.mu.Lock()
+	d.transfers[t.ID] = t
+	d.mu.Unlock()
+
+	d.mu.Lock()
+	autoAccept := d.cfg.AutoAccept
+	d.mu.Unlock()
+	if s := d.senderSettings(m); s.AutoAccept != nil {
+		autoAccept = *s.AutoAccept
+	}
+	if !autoAccept {
+		util.Emit(util.EventTransferRequest, "id", t.ID, "transfer_id", t.TransferID, "peer", remote, "file", m.FileName, "size", m.FileSize, "meta", m.Meta)
+		log.Info("Incoming transfer awaiting approval", "id", t.ID, "transfer_id", t.TransferID, "peer", remote, "file", m.FileName)
+
+		var ok bool
+		select {
+		case ok = <-t.decision:
+		case <-time.After(d.cfg.ApprovalTimeout):
+			log.Warn("Incoming transfer approval timed out", "id", t.ID)
+		}
+		if !ok {
+			d.setStatus(t, StatusRejected, nil)
+			return ErrRejected
+		}
+	}
+
+	d.mu.Lock()
+	d.receiving = t
+	d.mu.Unlock()
+	d.setStatus(t, StatusRunning, nil)
+	return nil
+}
+
+// senderSettings returns the settings for the sender of m, if any
+func (d *Daemon) senderSettings(m *transfer.Manifest) SenderSettings {
+	if d.cfg.Senders == nil {
+		return SenderSettings{}
+	}
+	return d.cfg.Senders(m)
+}
+
+// destination puts the files of senders with their own output directory
+// there
+func (d *Daemon) destination(remote string, m *transfer.Manifest) (string, error) {
+	dir := d.senderSettings(m).OutputDir
+	if dir == "" {
+		return "", nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return dir, nil
+}
+
+// Decide approves or rejects a pending incoming transfer
+func (d *Daemon) Decide(id string, approve bool) error {
+	d.mu.Lock()
+	t, ok := d.transfers[id]
+	d.mu.Unlock()
+	if !ok || t.decision == nil {
+		return fmt.Errorf("no incoming transfer %q", id)
+	}
+	select {
+	case t.decision <- approve:
+		return nil
+	default:
+		return fmt.Errorf("transfer %q already decided", id)
+	}
+}
+
+// QueueSend schedules a file to be sent to target (ip:port). Higher
+// priorities run first. If startAt is set the send waits in the queue until
+// then and the peer isn't contacted before. If temp is set the file is
+// deleted once the send finishes.
+func (d *Daemon) QueueSend(target, fingerprint, path string, temp bool, priority int, startAt time.Time) (*Transfer, error) {
+	if !transfer.OperatingMode.Sends() {
+		return nil, fmt.Errorf("%w: this daemon is %s", transfer.ErrModeRefused, transfer.OperatingMode)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot send %s: %w", path, err)
+	}
+	t := &Transfer{
+		ID:        newID(),
+		Direction: DirectionSend,
+		Peer:      target,
+		FileName:  info.Name(),
+		FileSize:  info.Size(),
+		Status:    StatusQueued,
+		Started:   time.Now(),
+		Priority:  priority,
+		StartAt:   startAt,
+		path:      path,
+		fp:        fingerprint,
+		temp:      temp,
+	}
+	if startAt.After(t.Started) {
+		t.Status = StatusScheduled
+		log.Info("Send scheduled", "id", t.ID, "file", t.FileName, "peer", target, "start", startAt.Format(time.DateTime))
+	}
+
+	d.mu.Lock()
+	if len(d.queue) >= maxQueued {
+		d.mu.Unlock()
+		return nil, errors.New("send queue full")
+	}
+	d.seq++
+	t.seq = d.seq
+	d.transfers[t.ID] = t
+	d.queue = append(d.queue, t)
+	d.mu.Unlock()
+
+	d.signal()
+	util.Emit(util.EventTransferStatus, "id", t.ID, "direction", t.Direction, "status", t.Status)
+	return t, nil
+}
+
+// runSend performs one queued send
+func (d *Daemon) runSend(t *Transfer) {
+	if t.temp {
+		defer os.RemoveAll(filepath.Dir(t.path))
+	}
+	host, port, err := splitTarget(t.Peer)
+	if err != nil {
+		d.mu.Lock()
+		delete(d.sending, t.ID)
+		d.mu.Unlock()
+		d.setStatus(t, StatusFailed, err)
+		return
+	}
+
+	d.setStatus(t, StatusRunning, nil)
+	err = netconn.ConnectTCP(host, port, t.path, t.fp)
+
+	d.mu.Lock()
+	delete(d.sending, t.ID)
+	d.mu.Unlock()
+	// Sends to the same peer may have been waiting on this one
+	d.signal()
+	d.finish(t, err)
+}
+
+// finish marks a transfer as done or failed
+func (d *Daemon) finish(t *Transfer, err error) {
+	if t == nil {
+		return
+	}
+	if errors.Is(err, transfer.ErrQuarantined) {
+		d.setStatus(t, StatusQuarantined, err)
+		return
+	}
+	if err != nil {
+		d.setStatus(t, StatusFailed, err)
+		return
+	}
+	d.mu.Lock()
+	t.Transferred = t.FileSize
+	d.mu.Unlock()
+	d.setStatus(t, StatusDone, nil)
+}
+
+func (d *Daemon) setStatus(t *Transfer, status string, err error) {
+	d.mu.Lock()
+	t.Status = status
+	if err != nil {
+		t.Error = err.Error()
+		t.Code = failureCode(err)
+	}
+	transferID := t.TransferID
+	d.mu.Unlock()
+	util.Emit(util.EventTransferStatus, "id", t.ID, "transfer_id", transferID, "direction", t.Direction, "status", status, "error", t.Error)
+}
+
+// onEvent folds start and progress events into the running transfer
+// records. Sends running in parallel are told apart by file name.
+func (d *Daemon) onEvent(ev util.Event) {
+	if ev.Type != util.EventProgress && ev.Type != util.EventTransferStarted {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var t *Transfer
+	if ev.Data["direction"] == "receiving" {
+		t = d.receiving
+	} else {
+		for _, s := range d.sending {
+			if s.FileName == ev.Data["file"] {
+				t = s
+				break
+			}
+		}
+	}
+	if t == nil {
+		return
+	}
+	if id, ok := ev.Data["transfer_id"].(string); ok && id != "" {
+		t.TransferID = id
+	}
+	if n, ok := ev.Data["transferred"].(int64); ok {
+		t.Transferred = n
+	}
+}
+
+// Transfer returns a snapshot of the transfer with id
+func (d *Daemon) Transfer(id string) (Transfer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.transfers[id]
+	if !ok {
+		return Transfer{}, fmt.Errorf("unknown transfer %q", id)
+	}
+	return *t, nil
+}
+
+// Transfers returns a snapshot of all known transfers, newest first
+func (d *Daemon) Transfers() []Transfer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]Transfer, 0, len(d.transfers))
+	for _, t := range d.transfers {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.After(list[j].Started) })
+	return list
+}
+
+// Failure codes of transfers, besides the refusal and final status codes of
+// the transfer package
+const (
+	CodeAuthFailed  = "auth_failed"
+	CodeKeyMismatch = "key_mismatch"
+	CodeUnreachable = "unreachable"
+	CodeFileChanged = "file_changed"
+)
+
+// failures pairs each Transfer.Code with the error it stands for, most
+// specific first
+var failures = []struct {
+	code string
+	err  error
+}{
+	{CodeAuthFailed, netconn.ErrAuthFailed},
+	{CodeKeyMismatch, netconn.ErrKeyMismatch},
+	{CodeUnreachable, netconn.ErrPeerUnreachable},
+	{transfer.CodeChecksumMismatch, transfer.ErrChecksumMismatch},
+	{transfer.CodeInsufficientSpace, transfer.ErrInsufficientSpace},
+	{transfer.CodeQuotaExceeded, transfer.ErrQuotaExceeded},
+	{transfer.CodeNotAllowed, transfer.ErrSenderNotAllowed},
+	{transfer.CodeSendOnly, transfer.ErrModeRefused},
+	{transfer.CodeQuarantined, transfer.ErrQuarantined},
+	{transfer.CodeHookRejected, transfer.ErrHookRejected},
+	{transfer.CodeRejected, transfer.ErrRejected},
+	{transfer.CodeRejected, ErrRejected},
+	{CodeFileChanged, transfer.ErrFileChanged},
+}
+
+// failureCode returns the code for a transfer that failed with err, "" if
+// it has none
+func failureCode(err error) string {
+	for _, f := range failures {
+		if errors.Is(err, f.err) {
+			return f.code
+		}
+	}
+	return ""
+}
+
+// transferError is a failure reported in a Transfer
+type transferError struct {
+	msg string
+	err error
+}
+
+func (e *transferError) Error() string { return e.msg }
+func (e *transferError) Unwrap() error { return e.err }
+
+// Err returns the error a transfer failed with, which matches the error
+// for its Code with errors.Is, or nil if it didn't fail
+func (t Transfer) Err() error {
+	if t.Error == "" {
+		return nil
+	}
+	for _, f := range failures {
+		if f.code == t.Code {
+			return &transferError{msg: t.Error, err: f.err}
+		}
+	}
+	return errors.New(t.Error)
+}
@@ -0,0 +1,5 @@
+// Package daemonpb holds the gRPC service and messages of the daemon's
+// remote control API, generated from daemon.proto.
+package daemonpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative daemon.proto
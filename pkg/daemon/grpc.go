@@ -0,0 +1,296 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/daemon/daemonpb"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The gRPC endpoint lets orchestration systems manage daemons on other
+// machines: queue sends, stream their progress and read the history. Unlike
+// the control socket it is reachable over the network, so it only speaks
+// TLS and every call must carry the daemon's token as a bearer token.
+
+// GRPCTokenEnv sets the token remote clients must present
+const GRPCTokenEnv = "P2P_GRPC_TOKEN"
+
+// grpcTokenFile holds the generated token under the data directory
+const grpcTokenFile = "grpc-token"
+
+// watchInterval is the shortest time between two updates of a transfer on
+// a WatchTransfers stream
+const watchInterval = 500 * time.Millisecond
+
+// GRPCConfig configures the remote control endpoint
+type GRPCConfig struct {
+	Token    string // Bearer token clients must present
+	CertFile string // TLS certificate; a self-signed one is made if empty
+	KeyFile  string // Key of CertFile
+}
+
+// GRPCToken returns $P2P_GRPC_TOKEN, or the token saved in the data
+// directory, generating and saving one the first time
+func GRPCToken() (string, error) {
+	if token := os.Getenv(GRPCTokenEnv); token != "" {
+		return token, nil
+	}
+	dir, err := util.DataDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, grpcTokenFile)
+	if data, err := os.ReadFile(path); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to save gRPC token: %w", err)
+	}
+	log.Info("Generated gRPC token", "path", path)
+	return token, nil
+}
+
+// ServeGRPC serves the remote control API on addr until ctx is cancelled
+func (d *Daemon) ServeGRPC(ctx context.Context, addr string, cfg GRPCConfig) error {
+	if cfg.Token == "" {
+		return errors.New("a gRPC token is required")
+	}
+	var cert tls.Certificate
+	var fingerprint string
+	var err error
+	if cfg.CertFile != "" {
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load gRPC certificate: %w", err)
+		}
+	} else if cert, fingerprint, err = selfSignedCert("p2p-client remote control"); err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for gRPC: %w", err)
+	}
+
+	auth := tokenAuth(cfg.Token)
+	srv := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})),
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := auth(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := auth(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	daemonpb.RegisterDaemonServer(srv, &grpcServer{d: d})
+	go func() {
+		<-ctx.Done()
+		stopped := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			srv.Stop()
+		}
+	}()
+	if fingerprint != "" {
+		log.Info("Remote control API listening", "addr", ln.Addr().String(), "cert_fingerprint", fingerprint)
+	} else {
+		log.Info("Remote control API listening", "addr", ln.Addr().String())
+	}
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("gRPC server error: %w", err)
+	}
+	return nil
+}
+
+// tokenAuth returns a check that a call carries "authorization: Bearer
+// <token>" metadata
+func tokenAuth(token string) func(context.Context) error {
+	want := []byte("Bearer " + token)
+	return func(ctx context.Context) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, v := range md.Get("authorization") {
+			if subtle.ConstantTimeCompare([]byte(v), want) == 1 {
+				return nil
+			}
+		}
+		return status.Error(codes.Unauthenticated, "missing or invalid token")
+	}
+}
+
+// grpcServer implements daemonpb.DaemonServer on a Daemon
+type grpcServer struct {
+	daemonpb.UnimplementedDaemonServer
+	d *Daemon
+}
+
+func (s *grpcServer) Send(ctx context.Context, req *daemonpb.SendRequest) (*daemonpb.Transfer, error) {
+	if !filepath.IsAbs(req.Path) {
+		return nil, status.Error(codes.InvalidArgument, "path must be absolute")
+	}
+	if _, _, err := splitTarget(req.Target); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var startAt time.Time
+	if req.StartAt != nil {
+		startAt = req.StartAt.AsTime()
+	}
+	t, err := s.d.QueueSend(req.Target, req.Fingerprint, req.Path, false, int(req.Priority), startAt)
+	if errors.Is(err, transfer.ErrModeRefused) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	snapshot, _ := s.d.Transfer(t.ID)
+	return transferProto(snapshot), nil
+}
+
+func (s *grpcServer) GetTransfer(ctx context.Context, req *daemonpb.GetTransferRequest) (*daemonpb.Transfer, error) {
+	t, err := s.d.Transfer(req.Id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return transferProto(t), nil
+}
+
+func (s *grpcServer) ListTransfers(ctx context.Context, req *daemonpb.ListTransfersRequest) (*daemonpb.ListTransfersResponse, error) {
+	resp := &daemonpb.ListTransfersResponse{}
+	for _, t := range s.d.Transfers() {
+		if (req.Direction != "" && t.Direction != req.Direction) || (req.Status != "" && t.Status != req.Status) {
+			continue
+		}
+		if req.Limit > 0 && len(resp.Transfers) >= int(req.Limit) {
+			break
+		}
+		resp.Transfers = append(resp.Transfers, transferProto(t))
+	}
+	return resp, nil
+}
+
+// WatchTransfers sends transfers as they change, at most every
+// watchInterval. Watching everything starts with the transfers still in
+// progress; watching one starts with it and ends once it has finished.
+func (s *grpcServer) WatchTransfers(req *daemonpb.WatchTransfersRequest, stream grpc.ServerStreamingServer[daemonpb.Transfer]) error {
+	if req.Id != "" {
+		if _, err := s.d.Transfer(req.Id); err != nil {
+			return status.Error(codes.NotFound, err.Error())
+		}
+	}
+	changed := make(chan struct{}, 1)
+	unsubscribe := util.Subscribe(func(ev util.Event) {
+		if ev.Type == util.EventTransferStatus || ev.Type == util.EventProgress {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	sent := make(map[string]Transfer)
+	for _, t := range s.d.Transfers() {
+		if req.Id == "" && finished(t.Status) {
+			sent[t.ID] = t
+		}
+	}
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		for _, t := range s.d.Transfers() {
+			if req.Id != "" && t.ID != req.Id {
+				continue
+			}
+			if prev, ok := sent[t.ID]; ok && prev.Status == t.Status && prev.Transferred == t.Transferred && prev.Error == t.Error {
+				continue
+			}
+			sent[t.ID] = t
+			if err := stream.Send(transferProto(t)); err != nil {
+				return err
+			}
+			if req.Id != "" && finished(t.Status) {
+				return nil
+			}
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-changed:
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *grpcServer) ListPeers(ctx context.Context, req *daemonpb.ListPeersRequest) (*daemonpb.ListPeersResponse, error) {
+	resp := &daemonpb.ListPeersResponse{}
+	for _, p := range s.d.Peers() {
+		resp.Peers = append(resp.Peers, &daemonpb.Peer{
+			Id:          p.ID,
+			Ip:          p.IP,
+			Port:        int32(p.Port),
+			Fingerprint: p.Fingerprint,
+			Online:      p.Online,
+			LastSeen:    timestamppb.New(p.LastSeen),
+		})
+	}
+	return resp, nil
+}
+
+// finished reports whether a transfer in status has ended
+func finished(status string) bool {
+	return status == StatusDone || status == StatusFailed || status == StatusRejected || status == StatusQuarantined
+}
+
+// transferProto converts a transfer snapshot for the wire
+func transferProto(t Transfer) *daemonpb.Transfer {
+	pt := &daemonpb.Transfer{
+		Id:          t.ID,
+		Direction:   t.Direction,
+		Peer:        t.Peer,
+		FileName:    t.FileName,
+		FileSize:    t.FileSize,
+		Transferred: t.Transferred,
+		Status:      t.Status,
+		Error:       t.Error,
+		Started:     timestamppb.New(t.Started),
+		Priority:    int32(t.Priority),
+	}
+	if !t.StartAt.IsZero() {
+		pt.StartAt = timestamppb.New(t.StartAt)
+	}
+	return pt
+}
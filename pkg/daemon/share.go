@@ -0,0 +1,305 @@
+package daemon
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Shared links let someone without the client download a file straight
+// from this machine with a browser. Each link carries a random token, works
+// for one complete download and expires after a while. The server uses a
+// self-signed certificate made at startup; its fingerprint is logged and
+// returned with every link so the recipient can check the browser's warning.
+
+// DefaultShareExpiry is how long a shared link stays valid by default
+const DefaultShareExpiry = time.Hour
+
+// ErrSharingDisabled is returned when the daemon serves no shared links
+var ErrSharingDisabled = errors.New("sharing is disabled; start the daemon with -share")
+
+// ErrNotShareable is returned for a path outside the directory the daemon
+// shares from
+var ErrNotShareable = errors.New("path is outside the share directory")
+
+// Share is a one-time download link for a local file
+type Share struct {
+	ID          string    `json:"id"`
+	FileName    string    `json:"file_name"`
+	FileSize    int64     `json:"file_size"`
+	URL         string    `json:"url"`
+	Expires     time.Time `json:"expires"`
+	Fingerprint string    `json:"cert_fingerprint"` // SHA-256 of the server certificate
+
+	path  string // relative to Config.ShareDir
+	token string
+	busy  bool // a download is in progress
+}
+
+// shareRequest is the JSON body accepted by POST /api/shares
+type shareRequest struct {
+	Path    string `json:"path"`
+	Expires string `json:"expires"` // duration such as "30m"; default DefaultShareExpiry
+}
+
+// Share creates a one-time link to the file at path, which must be
+// absolute and under Config.ShareDir, valid for expires. The file is
+// opened through an os.Root, so a symlink can't lead out of the directory.
+func (d *Daemon) Share(path string, expires time.Duration) (*Share, error) {
+	d.mu.Lock()
+	base, fingerprint := d.shareBase, d.shareCert
+	d.mu.Unlock()
+	if base == "" {
+		return nil, ErrSharingDisabled
+	}
+	if !transfer.OperatingMode.Sends() {
+		return nil, fmt.Errorf("%w: this daemon is %s", transfer.ErrModeRefused, transfer.OperatingMode)
+	}
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("path %q must be absolute", path)
+	}
+	rel, err := filepath.Rel(d.cfg.ShareDir, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return nil, fmt.Errorf("%w %s", ErrNotShareable, d.cfg.ShareDir)
+	}
+	root, err := os.OpenRoot(d.cfg.ShareDir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	info, err := root.Stat(rel)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if expires <= 0 {
+		expires = DefaultShareExpiry
+	}
+	token := make([]byte, 16)
+	rand.Read(token)
+	s := &Share{
+		ID:          newID(),
+		FileName:    filepath.Base(path),
+		FileSize:    info.Size(),
+		Expires:     time.Now().Add(expires),
+		Fingerprint: fingerprint,
+		path:        rel,
+		token:       hex.EncodeToString(token),
+	}
+	s.URL = base + "/d/" + s.token + "/" + s.FileName
+
+	d.mu.Lock()
+	d.shares[s.token] = s
+	d.mu.Unlock()
+	log.Info("Shared file", "id", s.ID, "file", path, "expires", s.Expires.Format(time.RFC3339))
+	c := *s
+	return &c, nil
+}
+
+// Shares lists the links not yet used or expired
+func (d *Daemon) Shares() []Share {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]Share, 0, len(d.shares))
+	for token, s := range d.shares {
+		if time.Now().After(s.Expires) {
+			delete(d.shares, token)
+			continue
+		}
+		list = append(list, *s)
+	}
+	return list
+}
+
+// Unshare revokes the link with id
+func (d *Daemon) Unshare(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for token, s := range d.shares {
+		if s.ID == id {
+			delete(d.shares, token)
+			return nil
+		}
+	}
+	return fmt.Errorf("no shared link %q", id)
+}
+
+// claimShare reserves the link with token for a download
+func (d *Daemon) claimShare(token string) (*Share, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.shares[token]
+	switch {
+	case !ok:
+		return nil, errors.New("this link is not valid or was already used")
+	case time.Now().After(s.Expires):
+		delete(d.shares, token)
+		return nil, errors.New("this link has expired")
+	case s.busy:
+		return nil, errors.New("this link is being downloaded")
+	}
+	s.busy = true
+	return s, nil
+}
+
+// releaseShare ends a download: a complete one uses the link up, a failed
+// one leaves it for another try
+func (d *Daemon) releaseShare(s *Share, complete bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s.busy = false
+	if complete {
+		delete(d.shares, s.token)
+	}
+}
+
+// handleDownload serves GET /d/{token}/{name} on the share server
+func (d *Daemon) handleDownload(w http.ResponseWriter, r *http.Request) {
+	s, err := d.claimShare(r.PathValue("token"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	complete := false
+	defer func() { d.releaseShare(s, complete) }()
+
+	root, err := os.OpenRoot(d.cfg.ShareDir)
+	if err != nil {
+		log.Error("Share directory unavailable", "id", s.ID, "error", err)
+		http.Error(w, "file no longer available", http.StatusGone)
+		return
+	}
+	defer root.Close()
+	f, err := root.Open(s.path)
+	if err != nil {
+		log.Error("Shared file unavailable", "id", s.ID, "error", err)
+		http.Error(w, "file no longer available", http.StatusGone)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "file no longer available", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": s.FileName}))
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return // link checkers shouldn't use the link up
+	}
+	log.Info("Shared file download started", "id", s.ID, "file", s.FileName, "remote", r.RemoteAddr)
+	n, err := io.Copy(w, f)
+	if err != nil || n != info.Size() {
+		log.Warn("Shared file download failed; the link stays valid", "id", s.ID, "sent", n, "error", err)
+		return
+	}
+	complete = true
+	log.Info("Shared file downloaded; link used up", "id", s.ID, "file", s.FileName, "remote", r.RemoteAddr)
+	util.Emit(util.EventTransferComplete, "direction", "shared", "file", s.FileName, "size", n, "remote", r.RemoteAddr)
+}
+
+// ServeShares serves shared links over HTTPS on addr until ctx is
+// cancelled. Links are built from the first LAN address, or from
+// advertised ("host:port") when the daemon is reached through a forwarded
+// port or a name.
+func (d *Daemon) ServeShares(ctx context.Context, addr, advertised string) error {
+	if d.cfg.ShareDir == "" {
+		return errors.New("sharing needs a directory to share from")
+	}
+	cert, fingerprint, err := selfSignedCert("p2p-client shared links")
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for shared links: %w", err)
+	}
+	if advertised == "" {
+		host := "localhost"
+		if ips, err := util.GetLocalIPs(); err == nil {
+			host = ips[0]
+		}
+		advertised = net.JoinHostPort(host, strconv.Itoa(ln.Addr().(*net.TCPAddr).Port))
+	}
+	d.mu.Lock()
+	d.shareBase, d.shareCert = "https://"+advertised, fingerprint
+	d.mu.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /d/{token}/{name}", d.handleDownload)
+	srv := &http.Server{
+		Handler:   mux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.Info("Serving shared links", "url", "https://"+advertised, "cert_fingerprint", fingerprint)
+	if err := srv.ServeTLS(ln, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("share server error: %w", err)
+	}
+	return nil
+}
+
+// selfSignedCert makes a certificate named commonName for a TLS server of
+// the daemon and returns it with the hex SHA-256 fingerprint browsers show
+// for it
+func selfSignedCert(commonName string) (tls.Certificate, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if ips, err := util.GetLocalIPs(); err == nil {
+		for _, ip := range ips {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(ip))
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("failed to create certificate: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,329 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// UDP broadcast discovery, for networks such as Docker bridges and some
+// corporate Wi-Fi that drop multicast. A searcher sends a probe holding the
+// hashed code to the broadcast address of each interface, and to any hosts
+// it is given, on BroadcastPort; every node announced under that code
+// answers it directly with the TXT records it advertises on mDNS. The probe
+// is repeated every ProbeInterval, since either datagram may be lost.
+//
+//	probe:  "p2p-probe <hash>"
+//	answer: "p2p-peer <hash>\nname=<name>\nport=<port>\nfp=...\n..."
+
+// BroadcastPort is the UDP port nodes answer probes on
+var BroadcastPort = 7354
+
+// ProbeInterval is how often a search repeats its probes
+var ProbeInterval = time.Second
+
+// BroadcastFallbackDelay is how long an mDNS search waits for an answer
+// before it also probes by broadcast
+var BroadcastFallbackDelay = time.Second
+
+const (
+	probePrefix  = "p2p-probe "
+	answerPrefix = "p2p-peer "
+	// maxAnswer bounds an answer, which holds a full public key at most
+	maxAnswer = 4096
+)
+
+// Broadcast finds peers by UDP broadcast on the local network, and by
+// unicast probes to Hosts. mDNS announcements answer its probes too, so it
+// finds nodes announced with either backend.
+type Broadcast struct {
+	Hosts []string // Hosts or addresses to probe as well, e.g. across a router
+}
+
+// Announce answers probes for code on BroadcastPort until ctx is cancelled.
+// node.Capabilities is asked again at each CapabilitiesChanged.
+func (Broadcast) Announce(ctx context.Context, code string, node Node) error {
+	entry, err := answerProbes(code)
+	if err != nil {
+		return err
+	}
+	defer entry.remove()
+	log.Printf("Answering broadcast probes for [%s] with hash [%s] on UDP port %d...\n", node.Name, hashCode(code), BroadcastPort)
+	for {
+		changed := nextChange()
+		entry.set(node.Name, nodeRecords(node))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// FindPeers probes for peers announced under code until ctx is done
+func (b Broadcast) FindPeers(ctx context.Context, code string) ([]Peer, error) {
+	peers := []Peer{}
+	err := probe(ctx, code, b.Hosts, func(p Peer) {
+		peers = append(peers, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// probe sends probes for code until ctx is done, and calls found, from a
+// single goroutine, for each peer that answers, once
+func probe(ctx context.Context, code string, hosts []string, found func(Peer)) error {
+	var laddr *net.UDPAddr
+	if ip := util.BoundIP(); ip != nil {
+		laddr = &net.UDPAddr{IP: ip}
+	}
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return fmt.Errorf("failed to open probe socket: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	hash := hashCode(code)
+	message := []byte(probePrefix + hash)
+	targets := probeTargets(hosts)
+	send := func() {
+		for _, addr := range targets {
+			if _, err := conn.WriteToUDP(message, addr); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to send discovery probe to %s: %v\n", addr, err)
+			}
+		}
+	}
+	send()
+	go func() {
+		ticker := time.NewTicker(ProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				send()
+			}
+		}
+	}()
+
+	seen := map[string]bool{}
+	buf := make([]byte, maxAnswer)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return fmt.Errorf("failed to read probe answer: %w", err)
+		}
+		p, ok := parseAnswer(buf[:n], hash)
+		if !ok {
+			continue
+		}
+		p.IP = from.IP.String()
+		key := p.ID + "@" + net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+		if !seen[key] {
+			seen[key] = true
+			found(p)
+		}
+	}
+}
+
+// probeTargets returns where probes go: the limited broadcast address, the
+// broadcast address of every IPv4 network this node is on, and hosts.
+// Broadcasts reach nodes on this machine too. With an interface or address
+// bound, only that interface's networks are probed.
+func probeTargets(hosts []string) []*net.UDPAddr {
+	var ips []net.IP
+	ifaces := util.BoundInterfaces()
+	if ifaces == nil && util.BoundIP() == nil {
+		ips = append(ips, net.IPv4bcast)
+		ifaces, _ = net.Interfaces()
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			if bound := util.BoundIP(); bound != nil && !ipnet.Contains(bound) {
+				continue
+			}
+			ip, mask := ipnet.IP.To4(), net.IP(ipnet.Mask).To4()
+			if mask == nil {
+				continue
+			}
+			bcast := make(net.IP, net.IPv4len)
+			for i := range bcast {
+				bcast[i] = ip[i] | ^mask[i]
+			}
+			ips = append(ips, bcast)
+		}
+	}
+
+	var targets []*net.UDPAddr
+	seen := map[string]bool{}
+	add := func(addr *net.UDPAddr) {
+		if !seen[addr.String()] {
+			seen[addr.String()] = true
+			targets = append(targets, addr)
+		}
+	}
+	for _, ip := range ips {
+		add(&net.UDPAddr{IP: ip, Port: BroadcastPort})
+	}
+	for _, host := range hosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, strconv.Itoa(BroadcastPort))
+		}
+		addr, err := net.ResolveUDPAddr("udp4", host)
+		if err != nil {
+			log.Printf("Cannot probe %s: %v\n", host, err)
+			continue
+		}
+		add(addr)
+	}
+	return targets
+}
+
+// parseAnswer reads a peer from an answer to a probe for hash
+func parseAnswer(data []byte, hash string) (Peer, bool) {
+	lines := strings.Split(string(data), "\n")
+	if lines[0] != answerPrefix+hash {
+		return Peer{}, false
+	}
+	text := lines[1:]
+	p := Peer{Port: -1}
+	for _, t := range text {
+		k, v, _ := strings.Cut(t, "=")
+		switch k {
+		case "name":
+			p.ID = v
+		case "port":
+			if port, err := strconv.Atoi(v); err == nil && port > 0 && port < 65536 {
+				p.Port = port
+			}
+		}
+	}
+	if p.ID == "" || p.Port < 0 {
+		return Peer{}, false
+	}
+	p.Fingerprint, p.PublicKey = parseKeyRecords(text)
+	p.Capabilities = parseCapabilityRecords(text)
+	return p, true
+}
+
+// nodeRecords builds the TXT records advertising node
+func nodeRecords(node Node) []string {
+	text := append([]string{"textv=0", "app=p2p", "port=" + strconv.Itoa(node.Port)}, keyRecords(node.PublicKey, node.FullKey)...)
+	if node.Capabilities != nil {
+		text = append(text, capabilityRecords(node.Capabilities())...)
+	}
+	return text
+}
+
+// probeEntry is one node answering probes for a code
+type probeEntry struct {
+	hash string
+
+	mu     sync.Mutex
+	answer []byte
+}
+
+// set updates the name and records entry answers with
+func (e *probeEntry) set(name string, text []string) {
+	answer := answerPrefix + e.hash + "\nname=" + name + "\n" + strings.Join(text, "\n")
+	e.mu.Lock()
+	e.answer = []byte(answer)
+	e.mu.Unlock()
+}
+
+// remove stops entry answering probes, closing the socket after the last
+func (e *probeEntry) remove() {
+	responder.Lock()
+	defer responder.Unlock()
+	delete(responder.entries, e)
+	if len(responder.entries) == 0 && responder.conn != nil {
+		responder.conn.Close()
+		responder.conn = nil
+	}
+}
+
+// responder answers probes for every node announced in this process, on
+// one socket shared between them
+var responder = struct {
+	sync.Mutex
+	conn    *net.UDPConn
+	entries map[*probeEntry]bool
+}{entries: map[*probeEntry]bool{}}
+
+// answerProbes returns an entry answering probes for code once set, opening
+// the socket on BroadcastPort if no other entry has. Only one process per
+// machine can answer probes.
+func answerProbes(code string) (*probeEntry, error) {
+	responder.Lock()
+	defer responder.Unlock()
+	if responder.conn == nil {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: BroadcastPort})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for broadcast probes: %w", err)
+		}
+		responder.conn = conn
+		go serveProbes(conn)
+	}
+	e := &probeEntry{hash: hashCode(code)}
+	responder.entries[e] = true
+	return e, nil
+}
+
+// serveProbes answers the probes arriving on conn until it is closed
+func serveProbes(conn *net.UDPConn) {
+	buf := make([]byte, 64)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		hash, ok := strings.CutPrefix(string(buf[:n]), probePrefix)
+		if !ok || from.Port == 0 {
+			continue
+		}
+		var answers [][]byte
+		responder.Lock()
+		for e := range responder.entries {
+			e.mu.Lock()
+			if e.hash == hash && e.answer != nil {
+				answers = append(answers, e.answer)
+			}
+			e.mu.Unlock()
+		}
+		responder.Unlock()
+		for _, answer := range answers {
+			conn.WriteToUDP(answer, from)
+		}
+	}
+}
@@ -1,13 +1,284 @@
 package discovery
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoPeers is returned when a search finds no matching peer
+	ErrNoPeers = errors.New("no peers found")
+)
+
 // Peer represents a node in the P2P network.
 type Peer struct {
-	ID        string
-	IP        string
-	Port      int
-	PublicKey []byte
+	ID          string
+	IP          string
+	Port        int
+	Fingerprint string // hex SHA-256 of the peer's PKCS1 public key, if advertised
+	PublicKey   []byte // PKCS1 DER public key, if advertised in full
+	Capabilities
+}
+
+// Transports a node may accept transfers over
+const (
+	TransportTCP    = "tcp"
+	TransportQUIC   = "quic"
+	TransportWebRTC = "webrtc"
+)
+
+// Capabilities is what a node advertises about the transfers it takes, so
+// senders can pick a suitable peer without connecting first. Nodes that
+// predate the advertisement are taken to accept any file over TCP.
+type Capabilities struct {
+	Version     int      // Highest transfer protocol version spoken, 0 if not advertised
+	Transports  []string // Transports transfers are accepted over
+	MaxFileSize int64    // Largest file accepted, 0 if there is no known limit
+	Accepting   bool     // Whether the node takes transfers at the moment
+	Busy        bool     // Whether the node is receiving a transfer right now
+}
+
+// Supports reports whether the node accepts transfers over transport
+func (c Capabilities) Supports(transport string) bool {
+	return slices.Contains(c.Transports, transport)
+}
+
+// Accepts reports whether the node currently takes a file of size bytes
+// over TCP. A negative size stands for one not known in advance.
+func (c Capabilities) Accepts(size int64) bool {
+	if !c.Accepting || c.Busy || !c.Supports(TransportTCP) {
+		return false
+	}
+	return size < 0 || c.MaxFileSize == 0 || size <= c.MaxFileSize
+}
+
+// changes is closed, and replaced, whenever CapabilitiesChanged is called
+var changes = struct {
+	sync.Mutex
+	ch chan struct{}
+}{ch: make(chan struct{})}
+
+// CapabilitiesChanged tells the announcements running in this process that
+// the node's capabilities changed, e.g. it started or finished receiving, so
+// they advertise them now instead of at the next re-announcement
+func CapabilitiesChanged() {
+	changes.Lock()
+	close(changes.ch)
+	changes.ch = make(chan struct{})
+	changes.Unlock()
+}
+
+// nextChange returns a channel closed at the next CapabilitiesChanged
+func nextChange() <-chan struct{} {
+	changes.Lock()
+	defer changes.Unlock()
+	return changes.ch
+}
+
+// Node is what a backend announces about this node
+type Node struct {
+	Name         string
+	Port         int
+	PublicKey    []byte              // PKCS1 DER public key
+	FullKey      bool                // Advertise the full key, not only its fingerprint, where the backend can
+	Capabilities func() Capabilities // Asked on every announcement, if set
 }
+
+// Discovery is a way for nodes to find each other. Nodes announce
+// themselves and search under a shared secret code.
 type Discovery interface {
-	Announce(serviceName string) error
-	FindPeers(serviceName string) ([]Peer, error)
+	// Announce makes node findable under code until ctx is cancelled
+	Announce(ctx context.Context, code string, node Node) error
+	// FindPeers returns the peers announced under code that are found
+	// before ctx is done
+	FindPeers(ctx context.Context, code string) ([]Peer, error)
+}
+
+// Env selects the discovery backends, in the form taken by Parse
+const Env = "P2P_DISCOVERY"
+
+// Default is the backend used by Announce, FindPeers and Watcher
+var Default Discovery = MDNS{}
+
+// Parse builds a backend from a comma-separated list of
+//
+//	mdns              multicast DNS on the local network
+//	static:<path>     peers listed in a JSON file, see LoadStatic
+//	tracker:<url>     an HTTP tracker, see Tracker
+//	broadcast         UDP broadcast on the local network, see Broadcast
+//	broadcast:<host>  UDP broadcast, also probing host; may be repeated
+//
+// Several backends are combined into a Multi.
+func Parse(spec string) (Discovery, error) {
+	var backends Multi
+	var broadcast *Broadcast
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		kind, arg, _ := strings.Cut(item, ":")
+		switch kind {
+		case "":
+			continue
+		case "mdns":
+			backends = append(backends, MDNS{})
+		case "broadcast":
+			if broadcast == nil {
+				broadcast = &Broadcast{}
+				backends = append(backends, broadcast)
+			}
+			if arg != "" {
+				broadcast.Hosts = append(broadcast.Hosts, arg)
+			}
+		case "static":
+			static, err := LoadStatic(arg)
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, static)
+		case "tracker":
+			u, err := url.Parse(arg)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid tracker URL %q", arg)
+			}
+			backends = append(backends, &Tracker{URL: strings.TrimSuffix(arg, "/")})
+		default:
+			return nil, fmt.Errorf("unknown discovery backend %q, expected mdns, static:<path>, tracker:<url> or broadcast[:<host>]", item)
+		}
+	}
+	switch len(backends) {
+	case 0:
+		return nil, errors.New("no discovery backend given")
+	case 1:
+		return backends[0], nil
+	}
+	return backends, nil
+}
+
+// Announce advertises this node under each of secretCodes with the Default
+// backend until ctx is cancelled. publicKey (PKCS1 DER) is advertised by
+// fingerprint, and in full when fullKey is set. caps, if set, is asked for
+// the node's capabilities on every announcement. Announce fails only if
+// every code does.
+func Announce(ctx context.Context, serviceName string, secretCodes []string, port int, publicKey []byte, fullKey bool, caps func() Capabilities) error {
+	node := Node{Name: serviceName, Port: port, PublicKey: publicKey, FullKey: fullKey, Capabilities: caps}
+	errs := make(chan error, len(secretCodes))
+	for _, code := range secretCodes {
+		go func() {
+			err := Default.Announce(ctx, code, node)
+			if err != nil && len(secretCodes) > 1 {
+				log.Printf("Failed to announce under code hash [%s]: %v\n", hashCode(code), err)
+			}
+			errs <- err
+		}()
+	}
+	var failed []error
+	for range secretCodes {
+		if err := <-errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == len(secretCodes) {
+		return errors.Join(failed...)
+	}
+	return nil
+}
+
+// FindPeers looks for peers with the same secret code with the Default
+// backend for timeout. secretCode may also name one of the saved groups,
+// whose secret is then searched.
+func FindPeers(secretCode string, timeout time.Duration) ([]Peer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	peers, err := Default.FindPeers(ctx, ResolveCode(secretCode))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range peers {
+		log.Printf("Found peer: %s (%s:%d)\n", p.ID, p.IP, p.Port)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Println("Peer discovery timed out")
+	}
+	return peers, nil
+}
+
+// Multi combines backends: a node is announced on all of them and the
+// peers they find are merged
+type Multi []Discovery
+
+// Announce announces on every backend until ctx is cancelled. A backend
+// that fails is logged; Announce fails only if all of them do.
+func (m Multi) Announce(ctx context.Context, code string, node Node) error {
+	errs := make(chan error, len(m))
+	for _, d := range m {
+		go func() {
+			err := d.Announce(ctx, code, node)
+			if err != nil {
+				log.Printf("Discovery backend %T failed to announce: %v\n", d, err)
+			}
+			errs <- err
+		}()
+	}
+	var failed []error
+	for range m {
+		if err := <-errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == len(m) {
+		return errors.Join(failed...)
+	}
+	return nil
+}
+
+// FindPeers searches every backend at once and merges what they find,
+// listing a peer found by several backends once. It fails only if all of
+// them do.
+func (m Multi) FindPeers(ctx context.Context, code string) ([]Peer, error) {
+	type result struct {
+		peers []Peer
+		err   error
+	}
+	results := make([]result, len(m))
+	var wg sync.WaitGroup
+	for i, d := range m {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peers, err := d.FindPeers(ctx, code)
+			results[i] = result{peers, err}
+		}()
+	}
+	wg.Wait()
+
+	var peers []Peer
+	var failed []error
+	seen := map[string]bool{}
+	for i, r := range results {
+		if r.err != nil {
+			log.Printf("Discovery backend %T failed: %v\n", m[i], r.err)
+			failed = append(failed, r.err)
+			continue
+		}
+		for _, p := range r.peers {
+			key := p.ID + "@" + net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+			if !seen[key] {
+				seen[key] = true
+				peers = append(peers, p)
+			}
+		}
+	}
+	if len(failed) == len(m) && len(m) > 0 {
+		return nil, errors.Join(failed...)
+	}
+	return peers, nil
 }
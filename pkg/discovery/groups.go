@@ -0,0 +1,165 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Groups: besides the default code every node announces under, a node can
+// belong to named groups, e.g. "homelab", each with a secret code of its
+// own, kept in ~/.p2p-client/groups.json. A node is announced under every
+// group's code, and a search may name a group instead of giving its code.
+
+// DefaultCode is the code nodes announce under and search with unless told
+// otherwise
+const DefaultCode = "123"
+
+// ErrNoGroup is returned when no group has the given name
+var ErrNoGroup = errors.New("no such group")
+
+// Group is a named set of nodes sharing a secret code
+type Group struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+}
+
+// Groups is the set of groups this node belongs to, keyed by name
+type Groups struct {
+	path   string
+	groups map[string]*Group
+}
+
+// OpenGroups loads the groups from the data directory; a missing file is
+// no groups
+func OpenGroups() (*Groups, error) {
+	dir, err := util.DataDir()
+	if err != nil {
+		return nil, err
+	}
+	return LoadGroups(filepath.Join(dir, "groups.json"))
+}
+
+// LoadGroups reads groups from path
+func LoadGroups(path string) (*Groups, error) {
+	g := &Groups{path: path, groups: map[string]*Group{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read groups: %w", err)
+	}
+	var list []*Group
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse groups %s: %w", path, err)
+	}
+	for _, group := range list {
+		g.groups[group.Name] = group
+	}
+	return g, nil
+}
+
+// Save writes the groups back to disk, readable only by the owner as they
+// hold the secrets
+func (g *Groups) Save() error {
+	data, err := json.MarshalIndent(g.List(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode groups: %w", err)
+	}
+	tmp := g.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write groups: %w", err)
+	}
+	return os.Rename(tmp, g.path)
+}
+
+// Get returns the group called name
+func (g *Groups) Get(name string) (*Group, error) {
+	group, ok := g.groups[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoGroup, name)
+	}
+	return group, nil
+}
+
+// Put adds or replaces a group
+func (g *Groups) Put(group *Group) error {
+	if group.Name == "" || group.Secret == "" {
+		return errors.New("a group needs a name and a secret")
+	}
+	if strings.ContainsAny(group.Name, ", \t") {
+		return errors.New("a group name can't contain spaces or commas")
+	}
+	g.groups[group.Name] = group
+	return nil
+}
+
+// Remove deletes the group called name
+func (g *Groups) Remove(name string) error {
+	if _, ok := g.groups[name]; !ok {
+		return fmt.Errorf("%w: %q", ErrNoGroup, name)
+	}
+	delete(g.groups, name)
+	return nil
+}
+
+// List returns the groups sorted by name
+func (g *Groups) List() []*Group {
+	list := make([]*Group, 0, len(g.groups))
+	for _, group := range g.groups {
+		list = append(list, group)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Codes returns the codes to announce under: code, then each group's
+// secret, once each
+func (g *Groups) Codes(code string) []string {
+	codes := []string{code}
+	for _, group := range g.List() {
+		if !slices.Contains(codes, group.Secret) {
+			codes = append(codes, group.Secret)
+		}
+	}
+	return codes
+}
+
+// Code returns the secret of the group called search, or search itself
+// when it names no group
+func (g *Groups) Code(search string) string {
+	if group, ok := g.groups[search]; ok {
+		return group.Secret
+	}
+	return search
+}
+
+// NewSecret returns a random secret for a new group
+func NewSecret() string {
+	return strings.ToLower(rand.Text())
+}
+
+// HashedCode returns the hash nodes announce code under, which is all that
+// is visible to others on the network
+func HashedCode(code string) string {
+	return hashCode(code)
+}
+
+// ResolveCode returns the secret of the saved group called code, or code
+// itself
+func ResolveCode(code string) string {
+	groups, err := OpenGroups()
+	if err != nil {
+		return code
+	}
+	return groups.Code(code)
+}
@@ -1,56 +1,371 @@
 package discovery
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/grandcat/zeroconf"
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"github.com/udit2303/p2p-client/pkg/util"
 )
 
+// maxTXTValue keeps each TXT string under the 255 byte DNS limit
+const maxTXTValue = 200
+
 // hashCode hashes a code to a short 8-byte hex string
 func hashCode(code string) string {
 	hash := sha256.Sum256([]byte(code))
 	return hex.EncodeToString(hash[:8])
 }
 
-// Announce starts advertising the service on mDNS with hashed service name
-func Announce(serviceName string, secretCode string, port int) error {
+// keyRecords builds the TXT records advertising a public key. The fingerprint
+// is always included; the full key is split across pk0, pk1, ... records.
+func keyRecords(publicKey []byte, fullKey bool) []string {
+	if len(publicKey) == 0 {
+		return nil
+	}
+	records := []string{"fp=" + keys.Fingerprint(publicKey)}
+	if !fullKey {
+		return records
+	}
+	encoded := base64.StdEncoding.EncodeToString(publicKey)
+	for i := 0; len(encoded) > 0; i++ {
+		n := min(maxTXTValue, len(encoded))
+		records = append(records, fmt.Sprintf("pk%d=%s", i, encoded[:n]))
+		encoded = encoded[n:]
+	}
+	return records
+}
+
+// parseKeyRecords extracts the fingerprint and, if present, the full public
+// key from TXT records. A full key that doesn't match the fingerprint is dropped.
+func parseKeyRecords(text []string) (string, []byte) {
+	var fingerprint string
+	parts := map[int]string{}
+	for _, t := range text {
+		k, v, ok := strings.Cut(t, "=")
+		if !ok {
+			continue
+		}
+		switch {
+		case k == "fp":
+			fingerprint = v
+		case strings.HasPrefix(k, "pk"):
+			if i, err := strconv.Atoi(k[2:]); err == nil {
+				parts[i] = v
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return fingerprint, nil
+	}
+
+	idx := make([]int, 0, len(parts))
+	for i := range parts {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	var buf bytes.Buffer
+	for n, i := range idx {
+		if n != i {
+			return fingerprint, nil // missing chunk
+		}
+		buf.WriteString(parts[i])
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(buf.String())
+	if err != nil || keys.Fingerprint(publicKey) != fingerprint {
+		log.Printf("Ignoring advertised public key with bad encoding or fingerprint\n")
+		return fingerprint, nil
+	}
+	return fingerprint, publicKey
+}
+
+// capabilityRecords builds the TXT records advertising caps
+func capabilityRecords(caps Capabilities) []string {
+	accepting := "0"
+	if caps.Accepting {
+		accepting = "1"
+	}
+	status := "available"
+	if caps.Busy {
+		status = "busy"
+	}
+	return []string{
+		"proto=" + strconv.Itoa(caps.Version),
+		"transports=" + strings.Join(caps.Transports, ","),
+		"maxsize=" + strconv.FormatInt(caps.MaxFileSize, 10),
+		"accepting=" + accepting,
+		"status=" + status,
+	}
+}
+
+// parseCapabilityRecords extracts a node's capabilities from TXT records.
+// Missing records keep the defaults of a node that advertises none.
+func parseCapabilityRecords(text []string) Capabilities {
+	caps := Capabilities{Transports: []string{TransportTCP}, Accepting: true}
+	for _, t := range text {
+		k, v, ok := strings.Cut(t, "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "proto":
+			if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+				caps.Version = n
+			}
+		case "transports":
+			caps.Transports = nil
+			for _, tr := range strings.Split(v, ",") {
+				if tr != "" {
+					caps.Transports = append(caps.Transports, tr)
+				}
+			}
+		case "maxsize":
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+				caps.MaxFileSize = n
+			}
+		case "accepting":
+			caps.Accepting = v != "0"
+		case "status":
+			caps.Busy = v == "busy"
+		}
+	}
+	return caps
+}
+
+// ReannounceInterval is how often Announce re-registers the service, so peers
+// that start browsing later, or missed the initial burst, still see us
+var ReannounceInterval = time.Minute
+
+// ProbeWindow is how long Announce browses for another node using its
+// instance name before registering, and again before each re-registration
+var ProbeWindow = time.Second
+
+// MDNS finds peers on the local network with multicast DNS. Each node
+// registers a service named after it, of a type derived from the hashed
+// secret code, with its key and capabilities in TXT records.
+type MDNS struct{}
+
+// Announce advertises node on mDNS until ctx is cancelled. The public key
+// is advertised by fingerprint, and in full when node.FullKey is set.
+// node.Capabilities, if set, is asked on every announcement, so changes
+// such as a filling disk reach peers by the next one, and again at each
+// CapabilitiesChanged, whose changes are sent out at once as updated TXT
+// records.
+//
+// zeroconf doesn't resolve name conflicts, so Announce does: if another
+// node (a different fingerprint or port) already uses the name, it
+// announces as name-2, -3 and so on instead. Two nodes that start at once
+// find each other at the next re-registration, where the one with the
+// greater fingerprint moves aside.
+func (MDNS) Announce(ctx context.Context, secretCode string, node Node) error {
 	hashedKey := hashCode(secretCode)
 	network := "_p2p-" + hashedKey + "._tcp"
+	self := Peer{Port: node.Port}
+	if len(node.PublicKey) > 0 {
+		self.Fingerprint = keys.Fingerprint(node.PublicKey)
+	}
+
+	records := func() []string { return nodeRecords(node) }
 
-	log.Printf("Announcing service [%s] with hash [%s] on port %d...\n", serviceName, hashedKey, port)
+	name, err := uniqueName(ctx, secretCode, node.Name, self, false)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	log.Printf("Announcing service [%s] with hash [%s] on port %d...\n", name, hashedKey, node.Port)
+	changed := nextChange()
+	text := records()
 
-	server, err := zeroconf.Register(serviceName, network, "local.", port, []string{"textv=0", "app=p2p"}, nil)
+	// Answer broadcast probes too, for searchers whose multicast is dropped
+	entry, err := answerProbes(secretCode)
+	if err != nil {
+		log.Printf("Not answering broadcast probes: %v\n", err)
+		entry = nil
+	} else {
+		defer entry.remove()
+		entry.set(name, text)
+	}
+	server, err := zeroconf.Register(name, network, "local.", node.Port, text, util.BoundInterfaces())
 	if err != nil {
 		return fmt.Errorf("failed to announce service: %w", err)
 	}
-	defer server.Shutdown()
+	// server is replaced on each re-registration
+	defer func() { server.Shutdown() }()
 
-	// Create a context that can be cancelled
-	ctx, cancel := context.WithCancel(context.Background())
+	ticker := time.NewTicker(ReannounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+			changed = nextChange()
+			if fresh := records(); !slices.Equal(fresh, text) {
+				text = fresh
+				server.SetText(text)
+				if entry != nil {
+					entry.set(name, text)
+				}
+			}
+		case <-ticker.C:
+			renamed, err := uniqueName(ctx, secretCode, name, self, true)
+			if err != nil {
+				log.Printf("Cannot check for name conflicts: %v\n", err)
+				renamed = name
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			name = renamed
+			server.Shutdown()
+			text = records()
+			server, err = zeroconf.Register(name, network, "local.", node.Port, text, util.BoundInterfaces())
+			if err != nil {
+				return fmt.Errorf("failed to re-announce service: %w", err)
+			}
+			if entry != nil {
+				entry.set(name, text)
+			}
+		}
+	}
+}
+
+// uniqueName browses for ProbeWindow and returns name, or the first of
+// name-2, name-3, ... that no other node announces. When registered is
+// set, self already announces name and keeps it unless the other node
+// ranks before it.
+func uniqueName(ctx context.Context, secretCode, name string, self Peer, registered bool) (string, error) {
+	probeCtx, cancel := context.WithTimeout(ctx, ProbeWindow)
 	defer cancel()
+	taken := map[string]Peer{}
+	err := browse(probeCtx, secretCode, func(p Peer) {
+		if p.Fingerprint != self.Fingerprint || p.Port != self.Port {
+			taken[p.ID] = p
+		}
+	})
+	if err != nil {
+		return name, err
+	}
+	other, ok := taken[name]
+	if !ok || (registered && ranksBefore(self, other)) {
+		return name, nil
+	}
 
-	// Wait for context cancellation
-	<-ctx.Done()
-	return nil
+	base, n := name, 2
+	if i := strings.LastIndex(name, "-"); i > 0 {
+		if k, err := strconv.Atoi(name[i+1:]); err == nil && k >= 2 {
+			base, n = name[:i], k+1
+		}
+	}
+	unique := fmt.Sprintf("%s-%d", base, n)
+	for _, ok := taken[unique]; ok; _, ok = taken[unique] {
+		n++
+		unique = fmt.Sprintf("%s-%d", base, n)
+	}
+	log.Printf("WARNING: another node (fingerprint %s, port %d) is announced as %q; announcing as %q instead. Set a distinct -name to avoid this.\n",
+		shortFingerprint(other.Fingerprint), other.Port, name, unique)
+	return unique, nil
+}
+
+// ranksBefore decides which of two nodes announcing the same name keeps it
+func ranksBefore(a, b Peer) bool {
+	if a.Fingerprint != b.Fingerprint {
+		return a.Fingerprint < b.Fingerprint
+	}
+	return a.Port < b.Port
+}
+
+// shortFingerprint abbreviates a fingerprint for messages
+func shortFingerprint(fp string) string {
+	if fp == "" {
+		return "unknown"
+	}
+	return fp[:min(12, len(fp))]
+}
+
+// FindPeers browses for peers announced with secretCode until ctx is done.
+// If nothing has answered after BroadcastFallbackDelay, multicast may be
+// blocked, so it probes by UDP broadcast as well, and returns what that
+// finds if mDNS still finds nothing.
+func (MDNS) FindPeers(ctx context.Context, secretCode string) ([]Peer, error) {
+	var mu sync.Mutex
+	peers := []Peer{}
+	fallback := []Peer{}
+	collect := func(p Peer) {
+		mu.Lock()
+		fallback = append(fallback, p)
+		mu.Unlock()
+	}
+	probed := make(chan error, 1)
+	timer := time.AfterFunc(BroadcastFallbackDelay, func() {
+		mu.Lock()
+		found := len(peers) > 0
+		mu.Unlock()
+		if found || ctx.Err() != nil {
+			probed <- nil
+			return
+		}
+		log.Printf("No mDNS answer yet; probing by UDP broadcast\n")
+		probed <- probe(ctx, secretCode, nil, collect)
+	})
+	err := browse(ctx, secretCode, func(p Peer) {
+		mu.Lock()
+		peers = append(peers, p)
+		mu.Unlock()
+	})
+	if timer.Stop() {
+		if err == nil {
+			probed <- nil
+		} else {
+			log.Printf("mDNS unavailable (%v); probing by UDP broadcast\n", err)
+			probed <- probe(ctx, secretCode, nil, collect)
+		}
+	}
+	if perr := <-probed; perr != nil {
+		log.Printf("Broadcast discovery failed: %v\n", perr)
+	}
+	if err != nil {
+		if len(fallback) > 0 {
+			return fallback, nil
+		}
+		return nil, err
+	}
+	if len(peers) == 0 {
+		return fallback, nil
+	}
+	return peers, nil
 }
 
-// FindPeers looks for peers with the same hashed secret code
-func FindPeers(secretCode string, timeout time.Duration) ([]Peer, error) {
+// browse calls found, from a single goroutine, for each peer with the same
+// hashed secret code that answers before ctx is done
+func browse(ctx context.Context, secretCode string, found func(Peer)) error {
 	hashedKey := hashCode(secretCode)
 	service := "_p2p-" + hashedKey + "._tcp"
 
-	resolver, err := zeroconf.NewResolver(nil)
+	var opts []zeroconf.ClientOption
+	if ifaces := util.BoundInterfaces(); ifaces != nil {
+		opts = append(opts, zeroconf.SelectIfaces(ifaces))
+	}
+	resolver, err := zeroconf.NewResolver(opts...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize resolver: %w", err)
+		return fmt.Errorf("failed to initialize resolver: %w", err)
 	}
 
 	entries := make(chan *zeroconf.ServiceEntry)
-	peers := []Peer{}
 
 	// Use a channel to signal when processing is complete
 	done := make(chan struct{})
@@ -58,34 +373,27 @@ func FindPeers(secretCode string, timeout time.Duration) ([]Peer, error) {
 	go func() {
 		defer close(done)
 		for entry := range entries {
+			fingerprint, publicKey := parseKeyRecords(entry.Text)
+			caps := parseCapabilityRecords(entry.Text)
 			for _, ip := range entry.AddrIPv4 {
-				peers = append(peers, Peer{
-					ID:   entry.Instance,
-					IP:   ip.String(),
-					Port: entry.Port,
+				found(Peer{
+					ID:           entry.Instance,
+					IP:           ip.String(),
+					Port:         entry.Port,
+					Fingerprint:  fingerprint,
+					PublicKey:    publicKey,
+					Capabilities: caps,
 				})
-				log.Printf("Found peer: %s (%s:%d)\n", entry.Instance, ip.String(), entry.Port)
 			}
 		}
 	}()
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	err = resolver.Browse(ctx, service, "local.", entries)
-	if err != nil {
-		cancel()
-		return nil, fmt.Errorf("failed to browse: %w", err)
+	if err := resolver.Browse(ctx, service, "local.", entries); err != nil {
+		return fmt.Errorf("failed to browse: %w", err)
 	}
 
-	// Wait for context to be done or all entries to be processed
-	select {
-	case <-ctx.Done():
-		if ctx.Err() == context.DeadlineExceeded {
-			log.Println("Peer discovery timed out")
-		}
-	case <-done:
-	}
-
-	return peers, nil
+	// The resolver closes entries once ctx is done
+	<-ctx.Done()
+	<-done
+	return nil
 }
@@ -0,0 +1,92 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// StaticPeer is one entry of a static peer list
+type StaticPeer struct {
+	Name        string `json:"name"`
+	Address     string `json:"address"`               // host:port the peer receives on
+	Fingerprint string `json:"fingerprint,omitempty"` // hex SHA-256 of its public key, to pin it
+	Code        string `json:"code,omitempty"`        // only list the peer for this secret code, if set
+}
+
+// Static lists a fixed set of peers, for networks where multicast doesn't
+// reach them. It announces nothing; the peers list this node in their own
+// files.
+type Static struct {
+	Peers []StaticPeer
+}
+
+// LoadStatic reads a static peer list from a JSON file holding an array of
+// StaticPeer, e.g.
+//
+//	[{"name": "nas", "address": "10.0.0.5:4000", "fingerprint": "3f9a..."}]
+func LoadStatic(path string) (*Static, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer list: %w", err)
+	}
+	var peers []StaticPeer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("failed to parse peer list %s: %w", path, err)
+	}
+	for i, p := range peers {
+		if _, _, err := splitAddress(p.Address); err != nil {
+			return nil, fmt.Errorf("peer %d in %s: %w", i+1, path, err)
+		}
+		if p.Name == "" {
+			peers[i].Name = p.Address
+		}
+	}
+	return &Static{Peers: peers}, nil
+}
+
+// Announce does nothing until ctx is cancelled
+func (s *Static) Announce(ctx context.Context, code string, node Node) error {
+	<-ctx.Done()
+	return nil
+}
+
+// FindPeers returns the listed peers for code. Their capabilities are not
+// known, so they are taken to accept any file over TCP.
+func (s *Static) FindPeers(ctx context.Context, code string) ([]Peer, error) {
+	peers := []Peer{}
+	for _, p := range s.Peers {
+		if p.Code != "" && p.Code != code {
+			continue
+		}
+		host, port, err := splitAddress(p.Address)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, Peer{
+			ID:           p.Name,
+			IP:           host,
+			Port:         port,
+			Fingerprint:  strings.ToLower(p.Fingerprint),
+			Capabilities: Capabilities{Transports: []string{TransportTCP}, Accepting: true},
+		})
+	}
+	return peers, nil
+}
+
+// splitAddress splits a host:port address and checks the port
+func splitAddress(address string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in address %q", address)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,258 @@
+package discovery
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/keys"
+)
+
+// A tracker is a small HTTP service where nodes that can't see each other's
+// multicast, such as on different subnets, meet. Nodes POST a record to
+// /announce every ReannounceInterval and DELETE it when they stop; searches
+// GET /peers?code=. Only the hashed secret code is sent, so the tracker
+// can't join the group itself.
+
+// TrackerTTL is how long a tracker lists a node after its last announcement
+var TrackerTTL = 3 * ReannounceInterval
+
+// trackerRecord is a node as sent to and listed by a tracker
+type trackerRecord struct {
+	Code        string   `json:"code"` // hashed secret code
+	Name        string   `json:"name"`
+	IP          string   `json:"ip,omitempty"` // taken from the connection if empty
+	Port        int      `json:"port"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	PublicKey   []byte   `json:"public_key,omitempty"`
+	Version     int      `json:"version,omitempty"`
+	Transports  []string `json:"transports,omitempty"`
+	MaxFileSize int64    `json:"max_size,omitempty"`
+	Accepting   bool     `json:"accepting"`
+	Busy        bool     `json:"busy,omitempty"`
+
+	expires time.Time
+}
+
+// key identifies the node a record is for
+func (r *trackerRecord) key() string {
+	return r.Code + "|" + net.JoinHostPort(r.IP, strconv.Itoa(r.Port))
+}
+
+// Tracker finds peers through the tracker at URL, e.g.
+// "http://tracker.lan:4600"
+type Tracker struct {
+	URL    string
+	Client *http.Client // http.DefaultClient if nil
+}
+
+func (t *Tracker) client() *http.Client {
+	if t.Client != nil {
+		return t.Client
+	}
+	return http.DefaultClient
+}
+
+// Announce posts node to the tracker every ReannounceInterval, and at each
+// CapabilitiesChanged, until ctx is cancelled, then withdraws it. A tracker that can't be reached is logged
+// and tried again at the next interval.
+func (t *Tracker) Announce(ctx context.Context, code string, node Node) error {
+	record := func() trackerRecord {
+		r := trackerRecord{Code: hashCode(code), Name: node.Name, Port: node.Port, Accepting: true}
+		if len(node.PublicKey) > 0 {
+			r.Fingerprint = keys.Fingerprint(node.PublicKey)
+			if node.FullKey {
+				r.PublicKey = node.PublicKey
+			}
+		}
+		if node.Capabilities != nil {
+			caps := node.Capabilities()
+			r.Version, r.Transports, r.MaxFileSize, r.Accepting, r.Busy = caps.Version, caps.Transports, caps.MaxFileSize, caps.Accepting, caps.Busy
+		}
+		return r
+	}
+
+	log.Printf("Announcing service [%s] on tracker %s, port %d...\n", node.Name, t.URL, node.Port)
+	ticker := time.NewTicker(ReannounceInterval)
+	defer ticker.Stop()
+	for {
+		changed := nextChange()
+		if err := t.send(ctx, http.MethodPost, record()); err != nil && ctx.Err() == nil {
+			log.Printf("Cannot announce on tracker %s: %v\n", t.URL, err)
+		}
+		select {
+		case <-ctx.Done():
+			withdrawCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := t.send(withdrawCtx, http.MethodDelete, record()); err != nil {
+				log.Printf("Cannot withdraw from tracker %s: %v\n", t.URL, err)
+			}
+			return nil
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// send sends r to the tracker's /announce with method
+func (t *Tracker) send(ctx context.Context, method string, r trackerRecord) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, t.URL+"/announce", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("tracker returned %s", resp.Status)
+	}
+	return nil
+}
+
+// FindPeers asks the tracker for the nodes announced with code
+func (t *Tracker) FindPeers(ctx context.Context, code string) ([]Peer, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.URL+"/peers?code="+url.QueryEscape(hashCode(code)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tracker: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker returned %s", resp.Status)
+	}
+	var records []trackerRecord
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return nil, fmt.Errorf("invalid tracker response: %w", err)
+	}
+
+	peers := []Peer{}
+	for _, r := range records {
+		publicKey := r.PublicKey
+		if len(publicKey) > 0 && keys.Fingerprint(publicKey) != r.Fingerprint {
+			log.Printf("Ignoring advertised public key with bad fingerprint\n")
+			publicKey = nil
+		}
+		transports := r.Transports
+		if len(transports) == 0 {
+			transports = []string{TransportTCP}
+		}
+		peers = append(peers, Peer{
+			ID:          r.Name,
+			IP:          r.IP,
+			Port:        r.Port,
+			Fingerprint: r.Fingerprint,
+			PublicKey:   publicKey,
+			Capabilities: Capabilities{
+				Version:     r.Version,
+				Transports:  transports,
+				MaxFileSize: r.MaxFileSize,
+				Accepting:   r.Accepting,
+				Busy:        r.Busy,
+			},
+		})
+	}
+	return peers, nil
+}
+
+// maxTrackerRecord limits the size of an announcement
+const maxTrackerRecord = 16 << 10
+
+// TrackerServer is the tracker side: it keeps the announced records in
+// memory and forgets them after TrackerTTL
+type TrackerServer struct {
+	mu      sync.Mutex
+	records map[string]*trackerRecord
+}
+
+// NewTrackerServer creates an empty tracker
+func NewTrackerServer() *TrackerServer {
+	return &TrackerServer{records: make(map[string]*trackerRecord)}
+}
+
+// ServeHTTP serves POST and DELETE /announce and GET /peers
+func (s *TrackerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/announce" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		s.handleAnnounce(w, r)
+	case r.URL.Path == "/peers" && r.Method == http.MethodGet:
+		s.handlePeers(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *TrackerServer) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	var rec trackerRecord
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTrackerRecord)).Decode(&rec); err != nil {
+		http.Error(w, "invalid record: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rec.Code == "" || rec.Port <= 0 || rec.Port > 65535 {
+		http.Error(w, "code and port are required", http.StatusBadRequest)
+		return
+	}
+	if rec.IP == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "cannot tell the node's address", http.StatusBadRequest)
+			return
+		}
+		rec.IP = host
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method == http.MethodDelete {
+		delete(s.records, rec.key())
+	} else {
+		rec.expires = time.Now().Add(TrackerTTL)
+		s.records[rec.key()] = &rec
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *TrackerServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+	list := []trackerRecord{}
+	s.mu.Lock()
+	for key, rec := range s.records {
+		if time.Now().After(rec.expires) {
+			delete(s.records, key)
+			continue
+		}
+		if rec.Code == code {
+			list = append(list, *rec)
+		}
+	}
+	s.mu.Unlock()
+	slices.SortFunc(list, func(a, b trackerRecord) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), cmp.Compare(a.Port, b.Port))
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,146 @@
+package discovery
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Timing of a Watcher's scans. A scan browses for ScanWindow every
+// ScanInterval; a peer not seen for PeerTTL is offline, and one not seen
+// for ForgetAfter is dropped from the list.
+var (
+	ScanInterval = 20 * time.Second
+	ScanWindow   = 3 * time.Second
+	PeerTTL      = time.Minute
+	ForgetAfter  = time.Hour
+)
+
+// PeerStatus is a peer as last seen by a Watcher
+type PeerStatus struct {
+	Peer
+	LastSeen time.Time `json:"last_seen"`
+	Online   bool      `json:"online"`
+}
+
+// Watcher keeps browsing for peers with a secret code, so a node can list
+// the peers around it with whether each is still there. zeroconf reports
+// an instance once per browse, so every scan is a fresh browse and each
+// answer refreshes the peer's last-seen time.
+type Watcher struct {
+	code string
+
+	// OnChange, if set, is called when a peer comes online or goes
+	// offline. It must not block.
+	OnChange func(PeerStatus)
+
+	mu    sync.Mutex
+	peers map[string]*PeerStatus // by instance name, address and port
+}
+
+// NewWatcher creates a watcher for peers announced with secretCode, or in
+// the saved group it names
+func NewWatcher(secretCode string) *Watcher {
+	return &Watcher{code: ResolveCode(secretCode), peers: make(map[string]*PeerStatus)}
+}
+
+// Run scans until ctx is cancelled
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(ScanInterval)
+	defer ticker.Stop()
+	for {
+		w.scan(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan searches once, then marks peers that have not answered for PeerTTL
+// offline
+func (w *Watcher) scan(ctx context.Context) {
+	scanCtx, cancel := context.WithTimeout(ctx, ScanWindow)
+	defer cancel()
+	peers, err := Default.FindPeers(scanCtx, w.code)
+	if err != nil {
+		log.Printf("Peer scan failed: %v\n", err)
+	}
+	for _, p := range peers {
+		w.seen(p)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	var changed []PeerStatus
+	w.mu.Lock()
+	for key, s := range w.peers {
+		age := time.Since(s.LastSeen)
+		if age > ForgetAfter {
+			delete(w.peers, key)
+			continue
+		}
+		if s.Online && age > PeerTTL {
+			s.Online = false
+			changed = append(changed, *s)
+		}
+	}
+	w.mu.Unlock()
+	w.notify(changed)
+}
+
+// seen records an answer from p
+func (w *Watcher) seen(p Peer) {
+	key := p.ID + "@" + net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+	w.mu.Lock()
+	s, ok := w.peers[key]
+	if !ok {
+		s = &PeerStatus{}
+		w.peers[key] = s
+	}
+	wasOnline := s.Online
+	s.Peer, s.LastSeen, s.Online = p, time.Now(), true
+	status := *s
+	w.mu.Unlock()
+	if !wasOnline {
+		w.notify([]PeerStatus{status})
+	}
+}
+
+func (w *Watcher) notify(changed []PeerStatus) {
+	if w.OnChange == nil {
+		return
+	}
+	for _, s := range changed {
+		w.OnChange(s)
+	}
+}
+
+// Peers returns every peer seen in the last ForgetAfter, online ones
+// first, then by name
+func (w *Watcher) Peers() []PeerStatus {
+	w.mu.Lock()
+	list := make([]PeerStatus, 0, len(w.peers))
+	for _, s := range w.peers {
+		st := *s
+		st.Online = time.Since(st.LastSeen) <= PeerTTL
+		list = append(list, st)
+	}
+	w.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Online != list[j].Online {
+			return list[i].Online
+		}
+		if list[i].ID != list[j].ID {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].IP < list[j].IP
+	})
+	return list
+}
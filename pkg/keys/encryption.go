@@ -12,12 +12,16 @@ import (
 	"os"
 )
 
-const (
-	PrivateKeyPath = "private.pem"
-	PublicKeyPath  = "public.pem"
-	KeySize        = 4096
+// Key files, in ~/.p2p-client unless UseDir moves them. They are never
+// kept in the working directory, where they could end up committed
+// alongside a project; see LegacyFiles.
+var (
+	PrivateKeyPath = defaultPath("private.pem")
+	PublicKeyPath  = defaultPath("public.pem")
 )
 
+const KeySize = 4096
+
 // GenerateRSAKeyPair generates a new RSA key pair and saves them to disk
 func GenerateRSAKeyPair() error {
 	// Check if private key exists
@@ -36,13 +40,16 @@ func GenerateRSAKeyPair() error {
 		return fmt.Errorf("failed to stat public key file: %w", err)
 	}
 
+	if err := prepare(PrivateKeyPath); err != nil {
+		return err
+	}
 	privKey, err := rsa.GenerateKey(rand.Reader, KeySize)
 	if err != nil {
 		return fmt.Errorf("failed to generate RSA key: %w", err)
 	}
 
-	// Save private key
-	privFile, err := os.Create(PrivateKeyPath)
+	// Save private key, readable by us alone
+	privFile, err := os.OpenFile(PrivateKeyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("failed to create private key file: %w", err)
 	}
@@ -54,7 +61,7 @@ func GenerateRSAKeyPair() error {
 	}
 
 	// Save public key
-	pubFile, err := os.Create(PublicKeyPath)
+	pubFile, err := os.OpenFile(PublicKeyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to create public key file: %w", err)
 	}
@@ -0,0 +1,120 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Identity keys: besides its RSA key pair, which receivers are known by
+// and which file keys are encrypted to, each node has an Ed25519 key that
+// signs what it sends. Its fingerprint is the node's peer ID. The RSA key
+// vouches for the identity key with a binding signature, so a peer that
+// knows either can tell the two belong together.
+
+// IdentityKeyPath holds the node's Ed25519 identity key, next to its RSA
+// key pair
+var IdentityKeyPath = defaultPath("identity.pem")
+
+// bindingContext is signed along with the identity key in a binding, so
+// the signature can't be passed off as any other
+const bindingContext = "p2p-client identity binding\n"
+
+// ErrInvalidBinding is returned when an RSA key doesn't vouch for an
+// identity key
+var ErrInvalidBinding = errors.New("identity key not bound to RSA key")
+
+// LoadIdentity loads the Ed25519 identity key from disk, generating it
+// first if there is none
+func LoadIdentity() (ed25519.PrivateKey, error) {
+	pemBytes, err := os.ReadFile(IdentityKeyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return generateIdentity()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity key file: %w", err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("invalid identity key PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity key: %w", err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity key is a %T, not Ed25519", key)
+	}
+	return priv, nil
+}
+
+// generateIdentity creates a new identity key and saves it, without
+// overwriting one written meanwhile
+func generateIdentity() (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode identity key: %w", err)
+	}
+	if err := prepare(IdentityKeyPath); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(IdentityKeyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return LoadIdentity()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create identity key file: %w", err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return nil, fmt.Errorf("failed to encode identity key: %w", err)
+	}
+	return priv, nil
+}
+
+// IdentityFingerprint returns the hex SHA-256 of an Ed25519 public key,
+// the peer ID of the node holding it
+func IdentityFingerprint(pub ed25519.PublicKey) string {
+	hash := sha256.Sum256(pub)
+	return hex.EncodeToString(hash[:])
+}
+
+// bindingDigest hashes what a binding signs
+func bindingDigest(pub ed25519.PublicKey) []byte {
+	sum := sha256.Sum256(append([]byte(bindingContext), pub...))
+	return sum[:]
+}
+
+// BindIdentity signs the identity key pub with the RSA key priv
+func BindIdentity(priv *rsa.PrivateKey, pub ed25519.PublicKey) ([]byte, error) {
+	sig, err := rsa.SignPSS(rand.Reader, priv, crypto.SHA256, bindingDigest(pub), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind identity key: %w", err)
+	}
+	return sig, nil
+}
+
+// VerifyBinding checks that the RSA key rsaPub signed binding for the
+// identity key pub
+func VerifyBinding(rsaPub *rsa.PublicKey, pub ed25519.PublicKey, binding []byte) error {
+	if len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: malformed identity key", ErrInvalidBinding)
+	}
+	if err := rsa.VerifyPSS(rsaPub, crypto.SHA256, bindingDigest(pub), binding, nil); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBinding, err)
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package keys
 
 import (
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
 )
 
@@ -9,3 +11,14 @@ func HashCode(code string) string {
 	hash := sha256.Sum256([]byte(code))
 	return hex.EncodeToString(hash[:8]) // first 8 bytes for shorter mDNS name
 }
+
+// Fingerprint returns the hex SHA-256 of a PKCS1 DER encoded public key
+func Fingerprint(pubDER []byte) string {
+	hash := sha256.Sum256(pubDER)
+	return hex.EncodeToString(hash[:])
+}
+
+// PublicKeyFingerprint returns the fingerprint of an RSA public key
+func PublicKeyFingerprint(pub *rsa.PublicKey) string {
+	return Fingerprint(x509.MarshalPKCS1PublicKey(pub))
+}
@@ -0,0 +1,125 @@
+package keys
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NodeNamePath holds this node's name, kept next to its keys
+var NodeNamePath = defaultPath("node-name")
+
+// dataDirName is the directory in the user's home the key files and node
+// name are kept in by default
+const dataDirName = ".p2p-client"
+
+// defaultPath returns where the file name is kept by default, "" if there
+// is no home directory to keep it in
+func defaultPath(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, dataDirName, name)
+}
+
+// prepare creates the directory the key file at path goes in
+func prepare(path string) error {
+	if path == "" {
+		return errors.New("no home directory to keep keys in")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
+	return nil
+}
+
+// UseDir keeps the key files and node name in dir instead of
+// ~/.p2p-client, e.g. a profile's
+func UseDir(dir string) {
+	for _, p := range []*string{&PrivateKeyPath, &PublicKeyPath, &IdentityKeyPath, &NodeNamePath} {
+		*p = filepath.Join(dir, filepath.Base(*p))
+	}
+}
+
+// LegacyFiles lists the key files and node name in the working directory,
+// where older versions kept them, if there is no key where they are kept
+// now. They are left alone: the caller only warns about them, as they may
+// well belong to something else.
+func LegacyFiles() []string {
+	if _, err := os.Stat(PrivateKeyPath); !errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	var found []string
+	for _, p := range []string{PrivateKeyPath, PublicKeyPath, IdentityKeyPath, NodeNamePath} {
+		if _, err := os.Stat(filepath.Base(p)); err == nil {
+			found = append(found, filepath.Base(p))
+		}
+	}
+	return found
+}
+
+var nameAdjectives = [64]string{
+	"agile", "amber", "bold", "brave", "bright", "brisk", "calm", "clever",
+	"cosmic", "crisp", "daring", "dusty", "eager", "early", "fancy", "fearless",
+	"fierce", "gentle", "giddy", "golden", "grand", "happy", "hardy", "hidden",
+	"humble", "icy", "jolly", "keen", "kind", "lively", "lucky", "lunar",
+	"mellow", "merry", "mighty", "misty", "nimble", "noble", "odd", "patient",
+	"plucky", "polite", "proud", "quick", "quiet", "rapid", "rusty", "shiny",
+	"silent", "sleepy", "snowy", "solar", "spry", "steady", "stormy", "sunny",
+	"swift", "tidy", "tiny", "vivid", "wandering", "witty", "young", "zesty",
+}
+
+var nameAnimals = [64]string{
+	"badger", "bat", "bear", "beaver", "bison", "bobcat", "camel", "cheetah",
+	"cobra", "condor", "coyote", "crane", "crow", "deer", "dingo", "dolphin",
+	"eagle", "eel", "elk", "falcon", "ferret", "finch", "fox", "gecko",
+	"gibbon", "goose", "hare", "hawk", "heron", "hyena", "ibis", "jackal",
+	"jaguar", "koala", "lemur", "lynx", "marmot", "mole", "moose", "narwhal",
+	"newt", "ocelot", "orca", "osprey", "otter", "owl", "panda", "panther",
+	"pelican", "puffin", "quail", "raven", "seal", "shrew", "sloth", "stoat",
+	"swan", "tapir", "tiger", "toucan", "viper", "walrus", "wolf", "yak",
+}
+
+// NameFromKey derives a human-friendly node name such as brave-otter-4f2a
+// from a public key. The same key always gives the same name.
+func NameFromKey(pub *rsa.PublicKey) string {
+	h := sha256.Sum256(x509.MarshalPKCS1PublicKey(pub))
+	return fmt.Sprintf("%s-%s-%s",
+		nameAdjectives[h[0]%64],
+		nameAnimals[h[1]%64],
+		hex.EncodeToString(h[2:4]))
+}
+
+// NodeName returns this node's name from NodeNamePath. On first run it is
+// derived from the public key and saved there; edit the file to rename the
+// node.
+func NodeName() (string, error) {
+	data, err := os.ReadFile(NodeNamePath)
+	if err == nil {
+		if name := strings.TrimSpace(string(data)); name != "" {
+			return name, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read node name: %w", err)
+	}
+
+	pub, err := LoadPublicKey()
+	if err != nil {
+		return "", err
+	}
+	name := NameFromKey(pub)
+	if err := prepare(NodeNamePath); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(NodeNamePath, []byte(name+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to save node name: %w", err)
+	}
+	return name, nil
+}
@@ -0,0 +1,179 @@
+// Package nat asks the local router to forward a port to us, using UPnP IGD
+// or NAT-PMP, so the TCP listener is reachable from the internet without
+// manual router configuration. PCP gateways are reached through their
+// NAT-PMP compatibility mode.
+package nat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+var (
+	log = util.DefaultLogger()
+)
+
+// Lifetime is the lease requested for each mapping. Mappings are renewed at
+// half their lifetime, so a crashed process leaves nothing behind for long.
+var Lifetime = 30 * time.Minute
+
+// DiscoverTimeout bounds the search for a gateway
+var DiscoverTimeout = 5 * time.Second
+
+// ErrNoGateway is returned when no UPnP or NAT-PMP gateway answers
+var ErrNoGateway = errors.New("no UPnP or NAT-PMP gateway found")
+
+// gateway is a router protocol able to forward ports
+type gateway interface {
+	Name() string
+	ExternalIP(ctx context.Context) (net.IP, error)
+	// AddMapping forwards external to internal and returns the external
+	// port actually granted, which may differ from the one requested
+	AddMapping(ctx context.Context, protocol string, internal, external int, lifetime time.Duration) (int, error)
+	DeleteMapping(ctx context.Context, protocol string, internal, external int) error
+}
+
+// Mapping is an active port forward, renewed until Close
+type Mapping struct {
+	Protocol     string // "tcp" or "udp"
+	InternalPort int
+	ExternalPort int
+	ExternalIP   net.IP
+	Gateway      string // Protocol used, "upnp" or "nat-pmp"
+
+	gw     gateway
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.Mutex
+}
+
+// Forward discovers a gateway and maps port for protocol ("tcp" or "udp")
+// to this machine. The mapping is refreshed in the background until Close.
+func Forward(ctx context.Context, protocol string, port int) (*Mapping, error) {
+	dctx, cancel := context.WithTimeout(ctx, DiscoverTimeout)
+	defer cancel()
+	gw, err := discover(dctx)
+	if err != nil {
+		return nil, err
+	}
+
+	external, err := gw.AddMapping(ctx, protocol, port, port, Lifetime)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to map %s port %d: %w", gw.Name(), protocol, port, err)
+	}
+	m := &Mapping{
+		Protocol:     protocol,
+		InternalPort: port,
+		ExternalPort: external,
+		Gateway:      gw.Name(),
+		gw:           gw,
+		done:         make(chan struct{}),
+	}
+	if ip, err := gw.ExternalIP(ctx); err == nil {
+		m.ExternalIP = ip
+	} else {
+		log.Debug("Gateway did not report an external IP", "gateway", gw.Name(), "error", err)
+	}
+
+	var rctx context.Context
+	rctx, m.cancel = context.WithCancel(context.Background())
+	go m.refresh(rctx)
+	log.Info("Port mapped on router", "gateway", m.Gateway, "protocol", protocol, "internal", port, "external", m.Address())
+	return m, nil
+}
+
+// Address returns the external ip:port, or just the port if the gateway
+// didn't report its address
+func (m *Mapping) Address() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ExternalIP == nil {
+		return fmt.Sprintf(":%d", m.ExternalPort)
+	}
+	return net.JoinHostPort(m.ExternalIP.String(), fmt.Sprint(m.ExternalPort))
+}
+
+// refresh renews the lease at half its lifetime until ctx is cancelled
+func (m *Mapping) refresh(ctx context.Context) {
+	defer close(m.done)
+	ticker := time.NewTicker(Lifetime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.mu.Lock()
+		requested := m.ExternalPort
+		m.mu.Unlock()
+		external, err := m.gw.AddMapping(ctx, m.Protocol, m.InternalPort, requested, Lifetime)
+		if err != nil {
+			log.Warn("Failed to renew port mapping", "gateway", m.Gateway, "port", m.InternalPort, "error", err)
+			continue
+		}
+		if external != requested {
+			log.Warn("Router changed the external port", "old", requested, "new", external)
+			m.mu.Lock()
+			m.ExternalPort = external
+			m.mu.Unlock()
+		}
+	}
+}
+
+// Close stops renewing the mapping and removes it from the router
+func (m *Mapping) Close() error {
+	m.cancel()
+	<-m.done
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := m.gw.DeleteMapping(ctx, m.Protocol, m.InternalPort, m.ExternalPort); err != nil {
+		return fmt.Errorf("%s: failed to remove port mapping: %w", m.Gateway, err)
+	}
+	log.Info("Port mapping removed", "gateway", m.Gateway, "external", m.ExternalPort)
+	return nil
+}
+
+// discover probes for UPnP and NAT-PMP gateways concurrently and returns
+// the first that answers
+func discover(ctx context.Context) (gateway, error) {
+	type result struct {
+		gw  gateway
+		err error
+	}
+	probes := []func(context.Context) (gateway, error){discoverUPnP, discoverNATPMP}
+	results := make(chan result, len(probes))
+	for _, probe := range probes {
+		go func() {
+			gw, err := probe(ctx)
+			results <- result{gw, err}
+		}()
+	}
+
+	var reasons []string
+	for range probes {
+		r := <-results
+		if r.err == nil {
+			return r.gw, nil
+		}
+		reasons = append(reasons, r.err.Error())
+	}
+	return nil, fmt.Errorf("%w (%s)", ErrNoGateway, strings.Join(reasons, "; "))
+}
+
+// localIPFor returns our address on the route towards ip
+func localIPFor(ip net.IP) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), "1"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
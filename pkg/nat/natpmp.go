@@ -0,0 +1,63 @@
+package nat
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	natpmp "github.com/jackpal/go-nat-pmp"
+	"github.com/libp2p/go-netroute"
+)
+
+// natpmpGateway maps ports with NAT-PMP (RFC 6886), which PCP routers also
+// answer for backwards compatibility
+type natpmpGateway struct {
+	client *natpmp.Client
+}
+
+// discoverNATPMP asks the default gateway for its external address
+func discoverNATPMP(ctx context.Context) (gateway, error) {
+	router, err := netroute.New()
+	if err != nil {
+		return nil, fmt.Errorf("nat-pmp: %w", err)
+	}
+	_, gw, _, err := router.Route(net.IPv4zero)
+	if err != nil {
+		return nil, fmt.Errorf("nat-pmp: no default gateway: %w", err)
+	}
+
+	timeout := DiscoverTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	client := natpmp.NewClientWithTimeout(gw, timeout)
+	if _, err := client.GetExternalAddress(); err != nil {
+		return nil, fmt.Errorf("nat-pmp: gateway %s did not answer: %w", gw, err)
+	}
+	return &natpmpGateway{client: client}, nil
+}
+
+func (g *natpmpGateway) Name() string { return "nat-pmp" }
+
+func (g *natpmpGateway) ExternalIP(ctx context.Context) (net.IP, error) {
+	res, err := g.client.GetExternalAddress()
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(res.ExternalIPAddress[:]), nil
+}
+
+func (g *natpmpGateway) AddMapping(ctx context.Context, protocol string, internal, external int, lifetime time.Duration) (int, error) {
+	res, err := g.client.AddPortMapping(protocol, internal, external, int(lifetime/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return int(res.MappedExternalPort), nil
+}
+
+func (g *natpmpGateway) DeleteMapping(ctx context.Context, protocol string, internal, external int) error {
+	// A zero lifetime deletes the mapping
+	_, err := g.client.AddPortMapping(protocol, internal, 0, 0)
+	return err
+}
@@ -0,0 +1,107 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/huin/goupnp/dcps/internetgateway2"
+)
+
+// igdClient is the port mapping subset shared by the WANIPConnection1/2 and
+// WANPPPConnection1 services
+type igdClient interface {
+	AddPortMappingCtx(ctx context.Context, remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error
+	DeletePortMappingCtx(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error
+	GetExternalIPAddressCtx(ctx context.Context) (string, error)
+	LocalAddr() net.IP
+}
+
+// upnpGateway maps ports through a UPnP Internet Gateway Device
+type upnpGateway struct {
+	client   igdClient
+	location *url.URL
+}
+
+// discoverUPnP searches for an IGD, preferring the newest service version
+func discoverUPnP(ctx context.Context) (gateway, error) {
+	type found struct {
+		client igdClient
+		loc    *url.URL
+	}
+	var candidates []found
+	if clients, _, err := internetgateway2.NewWANIPConnection2ClientsCtx(ctx); err == nil {
+		for _, c := range clients {
+			candidates = append(candidates, found{c, c.Location})
+		}
+	}
+	if clients, _, err := internetgateway2.NewWANIPConnection1ClientsCtx(ctx); err == nil {
+		for _, c := range clients {
+			candidates = append(candidates, found{c, c.Location})
+		}
+	}
+	if clients, _, err := internetgateway2.NewWANPPPConnection1ClientsCtx(ctx); err == nil {
+		for _, c := range clients {
+			candidates = append(candidates, found{c, c.Location})
+		}
+	}
+	for _, c := range candidates {
+		// Skip devices that are reachable but not actually connected
+		if _, err := c.client.GetExternalIPAddressCtx(ctx); err == nil {
+			return &upnpGateway{client: c.client, location: c.loc}, nil
+		}
+	}
+	return nil, errors.New("upnp: no internet gateway device found")
+}
+
+func (g *upnpGateway) Name() string { return "upnp" }
+
+func (g *upnpGateway) ExternalIP(ctx context.Context) (net.IP, error) {
+	s, err := g.client.GetExternalIPAddressCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid external address %q", s)
+	}
+	return ip, nil
+}
+
+func (g *upnpGateway) internalClient() (string, error) {
+	if ip := g.client.LocalAddr(); ip != nil {
+		return ip.String(), nil
+	}
+	host := g.location.Hostname()
+	ip, err := localIPFor(net.ParseIP(host))
+	if err != nil {
+		return "", fmt.Errorf("cannot determine local address towards %s: %w", host, err)
+	}
+	return ip.String(), nil
+}
+
+func (g *upnpGateway) AddMapping(ctx context.Context, protocol string, internal, external int, lifetime time.Duration) (int, error) {
+	client, err := g.internalClient()
+	if err != nil {
+		return 0, err
+	}
+	proto := strings.ToUpper(protocol)
+	lease := uint32(lifetime / time.Second)
+	err = g.client.AddPortMappingCtx(ctx, "", uint16(external), proto, uint16(internal), client, true, "p2p-client", lease)
+	if err != nil {
+		// Some routers only support permanent leases
+		err = g.client.AddPortMappingCtx(ctx, "", uint16(external), proto, uint16(internal), client, true, "p2p-client", 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return external, nil
+}
+
+func (g *upnpGateway) DeleteMapping(ctx context.Context, protocol string, internal, external int) error {
+	return g.client.DeletePortMappingCtx(ctx, "", uint16(external), strings.ToUpper(protocol))
+}
@@ -0,0 +1,26 @@
+package netconn
+
+import "time"
+
+// Outcomes of an incoming connection in its audit record
+const (
+	AuditOK         = "ok"          // A transfer was received
+	AuditFailed     = "failed"      // The sender got in, but nothing was received
+	AuditAuthFailed = "auth_failed" // The sender gave the wrong passcode
+	AuditLockedOut  = "locked_out"  // The sender's IP was locked out after failing too often
+)
+
+// AuditRecord describes an incoming connection once it has ended, for
+// ServerConfig.Audit
+type AuditRecord struct {
+	Time       time.Time `json:"time"`             // When the connection ended
+	Remote     string    `json:"remote"`           // Remote IP
+	Sender     string    `json:"sender,omitempty"` // Sender's key fingerprint, once known
+	Outcome    string    `json:"outcome"`
+	File       string    `json:"file,omitempty"`
+	TransferID string    `json:"transfer_id,omitempty"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	DurationMS int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
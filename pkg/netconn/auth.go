@@ -0,0 +1,150 @@
+package netconn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passcode handshake. The server greets with a random challenge, the salt
+// its passcode key is stretched with and its protocol version:
+//
+//	<challenge>-s<salt>-v<version>
+//
+// A client that sees v12 or later stretches the passcode with Argon2id
+// under that salt and answers "hmac-sha256 <HMAC of the greeting>"; the
+// server proves it holds the same key in its "SUCCESS <proof>" reply.
+// Stretching is done once per salt and passcode in each process, not once
+// per connection, and an answer is only good for the greeting it was made
+// for. Older clients answer with bcrypt(passcode + greeting), which servers
+// still take at bcrypt's default cost, the only one those clients used, and
+// only from senders whose manifest says they are older than v12. Failed
+// attempts are counted per remote IP and slowed down, and IPs that keep
+// failing are locked out; see authLimiter.
+
+// hmacAuthVersion is the first protocol version whose servers take an HMAC
+// answer
+const hmacAuthVersion = 12
+
+// saltTag introduces the salt in the server's greeting
+const saltTag = "-s"
+
+// hmacAnswer prefixes an HMAC answer to the greeting
+const hmacAnswer = "hmac-sha256 "
+
+// Argon2id parameters for stretching the passcode
+const (
+	argonTime    = 1
+	argonMemory  = 64 << 10 // KiB
+	argonThreads = 4
+	argonKeyLen  = 32
+)
+
+// serverSalt is the salt this process's server stretches its passcode with.
+// It is kept short because old clients bcrypt the whole greeting with the
+// passcode, and bcrypt only takes 72 bytes.
+var serverSalt = sync.OnceValue(func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+})
+
+// authKeys caches stretched passcodes by a hash of passcode and salt
+var authKeys sync.Map
+
+// authKey stretches passcode with salt
+func authKey(passcode, salt string) []byte {
+	id := sha256.Sum256([]byte(passcode + "\x00" + salt))
+	if key, ok := authKeys.Load(id); ok {
+		return key.([]byte)
+	}
+	key := argon2.IDKey([]byte(passcode), []byte("p2p-client auth "+salt), argonTime, argonMemory, argonThreads, argonKeyLen)
+	authKeys.Store(id, key)
+	return key
+}
+
+// greetingSalt returns the salt in a server's greeting, "" for servers that
+// only take bcrypt
+func greetingSalt(greeting string) string {
+	if greetingVersion(greeting) < hmacAuthVersion {
+		return ""
+	}
+	rest := greeting[:strings.LastIndex(greeting, greetingTag)]
+	i := strings.LastIndex(rest, saltTag)
+	if i < 0 {
+		return ""
+	}
+	return rest[i+len(saltTag):]
+}
+
+// authMAC is the HMAC under key of the parts, separated by newlines
+func authMAC(key []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// clientAnswer is the client's answer to greeting
+func clientAnswer(key []byte, greeting string) string {
+	return authMAC(key, "client", greeting)
+}
+
+// serverProof is the server's proof that it accepted answer with the same
+// key
+func serverProof(key []byte, greeting, answer string) string {
+	return authMAC(key, "server", greeting, answer)
+}
+
+// legacyAnswer reports whether answer is bcrypt's, from a client older
+// than hmacAuthVersion
+func legacyAnswer(answer string) bool {
+	return !strings.HasPrefix(answer, hmacAnswer)
+}
+
+// checkAnswer verifies a client's answer to greeting against the server's
+// passcode, and returns what to reply on success
+func checkAnswer(greeting, answer, passcode string) (string, error) {
+	if mac, ok := strings.CutPrefix(answer, hmacAnswer); ok {
+		key := authKey(passcode, serverSalt())
+		if !hmac.Equal([]byte(mac), []byte(clientAnswer(key, greeting))) {
+			return "", fmt.Errorf("%w: wrong passcode", ErrAuthFailed)
+		}
+		return "SUCCESS " + serverProof(key, greeting, mac), nil
+	}
+	// The cost is the client's to pick; a higher one than old clients used
+	// would have us spend hours on a single guess
+	if cost, err := bcrypt.Cost([]byte(answer)); err != nil || cost > bcrypt.DefaultCost {
+		return "", fmt.Errorf("%w: unexpected answer", ErrAuthFailed)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(answer), []byte(passcode+greeting)); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+	return "SUCCESS", nil
+}
+
+// checkAnswerVersion refuses a bcrypt answer from a sender whose manifest
+// says it is version, one that would have answered with an HMAC
+func checkAnswerVersion(answer string, version int) error {
+	if legacyAnswer(answer) && version >= hmacAuthVersion {
+		return fmt.Errorf("%w: a v%d sender answered with bcrypt", ErrAuthFailed, version)
+	}
+	return nil
+}
+
+// handshakeTranscript hashes the handshake as both ends saw it: greeting,
+// answer and reply, one line each, then the server's public key. Senders
+// sign it to tie their identity to this connection; see
+// transfer.Transcripter.
+func handshakeTranscript(greeting, answer, reply string, serverPub []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("p2p-client handshake\n" + greeting + "\n" + answer + "\n" + reply + "\n"))
+	h.Write(serverPub)
+	return h.Sum(nil)
+}
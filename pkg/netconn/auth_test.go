@@ -0,0 +1,85 @@
+package netconn
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// greeting makes a server greeting for protocol version
+func greeting(version int) string {
+	return "challenge" + saltTag + serverSalt() + greetingTag + strconv.Itoa(version)
+}
+
+func TestHMACAnswer(t *testing.T) {
+	g := greeting(hmacAuthVersion)
+	if salt := greetingSalt(g); salt != serverSalt() {
+		t.Fatalf("greetingSalt = %q, want %q", salt, serverSalt())
+	}
+	key := authKey("secret", greetingSalt(g))
+	mac := clientAnswer(key, g)
+	reply, err := checkAnswer(g, hmacAnswer+mac, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SUCCESS " + serverProof(key, g, mac); reply != want {
+		t.Errorf("reply = %q, want %q", reply, want)
+	}
+
+	wrong := hmacAnswer + clientAnswer(authKey("guess", greetingSalt(g)), g)
+	if _, err := checkAnswer(g, wrong, "secret"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("wrong passcode: got %v, want ErrAuthFailed", err)
+	}
+	// An answer is only good for the greeting it was made for
+	if _, err := checkAnswer(g+"0", hmacAnswer+mac, "secret"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("answer to another greeting: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestBcryptAnswer(t *testing.T) {
+	g := greeting(hmacAuthVersion - 1)
+	if salt := greetingSalt(g); salt != "" {
+		t.Errorf("greetingSalt of a v%d greeting = %q, want none", hmacAuthVersion-1, salt)
+	}
+	answer := func(passcode string, cost int) string {
+		hash, err := bcrypt.GenerateFromPassword([]byte(passcode+g), cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(hash)
+	}
+
+	good := answer("secret", bcrypt.DefaultCost)
+	if reply, err := checkAnswer(g, good, "secret"); err != nil || reply != "SUCCESS" {
+		t.Errorf("got %q, %v, want SUCCESS", reply, err)
+	}
+	if _, err := checkAnswer(g, answer("guess", bcrypt.DefaultCost), "secret"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("wrong passcode: got %v, want ErrAuthFailed", err)
+	}
+	if _, err := checkAnswer(g, answer("secret", bcrypt.DefaultCost+1), "secret"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("cost above the default: got %v, want ErrAuthFailed", err)
+	}
+	// A cost this high would take hours to check
+	costly := strings.Replace(good, "$10$", "$31$", 1)
+	if _, err := checkAnswer(g, costly, "secret"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("cost 31: got %v, want ErrAuthFailed", err)
+	}
+	if _, err := checkAnswer(g, "garbage", "secret"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("malformed answer: got %v, want ErrAuthFailed", err)
+	}
+
+	if err := checkAnswerVersion(good, hmacAuthVersion-1); err != nil {
+		t.Errorf("bcrypt from a v%d sender: %v", hmacAuthVersion-1, err)
+	}
+	for _, v := range []int{hmacAuthVersion, hmacAuthVersion + 1} {
+		if err := checkAnswerVersion(good, v); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("bcrypt from a v%d sender: got %v, want ErrAuthFailed", v, err)
+		}
+	}
+	if err := checkAnswerVersion(hmacAnswer+"00", hmacAuthVersion); err != nil {
+		t.Errorf("HMAC from a v%d sender: %v", hmacAuthVersion, err)
+	}
+}
@@ -1 +1,115 @@
 package netconn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// PasscodeEnv names the environment variable that supplies the passcode
+// non-interactively (required for scripted use, e.g. when stdin carries data)
+const PasscodeEnv = "P2P_PASSCODE"
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader that
+// may already hold data read ahead during the handshake
+type bufferedConn struct {
+	net.Conn
+	r           *bufio.Reader
+	peerVersion int    // the server's protocol version, from its greeting
+	transcript  []byte // hash of the handshake, once complete
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// PeerVersion implements transfer.PeerVersioner
+func (c *bufferedConn) PeerVersion() int {
+	return c.peerVersion
+}
+
+// Transcript implements transfer.Transcripter
+func (c *bufferedConn) Transcript() []byte {
+	return c.transcript
+}
+
+// transcriptConn is a server's connection after the handshake, carrying
+// its transcript
+type transcriptConn struct {
+	net.Conn
+	transcript []byte
+}
+
+// Transcript implements transfer.Transcripter
+func (c *transcriptConn) Transcript() []byte {
+	return c.transcript
+}
+
+// readLine reads one line of interactive input, using the terminal when
+// stdin is reserved for data
+func readLine() (string, error) {
+	in, err := util.PromptInput()
+	if err != nil {
+		return "", fmt.Errorf("no interactive input available: %w", err)
+	}
+	defer in.Close()
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// PromptDestination asks on the console where to save each incoming file,
+// for ServerConfig.Destination. An empty answer keeps the file in outputDir.
+func PromptDestination(outputDir string) func(remote string, m *transfer.Manifest) (string, error) {
+	return func(remote string, m *transfer.Manifest) (string, error) {
+		def := filepath.Join(outputDir, filepath.Base(m.FileName))
+		fmt.Fprintf(util.ConsoleOutput(), "Save %s (%s) from %s to [%s]: ", m.FileName, util.FormatSize(m.FileSize), remote, def)
+		path, err := readLine()
+		if err != nil {
+			return "", fmt.Errorf("no destination given: %w", err)
+		}
+		if strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+			if home, err := os.UserHomeDir(); err == nil {
+				path = filepath.Join(home, path[2:])
+			}
+		}
+		return path, nil
+	}
+}
+
+// ConfirmStore asks on the console whether to store an incoming file at
+// location, e.g. an object storage URL, rejecting the transfer unless
+// confirmed
+func ConfirmStore(remote string, m *transfer.Manifest, location string) error {
+	fmt.Fprintf(util.ConsoleOutput(), "Store %s (%s) from %s in %s? [y/N]: ", m.FileName, util.FormatSize(m.FileSize), remote, location)
+	answer, err := readLine()
+	if err != nil {
+		return fmt.Errorf("no answer given: %w", err)
+	}
+	if a := strings.ToLower(answer); a != "y" && a != "yes" {
+		return fmt.Errorf("%w: declined on the console", transfer.ErrRejected)
+	}
+	return nil
+}
+
+// PasscodeSource supplies the passcode for outgoing connections. It defaults
+// to readPasscode; non-interactive embedders such as the daemon replace it.
+var PasscodeSource = readPasscode
+
+// readPasscode returns the passcode from the environment, or prompts for it
+func readPasscode() (string, error) {
+	if p, ok := os.LookupEnv(PasscodeEnv); ok {
+		return p, nil
+	}
+	fmt.Fprint(util.ConsoleOutput(), "Enter passcode: ")
+	return readLine()
+}
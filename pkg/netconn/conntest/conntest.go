@@ -0,0 +1,156 @@
+// Package conntest runs the transfer protocol between a sender and a
+// receiver in one process, over an in-memory connection that can delay,
+// throttle, corrupt or cut the data. It exists to test the full exchange of
+// manifest, keys, chunks, acknowledgements and receipt deterministically.
+//
+// Both sides use the node's key pair, generating one if there is none, and
+// the sender stores its receipt under $HOME/.p2p-client. The key paths are
+// set when the program starts, so tests should move them with keys.UseDir
+// and run with a temporary home:
+//
+//	home := t.TempDir()
+//	t.Setenv("HOME", home)
+//	keys.UseDir(filepath.Join(home, ".p2p-client"))
+//	res := conntest.SendFile(path, transfer.ReceiveOptions{OutputDir: out}, conntest.Options{})
+package conntest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+)
+
+// ErrTruncated is returned by writes on a connection cut by
+// Faults.TruncateAfter
+var ErrTruncated = errors.New("connection truncated")
+
+// Pipe returns the two ends of an in-memory connection. Unlike net.Pipe, a
+// zero-length write returns at once rather than waiting for a read that
+// the protocol never makes.
+func Pipe() (net.Conn, net.Conn) {
+	a, b := net.Pipe()
+	return pipeConn{a}, pipeConn{b}
+}
+
+type pipeConn struct {
+	net.Conn
+}
+
+func (c pipeConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return c.Conn.Write(p)
+}
+
+// Faults are injected into the data written to a connection. Offsets
+// count bytes from the first write, so the same faults hit the same bytes
+// on every run.
+type Faults struct {
+	Latency       time.Duration // Delay before each write
+	Bandwidth     int64         // Bytes per second, 0 for unlimited
+	CorruptAt     []int64       // Offsets of bytes to flip a bit in
+	TruncateAfter int64         // Close the connection after this many bytes, 0 never
+}
+
+// Faulty wraps c so that its writes suffer f
+func Faulty(c net.Conn, f Faults) net.Conn {
+	return &faultyConn{Conn: c, f: f}
+}
+
+type faultyConn struct {
+	net.Conn
+	f Faults
+
+	mu      sync.Mutex
+	written int64
+}
+
+func (c *faultyConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.f.Latency > 0 {
+		time.Sleep(c.f.Latency)
+	}
+	if c.f.Bandwidth > 0 {
+		time.Sleep(time.Duration(int64(len(p)) * int64(time.Second) / c.f.Bandwidth))
+	}
+	cut := false
+	if c.f.TruncateAfter > 0 && c.written+int64(len(p)) >= c.f.TruncateAfter {
+		p = p[:max(c.f.TruncateAfter-c.written, 0)]
+		cut = true
+	}
+	// Corrupt a copy; the caller may still need its data, e.g. to replay it
+	buf := p
+	for _, off := range c.f.CorruptAt {
+		if off >= c.written && off < c.written+int64(len(p)) {
+			if len(buf) > 0 && &buf[0] == &p[0] {
+				buf = append([]byte(nil), p...)
+			}
+			buf[off-c.written] ^= 0x01
+		}
+	}
+	n, err := c.Conn.Write(buf)
+	c.written += int64(n)
+	if err == nil && cut {
+		c.Conn.Close()
+		err = ErrTruncated
+	}
+	return n, err
+}
+
+// Options sets the faults on each direction of a transfer
+type Options struct {
+	ToReceiver Faults // Manifest, keys and chunks
+	ToSender   Faults // Preflight answer, signatures, acknowledgements and receipt
+}
+
+// Result is the outcome of a transfer on both sides
+type Result struct {
+	Manifest   *transfer.Manifest // As the receiver saw it, nil if it never arrived
+	SendErr    error
+	ReceiveErr error
+}
+
+// SendFile sends the file at path to a receiver configured by opts, with
+// the faults in o, and returns once both sides are done. Each side closes
+// its end when it finishes, so a failure on one side ends the other.
+func SendFile(path string, opts transfer.ReceiveOptions, o Options) Result {
+	return Run(opts, o, func(conn net.Conn) error {
+		pub, err := keys.LoadPublicKey()
+		if err != nil {
+			return err
+		}
+		return transfer.SendFile(conn, path, pub)
+	})
+}
+
+// Run runs send, any sending side of the protocol, against a receiver
+// configured by opts over a pipe with the faults in o
+func Run(opts transfer.ReceiveOptions, o Options, send func(conn net.Conn) error) Result {
+	// Generate the key pair up front rather than on both sides at once
+	if _, err := keys.LoadPrivateKey(); err != nil {
+		return Result{SendErr: err, ReceiveErr: err}
+	}
+	senderEnd, receiverEnd := Pipe()
+	senderConn := Faulty(senderEnd, o.ToReceiver)
+	receiverConn := Faulty(receiverEnd, o.ToSender)
+
+	var res Result
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer receiverConn.Close()
+		res.Manifest, res.ReceiveErr = transfer.Receive(receiverConn, opts)
+	}()
+	res.SendErr = send(senderConn)
+	senderConn.Close()
+	wg.Wait()
+	return res
+}
@@ -0,0 +1,202 @@
+package conntest_test
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"github.com/udit2303/p2p-client/pkg/netconn/conntest"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+)
+
+// fileSize spans many chunks, so faults can be put in the middle of the data
+const fileSize = 1 << 20
+
+// setup isolates a test's keys and receipts, and writes the file it sends
+func setup(t *testing.T) (path, out string, data []byte) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Chdir(t.TempDir())
+	keys.UseDir(filepath.Join(home, ".p2p-client"))
+
+	data = make([]byte, fileSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	path = filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, t.TempDir(), data
+}
+
+// checkReceived fails t unless out holds data under the sent name
+func checkReceived(t *testing.T, res conntest.Result, out string, data []byte) {
+	t.Helper()
+	if res.SendErr != nil || res.ReceiveErr != nil {
+		t.Fatalf("transfer failed: send: %v, receive: %v", res.SendErr, res.ReceiveErr)
+	}
+	got, err := os.ReadFile(filepath.Join(out, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("received file differs from the one sent")
+	}
+}
+
+func TestPipe(t *testing.T) {
+	path, out, data := setup(t)
+	res := conntest.SendFile(path, transfer.ReceiveOptions{OutputDir: out}, conntest.Options{})
+	checkReceived(t, res, out, data)
+	if res.Manifest == nil || res.Manifest.FileSize != fileSize {
+		t.Fatalf("receiver saw manifest %+v", res.Manifest)
+	}
+}
+
+func TestSlowLink(t *testing.T) {
+	path, out, data := setup(t)
+	slow := conntest.Faults{Latency: time.Millisecond, Bandwidth: 8 << 20}
+	res := conntest.SendFile(path, transfer.ReceiveOptions{OutputDir: out}, conntest.Options{ToReceiver: slow, ToSender: slow})
+	checkReceived(t, res, out, data)
+}
+
+// A flipped bit in a chunk fails its authentication; the receiver asks for
+// it again and the file still arrives whole
+func TestCorruption(t *testing.T) {
+	path, out, data := setup(t)
+	faults := conntest.Faults{CorruptAt: []int64{fileSize / 2, fileSize * 3 / 4}}
+	res := conntest.SendFile(path, transfer.ReceiveOptions{OutputDir: out}, conntest.Options{ToReceiver: faults})
+	checkReceived(t, res, out, data)
+}
+
+// A connection cut mid-transfer fails both sides and leaves no file under
+// the sent name
+func TestTruncation(t *testing.T) {
+	path, out, _ := setup(t)
+	faults := conntest.Faults{TruncateAfter: fileSize / 2}
+	res := conntest.SendFile(path, transfer.ReceiveOptions{OutputDir: out}, conntest.Options{ToReceiver: faults})
+	if res.SendErr == nil || res.ReceiveErr == nil {
+		t.Fatalf("truncated transfer succeeded: send: %v, receive: %v", res.SendErr, res.ReceiveErr)
+	}
+	if _, err := os.Stat(filepath.Join(out, "data.bin")); !os.IsNotExist(err) {
+		t.Fatalf("truncated transfer left data.bin behind: %v", err)
+	}
+}
+
+// A sender can't name its file so that it, or its part file, lands outside
+// the output directory
+func TestUnsafeName(t *testing.T) {
+	_, out, data := setup(t)
+	for _, name := range []string{"..", ".", "/", "sub/.."} {
+		res := conntest.Run(transfer.ReceiveOptions{OutputDir: out}, conntest.Options{}, func(conn net.Conn) error {
+			pub, err := keys.LoadPublicKey()
+			if err != nil {
+				return err
+			}
+			m := &transfer.Manifest{FileName: name, FileSize: int64(len(data))}
+			return transfer.SendStream(conn, m, bytes.NewReader(data), pub)
+		})
+		if res.ReceiveErr == nil {
+			t.Errorf("receiver took a file named %q", name)
+		}
+		for _, p := range []string{filepath.Dir(out) + transfer.PartSuffix, out + transfer.PartSuffix} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("file named %q left %s behind", name, p)
+			}
+		}
+	}
+}
+
+// TestSyncPrune checks that a sync index only prunes a directory its own
+// sender's syncs created, and only on receivers that allow it
+func TestSyncPrune(t *testing.T) {
+	path, out, _ := setup(t)
+	other := filepath.Join(out, "other", "keep.txt")
+	if err := os.MkdirAll(filepath.Dir(other), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(other, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run := func(opts transfer.ReceiveOptions, send func(conn net.Conn) error) conntest.Result {
+		return conntest.Run(opts, conntest.Options{}, send)
+	}
+	index := func(name string) func(conn net.Conn) error {
+		return func(conn net.Conn) error {
+			pub, err := keys.LoadPublicKey()
+			if err != nil {
+				return err
+			}
+			m := &transfer.Manifest{FileName: name, FileSize: 2, Kind: transfer.KindSyncIndex}
+			return transfer.SendStream(conn, m, bytes.NewReader([]byte("[]")), pub)
+		}
+	}
+	allow := transfer.ReceiveOptions{OutputDir: out, SyncDelete: true}
+	for _, name := range []string{".", "", "other"} {
+		if res := run(allow, index(name)); res.ReceiveErr == nil {
+			t.Errorf("receiver took a sync index for %q", name)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("file not created by a sync was pruned: %v", err)
+	}
+
+	root := filepath.Dir(path)
+	synced := filepath.Join(out, filepath.Base(root), "data.bin")
+	res := run(transfer.ReceiveOptions{OutputDir: out}, func(conn net.Conn) error {
+		pub, err := keys.LoadPublicKey()
+		if err != nil {
+			return err
+		}
+		return transfer.SendSyncEntry(conn, root, transfer.SyncEntry{Path: "data.bin", Kind: transfer.KindSync}, pub)
+	})
+	if res.SendErr != nil || res.ReceiveErr != nil {
+		t.Fatalf("sync failed: send: %v, receive: %v", res.SendErr, res.ReceiveErr)
+	}
+	if res := run(transfer.ReceiveOptions{OutputDir: out}, index(filepath.Base(root))); res.ReceiveErr == nil {
+		t.Error("receiver without SyncDelete took a sync index")
+	}
+	if _, err := os.Stat(synced); err != nil {
+		t.Fatalf("synced file pruned without SyncDelete: %v", err)
+	}
+	if res := run(allow, index(filepath.Base(root))); res.ReceiveErr != nil {
+		t.Fatalf("sync index from the directory's sender refused: %v", res.ReceiveErr)
+	}
+	if _, err := os.Stat(synced); !os.IsNotExist(err) {
+		t.Errorf("synced file not pruned: %v", err)
+	}
+}
+
+// TestDeclaredSize checks that a receiver takes no more than the size a
+// sender declares, and no stream of unknown size under a quota
+func TestDeclaredSize(t *testing.T) {
+	_, out, data := setup(t)
+	for _, tt := range []struct {
+		name string
+		size int64
+		opts transfer.ReceiveOptions
+	}{
+		{"short.bin", 10, transfer.ReceiveOptions{OutputDir: out}},
+		{"unknown.bin", -1, transfer.ReceiveOptions{OutputDir: out, Quota: transfer.NewQuota(fileSize)}},
+	} {
+		res := conntest.Run(tt.opts, conntest.Options{}, func(conn net.Conn) error {
+			pub, err := keys.LoadPublicKey()
+			if err != nil {
+				return err
+			}
+			m := &transfer.Manifest{FileName: tt.name, FileSize: tt.size}
+			return transfer.SendStream(conn, m, bytes.NewReader(data), pub)
+		})
+		if res.ReceiveErr == nil {
+			t.Errorf("receiver took %d bytes declared as %d", len(data), tt.size)
+		}
+		if _, err := os.Stat(filepath.Join(out, tt.name)); !os.IsNotExist(err) {
+			t.Errorf("%s was kept", tt.name)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Package libp2p runs the p2p-client transfer protocol over libp2p streams.
+// libp2p takes care of NAT traversal (port mapping, hole punching and relays)
+// and addresses peers by IDs derived from our RSA keys.
+package libp2p
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	golibp2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+var (
+	log = util.DefaultLogger()
+)
+
+// ProtocolID identifies the transfer protocol on libp2p streams
+const ProtocolID protocol.ID = "/p2p-client/transfer/1.0.0"
+
+// Config controls the libp2p host
+type Config struct {
+	Port   int      // Port for TCP and QUIC listeners, 0 picks one
+	Relays []string // Static relay multiaddrs used when we're not directly reachable
+
+	// DialTimeout bounds connecting to a peer, including hole punching and
+	// relays; 0 leaves it to libp2p
+	DialTimeout time.Duration
+}
+
+// Host is a libp2p host whose identity is our RSA key pair
+type Host struct {
+	h           host.Host
+	dialTimeout time.Duration
+}
+
+// New creates a libp2p host using the key pair in private.pem
+func New(cfg Config) (*Host, error) {
+	priv, err := keys.LoadPrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %w", err)
+	}
+	sk, _, err := crypto.KeyPairFromStdKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert private key: %w", err)
+	}
+
+	opts := []golibp2p.Option{
+		golibp2p.Identity(sk),
+		golibp2p.ListenAddrStrings(
+			fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", cfg.Port),
+			fmt.Sprintf("/ip6/::/tcp/%d", cfg.Port),
+			fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic-v1", cfg.Port),
+			fmt.Sprintf("/ip6/::/udp/%d/quic-v1", cfg.Port),
+		),
+		golibp2p.NATPortMap(),
+		golibp2p.EnableRelay(),
+		golibp2p.EnableHolePunching(),
+		golibp2p.EnableNATService(),
+	}
+	if len(cfg.Relays) > 0 {
+		relays := make([]peer.AddrInfo, 0, len(cfg.Relays))
+		for _, r := range cfg.Relays {
+			info, err := peer.AddrInfoFromString(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid relay address %q: %w", r, err)
+			}
+			relays = append(relays, *info)
+		}
+		opts = append(opts, golibp2p.EnableAutoRelayWithStaticRelays(relays))
+	}
+
+	h, err := golibp2p.New(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create libp2p host: %w", err)
+	}
+	log.Info("libp2p host started", "peer", h.ID())
+	return &Host{h: h, dialTimeout: cfg.DialTimeout}, nil
+}
+
+// ID returns the host's peer ID
+func (h *Host) ID() peer.ID {
+	return h.h.ID()
+}
+
+// Addrs returns the host's dialable addresses, each including /p2p/<peer id>
+func (h *Host) Addrs() []string {
+	addrs := make([]string, 0, len(h.h.Addrs()))
+	for _, a := range h.h.Addrs() {
+		addrs = append(addrs, fmt.Sprintf("%s/p2p/%s", a, h.h.ID()))
+	}
+	return addrs
+}
+
+// Listen receives incoming transfers on ProtocolID as described by cfg
+func (h *Host) Listen(cfg netconn.ServerConfig) {
+	h.h.SetStreamHandler(ProtocolID, func(s network.Stream) {
+		log.Info("New libp2p stream", "peer", s.Conn().RemotePeer())
+		netconn.ServeConn(streamConn{s}, cfg)
+	})
+}
+
+// SendFile connects to target, a multiaddr ending in /p2p/<peer id>, and
+// sends filePath. The receiver's transfer key must match its libp2p identity.
+func (h *Host) SendFile(ctx context.Context, target string, filePath string) error {
+	info, err := peer.AddrInfoFromString(target)
+	if err != nil {
+		return fmt.Errorf("invalid peer address %q: %w", target, err)
+	}
+	log.Info("Connecting to libp2p peer", "peer", info.ID)
+	connectCtx := ctx
+	if h.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		connectCtx, cancel = context.WithTimeout(ctx, h.dialTimeout)
+		defer cancel()
+	}
+	if err := h.h.Connect(connectCtx, *info); err != nil {
+		return fmt.Errorf("%w: %s: %w", netconn.ErrPeerUnreachable, info.ID, err)
+	}
+	log.Info("Connected to libp2p peer", "peer", info.ID, "path", h.pathTo(info.ID))
+
+	fingerprint, err := fingerprintOf(h.h.Peerstore().PubKey(info.ID))
+	if err != nil {
+		return fmt.Errorf("cannot verify peer %s: %w", info.ID, err)
+	}
+
+	dial := func() (net.Conn, error) {
+		// Allow relayed connections: a relay is the last resort for peers
+		// that hole punching can't reach
+		s, err := h.h.NewStream(network.WithAllowLimitedConn(ctx, "transfer"), info.ID, ProtocolID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to open stream: %w", netconn.ErrPeerUnreachable, err)
+		}
+		return streamConn{s}, nil
+	}
+	return netconn.SendFileVia(dial, filePath, fingerprint)
+}
+
+// pathTo describes how we're connected to p: "direct" or "relay", followed
+// by the remote address, e.g. "direct /ip4/203.0.113.7/udp/4001/quic-v1"
+func (h *Host) pathTo(p peer.ID) string {
+	conns := h.h.Network().ConnsToPeer(p)
+	if len(conns) == 0 {
+		return "none"
+	}
+	// Prefer a direct connection; hole punching may have upgraded a relayed one
+	c := conns[0]
+	for _, cc := range conns {
+		if !cc.Stat().Limited {
+			c = cc
+			break
+		}
+	}
+	kind := "direct"
+	if c.Stat().Limited {
+		kind = "relay"
+	}
+	return kind + " " + c.RemoteMultiaddr().String()
+}
+
+// Close shuts the host down
+func (h *Host) Close() error {
+	return h.h.Close()
+}
+
+// fingerprintOf returns the transfer key fingerprint of a peer's libp2p key
+func fingerprintOf(pub crypto.PubKey) (string, error) {
+	if pub == nil {
+		return "", errors.New("public key unknown")
+	}
+	std, err := crypto.PubKeyToStdKey(pub)
+	if err != nil {
+		return "", err
+	}
+	rsaPub, ok := std.(*rsa.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("peer uses a %T key, expected RSA", std)
+	}
+	return keys.PublicKeyFingerprint(rsaPub), nil
+}
@@ -0,0 +1,27 @@
+package libp2p
+
+import (
+	"net"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// streamConn adapts a libp2p stream to net.Conn so the netconn handshake
+// and transfer code can run over it unchanged
+type streamConn struct {
+	network.Stream
+}
+
+func (c streamConn) LocalAddr() net.Addr {
+	return addr(c.Conn().LocalMultiaddr().String())
+}
+
+func (c streamConn) RemoteAddr() net.Addr {
+	return addr(c.Conn().RemoteMultiaddr().String() + "/p2p/" + c.Conn().RemotePeer().String())
+}
+
+// addr is a multiaddr string presented as a net.Addr
+type addr string
+
+func (a addr) Network() string { return "libp2p" }
+func (a addr) String() string  { return string(a) }
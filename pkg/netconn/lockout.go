@@ -0,0 +1,204 @@
+package netconn
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// MaxAuthFailures is how many failed handshakes in a row an IP may make
+	// before it is locked out
+	MaxAuthFailures = 5
+	// AuthLockout is how long an IP is locked out the first time; each
+	// lockout after that lasts twice as long as the one before, up to
+	// MaxAuthLockout
+	AuthLockout = time.Minute
+	// MaxAuthLockout caps how long an IP is locked out
+	MaxAuthLockout = 24 * time.Hour
+	// AuthDelay is how long the server waits before answering a failed
+	// handshake; it doubles with each failure in a row, up to MaxAuthDelay
+	AuthDelay = 250 * time.Millisecond
+	// MaxAuthDelay caps the wait before answering a failed handshake
+	MaxAuthDelay = 8 * time.Second
+	// MaxAuthInFlight is how many handshakes an IP may have checked at
+	// once; more are refused as if it were locked out
+	MaxAuthInFlight = 2
+)
+
+// authMemory is how long an IP's lockouts are remembered after its last
+// failure, for the next one to last longer
+const authMemory = 24 * time.Hour
+
+// ErrNotLockedOut is returned by Unlock for an IP that isn't locked out
+var ErrNotLockedOut = errors.New("IP is not locked out")
+
+// Reasons a handshake isn't checked at all
+var (
+	errLockedOut       = errors.New("locked out")
+	errTooManyInFlight = errors.New("too many handshakes at once")
+)
+
+// Lockout describes a locked out IP, or IPv6 /64
+type Lockout struct {
+	IP          string    `json:"ip"`       // An IPv4 address or an IPv6 /64 prefix
+	Failures    int       `json:"failures"` // Failed handshakes since it was last forgiven
+	Lockouts    int       `json:"lockouts"` // Times it has been locked out, this one included
+	LastFailure time.Time `json:"last_failure"`
+	Until       time.Time `json:"until"`
+}
+
+// authFailures counts the failed handshakes of one IP
+type authFailures struct {
+	count    int // Failures in a row, reset by a lockout
+	total    int
+	lockouts int
+	last     time.Time
+	until    time.Time // End of the current lockout, if any
+	inFlight int       // Handshakes being checked
+}
+
+// authLimiter slows down and locks out IPs that fail the handshake. Each
+// handshake counts as a failure from the moment it is checked until it
+// succeeds, so guesses made in parallel are all counted, and an IP may have
+// no more than MaxAuthInFlight of them checked at once. Each failure in a
+// row doubles the wait before the server answers, from AuthDelay; after
+// MaxAuthFailures of them the IP is locked out, for AuthLockout the first
+// time and twice as long each time after. Failures more than AuthLockout
+// apart don't count as a row, and an IP's lockouts are forgotten a day
+// after its last failure or when it gets the passcode right. IPv6 clients
+// are counted by /64, as one host is usually handed a whole prefix.
+type authLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*authFailures
+}
+
+var limiter = &authLimiter{failures: make(map[string]*authFailures)}
+
+// remoteIP returns the IP of a connection's remote address
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// limitKey returns what the failures of ip are counted under: the IP
+// itself, or its /64 for IPv6
+func limitKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return addr.String()
+	}
+	prefix, _ := addr.WithZone("").Prefix(64)
+	return prefix.String()
+}
+
+// begin admits a handshake from ip to be checked, counting it as a failure
+// until end says otherwise, and returns how long to wait before answering
+// it if it does fail. It returns errLockedOut or errTooManyInFlight for
+// one not to check at all.
+func (l *authLimiter) begin(ip string) (time.Duration, error) {
+	key := limitKey(ip)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	f, ok := l.failures[key]
+	if ok && now.Before(f.until) {
+		return 0, errLockedOut
+	}
+	if ok && f.inFlight >= MaxAuthInFlight {
+		return 0, errTooManyInFlight
+	}
+	if !ok || (now.Sub(f.last) > authMemory && f.inFlight == 0) {
+		f = &authFailures{}
+		l.failures[key] = f
+	}
+	f.inFlight++
+	return l.fail(key, f, now), nil
+}
+
+// end ends a handshake begun from ip; ok clears the failures of ip
+func (l *authLimiter) end(ip string, ok bool) {
+	key := limitKey(ip)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, found := l.failures[key]
+	if !found {
+		return
+	}
+	f.inFlight--
+	if ok {
+		*f = authFailures{inFlight: f.inFlight}
+	}
+}
+
+// fail records a failed handshake under key, and returns how long to wait
+// before answering it. l.mu is held.
+func (l *authLimiter) fail(key string, f *authFailures, now time.Time) time.Duration {
+	if now.Sub(f.last) > AuthLockout {
+		f.count = 0
+	}
+	f.count++
+	f.total++
+	f.last = now
+	delay := min(AuthDelay<<min(f.count-1, 16), MaxAuthDelay)
+	if f.count >= MaxAuthFailures {
+		f.count = 0
+		f.lockouts++
+		f.until = now.Add(min(AuthLockout<<min(f.lockouts-1, 16), MaxAuthLockout))
+		log.Warn("Too many failed handshakes; locking out", "ip", key, "for", f.until.Sub(now).String(),
+			"until", f.until.Format(time.RFC3339), "lockouts", f.lockouts, "failures", f.total)
+	}
+	// Forget IPs that have been quiet for a while
+	if len(l.failures) > 1024 {
+		for key, f := range l.failures {
+			if now.Sub(f.last) > AuthLockout && now.After(f.until) && f.inFlight == 0 {
+				delete(l.failures, key)
+			}
+		}
+	}
+	return delay
+}
+
+// Lockouts lists the IPs locked out for failing the handshake, those
+// locked out longest first
+func Lockouts() []Lockout {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := time.Now()
+	var locked []Lockout
+	for ip, f := range limiter.failures {
+		if now.Before(f.until) {
+			locked = append(locked, Lockout{IP: ip, Failures: f.total, Lockouts: f.lockouts, LastFailure: f.last, Until: f.until})
+		}
+	}
+	sort.Slice(locked, func(i, j int) bool { return locked[i].Until.After(locked[j].Until) })
+	return locked
+}
+
+// Unlock lifts the lockout of ip, or of the IPv6 /64 it is in, and
+// forgets its failures
+func Unlock(ip string) error {
+	key := ip
+	if _, err := netip.ParsePrefix(ip); err != nil {
+		key = limitKey(ip)
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	f, ok := limiter.failures[key]
+	if !ok || !time.Now().Before(f.until) {
+		return ErrNotLockedOut
+	}
+	*f = authFailures{inFlight: f.inFlight}
+	log.Info("Lifting lockout", "ip", key)
+	return nil
+}
@@ -0,0 +1,184 @@
+package netconn
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newLimiter() *authLimiter {
+	return &authLimiter{failures: make(map[string]*authFailures)}
+}
+
+// lockOut fails handshakes from ip until it is locked out
+func lockOut(t *testing.T, l *authLimiter, ip string) {
+	t.Helper()
+	for range MaxAuthFailures {
+		if _, err := l.begin(ip); err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+		l.end(ip, false)
+	}
+	if _, err := l.begin(ip); !errors.Is(err, errLockedOut) {
+		t.Fatalf("after %d failures: got %v, want errLockedOut", MaxAuthFailures, err)
+	}
+}
+
+func TestLimitKey(t *testing.T) {
+	for ip, want := range map[string]string{
+		"192.0.2.1":          "192.0.2.1",
+		"::ffff:192.0.2.1":   "192.0.2.1",
+		"2001:db8::1":        "2001:db8::/64",
+		"2001:db8::ffff:1":   "2001:db8::/64",
+		"2001:db8:0:1::1":    "2001:db8:0:1::/64",
+		"fe80::1%eth0":       "fe80::/64",
+		"not-an-ip":          "not-an-ip",
+		"2001:db8::/64":      "2001:db8::/64",
+		"192.0.2.1:8000":     "192.0.2.1:8000",
+		"[2001:db8::1]:8000": "[2001:db8::1]:8000",
+	} {
+		if got := limitKey(ip); got != want {
+			t.Errorf("limitKey(%q) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestAuthDelay(t *testing.T) {
+	l := newLimiter()
+	for i := range MaxAuthFailures {
+		delay, err := l.begin("192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := min(AuthDelay<<i, MaxAuthDelay); delay != want {
+			t.Errorf("failure %d: delay %v, want %v", i+1, delay, want)
+		}
+		l.end("192.0.2.1", false)
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	l := newLimiter()
+	lockOut(t, l, "2001:db8::1")
+	// The whole /64 is locked out, and nothing else
+	if _, err := l.begin("2001:db8::2"); !errors.Is(err, errLockedOut) {
+		t.Errorf("same /64: got %v, want errLockedOut", err)
+	}
+	for _, ip := range []string{"2001:db8:0:1::1", "192.0.2.1"} {
+		if _, err := l.begin(ip); err != nil {
+			t.Errorf("%s: %v", ip, err)
+		}
+		l.end(ip, true)
+	}
+}
+
+func TestAuthSuccess(t *testing.T) {
+	l := newLimiter()
+	for range MaxAuthFailures - 1 {
+		l.begin("192.0.2.1")
+		l.end("192.0.2.1", false)
+	}
+	// The handshake that would lock the IP out succeeds, clearing its
+	// failures
+	if _, err := l.begin("192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	l.end("192.0.2.1", true)
+	for range MaxAuthFailures - 1 {
+		if _, err := l.begin("192.0.2.1"); err != nil {
+			t.Fatalf("after success: %v", err)
+		}
+		l.end("192.0.2.1", false)
+	}
+}
+
+func TestAuthInFlight(t *testing.T) {
+	l := newLimiter()
+	for range MaxAuthInFlight {
+		if _, err := l.begin("192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Handshakes still being checked count as failures
+	if f := l.failures["192.0.2.1"]; f.count != MaxAuthInFlight {
+		t.Errorf("%d failures, want %d", f.count, MaxAuthInFlight)
+	}
+	if _, err := l.begin("192.0.2.1"); !errors.Is(err, errTooManyInFlight) {
+		t.Fatalf("got %v, want errTooManyInFlight", err)
+	}
+	if _, err := l.begin("192.0.2.2"); err != nil {
+		t.Errorf("other IP: %v", err)
+	}
+	l.end("192.0.2.1", true)
+	if _, err := l.begin("192.0.2.1"); err != nil {
+		t.Errorf("after one ended: %v", err)
+	}
+	for range MaxAuthInFlight {
+		l.end("192.0.2.1", false)
+	}
+	if f := l.failures["192.0.2.1"]; f.inFlight != 0 {
+		t.Errorf("%d in flight after all ended", f.inFlight)
+	}
+}
+
+func TestAuthLockoutExpiry(t *testing.T) {
+	defer func(d time.Duration) { AuthLockout = d }(AuthLockout)
+	AuthLockout = 50 * time.Millisecond
+	l := newLimiter()
+	lockOut(t, l, "192.0.2.1")
+	first := time.Until(l.failures["192.0.2.1"].until)
+	time.Sleep(AuthLockout + 10*time.Millisecond)
+	if _, err := l.begin("192.0.2.1"); err != nil {
+		t.Fatalf("after the lockout: %v", err)
+	}
+	l.end("192.0.2.1", false)
+	// The next lockout lasts twice as long
+	for range MaxAuthFailures - 1 {
+		l.begin("192.0.2.1")
+		l.end("192.0.2.1", false)
+	}
+	f := l.failures["192.0.2.1"]
+	if f.lockouts != 2 {
+		t.Fatalf("lockouts = %d, want 2", f.lockouts)
+	}
+	if second := time.Until(f.until); second <= first || second > 2*AuthLockout {
+		t.Errorf("second lockout %v, first %v", second, first)
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	defer func(l *authLimiter) { limiter = l }(limiter)
+	limiter = newLimiter()
+	if err := Unlock("192.0.2.1"); !errors.Is(err, ErrNotLockedOut) {
+		t.Errorf("unknown IP: got %v, want ErrNotLockedOut", err)
+	}
+
+	lockOut(t, limiter, "2001:db8::1")
+	locked := Lockouts()
+	if len(locked) != 1 || locked[0].IP != "2001:db8::/64" || locked[0].Failures != MaxAuthFailures || locked[0].Lockouts != 1 {
+		t.Fatalf("Lockouts() = %+v", locked)
+	}
+	// Any address in the /64 lifts it
+	if err := Unlock("2001:db8::2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unlock("2001:db8::1"); !errors.Is(err, ErrNotLockedOut) {
+		t.Errorf("unlocked twice: got %v, want ErrNotLockedOut", err)
+	}
+	if locked := Lockouts(); len(locked) != 0 {
+		t.Errorf("Lockouts() after Unlock = %+v", locked)
+	}
+	if _, err := limiter.begin("2001:db8::1"); err != nil {
+		t.Errorf("after Unlock: %v", err)
+	}
+	limiter.end("2001:db8::1", true)
+
+	// So does the prefix itself, and its failures are forgotten
+	lockOut(t, limiter, "2001:db8::1")
+	if err := Unlock("2001:db8::/64"); err != nil {
+		t.Fatal(err)
+	}
+	if f := limiter.failures["2001:db8::/64"]; f.total != 0 || f.lockouts != 0 {
+		t.Errorf("after Unlock: %d failures, %d lockouts", f.total, f.lockouts)
+	}
+}
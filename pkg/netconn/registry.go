@@ -0,0 +1,144 @@
+package netconn
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection directions
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// ErrNoConnection is returned by Disconnect when nothing matches
+var ErrNoConnection = errors.New("no such connection")
+
+// ConnInfo describes an active connection
+type ConnInfo struct {
+	ID        string    `json:"id"`
+	Remote    string    `json:"remote"`
+	Direction string    `json:"direction"`
+	File      string    `json:"file,omitempty"` // Transfer in progress, once known
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	Started   time.Time `json:"started"`
+}
+
+// trackedConn registers a connection while it is open and counts its traffic
+type trackedConn struct {
+	net.Conn
+	id        string
+	direction string
+	started   time.Time
+	in, out   atomic.Int64
+
+	mu   sync.Mutex
+	file string
+	once sync.Once
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]*trackedConn{}
+	nextConnID uint64
+)
+
+// track registers conn until it is closed
+func track(conn net.Conn, direction string) *trackedConn {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	nextConnID++
+	t := &trackedConn{Conn: conn, id: strconv.FormatUint(nextConnID, 10), direction: direction, started: time.Now()}
+	registry[t.id] = t
+	return t
+}
+
+func (t *trackedConn) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	t.in.Add(int64(n))
+	return n, err
+}
+
+func (t *trackedConn) Write(p []byte) (int, error) {
+	n, err := t.Conn.Write(p)
+	t.out.Add(int64(n))
+	return n, err
+}
+
+// Close closes the connection and removes it from the registry
+func (t *trackedConn) Close() error {
+	t.once.Do(func() {
+		registryMu.Lock()
+		delete(registry, t.id)
+		registryMu.Unlock()
+	})
+	return t.Conn.Close()
+}
+
+// setFile records the name of the transfer running on the connection
+func (t *trackedConn) setFile(name string) {
+	t.mu.Lock()
+	t.file = name
+	t.mu.Unlock()
+}
+
+func (t *trackedConn) info() ConnInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return ConnInfo{
+		ID:        t.id,
+		Remote:    t.RemoteAddr().String(),
+		Direction: t.direction,
+		File:      t.file,
+		BytesIn:   t.in.Load(),
+		BytesOut:  t.out.Load(),
+		Started:   t.started,
+	}
+}
+
+// Connections lists the open connections, oldest first
+func Connections() []ConnInfo {
+	registryMu.Lock()
+	conns := make([]*trackedConn, 0, len(registry))
+	for _, t := range registry {
+		conns = append(conns, t)
+	}
+	registryMu.Unlock()
+
+	infos := make([]ConnInfo, len(conns))
+	for i, t := range conns {
+		infos[i] = t.info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+	return infos
+}
+
+// Disconnect closes the connections matching peer, which is a connection ID,
+// a remote ip:port or a remote IP, and returns how many were closed
+func Disconnect(peer string) (int, error) {
+	registryMu.Lock()
+	var matched []*trackedConn
+	for _, t := range registry {
+		remote := t.RemoteAddr().String()
+		host, _, _ := net.SplitHostPort(remote)
+		if t.id == peer || remote == peer || host == peer {
+			matched = append(matched, t)
+		}
+	}
+	registryMu.Unlock()
+
+	if len(matched) == 0 {
+		return 0, ErrNoConnection
+	}
+	for _, t := range matched {
+		log.Info("Disconnecting", "id", t.id, "remote", t.RemoteAddr().String(), "direction", t.direction)
+		t.Close()
+	}
+	return len(matched), nil
+}
@@ -0,0 +1,63 @@
+package netconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/transfer"
+)
+
+// SelfTest sends filePath to an in-process server listening on addr (e.g.
+// "127.0.0.1:0") and waits for it to be written to outputDir. It exercises
+// the full handshake and encrypt/decrypt pipeline without another machine.
+func SelfTest(addr string, filePath string, outputDir string, timeout time.Duration) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %w", addr, err)
+	}
+	defer ln.Close()
+
+	received := make(chan error, 1)
+	go Serve(ln, ServerConfig{
+		OutputDir:  outputDir,
+		OnReceived: func(err error) { received <- err },
+	})
+
+	// Answer our own passcode prompt
+	prev := PasscodeSource
+	PasscodeSource = func() (string, error) { return DefaultPasscode, nil }
+	defer func() { PasscodeSource = prev }()
+
+	local := ln.Addr().(*net.TCPAddr)
+	host := local.IP.String()
+	if local.IP.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	// The server side takes the process-wide connection lock, so the client
+	// side runs without it
+	conn, err := TCPDialer(context.Background(), host, local.Port)()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	session, serverPub, err := authenticate(conn, "")
+	if err != nil {
+		return err
+	}
+	if err := transfer.SendFile(session, filePath, serverPub); err != nil {
+		return fmt.Errorf("send failed: %w", err)
+	}
+
+	select {
+	case err := <-received:
+		if err != nil {
+			return fmt.Errorf("receive failed: %w", err)
+		}
+		return nil
+	case <-time.After(timeout):
+		return errors.New("timed out waiting for the receiver")
+	}
+}
@@ -2,15 +2,26 @@ package netconn
 
 import (
 	"bufio"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/udit2303/p2p-client/pkg/discovery"
 	"github.com/udit2303/p2p-client/pkg/keys"
 	"github.com/udit2303/p2p-client/pkg/transfer"
 	"github.com/udit2303/p2p-client/pkg/util"
@@ -22,11 +33,99 @@ var (
 )
 
 var (
-	connectionLocked bool
-	lock             sync.Mutex
+	lock      sync.Mutex
+	receiving bool // an incoming transfer is in progress
+	sending   int  // outgoing transfers in progress
 )
 
-const passcode = "hello123"
+// MaxOutgoing is how many sends may run at once. The CLI sends one file at
+// a time; the daemon raises it to its queue concurrency.
+var MaxOutgoing = 1
+
+// DefaultPasscode is the passcode servers ask for unless configured with
+// one of their own
+const DefaultPasscode = "hello123"
+
+var (
+	// ErrAuthFailed is returned when the server rejects our passcode
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrConnectionLocked is returned when another transfer holds the connection lock
+	ErrConnectionLocked = errors.New("connection locked")
+	// ErrPeerUnreachable is returned when no connection could be established
+	ErrPeerUnreachable = errors.New("peer unreachable")
+	// ErrKeyMismatch is returned when the peer's key doesn't match the
+	// fingerprint it was expected to have
+	ErrKeyMismatch = errors.New("peer key does not match fingerprint")
+)
+
+// greetingTimeout bounds the wait for the server's nonce after connecting
+const greetingTimeout = 10 * time.Second
+
+// dialRetryPolicy bounds how long ConnectTCP keeps redialing an unreachable peer
+var dialRetryPolicy = util.RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 250 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Jitter:         0.5,
+	Deadline:       10 * time.Second,
+}
+
+// Retryable reports whether a ConnectTCP error is worth retrying. Failed
+// authentication, a mismatched key or session binding, a refusal by the
+// receiver or by the operating mode and a protocol mismatch are final; a
+// second attempt won't change them.
+func Retryable(err error) bool {
+	var remote *transfer.RemoteError
+	return !errors.Is(err, ErrAuthFailed) &&
+		!errors.Is(err, ErrKeyMismatch) &&
+		!errors.Is(err, transfer.ErrSessionBinding) &&
+		!errors.Is(err, transfer.ErrProtocolVersion) &&
+		!errors.Is(err, transfer.ErrModeRefused) &&
+		!errors.As(err, &remote)
+}
+
+// IsConnectionLost reports whether a transfer failed because the connection
+// broke, e.g. when the network changed under it, rather than because either
+// side turned it down. Reconnecting may resume such a transfer.
+func IsConnectionLost(err error) bool {
+	var remote *transfer.RemoteError
+	var delivery *transfer.DeliveryError
+	if err == nil || errors.As(err, &remote) || errors.As(err, &delivery) || errors.Is(err, ErrTransferTimeout) {
+		return false
+	}
+	return errors.Is(err, transfer.ErrReceiverStalled) ||
+		errors.Is(err, errWebRTCLost) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ETIMEDOUT) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTUNREACH)
+}
+
+// greetingTag separates the random nonce from the server's protocol
+// version in its greeting. The whole line is covered by the answer, so
+// the version can't be stripped to make a sender fall back to a plaintext
+// manifest; older clients hash it without looking inside.
+const greetingTag = "-v"
+
+// greetingVersion returns the protocol version in a server's greeting, 0
+// for servers too old to send one
+func greetingVersion(nonce string) int {
+	i := strings.LastIndex(nonce, greetingTag)
+	if i < 0 {
+		return 0
+	}
+	v, err := strconv.Atoi(nonce[i+len(greetingTag):])
+	if err != nil || v < 0 {
+		return 0
+	}
+	return v
+}
 
 func generateNonce(length int) (string, error) {
 	bytes := make([]byte, length)
@@ -36,82 +135,334 @@ func generateNonce(length int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// ConnectTCP connects to a TCP server and optionally sends a file
-func ConnectTCP(ip string, port int, filePath string) error {
+// ConnectTCP connects to a TCP server and optionally sends a file.
+// If fingerprint is non-empty (e.g. advertised via mDNS), the server's public
+// key must match it before any data is encrypted to it.
+func ConnectTCP(ip string, port int, filePath string, fingerprint string) error {
+	return SendFileVia(TCPDialer(context.Background(), ip, port), filePath, fingerprint)
+}
+
+// Dialer opens the underlying connection for a session. TCP is the default;
+// other stacks (e.g. libp2p streams) supply their own.
+type Dialer func() (net.Conn, error)
+
+// SendFileVia runs the passcode handshake and file protocol over a
+// connection obtained from dial
+func SendFileVia(dial Dialer, filePath string, fingerprint string) error {
+	if filePath == "" {
+		return withSession(dial, fingerprint, "", func(net.Conn, *rsa.PublicKey) error { return nil })
+	}
+	return withSession(dial, fingerprint, filepath.Base(filePath), func(conn net.Conn, serverPub *rsa.PublicKey) error {
+		log.Info("Starting file transfer", "file", filePath)
+		if err := transfer.SendFile(conn, filePath, serverPub); err != nil {
+			log.Error("File transfer failed", "error", err, "file", filePath)
+			return fmt.Errorf("file transfer failed: %w", err)
+		}
+		log.Info("File transfer completed successfully", "file", filePath)
+		return nil
+	})
+}
+
+// SendStreamTCP connects to a TCP server and sends the contents of r under
+// the given name. size may be -1 if unknown.
+func SendStreamTCP(ip string, port int, fingerprint string, name string, size int64, r io.Reader) error {
+	return SendStreamVia(TCPDialer(context.Background(), ip, port), fingerprint, name, size, r)
+}
+
+// SendStreamVia is SendStreamTCP over a connection obtained from dial
+func SendStreamVia(dial Dialer, fingerprint string, name string, size int64, r io.Reader) error {
+	return withSession(dial, fingerprint, name, func(conn net.Conn, serverPub *rsa.PublicKey) error {
+		log.Info("Starting stream transfer", "name", name)
+		if err := transfer.SendReader(conn, name, size, r, serverPub); err != nil {
+			log.Error("Stream transfer failed", "error", err, "name", name)
+			return fmt.Errorf("stream transfer failed: %w", err)
+		}
+		log.Info("Stream transfer completed successfully", "name", name)
+		return nil
+	})
+}
+
+// SendManifestVia sends the contents of r described by m over a connection
+// obtained from dial, e.g. one copy of a file that is read once and sent to
+// several peers, or content generated on the fly; see transfer.SendStream
+func SendManifestVia(dial Dialer, fingerprint string, m *transfer.Manifest, r io.Reader) error {
+	return withSession(dial, fingerprint, m.FileName, func(conn net.Conn, serverPub *rsa.PublicKey) error {
+		log.Info("Starting file transfer", "file", m.FileName)
+		if err := transfer.SendStream(conn, m, r, serverPub); err != nil {
+			log.Error("File transfer failed", "error", err, "file", m.FileName)
+			return fmt.Errorf("file transfer failed: %w", err)
+		}
+		log.Info("File transfer completed successfully", "file", m.FileName)
+		return nil
+	})
+}
+
+// SendSyncEntryVia sends e, an entry of the directory root being synced,
+// over a connection obtained from dial; see transfer.SendSyncEntry
+func SendSyncEntryVia(dial Dialer, fingerprint, root string, e transfer.SyncEntry) error {
+	return withSession(dial, fingerprint, e.Path, func(conn net.Conn, serverPub *rsa.PublicKey) error {
+		return transfer.SendSyncEntry(conn, root, e, serverPub)
+	})
+}
+
+// SendSyncIndexVia sends the list of entries in root over a connection
+// obtained from dial, so the receiver removes the ones no longer there
+func SendSyncIndexVia(dial Dialer, fingerprint, root string, files []string) error {
+	return withSession(dial, fingerprint, "sync index", func(conn net.Conn, serverPub *rsa.PublicKey) error {
+		return transfer.SendSyncIndex(conn, root, files, serverPub)
+	})
+}
+
+// SendFileOver sends filePath over conn, a connection to the peer that is
+// already authenticated some other way, e.g. by a rendezvous code. The peer's
+// key must still match fingerprint.
+func SendFileOver(conn net.Conn, filePath string, fingerprint string) error {
+	// The code stood in for the passcode; answer the prompt ourselves
+	prev := PasscodeSource
+	PasscodeSource = func() (string, error) { return DefaultPasscode, nil }
+	defer func() { PasscodeSource = prev }()
+	return SendFileVia(func() (net.Conn, error) { return conn, nil }, filePath, fingerprint)
+}
+
+// SendTextTCP sends a text snippet to the server at ip:port
+func SendTextTCP(ip string, port int, fingerprint string, text string) error {
+	return withSession(TCPDialer(context.Background(), ip, port), fingerprint, transfer.TextFileName, func(conn net.Conn, serverPub *rsa.PublicKey) error {
+		if err := transfer.SendText(conn, text, serverPub); err != nil {
+			return fmt.Errorf("text transfer failed: %w", err)
+		}
+		log.Info("Text sent", "bytes", len(text))
+		return nil
+	})
+}
+
+// ExchangePeersVia sends peer records over a connection obtained from dial
+// and returns the records the server answered with and its key, which
+// signed them; see transfer.ExchangePeers
+func ExchangePeersVia(dial Dialer, fingerprint string, records []byte) ([]byte, *rsa.PublicKey, error) {
+	var reply []byte
+	var peer *rsa.PublicKey
+	err := withSession(dial, fingerprint, transfer.KindPeers, func(conn net.Conn, serverPub *rsa.PublicKey) error {
+		var err error
+		peer = serverPub
+		reply, err = transfer.ExchangePeers(conn, records, serverPub)
+		return err
+	})
+	return reply, peer, err
+}
+
+// ListVia lists path in the directory exposed by the server, over a
+// connection obtained from dial; see transfer.ListRemote
+func ListVia(dial Dialer, fingerprint, path string) ([]transfer.RemoteEntry, error) {
+	var entries []transfer.RemoteEntry
+	err := withSession(dial, fingerprint, transfer.KindList, func(conn net.Conn, serverPub *rsa.PublicKey) error {
+		var err error
+		entries, err = transfer.ListRemote(conn, path, serverPub)
+		return err
+	})
+	return entries, err
+}
+
+// GetVia fetches the file at path in the directory exposed by the server,
+// over a connection obtained from dial, and receives it as opts describe;
+// see transfer.GetRemote
+func GetVia(dial Dialer, fingerprint, path string, opts transfer.ReceiveOptions) (*transfer.Manifest, error) {
+	var m *transfer.Manifest
+	err := withSession(dial, fingerprint, path, func(conn net.Conn, serverPub *rsa.PublicKey) error {
+		log.Info("Fetching file", "path", path)
+		var err error
+		if m, err = transfer.GetRemote(conn, path, serverPub, opts); err != nil {
+			return fmt.Errorf("fetch failed: %w", err)
+		}
+		log.Info("File fetched successfully", "path", path, "file", m.FileName)
+		return nil
+	})
+	return m, err
+}
+
+// Bench streams generated data to the server for about d through the full
+// handshake and encryption pipeline and reports the throughput
+func Bench(dial Dialer, fingerprint string, d time.Duration) (*transfer.BenchResult, error) {
+	var res *transfer.BenchResult
+	err := withSession(dial, fingerprint, "bench", func(conn net.Conn, serverPub *rsa.PublicKey) error {
+		var err error
+		res, err = transfer.SendBench(conn, d, serverPub)
+		return err
+	})
+	return res, err
+}
+
+// withSession takes the connection lock, dials and authenticates to the
+// server, and runs fn with the connection and the server's public key. name
+// labels the connection in the registry.
+func withSession(dial Dialer, fingerprint string, name string, fn func(conn net.Conn, serverPub *rsa.PublicKey) error) error {
 	// Check if we can establish a new connection
 	lock.Lock()
-	if connectionLocked {
+	if sending >= MaxOutgoing {
 		lock.Unlock()
-		log.Warn("Connection attempt rejected: connection is locked")
-		return fmt.Errorf("connection locked")
+		log.Warn("Connection attempt rejected: too many transfers in progress", "limit", MaxOutgoing)
+		return ErrConnectionLocked
 	}
-	connectionLocked = true
+	sending++
 	lock.Unlock()
 
-	log.Info("Attempting to establish connection", "remote", fmt.Sprintf("%s:%d", ip, port))
-
-	// Ensure we unlock when done
+	// Ensure we release the slot when done
 	defer func() {
 		lock.Lock()
-		connectionLocked = false
+		sending--
 		lock.Unlock()
 		log.Debug("Connection lock released")
 	}()
 
-	// Use net.JoinHostPort to properly handle both IPv4 and IPv6 addresses
-	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
-	conn, err := net.Dial("tcp", addr)
+	raw, err := dial()
 	if err != nil {
-		log.Error("Failed to establish connection", "error", err)
-		return fmt.Errorf("connection failed: %w", err)
+		return err
 	}
-	defer conn.Close()
+	tune(raw)
+	tracked := track(raw, DirectionOut)
+	tracked.setFile(name)
+	defer tracked.Close()
+	conn := withTimeouts(tracked)
+
+	conn, serverPub, err := authenticate(conn, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn, serverPub)
+}
 
+// TCPDialer returns a Dialer that connects to ip:port, retrying transient
+// failures. Cancelling ctx stops the retries and closes an established
+// connection, aborting a transfer in progress.
+func TCPDialer(ctx context.Context, ip string, port int) Dialer {
+	return func() (net.Conn, error) {
+		// Use net.JoinHostPort to properly handle both IPv4 and IPv6 addresses
+		addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
+		log.Info("Attempting to establish connection", "remote", addr)
+		var conn net.Conn
+		err := util.Retry(ctx, dialRetryPolicy, func() error {
+			// Bound each attempt, including any proxy handshake; Tor needs
+			// longer to build a circuit
+			attemptTimeout := 10 * time.Second
+			if viaTor(addr) {
+				attemptTimeout = TorDialTimeout
+			}
+			attemptCtx, cancel := context.WithTimeout(ctx, attemptTimeout)
+			defer cancel()
+			var dialErr error
+			conn, dialErr = dialOutbound(attemptCtx, "tcp", addr)
+			if dialErr != nil {
+				log.Debug("Dial attempt failed", "address", addr, "error", dialErr)
+			}
+			return dialErr
+		})
+		if err != nil {
+			log.Error("Failed to establish connection", "error", err)
+			return nil, fmt.Errorf("%w: %w", ErrPeerUnreachable, err)
+		}
+		context.AfterFunc(ctx, func() { conn.Close() })
+		return conn, nil
+	}
+}
+
+// DialTimeout bounds how long dial may take to connect. A connection that
+// arrives after the deadline is closed.
+func DialTimeout(dial Dialer, timeout time.Duration) Dialer {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	return func() (net.Conn, error) {
+		done := make(chan result, 1)
+		go func() {
+			conn, err := dial()
+			done <- result{conn, err}
+		}()
+		select {
+		case r := <-done:
+			return r.conn, r.err
+		case <-time.After(timeout):
+			go func() {
+				if r := <-done; r.conn != nil {
+					r.conn.Close()
+				}
+			}()
+			return nil, fmt.Errorf("%w: no connection within %s", ErrPeerUnreachable, timeout)
+		}
+	}
+}
+
+// authenticate runs the passcode handshake on conn and returns the
+// connection to use for the rest of the session along with the server's
+// public key. The caller keeps ownership of conn.
+func authenticate(conn net.Conn, fingerprint string) (net.Conn, *rsa.PublicKey, error) {
 	log.Debug("Connection established, waiting for nonce")
 
-	nonce, err := bufio.NewReader(conn).ReadString('\n')
+	// Use one buffered reader for the whole session; the server may send its
+	// public key right behind the auth result, in the same segment
+	br := bufio.NewReader(conn)
+	bc := &bufferedConn{Conn: conn, r: br}
+	conn = bc
+
+	// Something that accepts connections but never greets us isn't a peer
+	conn.SetReadDeadline(time.Now().Add(greetingTimeout))
+	nonce, err := br.ReadString('\n')
 	if err != nil {
 		log.Error("Failed to read nonce", "error", err)
-		return fmt.Errorf("failed to read nonce: %w", err)
+		return nil, nil, fmt.Errorf("%w: failed to read nonce: %w", ErrPeerUnreachable, err)
 	}
+	conn.SetReadDeadline(time.Time{})
 	nonce = strings.TrimSpace(nonce)
 	log.Debug("Received nonce", "nonce", nonce)
+	bc.peerVersion = greetingVersion(nonce)
 
 	// Step 2: Prompt user for passcode
 	log.Info("Authentication required")
-	fmt.Print("Enter passcode: ")
-	inputPass, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	inputPass, err := PasscodeSource()
 	if err != nil {
 		log.Error("Failed to read passcode", "error", err)
-		return fmt.Errorf("failed to read passcode: %w", err)
+		return nil, nil, fmt.Errorf("failed to read passcode: %w", err)
 	}
-	inputPass = strings.TrimSpace(inputPass)
 
-	// Step 3: Hash(passcode + nonce) using bcrypt
-	hash, err := bcrypt.GenerateFromPassword([]byte(inputPass+nonce), bcrypt.DefaultCost)
-	if err != nil {
-		log.Error("Failed to hash passcode", "error", err)
-		return fmt.Errorf("authentication failed: %w", err)
+	// Step 3: Answer with an HMAC of the greeting under the stretched
+	// passcode, or bcrypt(passcode + nonce) for servers too old for it
+	var answer string
+	var key []byte
+	if salt := greetingSalt(nonce); salt != "" {
+		key = authKey(inputPass, salt)
+		answer = hmacAnswer + clientAnswer(key, nonce)
+	} else {
+		hash, err := bcrypt.GenerateFromPassword([]byte(inputPass+nonce), bcrypt.DefaultCost)
+		if err != nil {
+			log.Error("Failed to hash passcode", "error", err)
+			return nil, nil, fmt.Errorf("failed to hash passcode: %w", err)
+		}
+		answer = string(hash)
 	}
 
-	_, err = conn.Write([]byte(string(hash) + "\n"))
+	_, err = conn.Write([]byte(answer + "\n"))
 	if err != nil {
 		log.Error("Failed to send authentication hash", "error", err)
-		return fmt.Errorf("failed to send authentication: %w", err)
+		return nil, nil, fmt.Errorf("failed to send authentication: %w", err)
 	}
 
 	// Step 4: Get result
-	result, err := bufio.NewReader(conn).ReadString('\n')
+	result, err := br.ReadString('\n')
 	if err != nil {
 		log.Error("Failed to read authentication response", "error", err)
-		return fmt.Errorf("failed to read server response: %w", err)
+		return nil, nil, fmt.Errorf("failed to read server response: %w", err)
 	}
 	result = strings.TrimSpace(result)
 	log.Debug("Authentication response received", "status", result)
 
-	if result != "SUCCESS" {
+	status, proof, _ := strings.Cut(result, " ")
+	if status != "SUCCESS" {
 		log.Warn("Authentication failed", "response", result)
-		return fmt.Errorf("authentication failed: server responded with '%s'", result)
+		return nil, nil, fmt.Errorf("%w: server responded with '%s'", ErrAuthFailed, result)
+	}
+	if key != nil && !hmac.Equal([]byte(proof), []byte(serverProof(key, nonce, strings.TrimPrefix(answer, hmacAnswer)))) {
+		log.Warn("Server did not prove it knows the passcode")
+		return nil, nil, fmt.Errorf("%w: server did not prove it knows the passcode", ErrAuthFailed)
 	}
 
 	log.Info("Authentication successful")
@@ -119,51 +470,158 @@ func ConnectTCP(ip string, port int, filePath string) error {
 	serverPubBytes, err := util.ReadWithLength(conn)
 	if err != nil {
 		log.Error("Failed to read server public key", "error", err)
-		return fmt.Errorf("failed to read server public key: %w", err)
+		return nil, nil, fmt.Errorf("failed to read server public key: %w", err)
 	}
 	serverPub, err := x509.ParsePKCS1PublicKey(serverPubBytes)
 	if err != nil {
 		log.Error("Failed to parse server public key", "error", err)
-		return fmt.Errorf("failed to parse server public key: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse server public key: %w", err)
+	}
+	if fingerprint != "" && keys.Fingerprint(serverPubBytes) != fingerprint {
+		log.Error("Server public key does not match advertised fingerprint", "expected", fingerprint)
+		return nil, nil, fmt.Errorf("%w: expected %s", ErrKeyMismatch, fingerprint)
 	}
+	bc.transcript = handshakeTranscript(nonce, answer, result, serverPubBytes)
 
-	if filePath != "" {
-		log.Info("Starting file transfer", "file", filePath)
-		err = transfer.SendFile(conn, filePath, serverPub)
-		if err != nil {
-			log.Error("File transfer failed", "error", err, "file", filePath)
-			return fmt.Errorf("file transfer failed: %w", err)
+	return conn, serverPub, nil
+}
+
+// ServerConfig controls how the TCP server stores incoming transfers
+type ServerConfig struct {
+	OutputDir  string                                          // Directory received files are written to
+	Output     io.Writer                                       // If set, received data is streamed here instead of OutputDir
+	Accept     func(remote string, m *transfer.Manifest) error // Approves incoming transfers, if set
+	OnReceived func(err error)                                 // Called after each transfer attempt, if set
+	Quota      *transfer.Quota                                 // Optional per-sender byte limit
+	AllowFrom  *transfer.Allowlist                             // If set, only senders whose key is listed may send
+	OnText     func(remote string, text string) error          // Receives text snippets; if nil they are printed
+	NoMetadata bool                                            // Don't restore the sender's file mode, mtime and owner
+	Extract    bool                                            // Unpack archives flagged by their senders into OutputDir
+	SyncDelete bool                                            // Let senders prune directories their syncs created
+	Dedup      *transfer.HashIndex                             // If set, files already held are linked instead of received
+	Chat       *transfer.Chat                                  // If set, exchange chat messages with senders during transfers
+	Hooks      []transfer.Hook                                 // Vet each received file before it takes its real name
+	Quarantine string                                          // Where files turned down by Hooks go; "" deletes them
+	Passcode   string                                          // Passcode senders must know (default DefaultPasscode)
+	Audit      func(r AuditRecord)                             // Told about every incoming connection once it ends, if set
+
+	// OnAuthFailed, if set, is told about each sender that answered the
+	// handshake with the wrong passcode
+	OnAuthFailed func(remote string, err error)
+
+	// Destination, if set, chooses where each accepted file is written; see
+	// transfer.ReceiveOptions.Destination
+	Destination func(remote string, m *transfer.Manifest) (string, error)
+
+	// OnPeers, if set, takes the peer records sent by a peer exchange and
+	// returns the records to answer with; without it exchanges are refused
+	OnPeers func(remote string, sender *rsa.PublicKey, records []byte) ([]byte, error)
+
+	// Expose, if set, lets the senders it allows list and fetch the files
+	// in a directory with ListVia and GetVia
+	Expose *transfer.Exposed
+
+	// Storage, if set, opens a writer each accepted file is streamed to
+	// instead of OutputDir, e.g. in object storage; see
+	// transfer.ReceiveOptions.Storage
+	Storage func(remote string, m *transfer.Manifest) (io.WriteCloser, error)
+}
+
+// Capabilities describes what a server with this configuration accepts, for
+// announcing over mDNS. The largest file is bounded by the free space in
+// OutputDir, unless files go to Storage, and by the quota; a full disk or send-only mode stops the node
+// accepting. The node is busy while it receives a transfer.
+func (cfg ServerConfig) Capabilities() discovery.Capabilities {
+	caps := discovery.Capabilities{
+		Version:    transfer.ProtocolVersion,
+		Transports: []string{discovery.TransportTCP},
+		Accepting:  true,
+	}
+	if cfg.Output == nil && cfg.Storage == nil {
+		if free, err := util.FreeSpace(cfg.OutputDir); err == nil {
+			caps.MaxFileSize = int64(min(free, math.MaxInt64))
+			caps.Accepting = free > 0
 		}
-		log.Info("File transfer completed successfully", "file", filePath)
 	}
-	return nil
+	if cfg.Quota != nil && (caps.MaxFileSize == 0 || cfg.Quota.Limit() < caps.MaxFileSize) {
+		caps.MaxFileSize = cfg.Quota.Limit()
+		caps.Accepting = caps.Accepting && caps.MaxFileSize > 0
+	}
+	caps.Accepting = caps.Accepting && transfer.OperatingMode.Receives()
+	lock.Lock()
+	caps.Busy = receiving
+	lock.Unlock()
+	return caps
 }
 
-func StartTCPServer(port int) error {
-	addr := fmt.Sprintf(":%d", port)
-	ln, err := net.Listen("tcp", addr)
+// StartTCPServer listens on port and receives incoming transfers as described by cfg
+func StartTCPServer(port int, cfg ServerConfig) error {
+	ln, err := ListenTCP(port, port)
 	if err != nil {
-		return fmt.Errorf("failed to start TCP server: %w", err)
+		return err
 	}
 	defer ln.Close()
+	return Serve(ln, cfg)
+}
+
+// ListenTCP binds the first free port between first and last inclusive.
+// Port 0 lets the OS pick an ephemeral port; ListenPort reports which.
+func ListenTCP(first, last int) (net.Listener, error) {
+	if first < 0 || last < first || last > 65535 {
+		return nil, fmt.Errorf("invalid port range %d-%d", first, last)
+	}
+	host := ""
+	if ip := util.BoundIP(); ip != nil {
+		host = ip.String()
+	}
+	var ln net.Listener
+	var err error
+	for port := first; port <= last; port++ {
+		if ln, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			break
+		}
+		log.Debug("Port unavailable", "port", port, "error", err)
+	}
+	if err != nil {
+		if first == last {
+			return nil, fmt.Errorf("failed to start TCP server on port %d: %w", first, err)
+		}
+		return nil, fmt.Errorf("failed to start TCP server: no free port in %d-%d: %w", first, last, err)
+	}
 
-	log.Info("TCP server started", "address", addr)
+	port := ListenPort(ln)
+	log.Info("TCP server started", "address", ln.Addr().String(), "port", port)
 	// Best-effort: list local IPs for user visibility
 	if ips, err := util.GetLocalIPs(); err == nil {
 		log.Info("Listening on local interfaces", "ips", ips, "port", port)
 	}
+	return ln, nil
+}
 
-	for {
-		lock.Lock()
-		if connectionLocked {
-			log.Info("Connection locked, not accepting new connections")
-			lock.Unlock()
-			return nil
-		}
-		lock.Unlock()
+// ListenPort returns the TCP port ln is bound to
+func ListenPort(ln net.Listener) int {
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// Serve accepts connections from ln and handles each as an incoming transfer
+func Serve(ln net.Listener, cfg ServerConfig) error {
+	return ServeReloadable(ln, func() ServerConfig { return cfg })
+}
 
+// ServeReloadable is Serve, taking the configuration for each connection
+// from config, so a reloaded configuration applies from the next transfer
+func ServeReloadable(ln net.Listener, config func() ServerConfig) error {
+	for {
+		// Connections arriving while a transfer holds the lock are still
+		// accepted; ServeConn rejects them once their manifest is in
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			log.Error("Error accepting connection", "error", err)
 			continue
 		}
@@ -171,32 +629,88 @@ func StartTCPServer(port int) error {
 		go func(c net.Conn) {
 			remoteAddr := c.RemoteAddr().String()
 			log.Info("New connection accepted", "remote", remoteAddr)
-			handleConnection(c)
+			ServeConn(c, config())
 			log.Info("Connection closed", "remote", remoteAddr)
 		}(conn)
 	}
 }
 
-func handleConnection(conn net.Conn) {
+// acquireReceive takes the lock on incoming transfers for m, ending an
+// earlier connection still receiving the same transfer from the same
+// sender. It reports false while another transfer holds the lock.
+func acquireReceive(m *transfer.Manifest) bool {
+	lock.Lock()
+	busy := receiving
+	lock.Unlock()
+	if busy && !transfer.TakeOver(m) {
+		return false
+	}
+	// The connection taken over releases the lock as it closes
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		if !receiving {
+			receiving = true
+			lock.Unlock()
+			discovery.CapabilitiesChanged()
+			return true
+		}
+		lock.Unlock()
+		if !busy || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ServeConn runs the server side of the passcode handshake and file protocol
+// on a single connection, then closes it
+func ServeConn(conn net.Conn, cfg ServerConfig) {
+	if cfg.OutputDir == "" {
+		cfg.OutputDir = "public"
+	}
 	remoteAddr := conn.RemoteAddr().String()
 	log := log.With("remote", remoteAddr)
+	tune(conn)
+	tracked := track(conn, DirectionIn)
+	conn = withTimeouts(tracked)
 
 	defer func() {
-		if err := conn.Close(); err != nil {
+		// A connection a resuming sender took over is closed already
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			log.Error("Error closing connection", "error", err)
 		}
 	}()
 
-	// Generate and send nonce
-	nonce, err := generateNonce(15)
+	// What the audit record says about the connection, filled in as it goes
+	audit := AuditRecord{Remote: remoteIP(conn.RemoteAddr()), Outcome: AuditFailed}
+	var auditErr error
+	if cfg.Audit != nil {
+		defer func() {
+			audit.Time = time.Now()
+			audit.BytesIn, audit.BytesOut = tracked.in.Load(), tracked.out.Load()
+			audit.DurationMS = time.Since(tracked.started).Milliseconds()
+			if auditErr != nil {
+				audit.Error = auditErr.Error()
+			}
+			cfg.Audit(audit)
+		}()
+	}
+
+	// Generate and send nonce, tagged with our passcode salt and protocol
+	// version
+	nonce, err := generateNonce(13)
 	if err != nil {
 		log.Error("Failed to generate nonce", "error", err)
+		auditErr = err
 		return
 	}
+	nonce += saltTag + serverSalt() + greetingTag + strconv.Itoa(transfer.ProtocolVersion)
 
 	log.Debug("Sending nonce to client")
 	if _, err := conn.Write([]byte(nonce + "\n")); err != nil {
 		log.Error("Failed to send nonce", "error", err)
+		auditErr = err
 		return
 	}
 
@@ -204,42 +718,65 @@ func handleConnection(conn net.Conn) {
 	clientHash, err := bufio.NewReader(conn).ReadString('\n')
 	if err != nil {
 		log.Error("Failed to read client hash", "error", err)
+		auditErr = err
 		return
 	}
 	clientHash = strings.TrimSpace(clientHash)
 
+	// IPs that failed too often, or are guessing in parallel, aren't
+	// checked at all
+	ip := remoteIP(conn.RemoteAddr())
+	delay, err := limiter.begin(ip)
+	if err != nil {
+		log.Warn("Rejecting handshake", "ip", ip, "reason", err)
+		audit.Outcome = AuditLockedOut
+		if _, err := conn.Write([]byte("LOCKED\n")); err != nil {
+			log.Error("Failed to send auth failure response", "error", err)
+		}
+		return
+	}
+
 	log.Debug("Verifying client authentication")
-	err = bcrypt.CompareHashAndPassword([]byte(clientHash), []byte(passcode+nonce))
+	passcode := cfg.Passcode
+	if passcode == "" {
+		passcode = DefaultPasscode
+	}
+	reply, err := checkAnswer(nonce, clientHash, passcode)
 	if err != nil {
 		log.Warn("Authentication failed", "error", err)
+		audit.Outcome, auditErr = AuditAuthFailed, err
+		if cfg.OnAuthFailed != nil {
+			cfg.OnAuthFailed(remoteAddr, err)
+		}
+		// Guessing gets slower with every wrong answer
+		time.Sleep(delay)
 		if _, err := conn.Write([]byte("FAIL\n")); err != nil {
 			log.Error("Failed to send auth failure response", "error", err)
 		}
+		limiter.end(ip, false)
 		return
 	}
+	limiter.end(ip, true)
 
 	log.Info("Authentication successful")
-	if _, err := conn.Write([]byte("SUCCESS\n")); err != nil {
+	if _, err := conn.Write([]byte(reply + "\n")); err != nil {
 		log.Error("Failed to send auth success response", "error", err)
+		auditErr = err
 		return
 	}
 
-	// Lock connection for file transfer
-	lock.Lock()
-	if connectionLocked {
-		log.Warn("Connection already locked, rejecting transfer")
-		lock.Unlock()
-		return
-	}
-	connectionLocked = true
-	lock.Unlock()
-
-	// Ensure we unlock when done
+	// Only one incoming transfer at a time. The lock is taken once the
+	// manifest is in, so a sender reconnecting to resume can take over from
+	// its own connection that broke off without us noticing.
+	held := false
 	defer func() {
-		lock.Lock()
-		connectionLocked = false
-		lock.Unlock()
-		log.Debug("Connection lock released")
+		if held {
+			lock.Lock()
+			receiving = false
+			lock.Unlock()
+			discovery.CapabilitiesChanged()
+			log.Debug("Connection lock released")
+		}
 	}()
 
 	// Handle file transfer
@@ -248,16 +785,69 @@ func handleConnection(conn net.Conn) {
 	serverPub, err := keys.LoadPublicKey()
 	if err != nil {
 		log.Error("Failed to load server public key", "error", err)
+		auditErr = err
 		return
 	}
 	serverPubBytes := x509.MarshalPKCS1PublicKey(serverPub)
 	if err := util.SendWithLength(conn, serverPubBytes); err != nil {
 		log.Error("Failed to send server public key", "error", err)
+		auditErr = err
 		return
 	}
 
-	if err := transfer.ReceiveFile(conn, "public"); err != nil {
+	opts := transfer.ReceiveOptions{OutputDir: cfg.OutputDir, Output: cfg.Output, Quota: cfg.Quota, AllowFrom: cfg.AllowFrom, NoMetadata: cfg.NoMetadata, Extract: cfg.Extract, SyncDelete: cfg.SyncDelete, Dedup: cfg.Dedup, Chat: cfg.Chat, Hooks: cfg.Hooks, Quarantine: cfg.Quarantine, Expose: cfg.Expose}
+	opts.Accept = func(m *transfer.Manifest) error {
+		tracked.setFile(m.FileName)
+		audit.Sender = m.Sender
+		if err := checkAnswerVersion(clientHash, m.Version); err != nil {
+			return err
+		}
+		if !acquireReceive(m) {
+			log.Warn("Connection already locked, rejecting transfer")
+			return ErrConnectionLocked
+		}
+		held = true
+		// Peer exchanges are vetted by OnPeers, and pull requests by the
+		// exposed directory's allowlist, rather than approved
+		if cfg.Accept != nil && m.Kind != transfer.KindPeers && m.Kind != transfer.KindList && m.Kind != transfer.KindGet {
+			return cfg.Accept(remoteAddr, m)
+		}
+		return nil
+	}
+	if cfg.OnText != nil {
+		opts.OnText = func(m *transfer.Manifest, text string) error { return cfg.OnText(remoteAddr, text) }
+	}
+	if cfg.Storage != nil {
+		opts.Storage = func(m *transfer.Manifest) (io.WriteCloser, error) { return cfg.Storage(remoteAddr, m) }
+	}
+	if cfg.OnPeers != nil {
+		opts.OnPeers = func(m *transfer.Manifest, sender *rsa.PublicKey, records []byte) ([]byte, error) {
+			return cfg.OnPeers(remoteAddr, sender, records)
+		}
+	}
+	if cfg.Destination != nil {
+		opts.Destination = func(m *transfer.Manifest) (string, error) { return cfg.Destination(remoteAddr, m) }
+	}
+	m, err := transfer.Receive(&transcriptConn{Conn: conn, transcript: handshakeTranscript(nonce, clientHash, reply, serverPubBytes)}, opts)
+	if cfg.OnReceived != nil {
+		defer cfg.OnReceived(err)
+	}
+	var transferID string
+	if m != nil {
+		transferID = m.TransferID
+		log = log.With("transfer_id", transferID)
+		audit.File, audit.TransferID = m.FileName, m.TransferID
+		if m.Sender != "" {
+			audit.Sender = m.Sender
+		}
+	}
+	auditErr = err
+	if err == nil {
+		audit.Outcome = AuditOK
+	}
+	if err != nil {
 		log.Error("File received failed", "error", err)
+		util.Emit(util.EventError, "stage", "receive", "remote", remoteAddr, "transfer_id", transferID, "error", err)
 	} else {
 		log.Info("File received successfully")
 	}
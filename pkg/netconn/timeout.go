@@ -0,0 +1,167 @@
+package netconn
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Timeouts: besides the connect timeout and the sender's wait for
+// acknowledgements, a transfer is bounded as a whole by TransferTimeout and
+// fails when a read or write on its connection makes no progress for
+// IdleTimeout. Both are enforced with deadlines on the connection, so a
+// stalled peer fails the blocked call instead of hanging it forever.
+
+// DefaultIdleTimeout is IdleTimeout unless configured otherwise
+const DefaultIdleTimeout = 5 * time.Minute
+
+var (
+	// TransferTimeout bounds each transfer from connecting to its final
+	// status; 0 is no limit
+	TransferTimeout time.Duration
+	// IdleTimeout is how long a read or write may wait for the peer; 0 is
+	// forever
+	IdleTimeout = DefaultIdleTimeout
+)
+
+var (
+	// ErrTransferTimeout is returned when a transfer runs past TransferTimeout
+	ErrTransferTimeout = errors.New("transfer timed out")
+	// ErrIdleTimeout is returned when the peer moved no data for IdleTimeout
+	ErrIdleTimeout = errors.New("connection idle")
+)
+
+// readWriteDeadliner is a connection whose reads and writes can be bounded,
+// like a net.Conn or a WebRTC data channel
+type readWriteDeadliner interface {
+	io.ReadWriter
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// timeouts enforces TransferTimeout and IdleTimeout on a connection. Before
+// each read or write it sets the earliest of the caller's own deadline for
+// it, the idle deadline and the end of the transfer.
+type timeouts struct {
+	rw    readWriteDeadliner
+	total time.Duration
+	end   time.Time // Zero for no limit
+	idle  time.Duration
+
+	mu            sync.Mutex
+	readDeadline  time.Time // As set by the caller
+	writeDeadline time.Time
+}
+
+func newTimeouts(rw readWriteDeadliner) *timeouts {
+	t := &timeouts{rw: rw, total: TransferTimeout, idle: IdleTimeout}
+	if t.total > 0 {
+		t.end = time.Now().Add(t.total)
+	}
+	return t
+}
+
+// deadline returns the earliest of set, the idle deadline and the end of the
+// transfer
+func (t *timeouts) deadline(set time.Time) time.Time {
+	d := set
+	earlier := func(o time.Time) {
+		if !o.IsZero() && (d.IsZero() || o.Before(d)) {
+			d = o
+		}
+	}
+	if t.idle > 0 {
+		earlier(time.Now().Add(t.idle))
+	}
+	earlier(t.end)
+	return d
+}
+
+// explain tells a timeout of ours apart from one of the caller's deadlines
+func (t *timeouts) explain(err error, set time.Time) error {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	now := time.Now()
+	switch {
+	case !set.IsZero() && !now.Before(set):
+		return err
+	case !t.end.IsZero() && !now.Before(t.end):
+		return fmt.Errorf("%w: not done after %s: %w", ErrTransferTimeout, t.total, err)
+	case t.idle > 0:
+		return fmt.Errorf("%w: nothing moved for %s: %w", ErrIdleTimeout, t.idle, err)
+	}
+	return err
+}
+
+func (t *timeouts) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	set := t.readDeadline
+	t.mu.Unlock()
+	t.rw.SetReadDeadline(t.deadline(set))
+	n, err := t.rw.Read(p)
+	return n, t.explain(err, set)
+}
+
+func (t *timeouts) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	set := t.writeDeadline
+	t.mu.Unlock()
+	t.rw.SetWriteDeadline(t.deadline(set))
+	n, err := t.rw.Write(p)
+	return n, t.explain(err, set)
+}
+
+func (t *timeouts) SetReadDeadline(d time.Time) error {
+	t.mu.Lock()
+	t.readDeadline = d
+	t.mu.Unlock()
+	return t.rw.SetReadDeadline(t.deadline(d))
+}
+
+func (t *timeouts) SetWriteDeadline(d time.Time) error {
+	t.mu.Lock()
+	t.writeDeadline = d
+	t.mu.Unlock()
+	return t.rw.SetWriteDeadline(t.deadline(d))
+}
+
+// timeoutConn is a net.Conn under TransferTimeout and IdleTimeout
+type timeoutConn struct {
+	net.Conn
+	*timeouts
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error)  { return c.timeouts.Read(p) }
+func (c *timeoutConn) Write(p []byte) (int, error) { return c.timeouts.Write(p) }
+
+func (c *timeoutConn) SetReadDeadline(d time.Time) error  { return c.timeouts.SetReadDeadline(d) }
+func (c *timeoutConn) SetWriteDeadline(d time.Time) error { return c.timeouts.SetWriteDeadline(d) }
+
+func (c *timeoutConn) SetDeadline(d time.Time) error {
+	c.timeouts.SetReadDeadline(d)
+	return c.timeouts.SetWriteDeadline(d)
+}
+
+// withTimeouts puts conn under TransferTimeout and IdleTimeout, if either
+// is set
+func withTimeouts(conn net.Conn) net.Conn {
+	if TransferTimeout <= 0 && IdleTimeout <= 0 {
+		return conn
+	}
+	return &timeoutConn{Conn: conn, timeouts: newTimeouts(conn)}
+}
+
+// withIdleTimeout puts a WebRTC data channel under IdleTimeout; the
+// transfer as a whole is bounded by WebRTCTimeout instead
+func withIdleTimeout(rw io.ReadWriter) io.ReadWriter {
+	d, ok := rw.(readWriteDeadliner)
+	if !ok || IdleTimeout <= 0 {
+		return rw
+	}
+	return &timeouts{rw: d, idle: IdleTimeout}
+}
@@ -0,0 +1,209 @@
+package netconn
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+	"golang.org/x/net/proxy"
+)
+
+// Tor: .onion addresses are always dialed through the local Tor SOCKS
+// port, which resolves them, and SetTor sends every other outgoing
+// connection there too, so the receiver never learns the sender's IP. A
+// receiver hides its own by publishing an onion service for its listener
+// through Tor's control port (PublishOnion). Either way the transfer
+// protocol runs unchanged on top, with its own encryption and passcode.
+
+const (
+	TorSOCKSEnv       = "P2P_TOR_SOCKS"    // Tor SOCKS address, if not DefaultTorSOCKS
+	TorControlEnv     = "P2P_TOR_CONTROL"  // Tor control port address, if not DefaultTorControl
+	TorPasswordEnv    = "P2P_TOR_PASSWORD" // Control port password, for HashedControlPassword
+	DefaultTorSOCKS   = "127.0.0.1:9050"
+	DefaultTorControl = "127.0.0.1:9051"
+)
+
+// TorDialTimeout bounds one attempt to connect through Tor, which builds a
+// circuit first; reaching an onion service often takes tens of seconds
+const TorDialTimeout = time.Minute
+
+// ErrTorUnavailable is returned when Tor's control port can't be used
+var ErrTorUnavailable = errors.New("tor unavailable")
+
+var torAll atomic.Bool
+
+// SetTor routes every outgoing TCP connection through Tor when on,
+// ignoring SetProxy and NO_PROXY
+func SetTor(on bool) {
+	torAll.Store(on)
+}
+
+// TorEnabled reports whether SetTor routes everything through Tor
+func TorEnabled() bool {
+	return torAll.Load()
+}
+
+// IsOnion reports whether host is an onion service address
+func IsOnion(host string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".onion")
+}
+
+// viaTor reports whether a connection to addr goes through Tor
+func viaTor(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return torAll.Load() || (err == nil && IsOnion(host))
+}
+
+// torAddr returns the address of Tor's SOCKS or control port
+func torAddr(env, def string) string {
+	if v := os.Getenv(env); v != "" {
+		return v
+	}
+	return def
+}
+
+// dialTor connects to addr through Tor's SOCKS port. Host names are passed
+// on for Tor to resolve, so DNS doesn't leak either.
+func dialTor(ctx context.Context, network, addr string) (net.Conn, error) {
+	socks := torAddr(TorSOCKSEnv, DefaultTorSOCKS)
+	d, err := proxy.SOCKS5("tcp", socks, nil, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTorUnavailable, err)
+	}
+	conn, err := d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("through Tor at %s (set %s): %w", socks, TorSOCKSEnv, err)
+	}
+	return conn, nil
+}
+
+// PublishOnion publishes an onion service forwarding virtPort to the
+// listener at local (host:port) through Tor's control port, and returns
+// its address as host:port. The service's key is kept in keyPath, or in ~/.p2p-client if
+// it is "", so the address stays the same across runs. The service is
+// withdrawn when ctx ends.
+func PublishOnion(ctx context.Context, local string, virtPort int, keyPath string) (string, error) {
+	if keyPath == "" {
+		dir, err := util.DataDir()
+		if err != nil {
+			return "", err
+		}
+		keyPath = filepath.Join(dir, "onion_key")
+	}
+	addr := torAddr(TorControlEnv, DefaultTorControl)
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("%w: no control port at %s (set %s): %w", ErrTorUnavailable, addr, TorControlEnv, err)
+	}
+	c := &torControl{conn: conn, r: bufio.NewReader(conn)}
+	if err := c.authenticate(); err != nil {
+		conn.Close()
+		return "", err
+	}
+
+	key := "NEW:ED25519-V3"
+	if b, err := os.ReadFile(keyPath); err == nil {
+		key = strings.TrimSpace(string(b))
+	}
+	reply, err := c.command(fmt.Sprintf("ADD_ONION %s Port=%d,%s", key, virtPort, local))
+	if err != nil {
+		conn.Close()
+		return "", fmt.Errorf("failed to publish onion service: %w", err)
+	}
+	if priv := reply["PrivateKey"]; priv != "" {
+		if err := os.WriteFile(keyPath, []byte(priv+"\n"), 0600); err != nil {
+			log.Warn("Failed to save onion service key; the address will change next run", "path", keyPath, "error", err)
+		}
+	}
+	id := reply["ServiceID"]
+	if id == "" {
+		conn.Close()
+		return "", errors.New("failed to publish onion service: tor returned no service ID")
+	}
+	// Tor removes the service when the control connection closes
+	context.AfterFunc(ctx, func() { conn.Close() })
+	return net.JoinHostPort(id+".onion", strconv.Itoa(virtPort)), nil
+}
+
+// torControl speaks Tor's control protocol
+type torControl struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// command sends cmd and returns the key=value pairs of a successful reply
+func (c *torControl) command(cmd string) (map[string]string, error) {
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", cmd); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, fmt.Errorf("malformed control reply %q", line)
+		}
+		code, sep, text := line[:3], line[3], line[4:]
+		if code != "250" {
+			return nil, fmt.Errorf("tor: %s %s", code, text)
+		}
+		// ServiceID=..., or PROTOCOLINFO's AUTH METHODS=... COOKIEFILE="..."
+		if i := strings.IndexAny(text, " ="); i > 0 {
+			values[text[:i]] = text[i+1:]
+		}
+		if sep == ' ' {
+			return values, nil
+		}
+	}
+}
+
+// authenticate logs in with no credentials, the auth cookie or
+// TorPasswordEnv, whichever Tor accepts
+func (c *torControl) authenticate() error {
+	info, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrTorUnavailable, err)
+	}
+	methods, cookieFile := "", ""
+	for _, field := range strings.Fields(info["AUTH"]) {
+		if v, ok := strings.CutPrefix(field, "METHODS="); ok {
+			methods = "," + v + ","
+		}
+		if v, ok := strings.CutPrefix(field, "COOKIEFILE="); ok {
+			cookieFile, _ = strconv.Unquote(v)
+		}
+	}
+	auth := "AUTHENTICATE"
+	switch password := os.Getenv(TorPasswordEnv); {
+	case strings.Contains(methods, ",NULL,"):
+	case password != "" && strings.Contains(methods, ",HASHEDPASSWORD,"):
+		auth += " " + strconv.Quote(password)
+	case cookieFile != "" && strings.Contains(methods, ",COOKIE,"):
+		cookie, err := os.ReadFile(cookieFile)
+		if err != nil {
+			return fmt.Errorf("%w: cannot read auth cookie: %w", ErrTorUnavailable, err)
+		}
+		auth += " " + hex.EncodeToString(cookie)
+	default:
+		return fmt.Errorf("%w: no usable control port authentication among %s (set %s for a password)", ErrTorUnavailable, strings.Trim(methods, ","), TorPasswordEnv)
+	}
+	if _, err := c.command(auth); err != nil {
+		return fmt.Errorf("%w: %w", ErrTorUnavailable, err)
+	}
+	return nil
+}
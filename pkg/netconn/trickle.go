@@ -0,0 +1,271 @@
+package netconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Signaler carries WebRTC signaling messages to the peer, in order and
+// authenticated, e.g. a rendezvous session. With one, each side sends its
+// description as soon as it is made and its ICE candidates as they are
+// gathered (trickle ICE), so the connection comes up with the first
+// candidate pair that works instead of after gathering has finished.
+type Signaler interface {
+	WriteSignal(v any) error
+	ReadSignal(v any) error
+}
+
+// ManualGatherTimeout bounds how long manual signaling waits for ICE
+// gathering before printing the description with the candidates found so
+// far
+var ManualGatherTimeout = 5 * time.Second
+
+var (
+	// errSignalingLost is returned when the signaling channel fails before
+	// the connection is up
+	errSignalingLost = errors.New("signaling failed")
+	// errWebRTCLost is returned when a WebRTC connection that was up breaks
+	errWebRTCLost = errors.New("WebRTC connection lost")
+	// errPeerRestarted is returned when the peer gives up on the current
+	// connection and signals a new one
+	errPeerRestarted = errors.New("peer started a new WebRTC connection")
+)
+
+// signalMessage is one trickle ICE message: a description, a candidate, or
+// the end of the sender's candidates. Attempt numbers the connections
+// signaled over the same channel, as a dropped one is replaced to resume.
+type signalMessage struct {
+	Attempt     int                      `json:"attempt,omitempty"`
+	Description *sdpBlob                 `json:"description,omitempty"`
+	Candidate   *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+	Done        bool                     `json:"done,omitempty"`
+}
+
+// signaling carries the messages of successive connection attempts over
+// sig. One goroutine reads sig for all of them, so an attempt can end while
+// a read is pending without the next attempt losing what it returns.
+type signaling struct {
+	sig  Signaler
+	mu   sync.Mutex // Serializes writes to sig
+	msgs chan signalMessage
+	err  error // Why reading stopped, set before msgs is closed
+	stop chan struct{}
+	next *signalMessage // Handed back by an attempt that ended on it
+}
+
+// newSignaling starts reading sig until it fails or close is called
+func newSignaling(sig Signaler) *signaling {
+	s := &signaling{sig: sig, msgs: make(chan signalMessage), stop: make(chan struct{})}
+	go func() {
+		defer close(s.msgs)
+		for {
+			var msg signalMessage
+			if err := sig.ReadSignal(&msg); err != nil {
+				s.err = err
+				return
+			}
+			select {
+			case s.msgs <- msg:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// close stops reading; sig itself is closed by its owner
+func (s *signaling) close() {
+	close(s.stop)
+}
+
+// write sends msg to the peer
+func (s *signaling) write(msg signalMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sig.WriteSignal(msg)
+}
+
+// receive returns the next message from the peer
+func (s *signaling) receive(ctx context.Context) (signalMessage, error) {
+	if s.next != nil {
+		msg := *s.next
+		s.next = nil
+		return msg, nil
+	}
+	select {
+	case msg, ok := <-s.msgs:
+		if !ok {
+			return msg, s.err
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return signalMessage{}, ctx.Err()
+	}
+}
+
+// trickle exchanges descriptions and candidates for pc, one connection
+// attempt, over a signaling channel
+type trickle struct {
+	pc      *webrtc.PeerConnection
+	s       *signaling
+	attempt atomic.Int32
+}
+
+// newTrickle starts sending pc's candidates over s as they are gathered,
+// tagged with attempt. It must be called before the local description is
+// set.
+func newTrickle(pc *webrtc.PeerConnection, s *signaling, attempt int) *trickle {
+	t := &trickle{pc: pc, s: s}
+	t.attempt.Store(int32(attempt))
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		msg := signalMessage{Done: true}
+		if c != nil {
+			init := c.ToJSON()
+			msg = signalMessage{Candidate: &init}
+		}
+		if err := t.write(msg); err != nil {
+			log.Debug("Failed to send ICE candidate", "error", err)
+		}
+	})
+	return t
+}
+
+// write sends msg to the peer as part of this attempt
+func (t *trickle) write(msg signalMessage) error {
+	msg.Attempt = int(t.attempt.Load())
+	return t.s.write(msg)
+}
+
+// sendDescription sends sd to the peer
+func (t *trickle) sendDescription(sd webrtc.SessionDescription) error {
+	if err := t.write(signalMessage{Description: &sdpBlob{Type: sd.Type, SDP: sd.SDP}}); err != nil {
+		return fmt.Errorf("failed to send %s: %w", sd.Type, err)
+	}
+	return nil
+}
+
+// run reads the peer's messages until ctx is done, passing its description
+// to onDescription. Candidates that arrive before the description are held
+// until it has been set, and messages left over from earlier attempts are
+// dropped. Before the description, run follows a peer that is already
+// further along; after it, a message from a later attempt ends run with
+// errPeerRestarted. Losing the signaling channel once the connection is up
+// is not an error.
+func (t *trickle) run(ctx context.Context, onDescription func(webrtc.SessionDescription) error) error {
+	var pending []webrtc.ICECandidateInit
+	var described bool
+	for {
+		msg, err := t.s.receive(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if s := t.pc.ICEConnectionState(); s == webrtc.ICEConnectionStateConnected || s == webrtc.ICEConnectionStateCompleted {
+				return nil
+			}
+			return fmt.Errorf("%w: %w", errSignalingLost, err)
+		}
+		attempt := int(t.attempt.Load())
+		switch {
+		case msg.Attempt < attempt:
+			continue
+		case msg.Attempt > attempt && described:
+			t.s.next = &msg
+			return errPeerRestarted
+		case msg.Attempt > attempt:
+			t.attempt.Store(int32(msg.Attempt))
+			pending = nil
+		}
+		switch {
+		case msg.Description != nil:
+			if err := onDescription(webrtc.SessionDescription{Type: msg.Description.Type, SDP: msg.Description.SDP}); err != nil {
+				return err
+			}
+			described = true
+			for _, c := range pending {
+				t.addCandidate(c)
+			}
+			pending = nil
+		case msg.Candidate != nil:
+			if !described {
+				pending = append(pending, *msg.Candidate)
+				continue
+			}
+			t.addCandidate(*msg.Candidate)
+		case msg.Done:
+			log.Debug("Peer finished sending ICE candidates")
+		}
+	}
+}
+
+// start runs t in the background until the returned func is called, which
+// waits for it to stop. A failure is reported on done.
+func (t *trickle) start(ctx context.Context, done chan<- error, onDescription func(webrtc.SessionDescription) error) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := t.run(ctx, onDescription); err != nil {
+			report(done, err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// addCandidate adds a remote candidate; one that can't be used is skipped
+func (t *trickle) addCandidate(c webrtc.ICECandidateInit) {
+	if err := t.pc.AddICECandidate(c); err != nil {
+		log.Debug("Ignoring remote ICE candidate", "candidate", c.Candidate, "error", err)
+	}
+}
+
+// gatherWait waits for pc to finish gathering ICE candidates, or at most
+// ManualGatherTimeout
+func gatherWait(pc *webrtc.PeerConnection) {
+	select {
+	case <-webrtc.GatheringCompletePromise(pc):
+	case <-time.After(ManualGatherTimeout):
+		log.Debug("ICE gathering still running; using the candidates found so far")
+	}
+}
+
+// report passes the outcome of a connection attempt on done, unless one is
+// there already
+func report(done chan<- error, err error) {
+	select {
+	case done <- err:
+	default:
+	}
+}
+
+// watchICE logs pc's ICE connection state and reports on done a connection
+// that can't be made, or that broke after it was made
+func watchICE(pc *webrtc.PeerConnection, done chan<- error) {
+	start := time.Now()
+	var connected atomic.Bool
+	pc.OnICEConnectionStateChange(func(s webrtc.ICEConnectionState) {
+		log.Debug("ICE connection state changed", "state", s.String())
+		switch s {
+		case webrtc.ICEConnectionStateConnected:
+			if !connected.Swap(true) {
+				log.Info("WebRTC connected", "took", time.Since(start).Round(time.Millisecond).String())
+			}
+		case webrtc.ICEConnectionStateFailed:
+			if connected.Load() {
+				report(done, fmt.Errorf("%w: ICE failed", errWebRTCLost))
+				return
+			}
+			report(done, fmt.Errorf("%w: no WebRTC candidate pair worked", ErrPeerUnreachable))
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package netconn
+
+import (
+	"net"
+	"time"
+)
+
+// Tuning: TCP connections, dialed or accepted, get the socket options in
+// DefaultTCPTuning before the handshake. The operating system's buffer
+// sizes cap throughput on paths with a large bandwidth-delay product, such
+// as a fast link across continents, so they can be raised; keepalives let
+// either end notice a peer that vanished without closing the connection.
+// Connections of other transports, and those through a proxy that hides
+// the socket, are left as they are.
+
+// TCPTuning holds the socket options set on TCP connections
+type TCPTuning struct {
+	NoDelay           bool          // Send small writes at once rather than coalescing them (TCP_NODELAY)
+	SendBuffer        int           // SO_SNDBUF in bytes, 0 for the system default
+	RecvBuffer        int           // SO_RCVBUF in bytes, 0 for the system default
+	KeepAlive         time.Duration // Idle time before the first keepalive probe, negative to disable
+	KeepAliveInterval time.Duration // Time between unanswered probes
+	KeepAliveCount    int           // Unanswered probes before the connection is dropped
+}
+
+// DefaultTCPTuning is applied to every TCP connection; the CLI sets it
+// from its flags. A buffer size set explicitly turns off the system's
+// automatic sizing, which on most systems grows past the default as needed.
+var DefaultTCPTuning = TCPTuning{
+	NoDelay:           true,
+	KeepAlive:         30 * time.Second,
+	KeepAliveInterval: 15 * time.Second,
+	KeepAliveCount:    4,
+}
+
+// tune sets DefaultTCPTuning on conn if it is a TCP connection. Failures
+// leave the system's settings in place.
+func tune(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	t := DefaultTCPTuning
+	if err := tc.SetNoDelay(t.NoDelay); err != nil {
+		log.Debug("Failed to set TCP_NODELAY", "error", err)
+	}
+	if t.SendBuffer > 0 {
+		if err := tc.SetWriteBuffer(t.SendBuffer); err != nil {
+			log.Debug("Failed to set send buffer", "size", t.SendBuffer, "error", err)
+		}
+	}
+	if t.RecvBuffer > 0 {
+		if err := tc.SetReadBuffer(t.RecvBuffer); err != nil {
+			log.Debug("Failed to set receive buffer", "size", t.RecvBuffer, "error", err)
+		}
+	}
+	ka := net.KeepAliveConfig{Enable: t.KeepAlive >= 0, Idle: t.KeepAlive, Interval: t.KeepAliveInterval, Count: t.KeepAliveCount}
+	if err := tc.SetKeepAliveConfig(ka); err != nil {
+		log.Debug("Failed to set TCP keepalive", "error", err)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -17,6 +19,134 @@ import (
 	"github.com/udit2303/p2p-client/pkg/util"
 )
 
+// TURNServers are TURN relays added to the WebRTC ICE configuration, as
+// turn:user:pass@host:port?transport=tcp. TURN over TCP is the one ICE path
+// that can go through the proxy (see SetProxy), for networks that block UDP.
+var TURNServers []string
+
+// WebRTCTimeout is how long a WebRTC transfer may take, from the end of
+// signaling until the file is through
+var WebRTCTimeout = 30 * time.Minute
+
+// WebRTCRetries is how many times a WebRTC send whose connection drops
+// signals a new one and resumes. It takes a Signaler to reconnect, so a
+// send signaled by copy and paste is never retried.
+var WebRTCRetries = 3
+
+// newWebRTCAPI returns an API with detached data channels whose TURN
+// connections use the outgoing proxy
+func newWebRTCAPI() *webrtc.API {
+	se := webrtc.SettingEngine{}
+	se.DetachDataChannels()
+	se.SetICEProxyDialer(ProxyDialer())
+	return webrtc.NewAPI(webrtc.WithSettingEngine(se))
+}
+
+// iceServers returns util.STUNServers followed by TURNServers
+func iceServers() ([]webrtc.ICEServer, error) {
+	var servers []webrtc.ICEServer
+	for _, s := range util.STUNServers {
+		servers = append(servers, webrtc.ICEServer{URLs: []string{"stun:" + s}})
+	}
+	for _, t := range TURNServers {
+		scheme, rest, ok := strings.Cut(t, ":")
+		if !ok || (scheme != "turn" && scheme != "turns") {
+			return nil, fmt.Errorf("invalid TURN server %q, expected turn:[user:pass@]host:port", t)
+		}
+		server := webrtc.ICEServer{URLs: []string{t}}
+		if creds, host, ok := strings.Cut(rest, "@"); ok {
+			user, pass, _ := strings.Cut(creds, ":")
+			server = webrtc.ICEServer{URLs: []string{scheme + ":" + host}, Username: user, Credential: pass}
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// maxMessageSize is the largest data channel message a read must hold,
+// well above the 64 KiB SCTP default
+const maxMessageSize = 1 << 20
+
+// messageStream reads a detached data channel as a byte stream. A read of
+// the channel returns one whole message and fails if p is too small for
+// it, so reads go through a buffer that can hold the largest message.
+type messageStream struct {
+	*bufio.Reader
+	io.Writer
+}
+
+func newMessageStream(rw io.ReadWriter) *messageStream {
+	return &messageStream{Reader: bufio.NewReaderSize(rw, maxMessageSize), Writer: rw}
+}
+
+// maxWriteMessage is the largest message written: the 64 KiB a peer takes
+// unless its description allows more
+const maxWriteMessage = 64 << 10
+
+// Write sends p as messages of at most maxWriteMessage, which the reading
+// side joins back into a stream
+func (s *messageStream) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		k := min(len(p), maxWriteMessage)
+		w, err := s.Writer.Write(p[:k])
+		n += w
+		if err != nil {
+			return n, err
+		}
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// Backpressure: a detached data channel queues whatever is written to it
+// in its SCTP send buffer, without limit, so a sender faster than the path
+// would hold much of a large file in memory. Writes wait while more than
+// maxBufferedAmount is queued, until the channel drains to
+// bufferedAmountLow; progress then follows what actually left.
+const (
+	maxBufferedAmount = 4 << 20
+	bufferedAmountLow = 1 << 20
+)
+
+// flowControl is a data channel whose writes wait while too much of what
+// was written before is still queued
+type flowControl struct {
+	io.ReadWriter
+	dc  *webrtc.DataChannel
+	low chan struct{}
+}
+
+// withBackpressure bounds what is queued on dc, which rw writes to
+func withBackpressure(dc *webrtc.DataChannel, rw io.ReadWriter) io.ReadWriter {
+	f := &flowControl{ReadWriter: rw, dc: dc, low: make(chan struct{}, 1)}
+	dc.SetBufferedAmountLowThreshold(bufferedAmountLow)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case f.low <- struct{}{}:
+		default:
+		}
+	})
+	return f
+}
+
+func (f *flowControl) Write(p []byte) (int, error) {
+	start := time.Now()
+	for f.dc.BufferedAmount() > maxBufferedAmount {
+		if f.dc.ReadyState() != webrtc.DataChannelStateOpen {
+			return 0, fmt.Errorf("%w: data channel closed", errWebRTCLost)
+		}
+		if IdleTimeout > 0 && time.Since(start) > IdleTimeout {
+			return 0, fmt.Errorf("%w: nothing drained for %s: %w", ErrIdleTimeout, IdleTimeout, os.ErrDeadlineExceeded)
+		}
+		select {
+		case <-f.low:
+		case <-time.After(time.Second):
+		}
+	}
+	return f.ReadWriter.Write(p)
+}
+
 // sdpBlob is a simplified container for manual signaling
 type sdpBlob struct {
 	Type webrtc.SDPType `json:"type"`
@@ -45,19 +175,57 @@ func decodeSDP(s string) (webrtc.SessionDescription, error) {
 }
 
 // StartWebRTCSender starts a WebRTC sender that sends a file to a receiver over a reliable data channel.
-// Manual copy-paste signaling is used. The receiver must paste the OFFER and return an ANSWER.
-func StartWebRTCSender(filePath string) error {
+// With a nil sig, manual copy-paste signaling is used: the receiver must paste the OFFER and return an ANSWER.
+// Otherwise the offer, answer and ICE candidates are trickled over sig, and a connection that drops is
+// signaled again over it, up to WebRTCRetries times, resuming where the last one broke off.
+func StartWebRTCSender(filePath string, sig Signaler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), WebRTCTimeout)
+	defer cancel()
+	if sig == nil {
+		return webrtcSend(ctx, filePath, nil, 0)
+	}
+
+	// Every attempt sends under the same ID, so the receiver resumes where
+	// the last one broke off
+	if transfer.DefaultSendOptions.TransferID == "" {
+		transfer.DefaultSendOptions.TransferID = transfer.NewTransferID()
+		defer func() { transfer.DefaultSendOptions.TransferID = "" }()
+	}
+	s := newSignaling(sig)
+	defer s.close()
+	for attempt := 0; ; attempt++ {
+		err := webrtcSend(ctx, filePath, s, attempt)
+		if err == nil || attempt >= WebRTCRetries || !reconnectable(err, attempt) {
+			return err
+		}
+		log.Warn("WebRTC connection lost, reconnecting to resume", "attempt", attempt+2, "of", WebRTCRetries+1, "error", err)
+	}
+}
+
+// reconnectable reports whether a WebRTC transfer that failed with err on
+// attempt may be resumed over a new connection. As over TCP, a peer that
+// can't be reached at first isn't waited for, but after a drop it may take
+// a while to reappear.
+func reconnectable(err error, attempt int) bool {
+	if errors.Is(err, errSignalingLost) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return IsConnectionLost(err) || errors.Is(err, errPeerRestarted) || (attempt > 0 && errors.Is(err, ErrPeerUnreachable))
+}
+
+// webrtcSend makes one attempt at sending filePath over a new WebRTC
+// connection, signaled over s or by copy and paste if s is nil
+func webrtcSend(ctx context.Context, filePath string, s *signaling, attempt int) error {
+	out := util.ConsoleOutput()
+
 	// Enable Detach to get io.ReadWriteCloser
-	se := webrtc.SettingEngine{}
-	se.DetachDataChannels()
-	api := webrtc.NewAPI(webrtc.WithSettingEngine(se))
+	api := newWebRTCAPI()
 
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
+	servers, err := iceServers()
+	if err != nil {
+		return err
 	}
-	pc, err := api.NewPeerConnection(config)
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICEServers: servers})
 	if err != nil {
 		return err
 	}
@@ -70,167 +238,232 @@ func StartWebRTCSender(filePath string) error {
 	}
 
 	done := make(chan error, 1)
+	watchICE(pc, done)
 
 	dc.OnOpen(func() {
 		log.Info("WebRTC data channel open; waiting for receiver public key")
-		rw, err := dc.Detach()
+		detached, err := dc.Detach()
 		if err != nil {
-			done <- fmt.Errorf("detach failed: %w", err)
+			report(done, fmt.Errorf("detach failed: %w", err))
 			return
 		}
+		rw := newMessageStream(withBackpressure(dc, withIdleTimeout(detached)))
 		go func() {
 			// Read receiver's public key (length-prefixed)
 			rpubBytes, rerr := util.ReadWithLength(rw)
 			if rerr != nil {
-				done <- fmt.Errorf("failed to read receiver pub key: %w", rerr)
+				report(done, fmt.Errorf("failed to read receiver pub key: %w", rerr))
 				return
 			}
 			rpub, perr := x509.ParsePKCS1PublicKey(rpubBytes)
 			if perr != nil {
-				done <- fmt.Errorf("failed to parse receiver pub key: %w", perr)
+				report(done, fmt.Errorf("failed to parse receiver pub key: %w", perr))
 				return
 			}
 			// Send the file using our existing pipeline
 			if err := transfer.SendFile(rw, filePath, rpub); err != nil {
-				done <- err
+				report(done, err)
 				return
 			}
 			log.Info("WebRTC file transfer finished")
-			done <- nil
+			report(done, nil)
 		}()
 	})
 
-	// Create offer and gather ICE
-	offer, err := pc.CreateOffer(nil)
-	if err != nil {
-		return err
-	}
-	if err := pc.SetLocalDescription(offer); err != nil {
-		return err
-	}
-	<-webrtc.GatheringCompletePromise(pc)
+	if s != nil {
+		t := newTrickle(pc, s, attempt)
+		offer, err := pc.CreateOffer(nil)
+		if err != nil {
+			return err
+		}
+		if err := pc.SetLocalDescription(offer); err != nil {
+			return err
+		}
+		if err := t.sendDescription(offer); err != nil {
+			return err
+		}
+		stop := t.start(ctx, done, func(ans webrtc.SessionDescription) error {
+			if err := pc.SetRemoteDescription(ans); err != nil {
+				return fmt.Errorf("set remote failed: %w", err)
+			}
+			return nil
+		})
+		defer stop()
+	} else {
+		// Create offer and gather ICE
+		offer, err := pc.CreateOffer(nil)
+		if err != nil {
+			return err
+		}
+		if err := pc.SetLocalDescription(offer); err != nil {
+			return err
+		}
+		gatherWait(pc)
 
-	enc, err := encodeSDP(*pc.LocalDescription())
-	if err != nil {
-		return err
-	}
-	fmt.Println("--- BEGIN WEBRTC OFFER ---")
-	fmt.Println(enc)
-	fmt.Println("--- END WEBRTC OFFER ---")
-	fmt.Print("Paste remote ANSWER and press Enter: ")
-	ansLine, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-	ans, err := decodeSDP(ansLine)
-	if err != nil {
-		return fmt.Errorf("failed to decode answer: %w", err)
-	}
-	if err := pc.SetRemoteDescription(ans); err != nil {
-		return fmt.Errorf("set remote failed: %w", err)
+		enc, err := encodeSDP(*pc.LocalDescription())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "--- BEGIN WEBRTC OFFER ---")
+		fmt.Fprintln(out, enc)
+		fmt.Fprintln(out, "--- END WEBRTC OFFER ---")
+		fmt.Fprint(out, "Paste remote ANSWER and press Enter: ")
+		ansLine, err := readLine()
+		if err != nil {
+			return fmt.Errorf("failed to read answer: %w", err)
+		}
+		ans, err := decodeSDP(ansLine)
+		if err != nil {
+			return fmt.Errorf("failed to decode answer: %w", err)
+		}
+		if err := pc.SetRemoteDescription(ans); err != nil {
+			return fmt.Errorf("set remote failed: %w", err)
+		}
 	}
 
-	// Add a local ICE candidate manually
-	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate != nil {
-			fmt.Printf("ICE Candidate: %s\n", candidate.ToJSON().Candidate)
-		}
-	})
+	return waitWebRTC(ctx, done)
+}
 
-	// Wait for completion
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
-	defer cancel()
+// waitWebRTC waits for the outcome of a WebRTC transfer on done
+func waitWebRTC(ctx context.Context, done <-chan error) error {
 	select {
 	case err := <-done:
 		return err
 	case <-ctx.Done():
-		return ctx.Err()
+		return fmt.Errorf("WebRTC transfer not done after %s: %w", WebRTCTimeout, ctx.Err())
 	}
 }
 
 // StartWebRTCReceiver starts a WebRTC receiver that accepts a file over a reliable data channel.
-// It prints an ANSWER to paste back to the sender.
-func StartWebRTCReceiver(outputDir string) error {
-	se := webrtc.SettingEngine{}
-	se.DetachDataChannels()
-	api := webrtc.NewAPI(webrtc.WithSettingEngine(se))
+// With a nil sig it prints an ANSWER to paste back to the sender; otherwise the offer, answer and ICE
+// candidates are trickled over sig, and when the connection drops the receiver waits on sig for the
+// sender to signal a new one and resume.
+func StartWebRTCReceiver(outputDir string, sig Signaler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), WebRTCTimeout)
+	defer cancel()
+	if sig == nil {
+		return webrtcReceive(ctx, outputDir, nil, 0)
+	}
 
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-			{URLs: []string{"stun:stun1.l.google.com:19302"}},
-			{URLs: []string{"stun:stun.stunprotocol.org:3478"}},
-			{URLs: []string{"stun:stun.cloudflare.com:3478"}},
-		},
+	s := newSignaling(sig)
+	defer s.close()
+	for attempt := 0; ; attempt++ {
+		err := webrtcReceive(ctx, outputDir, s, attempt)
+		if err == nil || !reconnectable(err, attempt) {
+			return err
+		}
+		log.Warn("WebRTC connection lost, waiting for the sender to reconnect", "error", err)
+	}
+}
+
+// webrtcReceive makes one attempt at receiving a file into outputDir over a
+// new WebRTC connection, signaled over s or by copy and paste if s is nil
+func webrtcReceive(ctx context.Context, outputDir string, s *signaling, attempt int) error {
+	out := util.ConsoleOutput()
+
+	api := newWebRTCAPI()
+
+	servers, err := iceServers()
+	if err != nil {
+		return err
 	}
-	pc, err := api.NewPeerConnection(config)
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICEServers: servers})
 	if err != nil {
 		return err
 	}
 	defer pc.Close()
 
 	done := make(chan error, 1)
+	watchICE(pc, done)
 
 	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
 		dc.OnOpen(func() {
 			log.Info("WebRTC data channel open; sending receiver public key and awaiting file")
-			rw, err := dc.Detach()
+			detached, err := dc.Detach()
 			if err != nil {
-				done <- fmt.Errorf("detach failed: %w", err)
+				report(done, fmt.Errorf("detach failed: %w", err))
 				return
 			}
+			rw := newMessageStream(withBackpressure(dc, withIdleTimeout(detached)))
 			go func() {
 				// Load and send our public key so sender can encrypt a session key
 				pub, kerr := keys.LoadPublicKey()
 				if kerr != nil {
-					done <- fmt.Errorf("failed to load public key: %w", kerr)
+					report(done, fmt.Errorf("failed to load public key: %w", kerr))
 					return
 				}
 				pubBytes := x509.MarshalPKCS1PublicKey(pub)
 				if err := util.SendWithLength(rw, pubBytes); err != nil {
-					done <- fmt.Errorf("failed to send public key: %w", err)
+					report(done, fmt.Errorf("failed to send public key: %w", err))
 					return
 				}
 				if err := transfer.ReceiveFile(rw, outputDir); err != nil {
-					done <- err
+					report(done, err)
 					return
 				}
+				// Closing the connection drops what SCTP hasn't delivered
+				// yet, so let the sender read the final status and hang up
+				hungUp := make(chan struct{})
+				go func() {
+					io.Copy(io.Discard, rw)
+					close(hungUp)
+				}()
+				select {
+				case <-hungUp:
+				case <-time.After(5 * time.Second):
+				}
 				log.Info("WebRTC file received successfully")
-				done <- nil
+				report(done, nil)
 			}()
 		})
 	})
 
-	fmt.Print("Paste remote OFFER and press Enter: ")
-	offerLine, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-	offer, err := decodeSDP(offerLine)
-	if err != nil {
-		return fmt.Errorf("failed to decode offer: %w", err)
-	}
-	if err := pc.SetRemoteDescription(offer); err != nil {
-		return fmt.Errorf("set remote failed: %w", err)
-	}
-	answer, err := pc.CreateAnswer(nil)
-	if err != nil {
-		return err
-	}
-	if err := pc.SetLocalDescription(answer); err != nil {
-		return err
-	}
-	<-webrtc.GatheringCompletePromise(pc)
+	if s != nil {
+		t := newTrickle(pc, s, attempt)
+		stop := t.start(ctx, done, func(offer webrtc.SessionDescription) error {
+			if err := pc.SetRemoteDescription(offer); err != nil {
+				return fmt.Errorf("set remote failed: %w", err)
+			}
+			answer, err := pc.CreateAnswer(nil)
+			if err != nil {
+				return err
+			}
+			if err := pc.SetLocalDescription(answer); err != nil {
+				return err
+			}
+			return t.sendDescription(answer)
+		})
+		defer stop()
+	} else {
+		fmt.Fprint(out, "Paste remote OFFER and press Enter: ")
+		offerLine, err := readLine()
+		if err != nil {
+			return fmt.Errorf("failed to read offer: %w", err)
+		}
+		offer, err := decodeSDP(offerLine)
+		if err != nil {
+			return fmt.Errorf("failed to decode offer: %w", err)
+		}
+		if err := pc.SetRemoteDescription(offer); err != nil {
+			return fmt.Errorf("set remote failed: %w", err)
+		}
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			return err
+		}
+		if err := pc.SetLocalDescription(answer); err != nil {
+			return err
+		}
+		gatherWait(pc)
 
-	enc, err := encodeSDP(*pc.LocalDescription())
-	if err != nil {
-		return err
+		enc, err := encodeSDP(*pc.LocalDescription())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "--- BEGIN WEBRTC ANSWER ---")
+		fmt.Fprintln(out, enc)
+		fmt.Fprintln(out, "--- END WEBRTC ANSWER ---")
 	}
-	fmt.Println("--- BEGIN WEBRTC ANSWER ---")
-	fmt.Println(enc)
-	fmt.Println("--- END WEBRTC ANSWER ---")
 
-	// Wait for completion
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
-	defer cancel()
-	select {
-	case err := <-done:
-		return err
-	case <-ctx.Done():
-		return ctx.Err()
-	}
+	return waitWebRTC(ctx, done)
 }
@@ -0,0 +1,350 @@
+// Package objstore streams received files into S3-compatible object
+// storage: Amazon S3, MinIO and other S3-compatible servers, and Google
+// Cloud Storage through its XML API with HMAC keys. It speaks the REST API
+// directly, signing requests with AWS Signature Version 4.
+//
+// A file is uploaded as it arrives, in parts of at least 16 MiB, so only
+// one part is held in memory. Nothing is visible in the bucket until the
+// object is closed, and an aborted object leaves nothing behind.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	minPartSize = 16 << 20 // Parts uploaded, but for the last
+	maxParts    = 10000    // Parts one object may have
+	maxAttempts = 3        // Tries per request before giving up
+)
+
+// ErrNoCredentials is returned by Open when the credentials aren't set
+var ErrNoCredentials = errors.New("storage credentials missing: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+
+// ErrObjectTooLarge is returned for a file with more data than fits in the
+// parts an object may have
+var ErrObjectTooLarge = errors.New("object too large")
+
+// Store is a bucket, and a key prefix in it, that files are stored under
+type Store struct {
+	URL string // As configured
+
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	pathStyle bool // Bucket in the path rather than the host name
+	creds     credentials
+	client    *http.Client
+}
+
+// Open parses a storage URL:
+//
+//	s3://bucket/prefix  Amazon S3, or the S3-compatible server at endpoint
+//	gs://bucket/prefix  Google Cloud Storage
+//
+// Query parameters set the endpoint (e.g. http://localhost:9000 for
+// MinIO, default $AWS_ENDPOINT_URL) and region (default $AWS_REGION, else
+// us-east-1). Credentials, HMAC keys for Cloud Storage, are read from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN; without
+// them the store is returned along with ErrNoCredentials, so the URL can
+// still be checked.
+func Open(raw string) (*Store, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid storage URL %q: no bucket", raw)
+	}
+	s := &Store{
+		URL:    raw,
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		region: u.Query().Get("region"),
+		creds: credentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		client: &http.Client{Timeout: 10 * time.Minute},
+	}
+	endpoint := u.Query().Get("endpoint")
+	switch u.Scheme {
+	case "s3":
+		if endpoint == "" {
+			endpoint = os.Getenv("AWS_ENDPOINT_URL")
+		}
+		if s.region == "" {
+			s.region = os.Getenv("AWS_REGION")
+		}
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		if endpoint == "" {
+			// Amazon S3 itself addresses buckets by host name
+			endpoint = "https://s3." + s.region + ".amazonaws.com"
+		} else {
+			s.pathStyle = true
+		}
+	case "gs":
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+		if s.region == "" {
+			s.region = "auto"
+		}
+		s.pathStyle = true
+	default:
+		return nil, fmt.Errorf("invalid storage URL %q: scheme must be s3 or gs", raw)
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid storage endpoint %q", endpoint)
+	}
+	if s.creds.accessKey == "" || s.creds.secretKey == "" {
+		return s, ErrNoCredentials
+	}
+	return s, nil
+}
+
+// Check makes sure the bucket exists and the credentials can reach it
+func (s *Store) Check(ctx context.Context) error {
+	resp, err := s.do(ctx, http.MethodHead, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Key returns the object key a file called name is stored under
+func (s *Store) Key(name string) string {
+	return path.Join(s.prefix, path.Base(name))
+}
+
+// Create starts storing the file called name, of size bytes or -1 if
+// unknown. Data written to the object is uploaded as it comes; Close
+// keeps the object and Abort discards it.
+func (s *Store) Create(name string, size int64) *Object {
+	partSize := int64(minPartSize)
+	if size > 0 && (size+maxParts-1)/maxParts > partSize {
+		// Round up to whole MiB
+		partSize = ((size+maxParts-1)/maxParts + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+	return &Object{s: s, key: s.Key(name), partSize: int(partSize)}
+}
+
+// Object is a file being uploaded
+type Object struct {
+	s        *Store
+	key      string
+	partSize int
+	buf      []byte
+	uploadID string // Set once a multipart upload has started
+	parts    []completedPart
+	err      error // Sticky error from an upload
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// Write buffers p and uploads every part it fills
+func (o *Object) Write(p []byte) (int, error) {
+	if o.err != nil {
+		return 0, o.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), o.partSize-len(o.buf))
+		o.buf = append(o.buf, p[:n]...)
+		p, written = p[n:], written+n
+		if len(o.buf) == o.partSize {
+			if o.err = o.uploadPart(); o.err != nil {
+				return written, o.err
+			}
+		}
+	}
+	return written, nil
+}
+
+// uploadPart uploads the buffered data as the next part, starting the
+// multipart upload on the first
+func (o *Object) uploadPart() error {
+	ctx := context.Background()
+	if o.uploadID == "" {
+		resp, err := o.s.do(ctx, http.MethodPost, o.key, map[string]string{"uploads": ""}, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || result.UploadID == "" {
+			return fmt.Errorf("failed to start upload of %s: no upload id", o.key)
+		}
+		o.uploadID = result.UploadID
+	}
+	if len(o.parts) == maxParts {
+		return fmt.Errorf("%w: %s has more than %d parts of %d bytes", ErrObjectTooLarge, o.key, maxParts, o.partSize)
+	}
+	number := len(o.parts) + 1
+	resp, err := o.s.do(ctx, http.MethodPut, o.key, map[string]string{
+		"partNumber": strconv.Itoa(number),
+		"uploadId":   o.uploadID,
+	}, o.buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	o.parts = append(o.parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	o.buf = o.buf[:0]
+	return nil
+}
+
+// Close uploads what is left and completes the object, making it visible
+func (o *Object) Close() error {
+	if o.err != nil {
+		o.Abort()
+		return o.err
+	}
+	ctx := context.Background()
+	if o.uploadID == "" {
+		// A file smaller than a part is put in one go
+		resp, err := o.s.do(ctx, http.MethodPut, o.key, nil, o.buf)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if len(o.buf) > 0 {
+		if err := o.uploadPart(); err != nil {
+			o.Abort()
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: o.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := o.s.do(ctx, http.MethodPost, o.key, map[string]string{"uploadId": o.uploadID}, body)
+	if err != nil {
+		o.Abort()
+		return err
+	}
+	defer resp.Body.Close()
+	// Completing may fail after the response has started, reported in its
+	// body rather than its status
+	reply, _ := io.ReadAll(resp.Body)
+	if err := parseError(reply); err != nil {
+		o.Abort()
+		return fmt.Errorf("failed to complete %s: %w", o.key, err)
+	}
+	return nil
+}
+
+// Abort discards the object and any parts already uploaded
+func (o *Object) Abort() error {
+	o.buf = nil
+	if o.uploadID == "" {
+		return nil
+	}
+	resp, err := o.s.do(context.Background(), http.MethodDelete, o.key, map[string]string{"uploadId": o.uploadID}, nil)
+	o.uploadID = ""
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Location returns the object's URL, for logs
+func (o *Object) Location() string {
+	scheme, _, _ := strings.Cut(o.s.URL, ":")
+	return scheme + "://" + o.s.bucket + "/" + o.key
+}
+
+// do sends a signed request for key, "" for the bucket itself, retrying
+// on network errors and server failures. Error responses are returned as
+// errors.
+func (s *Store) do(ctx context.Context, method, key string, query map[string]string, body []byte) (*http.Response, error) {
+	host, uri := s.endpoint.Host, "/"+escape(key, true)
+	if s.pathStyle {
+		uri = "/" + escape(s.bucket, false) + strings.TrimSuffix(uri, "/")
+	} else {
+		host = s.bucket + "." + host
+	}
+	rawQuery := canonicalQuery(query)
+	payloadHash := hashHex(body)
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, method, s.endpoint.Scheme+"://"+host, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.URL.Opaque = uri
+		req.URL.RawQuery = rawQuery
+		req.ContentLength = int64(len(body))
+		s.creds.sign(req, uri, rawQuery, s.region, payloadHash, time.Now())
+		resp, err := s.client.Do(req)
+		if err != nil {
+			lastErr = fmt.Errorf("storage request failed: %w", err)
+			continue
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		lastErr = parseError(reply)
+		if lastErr == nil {
+			lastErr = errors.New(resp.Status)
+		}
+		lastErr = fmt.Errorf("storage %s %s: %w", method, path.Join(s.bucket, key), lastErr)
+		if resp.StatusCode < 500 {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// parseError returns the error an S3 error document describes, or nil if
+// reply isn't one
+func parseError(reply []byte) error {
+	var e struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}
+	if xml.Unmarshal(reply, &e) != nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", e.Code, e.Message)
+}
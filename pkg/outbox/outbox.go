@@ -0,0 +1,160 @@
+// Package outbox watches a directory and hands every file dropped into it to
+// a send function, moving it to a "sent" subdirectory once delivered.
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+var (
+	log = util.DefaultLogger()
+)
+
+// Config controls a watched outbox
+type Config struct {
+	Dir     string                                       // Directory to watch
+	SentDir string                                       // Where delivered files are moved (default Dir/sent)
+	Settle  time.Duration                                // How long a file must be unchanged before it is sent (default 2s)
+	Retry   time.Duration                                // How long to wait before retrying a failed send (default 30s)
+	Send    func(ctx context.Context, path string) error // Delivers one file
+}
+
+// Watch sends files appearing in cfg.Dir until ctx is cancelled. Files
+// already present when it starts are sent too.
+func Watch(ctx context.Context, cfg Config) error {
+	if cfg.Send == nil {
+		return errors.New("outbox: no send function")
+	}
+	if cfg.SentDir == "" {
+		cfg.SentDir = filepath.Join(cfg.Dir, "sent")
+	}
+	if cfg.Settle <= 0 {
+		cfg.Settle = 2 * time.Second
+	}
+	if cfg.Retry <= 0 {
+		cfg.Retry = 30 * time.Second
+	}
+	if err := os.MkdirAll(cfg.SentDir, 0755); err != nil {
+		return fmt.Errorf("failed to create sent directory: %w", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(cfg.Dir); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", cfg.Dir, err)
+	}
+	log.Info("Watching outbox", "dir", cfg.Dir, "sent", cfg.SentDir)
+
+	// pending maps a path to the time it becomes eligible for sending
+	pending := map[string]time.Time{}
+	scan := func(delay time.Duration) {
+		entries, err := os.ReadDir(cfg.Dir)
+		if err != nil {
+			log.Warn("Failed to scan outbox", "error", err)
+			return
+		}
+		for _, e := range entries {
+			if path := filepath.Join(cfg.Dir, e.Name()); eligible(path) {
+				if _, ok := pending[path]; !ok {
+					pending[path] = time.Now().Add(delay)
+				}
+			}
+		}
+	}
+	scan(cfg.Settle)
+
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	rescan := time.NewTicker(cfg.Retry)
+	defer rescan.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warn("Outbox watcher error", "error", err)
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// Any change restarts the settle timer, so files still being
+			// written or copied aren't sent half-finished
+			if ev.Has(fsnotify.Create) || ev.Has(fsnotify.Write) || ev.Has(fsnotify.Chmod) {
+				if eligible(ev.Name) {
+					pending[ev.Name] = time.Now().Add(cfg.Settle)
+				}
+			}
+			if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+				delete(pending, ev.Name)
+			}
+		case <-rescan.C:
+			// Pick up failed sends and anything the watcher missed
+			scan(0)
+		case now := <-tick.C:
+			var ready []string
+			for path, at := range pending {
+				if !now.Before(at) {
+					ready = append(ready, path)
+				}
+			}
+			sort.Strings(ready)
+			for _, path := range ready {
+				if ctx.Err() != nil {
+					return nil
+				}
+				delete(pending, path)
+				if !eligible(path) {
+					continue
+				}
+				if err := deliver(ctx, cfg, path); err != nil {
+					log.Error("Outbox send failed, will retry", "file", path, "error", err, "retry_in", cfg.Retry)
+				}
+			}
+		}
+	}
+}
+
+// eligible reports whether path is a regular, non-hidden file
+func eligible(path string) bool {
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return false
+	}
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// deliver sends one file and moves it to the sent directory
+func deliver(ctx context.Context, cfg Config, path string) error {
+	log.Info("Sending outbox file", "file", path)
+	if err := cfg.Send(ctx, path); err != nil {
+		return err
+	}
+	dest := filepath.Join(cfg.SentDir, filepath.Base(path))
+	if _, err := os.Stat(dest); err == nil {
+		// Keep earlier deliveries of the same name
+		ext := filepath.Ext(dest)
+		dest = fmt.Sprintf("%s-%s%s", strings.TrimSuffix(dest, ext), time.Now().Format("20060102T150405"), ext)
+	}
+	if err := os.Rename(path, dest); err != nil {
+		return fmt.Errorf("sent, but failed to move to %s: %w", cfg.SentDir, err)
+	}
+	log.Info("Outbox file delivered", "file", filepath.Base(path), "moved_to", dest)
+	return nil
+}
@@ -0,0 +1,83 @@
+package rendezvous
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// words are the 256 words codes are built from: short, distinct and easy
+// to say out loud
+var words = [256]string{
+	"acorn", "adult", "agent", "alarm", "album", "alley", "amber", "angle",
+	"ankle", "apple", "apron", "arena", "arrow", "aspen", "atlas", "attic",
+	"bacon", "badge", "bagel", "baker", "bamboo", "banjo", "barn", "basil",
+	"beach", "beard", "bench", "berry", "bison", "blade", "blanket", "blaze",
+	"bloom", "boat", "bolt", "bonus", "boot", "bottle", "brave", "bread",
+	"brick", "bridge", "brook", "brush", "bucket", "buffalo", "bugle", "cabin",
+	"cable", "cactus", "camel", "candle", "canoe", "canyon", "carrot", "castle",
+	"cedar", "chalk", "cherry", "chess", "chimney", "cider", "cinema", "circus",
+	"citrus", "claw", "clock", "cloud", "clover", "cobalt", "cocoa", "comet",
+	"copper", "coral", "cotton", "cowboy", "crane", "crayon", "cricket", "crown",
+	"crystal", "cube", "curtain", "cushion", "daisy", "dancer", "delta", "denim",
+	"desert", "diamond", "dinner", "dolphin", "domino", "donkey", "dragon", "drum",
+	"eagle", "echo", "elbow", "ember", "engine", "falcon", "feather", "fern",
+	"fiddle", "finch", "flame", "flute", "forest", "fossil", "fox", "frost",
+	"galaxy", "garden", "garlic", "gecko", "ginger", "glacier", "globe", "goat",
+	"granite", "grape", "gravel", "guitar", "hammer", "harbor", "harp", "hazel",
+	"helmet", "heron", "hollow", "honey", "horizon", "hornet", "iceberg", "igloo",
+	"island", "ivory", "jacket", "jaguar", "jasmine", "jelly", "jigsaw", "juniper",
+	"kayak", "kernel", "kettle", "kiwi", "koala", "ladder", "lagoon", "lantern",
+	"lava", "lemon", "lily", "lion", "lizard", "llama", "lobster", "locket",
+	"lotus", "magnet", "mango", "maple", "marble", "meadow", "melon", "meteor",
+	"mirror", "mitten", "moose", "mosaic", "muffin", "napkin", "nectar", "needle",
+	"nickel", "noodle", "nutmeg", "oasis", "ocean", "olive", "onion", "orbit",
+	"orchid", "otter", "owl", "paddle", "panda", "parrot", "peach", "pebble",
+	"pepper", "piano", "pickle", "pigeon", "pillow", "pine", "planet", "plum",
+	"pocket", "pony", "puffin", "pumpkin", "puzzle", "quartz", "quilt", "rabbit",
+	"radar", "raven", "reef", "ribbon", "river", "robin", "rocket", "saddle",
+	"salmon", "sandal", "saturn", "scarf", "shadow", "shell", "silver", "sketch",
+	"sparrow", "spider", "spruce", "squid", "stone", "sunset", "tango", "teapot",
+	"thistle", "thunder", "tiger", "toast", "tomato", "topaz", "tulip", "tundra",
+	"turtle", "umbrella", "valley", "velvet", "violin", "volcano", "wagon", "walrus",
+	"walnut", "whale", "willow", "window", "wizard", "yogurt", "zebra", "zephyr",
+}
+
+// maxNameplate bounds the number at the start of a code
+const maxNameplate = 999
+
+// newCode returns a code for nameplate: the number followed by two random
+// words, e.g. "7-walrus-kettle"
+func newCode(nameplate int) (string, error) {
+	parts := []string{strconv.Itoa(nameplate)}
+	for range 2 {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, words[i.Int64()])
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// randomNameplate picks a nameplate below limit
+func randomNameplate(limit int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(limit)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()) + 1, nil
+}
+
+// parseCode splits a code into its nameplate and the full code used as the
+// PAKE password
+func parseCode(code string) (nameplate int, err error) {
+	num, rest, ok := strings.Cut(strings.TrimSpace(code), "-")
+	nameplate, err = strconv.Atoi(num)
+	if !ok || rest == "" || err != nil || nameplate < 1 || nameplate > maxNameplate {
+		return 0, fmt.Errorf("invalid code %q, expected e.g. 7-walrus-kettle", code)
+	}
+	return nameplate, nil
+}
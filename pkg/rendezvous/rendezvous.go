@@ -0,0 +1,419 @@
+// Package rendezvous lets two peers find each other with a short code such
+// as "7-walrus-kettle" instead of an ip:port. Both connect to a rendezvous
+// server, which pairs them by the number in the code and relays their
+// traffic. Over that relay the peers run SPAKE2 keyed by the whole code, so
+// the server learns nothing it could use to impersonate either side, then
+// use the authenticated channel to swap the receiver's key fingerprint and
+// addresses for a direct connection. The relay remains the fallback when
+// no direct connection can be made.
+package rendezvous
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+var (
+	log = util.DefaultLogger()
+)
+
+// ServerEnv names the environment variable holding the default server
+// address
+const ServerEnv = "P2P_RENDEZVOUS"
+
+var (
+	// ErrWrongCode is returned when the peer doesn't prove it knows the code
+	ErrWrongCode = errors.New("wrong code")
+	// ErrNoServer is returned when no rendezvous server is configured
+	ErrNoServer = errors.New("no rendezvous server configured")
+)
+
+// errNameplateInUse is the server's answer when a sender picks a taken number
+var errNameplateInUse = errors.New("nameplate in use")
+
+// DirectTimeout bounds each attempt to reach the receiver directly
+var DirectTimeout = 3 * time.Second
+
+// ServerAddr returns addr, or the server from the environment if addr is
+// empty
+func ServerAddr(addr string) (string, error) {
+	if addr == "" {
+		addr = os.Getenv(ServerEnv)
+	}
+	if addr == "" {
+		return "", fmt.Errorf("%w: pass -rendezvous host:port or set %s", ErrNoServer, ServerEnv)
+	}
+	return addr, nil
+}
+
+// Pending is a code claimed on the server, waiting for the receiver
+type Pending struct {
+	Code string // What the receiver has to enter
+
+	conn *lineConn
+}
+
+// Offer connects to server and claims a fresh code for the sending side
+func Offer(ctx context.Context, server string) (*Pending, error) {
+	// Keep codes short while few are in use; widen the range on collisions
+	limit := 99
+	for range 5 {
+		nameplate, err := randomNameplate(limit)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := request(ctx, server, roleSend, nameplate)
+		if errors.Is(err, errNameplateInUse) {
+			limit = maxNameplate
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		code, err := newCode(nameplate)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &Pending{Code: code, conn: conn}, nil
+	}
+	return nil, errors.New("no free code on the rendezvous server")
+}
+
+// Wait blocks until the receiver joins and both sides have proved they
+// know the code
+func (p *Pending) Wait(ctx context.Context) (*Session, error) {
+	stop := context.AfterFunc(ctx, func() { p.conn.Close() })
+	defer stop()
+	if err := expect(p.conn, "OK"); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return handshake(p.conn, p.Code, true)
+}
+
+// Close gives up the code
+func (p *Pending) Close() error {
+	return p.conn.Close()
+}
+
+// Join connects to server as the receiving side of code
+func Join(ctx context.Context, server, code string) (*Session, error) {
+	nameplate, err := parseCode(code)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := request(ctx, server, roleRecv, nameplate)
+	if err != nil {
+		return nil, err
+	}
+	s, err := handshake(conn, strings.TrimSpace(code), false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// lineConn is a connection whose reads go through the reader used for the
+// server's reply lines, which may hold the peer's first bytes
+type lineConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *lineConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// request connects to the server and sends the request line for role,
+// returning once the server accepted it
+func request(ctx context.Context, server, role string, nameplate int) (*lineConn, error) {
+	host, portStr, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rendezvous server %q, expected host:port: %w", server, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rendezvous server %q: %w", server, err)
+	}
+	raw, err := netconn.TCPDialer(ctx, host, port)()
+	if err != nil {
+		return nil, err
+	}
+	conn := &lineConn{Conn: raw, r: bufio.NewReader(raw)}
+	if _, err := fmt.Fprintf(conn, "%s %s %d\n", greeting, role, nameplate); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to contact rendezvous server: %w", err)
+	}
+	if role == roleSend {
+		if err := expect(conn, "WAIT"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	if err := expect(conn, "OK"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// expect reads the server's next line and fails unless it is want
+func expect(conn *lineConn, want string) error {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("rendezvous server closed the connection: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	if line == want {
+		return nil
+	}
+	reason, isErr := strings.CutPrefix(line, "ERR ")
+	switch {
+	case isErr && reason == errNameplateInUse.Error():
+		return errNameplateInUse
+	case isErr:
+		return fmt.Errorf("rendezvous server: %s", reason)
+	}
+	return fmt.Errorf("unexpected reply from rendezvous server: %q", line)
+}
+
+// Session is a channel to the peer, through the server, authenticated and
+// encrypted with the key agreed from the code
+type Session struct {
+	relay  net.Conn
+	sender bool
+	key    []byte
+	aead   cipher.AEAD
+	seq    [2]uint64 // messages sealed by the sender and by the receiver
+}
+
+// handshake runs SPAKE2 and key confirmation over conn
+func handshake(conn net.Conn, code string, sender bool) (*Session, error) {
+	pake, err := newSPAKE2(code, sender)
+	if err != nil {
+		return nil, err
+	}
+	// The relay is full duplex: both sides speak first
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if err := util.SendWithLength(conn, pake.msg); err != nil {
+		return nil, fmt.Errorf("failed to send PAKE message: %w", err)
+	}
+	peerMsg, err := util.ReadWithLength(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PAKE message: %w", err)
+	}
+	key, err := pake.finish(peerMsg)
+	if err != nil {
+		return nil, err
+	}
+	if err := util.SendWithLength(conn, confirmation(key, sender)); err != nil {
+		return nil, fmt.Errorf("failed to send key confirmation: %w", err)
+	}
+	peerConfirm, err := util.ReadWithLength(conn)
+	if err != nil {
+		// A peer that derived another key hangs up rather than confirm
+		return nil, fmt.Errorf("%w: %w", ErrWrongCode, err)
+	}
+	if !hmac.Equal(peerConfirm, confirmation(key, !sender)) {
+		return nil, ErrWrongCode
+	}
+
+	block, err := aes.NewCipher(mac(key, "messages"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Rendezvous code verified")
+	return &Session{relay: conn, sender: sender, key: key, aead: aead}, nil
+}
+
+// nonce returns the nonce for the next message sealed by side
+func (s *Session) nonce(sender bool) []byte {
+	side := 1
+	if sender {
+		side = 0
+	}
+	n := make([]byte, s.aead.NonceSize())
+	n[0] = byte(side)
+	binary.BigEndian.PutUint64(n[len(n)-8:], s.seq[side])
+	s.seq[side]++
+	return n
+}
+
+// writeMessage sends v as sealed JSON
+func (s *Session) writeMessage(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return util.SendWithLength(s.relay, s.aead.Seal(nil, s.nonce(s.sender), data, nil))
+}
+
+// readMessage reads sealed JSON from the peer into v
+func (s *Session) readMessage(v any) error {
+	data, err := util.ReadWithLength(s.relay)
+	if err != nil {
+		return fmt.Errorf("failed to read from peer: %w", err)
+	}
+	plain, err := s.aead.Open(nil, s.nonce(!s.sender), data, nil)
+	if err != nil {
+		return fmt.Errorf("message from peer failed to authenticate: %w", err)
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// WriteSignal sends v to the peer as a sealed message, to signal another
+// transport over the session (see netconn.Signaler)
+func (s *Session) WriteSignal(v any) error {
+	return s.writeMessage(v)
+}
+
+// ReadSignal reads a message the peer sent with WriteSignal into v
+func (s *Session) ReadSignal(v any) error {
+	return s.readMessage(v)
+}
+
+// Close closes the relayed connection
+func (s *Session) Close() error {
+	return s.relay.Close()
+}
+
+// offer is the receiver's first message: its identity and where it may be
+// reached directly
+type offer struct {
+	Fingerprint string   `json:"fingerprint"`
+	Candidates  []string `json:"candidates,omitempty"`
+}
+
+// answer tells the receiver how the sender connected
+type answer struct {
+	Direct string `json:"direct,omitempty"` // candidate reached, empty for the relay
+}
+
+// AcceptTransfer is the receiver's side of choosing a connection for the
+// transfer. It offers fingerprint, the receiver's key, and a fresh listener's
+// addresses, then returns the connection the sender's transfer arrives on:
+// a direct one if the sender reached the listener, otherwise the relay.
+func (s *Session) AcceptTransfer(ctx context.Context, fingerprint string) (net.Conn, error) {
+	o := offer{Fingerprint: fingerprint}
+	accepted := make(chan net.Conn, 1)
+	if ln, err := net.Listen("tcp", ":0"); err != nil {
+		log.Warn("Cannot listen for a direct connection, using the relay", "error", err)
+	} else {
+		defer ln.Close()
+		port := netconn.ListenPort(ln)
+		if ips, err := util.GetLocalIPs(); err == nil {
+			for _, ip := range ips {
+				o.Candidates = append(o.Candidates, net.JoinHostPort(ip, strconv.Itoa(port)))
+			}
+		}
+		go s.acceptDirect(ln, accepted)
+	}
+	if err := s.writeMessage(o); err != nil {
+		return nil, err
+	}
+
+	var a answer
+	if err := s.readMessage(&a); err != nil {
+		return nil, err
+	}
+	if a.Direct == "" {
+		log.Info("Receiving through the rendezvous relay")
+		return s.relay, nil
+	}
+	select {
+	case conn := <-accepted:
+		log.Info("Connected directly", "address", a.Direct)
+		s.relay.Close()
+		return conn, nil
+	case <-time.After(DirectTimeout):
+		return nil, errors.New("sender reported a direct connection that never arrived")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acceptDirect waits on ln for the sender, which proves itself with a MAC
+// under the session key; anyone else is turned away
+func (s *Session) acceptDirect(ln net.Listener, accepted chan<- net.Conn) {
+	want := mac(s.key, "direct")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(DirectTimeout))
+		got := make([]byte, len(want))
+		_, err = io.ReadFull(conn, got)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil || !hmac.Equal(got, want) {
+			conn.Close()
+			continue
+		}
+		accepted <- conn
+		return
+	}
+}
+
+// DialTransfer is the sender's side of choosing a connection for the
+// transfer. It tries each address the receiver offered and falls back to
+// the relay, returning the connection along with the fingerprint the
+// receiver's key must match.
+func (s *Session) DialTransfer(ctx context.Context) (net.Conn, string, error) {
+	var o offer
+	if err := s.readMessage(&o); err != nil {
+		return nil, "", err
+	}
+	if o.Fingerprint == "" {
+		return nil, "", errors.New("receiver sent no key fingerprint")
+	}
+	d := net.Dialer{Timeout: DirectTimeout}
+	for _, addr := range o.Candidates {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			log.Debug("Direct connection failed", "address", addr, "error", err)
+			continue
+		}
+		if _, err := conn.Write(mac(s.key, "direct")); err != nil {
+			conn.Close()
+			continue
+		}
+		if err := s.writeMessage(answer{Direct: addr}); err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+		log.Info("Connected directly", "address", addr)
+		s.relay.Close()
+		return conn, o.Fingerprint, nil
+	}
+	if err := s.writeMessage(answer{}); err != nil {
+		return nil, "", err
+	}
+	log.Info("Sending through the rendezvous relay")
+	return s.relay, o.Fingerprint, nil
+}
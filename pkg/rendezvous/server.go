@@ -0,0 +1,163 @@
+package rendezvous
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server speaks a line protocol before splicing. A client opens with
+// "P2P-RENDEZVOUS send <nameplate>" or "P2P-RENDEZVOUS recv <nameplate>".
+// A sender is told "WAIT" once its nameplate is claimed, and both sides get
+// "OK" when paired; failures are reported as "ERR <reason>". After "OK" the
+// server relays bytes between the two connections until either closes.
+
+const greeting = "P2P-RENDEZVOUS"
+
+// Server roles
+const (
+	roleSend = "send"
+	roleRecv = "recv"
+)
+
+// ClaimTimeout is how long a sender's nameplate stays claimed waiting for
+// the receiver
+var ClaimTimeout = 10 * time.Minute
+
+// Server pairs senders and receivers by nameplate and relays their traffic
+type Server struct {
+	mu      sync.Mutex
+	waiting map[int]*claim
+}
+
+// claim is a sender waiting for its receiver
+type claim struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	timer *time.Timer
+}
+
+// NewServer creates a rendezvous server
+func NewServer() *Server {
+	return &Server{waiting: make(map[int]*claim)}
+}
+
+// Serve accepts clients from ln until it is closed
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Error("Error accepting connection", "error", err)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle reads a client's request and pairs it or parks it
+func (s *Server) handle(conn net.Conn) {
+	remote := conn.RemoteAddr().String()
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := r.ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != greeting {
+		reply(conn, "ERR bad request")
+		conn.Close()
+		return
+	}
+	nameplate, err := strconv.Atoi(fields[2])
+	if err != nil || nameplate < 1 || nameplate > maxNameplate {
+		reply(conn, "ERR bad nameplate")
+		conn.Close()
+		return
+	}
+
+	switch fields[1] {
+	case roleSend:
+		s.mu.Lock()
+		if _, taken := s.waiting[nameplate]; taken {
+			s.mu.Unlock()
+			reply(conn, "ERR nameplate in use")
+			conn.Close()
+			return
+		}
+		c := &claim{conn: conn, r: r}
+		c.timer = time.AfterFunc(ClaimTimeout, func() { s.expire(nameplate, c) })
+		s.waiting[nameplate] = c
+		s.mu.Unlock()
+		log.Info("Nameplate claimed", "nameplate", nameplate, "remote", remote)
+		if err := reply(conn, "WAIT"); err != nil {
+			s.expire(nameplate, c)
+		}
+	case roleRecv:
+		s.mu.Lock()
+		c, ok := s.waiting[nameplate]
+		delete(s.waiting, nameplate)
+		s.mu.Unlock()
+		if !ok {
+			reply(conn, "ERR no sender is waiting with this code")
+			conn.Close()
+			return
+		}
+		c.timer.Stop()
+		if reply(c.conn, "OK") != nil || reply(conn, "OK") != nil {
+			c.conn.Close()
+			conn.Close()
+			return
+		}
+		log.Info("Peers paired, relaying", "nameplate", nameplate, "sender", c.conn.RemoteAddr().String(), "receiver", remote)
+		splice(c.conn, c.r, conn, r)
+	default:
+		reply(conn, "ERR bad role")
+		conn.Close()
+	}
+}
+
+// expire drops a claim nobody joined
+func (s *Server) expire(nameplate int, c *claim) {
+	s.mu.Lock()
+	if s.waiting[nameplate] == c {
+		delete(s.waiting, nameplate)
+	}
+	s.mu.Unlock()
+	c.conn.Close()
+}
+
+// reply writes one protocol line
+func reply(conn net.Conn, line string) error {
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err := fmt.Fprintf(conn, "%s\n", line)
+	return err
+}
+
+// splice relays between two paired clients until either side closes. Each
+// reader may hold bytes its client sent right behind the request line.
+func splice(a net.Conn, ar io.Reader, b net.Conn, br io.Reader) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	relay := func(dst net.Conn, src io.Reader) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		a.Close()
+		b.Close()
+	}
+	go relay(a, br)
+	go relay(b, ar)
+	wg.Wait()
+}
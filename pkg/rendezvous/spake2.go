@@ -0,0 +1,143 @@
+package rendezvous
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// SPAKE2 over the 2048-bit MODP group of RFC 3526 (group 14). The prime is
+// safe, p = 2q+1, and 2 generates the subgroup of order q. M and N are
+// hashed into that subgroup, so nobody knows their discrete logarithms.
+//
+// The sender picks x and sends X = g^x * M^w, the receiver picks y and sends
+// Y = g^y * N^w, where w is derived from the code. Both compute g^xy, and
+// the session key hashes it with the transcript. Someone who doesn't know
+// the code, including the rendezvous server, gets one guess per session.
+
+var (
+	groupP, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+			"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+			"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+			"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+			"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D"+
+			"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F"+
+			"83655D23DCA3AD961C62F356208552BB9ED529077096966D"+
+			"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+			"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9"+
+			"DE2BCBF6955817183995497CEA956AE515D2261898FA0510"+
+			"15728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
+	groupQ = new(big.Int).Rsh(groupP, 1)
+	groupG = big.NewInt(2)
+
+	spakeM = hashToGroup("p2p-client spake2 M")
+	spakeN = hashToGroup("p2p-client spake2 N")
+)
+
+// elementSize is the encoded size of a group element
+const elementSize = 256
+
+// errBadElement is returned for a peer message outside the group
+var errBadElement = errors.New("invalid PAKE message")
+
+// hashToGroup maps label to an element of the order-q subgroup by
+// expanding its hash well past the size of p and squaring the result
+func hashToGroup(label string) *big.Int {
+	var buf []byte
+	for i := uint32(0); len(buf) < elementSize+32; i++ {
+		h := sha256.New()
+		h.Write([]byte(label))
+		h.Write(binary.BigEndian.AppendUint32(nil, i))
+		buf = h.Sum(buf)
+	}
+	e := new(big.Int).SetBytes(buf)
+	e.Mod(e, groupP)
+	return e.Exp(e, big.NewInt(2), groupP)
+}
+
+// spake2 is one side of an exchange
+type spake2 struct {
+	sender bool
+	w      *big.Int // password scalar
+	secret *big.Int // x or y
+	msg    []byte   // X or Y, as sent
+}
+
+// newSPAKE2 starts an exchange for code. The sender and the receiver blind
+// their messages with different constants, so they can't be reflected.
+func newSPAKE2(code string, sender bool) (*spake2, error) {
+	h := sha256.Sum256([]byte("p2p-client spake2 password\x00" + code))
+	w := new(big.Int).SetBytes(h[:])
+	w.Mod(w, groupQ)
+
+	secret, err := rand.Int(rand.Reader, new(big.Int).Sub(groupQ, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	secret.Add(secret, big.NewInt(1))
+
+	blind := spakeN
+	if sender {
+		blind = spakeM
+	}
+	msg := new(big.Int).Exp(groupG, secret, groupP)
+	msg.Mul(msg, new(big.Int).Exp(blind, w, groupP))
+	msg.Mod(msg, groupP)
+	return &spake2{sender: sender, w: w, secret: secret, msg: msg.FillBytes(make([]byte, elementSize))}, nil
+}
+
+// finish takes the peer's message and returns the shared session key
+func (s *spake2) finish(peerMsg []byte) ([]byte, error) {
+	if len(peerMsg) != elementSize {
+		return nil, errBadElement
+	}
+	e := new(big.Int).SetBytes(peerMsg)
+	one := big.NewInt(1)
+	if e.Cmp(one) <= 0 || e.Cmp(new(big.Int).Sub(groupP, one)) >= 0 || new(big.Int).Exp(e, groupQ, groupP).Cmp(one) != 0 {
+		return nil, errBadElement
+	}
+
+	// Remove the peer's blinding: multiply by its constant to the power -w,
+	// which is q-w in a group of order q
+	blind := spakeM
+	if s.sender {
+		blind = spakeN
+	}
+	unblind := new(big.Int).Exp(blind, new(big.Int).Sub(groupQ, s.w), groupP)
+	e.Mul(e, unblind)
+	e.Mod(e, groupP)
+	k := e.Exp(e, s.secret, groupP)
+
+	senderMsg, receiverMsg := s.msg, peerMsg
+	if !s.sender {
+		senderMsg, receiverMsg = peerMsg, s.msg
+	}
+	h := sha256.New()
+	h.Write([]byte("p2p-client spake2 key\x00"))
+	h.Write(senderMsg)
+	h.Write(receiverMsg)
+	h.Write(k.FillBytes(make([]byte, elementSize)))
+	h.Write(s.w.FillBytes(make([]byte, 32)))
+	return h.Sum(nil), nil
+}
+
+// confirmation is the key confirmation MAC each side sends, proving it
+// derived the same key
+func confirmation(key []byte, sender bool) []byte {
+	label := "receiver confirm"
+	if sender {
+		label = "sender confirm"
+	}
+	return mac(key, label)
+}
+
+// mac authenticates label under key
+func mac(key []byte, label string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(label))
+	return m.Sum(nil)
+}
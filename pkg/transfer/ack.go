@@ -0,0 +1,412 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Chunk acknowledgements (protocol v5): after writing each chunk the
+// receiver answers with the number of chunks it has written so far, as a
+// uint64. The sender keeps at most a window of chunks unacknowledged, so a
+// receiver that stops making progress is noticed within AckTimeout instead of
+// whenever TCP buffers happen to fill, and progress reflects what the
+// receiver confirmed rather than what was handed to the socket. After the
+// end-of-file marker the receiver sends ackDone, then its receipt.
+//
+// Receiver progress (protocol v7): about every ProgressInterval the receiver
+// sends ackProgress followed by the bytes it has written and the offset up
+// to which they are known to be on disk, both uint64. Files are flushed in
+// the background between frames, and once more before ackDone, so a sender
+// knows how much survives a crash of the receiver, not only what reached it.
+//
+// Retransmission (protocol v8): a chunk that fails to decrypt, e.g. after
+// corruption the TCP checksum missed, is answered with ackNack followed by
+// the number of chunks written so far. The sender keeps every
+// unacknowledged chunk as sent and replays them all, setting retransmitFlag
+// on the first; the receiver drops whatever arrives before it, including an
+// end-of-file marker sent before the sender saw the request. A chunk that
+// fails maxRetransmits times in a row aborts the transfer.
+//
+// From v24 a receiver that gives up sends ackError and an error frame
+// instead of ackDone; see errorframe.go.
+
+// DefaultAckWindow is the default number of chunks in flight, 8 MiB at the
+// default chunk size
+const DefaultAckWindow = 128
+
+// AckTimeout is how long the sender waits for the receiver to acknowledge a
+// chunk when its window is full
+var AckTimeout = 30 * time.Second
+
+// ProgressInterval is how often a receiver flushes the file and reports
+// its progress
+var ProgressInterval = time.Second
+
+// ackDone follows the last acknowledgement
+const ackDone = math.MaxUint64
+
+// ackProgress introduces a progress frame; chunk counts never get near it
+const ackProgress = math.MaxUint64 - 1
+
+// ackNack introduces a retransmission request
+const ackNack = math.MaxUint64 - 2
+
+// retransmitFlag marks the first replayed chunk in the chunk length
+const retransmitFlag = 1 << 30
+
+// maxRetransmits is how often one chunk may be requested again
+const maxRetransmits = 3
+
+// sendAck writes one acknowledgement
+func sendAck(w io.Writer, n uint64) error {
+	if err := binary.Write(w, binary.BigEndian, n); err != nil {
+		return fmt.Errorf("failed to send chunk acknowledgement: %w", err)
+	}
+	return nil
+}
+
+// sendNack asks the sender to replay everything after the first written chunks
+func sendNack(w io.Writer, written uint64) error {
+	if err := binary.Write(w, binary.BigEndian, [2]uint64{ackNack, written}); err != nil {
+		return fmt.Errorf("failed to request retransmission: %w", err)
+	}
+	return nil
+}
+
+// sendProgress writes one progress frame
+func sendProgress(w io.Writer, written, persisted int64) error {
+	frame := [3]uint64{ackProgress, uint64(written), uint64(persisted)}
+	if err := binary.Write(w, binary.BigEndian, frame); err != nil {
+		return fmt.Errorf("failed to send progress: %w", err)
+	}
+	return nil
+}
+
+// fileSyncer flushes the receiver's output to disk in the background and
+// tracks the offset known to be durable
+type fileSyncer struct {
+	f         interface{ Sync() error }
+	written   *countingWriter
+	persisted atomic.Int64
+	busy      atomic.Bool
+	wg        sync.WaitGroup
+}
+
+// newFileSyncer returns a syncer for sink, or nil if sink isn't a file
+func newFileSyncer(sink io.Writer, written *countingWriter) *fileSyncer {
+	f, ok := sink.(*os.File)
+	if !ok {
+		return nil
+	}
+	return &fileSyncer{f: f, written: written}
+}
+
+// start flushes what has been written so far, unless a flush is running
+func (s *fileSyncer) start() {
+	if s.busy.Swap(true) {
+		return
+	}
+	offset := s.written.n.Load()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.busy.Store(false)
+		if err := s.f.Sync(); err != nil {
+			log.Warn("Failed to flush received data to disk", "error", err)
+			return
+		}
+		s.persisted.Store(offset)
+	}()
+}
+
+// flush waits for any background flush, then flushes everything written
+func (s *fileSyncer) flush() error {
+	s.wait()
+	offset := s.written.n.Load()
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("failed to flush file to disk: %w", err)
+	}
+	s.persisted.Store(offset)
+	return nil
+}
+
+// wait blocks until no flush is running
+func (s *fileSyncer) wait() {
+	s.wg.Wait()
+}
+
+// sentChunk is a chunk kept as sent until acknowledged, to be replayed
+type sentChunk struct {
+	length     uint32  // with any flags
+	ciphertext *[]byte // pooled, released once acknowledged
+}
+
+// ackFrame is an acknowledgement, or a retransmission request
+type ackFrame struct {
+	n    uint64
+	nack bool
+}
+
+// ackWindow tracks the sender's unacknowledged chunks
+type ackWindow struct {
+	log       *util.Logger
+	conn      io.Writer
+	size      int
+	sent      uint64
+	acked     uint64
+	offsets   []int64     // source offset after each unacknowledged chunk, oldest first
+	chunks    []sentChunk // unacknowledged chunks, kept from v8 to replay
+	retain    bool
+	version   int
+	eof       bool   // the end-of-file marker was sent, and must follow a replay
+	trailer   []byte // the trailer frame sent before it, from v22
+	confirmed int64
+	written   atomic.Int64 // bytes the receiver last reported writing
+	persisted atomic.Int64 // bytes the receiver last reported on disk, -1 if unknown
+	finished  bool
+
+	acks chan ackFrame // acknowledgements read from the receiver
+	done chan error    // result of the reader once it saw ackDone or failed
+	chat *chatSession  // delivers the receiver's chat messages, nil without chat
+}
+
+// newAckWindow starts reading acknowledgements from conn. Nothing else may
+// read from conn until finish returns. From v8 chunks are kept until
+// acknowledged, and replayed over conn when the receiver asks. chat, if
+// not nil, gets the receiver's chat messages. sealer opens the receiver's
+// error frame.
+func newAckWindow(conn io.ReadWriter, size, version int, chat *chatSession, sealer *frameSealer, log *util.Logger) *ackWindow {
+	if size <= 0 {
+		size = DefaultAckWindow
+	}
+	w := &ackWindow{log: log, conn: conn, size: size, retain: version >= ProtocolV8, version: version, acks: make(chan ackFrame, size), done: make(chan error, 1), chat: chat}
+	w.persisted.Store(-1)
+	go func() {
+		var n uint64
+		for {
+			if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+				w.done <- fmt.Errorf("failed to read chunk acknowledgement: %w", err)
+				return
+			}
+			switch n {
+			case ackDone:
+				w.done <- nil
+				return
+			case ackProgress:
+				var frame [2]uint64
+				if err := binary.Read(conn, binary.BigEndian, &frame); err != nil {
+					w.done <- fmt.Errorf("failed to read receiver progress: %w", err)
+					return
+				}
+				w.written.Store(int64(frame[0]))
+				w.persisted.Store(int64(frame[1]))
+				continue
+			case ackNack:
+				if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+					w.done <- fmt.Errorf("failed to read retransmission request: %w", err)
+					return
+				}
+				w.acks <- ackFrame{n: n, nack: true}
+				continue
+			case ackError:
+				if version >= ProtocolV24 {
+					w.done <- readReceiverAbort(conn, sealer)
+					return
+				}
+			case ackChat:
+				var size uint32
+				err := binary.Read(conn, binary.BigEndian, &size)
+				if err == nil {
+					err = w.chat.read(conn, size)
+				}
+				if err != nil {
+					w.done <- err
+					return
+				}
+				continue
+			}
+			w.acks <- ackFrame{n: n}
+		}
+	}()
+	return w
+}
+
+// record notes that a chunk was sent, leaving the source at offset. The
+// window takes ciphertext, a pooled buffer, and releases it once it is no
+// longer needed for a replay.
+func (w *ackWindow) record(offset int64, length uint32, ciphertext *[]byte) {
+	w.sent++
+	w.offsets = append(w.offsets, offset)
+	if w.retain {
+		w.chunks = append(w.chunks, sentChunk{length: length, ciphertext: ciphertext})
+	} else {
+		putBuffer(ciphertext)
+	}
+}
+
+// apply handles one frame from the receiver
+func (w *ackWindow) apply(f ackFrame) error {
+	if f.nack {
+		return w.replay(f.n)
+	}
+	return w.ack(f.n)
+}
+
+// ack applies an acknowledgement of the first n chunks
+func (w *ackWindow) ack(n uint64) error {
+	if n <= w.acked || n > w.sent {
+		return fmt.Errorf("invalid acknowledgement of %d chunks, %d sent", n, w.sent)
+	}
+	k := int(n - w.acked)
+	w.confirmed = w.offsets[k-1]
+	w.offsets = w.offsets[k:]
+	if w.retain {
+		for _, c := range w.chunks[:k] {
+			putBuffer(c.ciphertext)
+		}
+		clear(w.chunks[:k])
+		w.chunks = w.chunks[k:]
+	}
+	w.acked = n
+	return nil
+}
+
+// replay sends every unacknowledged chunk again after the receiver, having
+// written n chunks, failed to decrypt the next
+func (w *ackWindow) replay(n uint64) error {
+	if !w.retain || n != w.acked || len(w.chunks) == 0 {
+		return fmt.Errorf("invalid retransmission request after %d chunks, %d acknowledged", n, w.acked)
+	}
+	w.log.Warn("Receiver could not decrypt a chunk, sending it again", "chunk", n+1, "replayed", len(w.chunks))
+	deadliner, _ := w.conn.(interface{ SetWriteDeadline(time.Time) error })
+	for i, c := range w.chunks {
+		if deadliner != nil && !w.eof {
+			deadliner.SetWriteDeadline(time.Now().Add(AckTimeout))
+		}
+		length := c.length
+		if i == 0 {
+			length |= retransmitFlag
+		}
+		if _, err := w.conn.Write(chunkHeader(nil, w.version, length, w.acked+uint64(i))); err != nil {
+			return stalled(fmt.Errorf("failed to resend chunk size: %w", err))
+		}
+		if _, err := w.conn.Write(*c.ciphertext); err != nil {
+			return stalled(fmt.Errorf("failed to resend chunk: %w", err))
+		}
+	}
+	if w.eof {
+		if _, err := w.conn.Write(w.trailer); err != nil {
+			return fmt.Errorf("failed to resend trailer: %w", err)
+		}
+		if err := binary.Write(w.conn, binary.BigEndian, uint32(0)); err != nil {
+			return fmt.Errorf("failed to send EOF marker: %w", err)
+		}
+	}
+	return nil
+}
+
+// drain applies the acknowledgements that have arrived, without blocking
+func (w *ackWindow) drain() error {
+	for {
+		select {
+		case f := <-w.acks:
+			if err := w.apply(f); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// wait blocks until the window has room for another chunk
+func (w *ackWindow) wait() error {
+	if err := w.drain(); err != nil {
+		return err
+	}
+	for w.sent-w.acked >= uint64(w.size) {
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next waits for one acknowledgement
+func (w *ackWindow) next() error {
+	timer := time.NewTimer(AckTimeout)
+	defer timer.Stop()
+	select {
+	case f := <-w.acks:
+		return w.apply(f)
+	case err := <-w.done:
+		// The reader queues every acknowledgement before finishing
+		w.done <- err
+		if len(w.acks) > 0 {
+			return w.drain()
+		}
+		if err == nil {
+			err = fmt.Errorf("receiver finished after %d of %d chunks", w.acked, w.sent)
+		}
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%w: no acknowledgement for %s, %d chunks outstanding", ErrReceiverStalled, AckTimeout, w.sent-w.acked)
+	}
+}
+
+// finish waits for every chunk to be acknowledged and for ackDone, once
+// the end-of-file marker is sent
+func (w *ackWindow) finish() error {
+	w.eof = true
+	for w.acked < w.sent {
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	select {
+	case err := <-w.done:
+		w.finished = err == nil
+		return err
+	case <-time.After(AckTimeout):
+		return fmt.Errorf("%w: no end of acknowledgements after %s", ErrReceiverStalled, AckTimeout)
+	}
+}
+
+// failure returns the receiver's own account of why it gave up in place of
+// err, a write that failed once it stopped reading, if its error frame
+// arrives within errorGrace
+func (w *ackWindow) failure(err error) error {
+	if w == nil || w.version < ProtocolV24 {
+		return err
+	}
+	select {
+	case e := <-w.done:
+		w.done <- e
+		var delivery *DeliveryError
+		if errors.As(e, &delivery) {
+			return delivery
+		}
+	case <-time.After(errorGrace):
+	}
+	return err
+}
+
+// reportIncomplete logs how much of an interrupted transfer the receiver
+// had written and stored durably
+func (w *ackWindow) reportIncomplete() {
+	if w.finished {
+		return
+	}
+	if persisted := w.persisted.Load(); persisted >= 0 {
+		w.log.Warn("Transfer interrupted", "receiver_written", w.written.Load(), "receiver_on_disk", persisted)
+	}
+}
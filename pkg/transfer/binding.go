@@ -0,0 +1,115 @@
+package transfer
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Session binding (protocol v23): the manifest is sealed and the sender
+// signs it with the handshake transcript, but the receiver's preflight
+// answer, which picks the version, cipher suite and hash algorithm and the
+// offset to resume from, travels bare, so an active attacker on the path
+// could swap it for another. On a transfer with a sealed manifest both
+// ends MAC a digest of the whole session setup under a key derived from
+// the file key, which only they know: the handshake transcript, the
+// manifest frame, the sender's key and the parameters agreed. The receiver
+// puts its MAC in the preflight answer; the sender checks it and sends
+// its own before the first chunk, and the receiver checks that before
+// writing anything. A sender that saw v23 in the greeting, itself covered
+// by the transcript, insists on the receiver's MAC, so stripping it
+// doesn't downgrade the transfer.
+
+// ErrSessionBinding is returned when the other end's MAC of the session
+// setup is missing or doesn't match ours: something on the path changed
+// what one of the two sent
+var ErrSessionBinding = errors.New("session binding mismatch")
+
+// Roles in the binding MACs, so one end's MAC can't be reflected as the
+// other's
+const (
+	bindingReceiver = "receiver"
+	bindingSender   = "sender"
+)
+
+// binds reports whether a transfer at version with a sealed manifest is
+// bound
+func binds(version int, sealed bool) bool {
+	return sealed && version >= ProtocolV23
+}
+
+// expectsBinding reports whether the receiver at the other end of conn
+// announced v23 in its greeting, so its preflight answer must carry a MAC
+func expectsBinding(conn any) bool {
+	pv, ok := conn.(PeerVersioner)
+	return ok && pv.PeerVersion() >= ProtocolV23
+}
+
+// sessionDigest hashes the setup of a transfer as one end saw it. Each part
+// is length-prefixed so none can be shifted into another.
+func sessionDigest(transcript, manifestFrame, senderKey []byte, version int, suite, hashAlg string, offset int64) []byte {
+	h := sha256.New()
+	h.Write([]byte("p2p-client session binding\n"))
+	params := []byte(strconv.Itoa(version) + "\n" + suite + "\n" + hashAlg + "\n" + strconv.FormatInt(offset, 10))
+	for _, part := range [][]byte{transcript, manifestFrame, senderKey, params} {
+		binary.Write(h, binary.BigEndian, uint32(len(part)))
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// bindingMAC is the MAC of digest by role under a key derived from the
+// file key and base nonce
+func bindingMAC(fileKey, nonce, digest []byte, role string) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nonce, "p2p-client session binding", sha256.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive binding key: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(role + "\n"))
+	mac.Write(digest)
+	return mac.Sum(nil), nil
+}
+
+// checkBinding verifies the MAC got from role over digest
+func checkBinding(fileKey, nonce, digest []byte, role string, got []byte) error {
+	if len(got) == 0 {
+		return fmt.Errorf("%w: no MAC from the %s", ErrSessionBinding, role)
+	}
+	want, err := bindingMAC(fileKey, nonce, digest, role)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(got, want) {
+		return fmt.Errorf("%w: the %s saw a different session", ErrSessionBinding, role)
+	}
+	return nil
+}
+
+// sendBinding sends the sender's MAC over digest, ahead of the first chunk
+func sendBinding(w io.Writer, fileKey, nonce, digest []byte) error {
+	mac, err := bindingMAC(fileKey, nonce, digest, bindingSender)
+	if err != nil {
+		return err
+	}
+	if err := util.SendWithLength(w, mac); err != nil {
+		return fmt.Errorf("failed to send session binding: %w", err)
+	}
+	return nil
+}
+
+// readBinding reads the sender's MAC and checks it against digest
+func readBinding(r io.Reader, fileKey, nonce, digest []byte) error {
+	mac, err := util.ReadWithLength(r)
+	if err != nil {
+		return fmt.Errorf("failed to read session binding: %w", err)
+	}
+	return checkBinding(fileKey, nonce, digest, bindingSender, mac)
+}
@@ -0,0 +1,56 @@
+package transfer
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Chunk buffers are pooled across transfers, so moving a file doesn't
+// allocate, and later collect, a chunk's worth of memory for every chunk.
+// Buffers come in power-of-two size classes from 64 KiB, which holds a
+// default chunk with its tag, to the class holding the largest chunk.
+
+// Log2 of the smallest and largest pooled buffers; the largest holds
+// MaxChunkSize plus a tag
+const (
+	minBufferShift = 16
+	maxBufferShift = 24
+)
+
+// bufferPools holds one pool per size class
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// bufferClass returns the size class holding n bytes
+func bufferClass(n int) int {
+	if n <= 1<<minBufferShift {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minBufferShift
+}
+
+// getBuffer returns a pooled buffer of at least n bytes, sliced to n. Sizes
+// beyond the largest class are allocated and never pooled.
+func getBuffer(n int) *[]byte {
+	class := bufferClass(n)
+	if class >= len(bufferPools) {
+		b := make([]byte, n)
+		return &b
+	}
+	if b, ok := bufferPools[class].Get().(*[]byte); ok {
+		*b = (*b)[:n]
+		return b
+	}
+	b := make([]byte, n, 1<<(class+minBufferShift))
+	return &b
+}
+
+// putBuffer returns b to its pool. The caller must not use it afterwards.
+func putBuffer(b *[]byte) {
+	if b == nil {
+		return
+	}
+	class := bufferClass(cap(*b))
+	if class < len(bufferPools) && cap(*b) == 1<<(class+minBufferShift) {
+		bufferPools[class].Put(b)
+	}
+}
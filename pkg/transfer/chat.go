@@ -0,0 +1,210 @@
+package transfer
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Chat (protocol v9): while chunks flow, either side may send short text
+// messages. The sender writes a chunk length with chatFlag set followed by
+// the sealed message; the receiver writes ackChat, the sealed length as a
+// uint32 and the message among its acknowledgements. Each direction has its
+// own ChaCha20-Poly1305 key derived from the file key and a counter nonce,
+// so chat never disturbs the chunk cipher or its replays. Messages go out
+// between chunks: the sender's stop with its end-of-file marker, the
+// receiver's with ackDone.
+
+// chatFlag marks a chat frame in the chunk length
+const chatFlag = 1 << 29
+
+// ackChat introduces a chat frame among acknowledgements
+const ackChat = ackNack - 1
+
+// MaxChatMessage is the longest message in bytes
+const MaxChatMessage = 4096
+
+// ErrChatUnavailable is returned by Chat.Send when no transfer able to
+// carry the message is in progress
+var ErrChatUnavailable = errors.New("chat unavailable")
+
+// Chat states
+const (
+	chatIdle = iota
+	chatActive
+	chatUnsupported
+	chatEnded
+)
+
+// Chat carries text messages between the two ends of a transfer, set in
+// SendOptions or ReceiveOptions. It may be reused for later transfers.
+type Chat struct {
+	// OnMessage is called with each message from the peer; it must not
+	// block the transfer for long
+	OnMessage func(text string)
+
+	outgoing chan string
+	state    atomic.Int32
+}
+
+// NewChat returns a chat delivering incoming messages to onMessage
+func NewChat(onMessage func(text string)) *Chat {
+	return &Chat{OnMessage: onMessage, outgoing: make(chan string, 16)}
+}
+
+// Send queues text for the peer. It fails when the current transfer can't
+// carry chat, there is none, or too many messages are waiting.
+func (c *Chat) Send(text string) error {
+	if len(text) > MaxChatMessage || !utf8.ValidString(text) {
+		return fmt.Errorf("chat messages must be valid UTF-8 of at most %d bytes", MaxChatMessage)
+	}
+	switch c.state.Load() {
+	case chatUnsupported:
+		return fmt.Errorf("%w: the peer's client is too old", ErrChatUnavailable)
+	case chatEnded:
+		return fmt.Errorf("%w: the transfer has finished", ErrChatUnavailable)
+	}
+	select {
+	case c.outgoing <- text:
+		return nil
+	default:
+		return fmt.Errorf("%w: too many messages waiting", ErrChatUnavailable)
+	}
+}
+
+// chatSession seals and opens the messages of one transfer
+type chatSession struct {
+	chat     *Chat
+	out, in  cipher.AEAD
+	sent     uint64
+	received uint64
+}
+
+// startChat sets up chat for a transfer that negotiated version, or returns
+// nil when chat is off or the peer can't take part. sender tells which end
+// this is, so each direction gets its own key.
+func startChat(c *Chat, version int, fileKey, baseNonce []byte, sender bool) (*chatSession, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if version < ProtocolV9 {
+		c.state.Store(chatUnsupported)
+		log.Info("The peer's client does not support chat")
+		return nil, nil
+	}
+	key := func(dir string) (cipher.AEAD, error) {
+		k, err := hkdf.Key(sha256.New, fileKey, baseNonce, "p2p-client chat "+dir, chacha20poly1305.KeySize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive chat key: %w", err)
+		}
+		return chacha20poly1305.New(k)
+	}
+	toReceiver, err := key("to receiver")
+	if err != nil {
+		return nil, err
+	}
+	toSender, err := key("to sender")
+	if err != nil {
+		return nil, err
+	}
+	s := &chatSession{chat: c, out: toReceiver, in: toSender}
+	if !sender {
+		s.out, s.in = toSender, toReceiver
+	}
+	c.state.Store(chatActive)
+	return s, nil
+}
+
+// end stops taking messages for this transfer
+func (s *chatSession) end() {
+	if s != nil {
+		s.chat.state.Store(chatEnded)
+	}
+}
+
+// pending returns the sealed messages waiting to be sent
+func (s *chatSession) pending() [][]byte {
+	if s == nil {
+		return nil
+	}
+	var sealed [][]byte
+	for {
+		select {
+		case text := <-s.chat.outgoing:
+			sealed = append(sealed, s.out.Seal(nil, chatNonce(s.sent), []byte(text), nil))
+			s.sent++
+		default:
+			return sealed
+		}
+	}
+}
+
+// read reads a sealed message of n bytes from r and delivers it, or drops
+// it when this side has chat off. A message that fails to decrypt is
+// dropped too; chat isn't worth failing a transfer for.
+func (s *chatSession) read(r io.Reader, n uint32) error {
+	if n > MaxChatMessage+chacha20poly1305.Overhead {
+		return fmt.Errorf("chat message too large: %d bytes", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("failed to read chat message: %w", err)
+	}
+	if s == nil {
+		log.Debug("Dropped a chat message; chat is off")
+		return nil
+	}
+	text, err := s.in.Open(nil, chatNonce(s.received), buf, nil)
+	s.received++
+	if err != nil {
+		log.Warn("Dropped a chat message that failed to decrypt", "error", err)
+		return nil
+	}
+	util.Emit(util.EventChatMessage, "text", string(text))
+	if s.chat.OnMessage != nil {
+		s.chat.OnMessage(string(text))
+	}
+	return nil
+}
+
+// chatNonce is the nonce of the nth message in one direction
+func chatNonce(n uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+// sendChatFrames writes the sender's waiting messages as chunk frames
+func sendChatFrames(w io.Writer, s *chatSession) error {
+	for _, m := range s.pending() {
+		if err := binary.Write(w, binary.BigEndian, uint32(len(m))|chatFlag); err != nil {
+			return fmt.Errorf("failed to send chat message: %w", err)
+		}
+		if _, err := w.Write(m); err != nil {
+			return fmt.Errorf("failed to send chat message: %w", err)
+		}
+	}
+	return nil
+}
+
+// sendChatAcks writes the receiver's waiting messages among its
+// acknowledgements
+func sendChatAcks(w io.Writer, s *chatSession) error {
+	for _, m := range s.pending() {
+		header := binary.BigEndian.AppendUint64(nil, ackChat)
+		header = binary.BigEndian.AppendUint32(header, uint32(len(m)))
+		if _, err := w.Write(append(header, m...)); err != nil {
+			return fmt.Errorf("failed to send chat message: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package transfer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultChunkSize keeps each encrypted chunk within 64KB
+	DefaultChunkSize = 64*1024 - 28 // 64KB - 28 bytes for GCM overhead
+	// MinChunkSize is the smallest chunk the sender will use
+	MinChunkSize = 4 * 1024
+	// MaxChunkSize is the largest plaintext chunk a receiver accepts
+	MaxChunkSize = 8 * 1024 * 1024
+)
+
+// SendOptions tunes how the sender splits a file into chunks
+type SendOptions struct {
+	ChunkSize      int    // Plaintext bytes per chunk (initial size in adaptive mode)
+	AdaptiveChunks bool   // Grow chunks on fast links and shrink them on slow ones
+	Cipher         string // Offer only this cipher suite; empty picks by hardware
+	AckWindow      int    // Chunks that may be unacknowledged at once (default DefaultAckWindow)
+	HideProgress   bool   // Leave progress reporting to the caller, e.g. when several sends share the console
+	NoContentHash  bool   // Don't hash files before sending, so receivers can't spot copies they already have
+	HashAheadLimit int64  // Largest file hashed before sending to receivers that check the trailer (v22); 0 for no limit
+	Chat           *Chat  // If set, exchange chat messages with the receiver during the transfer
+	Compress       bool   // Compress chunks for receivers that take it, sending those that shrink
+	RateLimit      int64  // Bytes per second to send at most, 0 for no limit
+	TransferID     string // ID to send files under, so a retry resumes where the last attempt broke off; empty picks a new one per send
+	Workers        int    // Chunks compressed and encrypted in parallel (default one per core, up to MaxSendWorkers)
+
+	// Meta is attached to every manifest sent that doesn't carry its own
+	Meta map[string]string
+}
+
+// DefaultSendOptions is used by SendFile and SendReader
+var DefaultSendOptions = SendOptions{ChunkSize: DefaultChunkSize, HashAheadLimit: DefaultHashAheadLimit}
+
+// chunkSize returns the configured size clamped to the supported range
+func (o SendOptions) chunkSize() int {
+	switch {
+	case o.ChunkSize <= 0:
+		return DefaultChunkSize
+	case o.ChunkSize < MinChunkSize:
+		return MinChunkSize
+	case o.ChunkSize > MaxChunkSize:
+		return MaxChunkSize
+	}
+	return o.ChunkSize
+}
+
+// chunkTuner adapts the chunk size to the observed per-chunk latency. Fast
+// chunks mean per-chunk GCM and syscall overhead dominates, so chunks grow;
+// slow chunks shrink to keep progress and cancellation responsive. With the
+// send pipeline overlapping chunks, a chunk's latency is the time between
+// it and the previous one going out.
+type chunkTuner struct {
+	size     atomic.Int64 // Read by the pipeline's reader
+	adaptive bool
+	last     time.Time
+}
+
+const (
+	growBelow   = 5 * time.Millisecond   // grow when a chunk completes faster than this
+	shrinkAbove = 250 * time.Millisecond // shrink when a chunk takes longer than this
+)
+
+func newChunkTuner(o SendOptions) *chunkTuner {
+	t := &chunkTuner{adaptive: o.AdaptiveChunks, last: time.Now()}
+	t.size.Store(int64(o.chunkSize()))
+	return t
+}
+
+// current returns the size to read the next chunk with
+func (t *chunkTuner) current() int {
+	return int(t.size.Load())
+}
+
+// done records a chunk of size bytes going out. Chunks read before the
+// size last changed are only timed, so the pipeline's backlog of them
+// doesn't change it again.
+func (t *chunkTuner) done(size int) {
+	now := time.Now()
+	elapsed := now.Sub(t.last)
+	t.last = now
+	current := t.current()
+	if !t.adaptive || size != current {
+		return
+	}
+	switch {
+	case elapsed < growBelow && current < MaxChunkSize:
+		current = min(current*2, MaxChunkSize)
+		log.Debug("Growing chunk size", "size", current)
+	case elapsed > shrinkAbove && current > MinChunkSize:
+		current = max(current/2, MinChunkSize)
+		log.Debug("Shrinking chunk size", "size", current)
+	}
+	t.size.Store(int64(current))
+}
@@ -0,0 +1,291 @@
+package transfer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"runtime"
+	"slices"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// Protocol versions understood by this build. The sender offers its highest
+// version in the manifest and the receiver answers with the one both use.
+const (
+	// ProtocolV1 encrypts every chunk with the session key and a 32-bit
+	// counter nonce, limiting a transfer to 2^32 chunks
+	ProtocolV1 = 1
+	// ProtocolV2 derives a fresh chunk key with HKDF every RekeyInterval
+	// bytes, restarting the counter, so transfers have no size limit
+	ProtocolV2 = 2
+	// ProtocolV3 adds delta transfers: the receiver sends block signatures
+	// of its existing copy and the sender transmits only what changed
+	ProtocolV3 = 3
+	// ProtocolV4 receivers understand manifest kinds other than files, such
+	// as benchmark streams they must not write to disk
+	ProtocolV4 = 4
+	// ProtocolV5 receivers acknowledge every chunk, and senders keep at most
+	// a window of chunks unacknowledged
+	ProtocolV5 = 5
+	// ProtocolV6 adds skip frames standing for runs of zeros, so sparse
+	// files keep their holes
+	ProtocolV6 = 6
+	// ProtocolV7 receivers interleave progress frames with their
+	// acknowledgements, reporting how much of the file is durably on disk
+	ProtocolV7 = 7
+	// ProtocolV8 receivers ask for a chunk that fails to decrypt to be sent
+	// again instead of aborting the transfer
+	ProtocolV8 = 8
+	// ProtocolV9 lets both sides exchange chat messages while chunks flow
+	ProtocolV9 = 9
+	// ProtocolV10 receivers take a sealed manifest, so file names and sizes
+	// are never sent in the clear; see sealedEnvelope
+	ProtocolV10 = 10
+	// ProtocolV11 receivers end with a final status frame, reporting a file
+	// that failed its hash check or couldn't be stored; see statusFrame
+	ProtocolV11 = 11
+	// ProtocolV12 servers take an HMAC answer to their greeting, keyed by
+	// the passcode stretched with Argon2id, instead of bcrypt
+	ProtocolV12 = 12
+	// ProtocolV13 receivers take zstd-compressed chunks; see compressFlag
+	ProtocolV13 = 13
+	// ProtocolV14 receivers take the files and path lists of a directory
+	// sync; see KindSync
+	ProtocolV14 = 14
+	// ProtocolV15 receivers resume a transfer that broke off where its
+	// data ends; see resume.go
+	ProtocolV15 = 15
+	// ProtocolV16 receivers check the data they kept before resuming with
+	// the sender, block by block; see encodeResume
+	ProtocolV16 = 16
+	// ProtocolV17 receivers exchange peer records; see KindPeers
+	ProtocolV17 = 17
+	// ProtocolV18 receivers take a signed identity frame in place of the
+	// sender's bare key; see identityFrame
+	ProtocolV18 = 18
+	// ProtocolV19 numbers chunk frames with a 64-bit index bound to their
+	// encryption, and widens delta signatures and copy ops to 64 bits; see
+	// framing.go
+	ProtocolV19 = 19
+	// ProtocolV20 receivers may expose a directory to list and fetch files
+	// from; see pull.go
+	ProtocolV20 = 20
+	// ProtocolV21 receivers take the empty directories, symbolic links and
+	// named pipes of a synced directory; see KindSyncDir
+	ProtocolV21 = 21
+	// ProtocolV22 receivers check a trailer carrying the hash of the file
+	// as it was sent; see trailer.go
+	ProtocolV22 = 22
+	// ProtocolV23 binds the setup of a transfer with a sealed manifest,
+	// the receiver's preflight answer included, with a MAC from each end;
+	// see binding.go
+	ProtocolV23 = 23
+	// ProtocolV24 lets either end explain why it gave up while data flowed
+	// with an error frame; see errorframe.go
+	ProtocolV24 = 24
+
+	// ProtocolVersion is the highest version this build speaks
+	ProtocolVersion = ProtocolV24
+)
+
+// Cipher suites for chunk encryption. Both use 256-bit keys, 96-bit nonces
+// and 16-byte tags, so they slot into the same framing.
+const (
+	CipherAESGCM   = "aes-256-gcm"
+	CipherChaCha20 = "chacha20-poly1305"
+)
+
+// hasAESHardware reports whether this CPU accelerates AES-GCM. Without it,
+// ChaCha20-Poly1305 is several times faster (e.g. on a Raspberry Pi).
+func hasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasGHASH
+	case "ppc64", "ppc64le":
+		return true
+	}
+	return false
+}
+
+// PreferredCiphers lists the supported suites, fastest on this machine first
+func PreferredCiphers() []string {
+	if hasAESHardware() {
+		return []string{CipherAESGCM, CipherChaCha20}
+	}
+	return []string{CipherChaCha20, CipherAESGCM}
+}
+
+// negotiateCipher picks a suite from the sender's offer, listed in its
+// order of preference. ChaCha20 wins if either side lacks AES hardware;
+// peers that offer nothing predate negotiation and use AES-GCM.
+func negotiateCipher(offered []string) string {
+	if len(offered) == 0 {
+		return CipherAESGCM
+	}
+	if !hasAESHardware() && slices.Contains(offered, CipherChaCha20) {
+		return CipherChaCha20
+	}
+	for _, c := range offered {
+		if c == CipherAESGCM || c == CipherChaCha20 {
+			return c
+		}
+	}
+	return CipherAESGCM
+}
+
+// RekeyInterval is how much plaintext is encrypted under one chunk key in
+// protocol v2 before moving to the next
+const RekeyInterval = 1 << 30
+
+// nonceSize is the base nonce length of both cipher suites
+const nonceSize = 12
+
+// errTooManyChunks is returned when a v1 transfer would reuse a nonce; see
+// MaxFileSize
+var errTooManyChunks = fmt.Errorf("%w: transfer exceeds 2^32 chunks; peer must support protocol v2", ErrProtocolVersion)
+
+// negotiateVersion returns the version to use given the peer's offer. A
+// missing offer means an old peer speaking v1.
+func negotiateVersion(offered int) int {
+	if offered <= 0 {
+		return ProtocolV1
+	}
+	return min(offered, ProtocolVersion)
+}
+
+// chunkCipher encrypts or decrypts the chunk sequence of one transfer,
+// deriving per-chunk nonces and, from v2, rotating keys
+type chunkCipher struct {
+	version   int
+	suite     string
+	fileKey   []byte
+	baseNonce []byte
+
+	aead       cipher.AEAD
+	epoch      uint64
+	counter    uint32
+	index      uint64 // Chunks sealed or opened so far
+	epochBytes int64
+	nonceBuf   [nonceSize]byte
+}
+
+func newChunkCipher(version int, suite string, fileKey, baseNonce []byte) (*chunkCipher, error) {
+	if len(baseNonce) != nonceSize {
+		return nil, fmt.Errorf("invalid nonce size: expected %d, got %d", nonceSize, len(baseNonce))
+	}
+	if suite != CipherAESGCM && suite != CipherChaCha20 {
+		return nil, fmt.Errorf("%w: unknown cipher %q", ErrProtocolVersion, suite)
+	}
+	c := &chunkCipher{version: version, suite: suite, fileKey: fileKey, baseNonce: baseNonce}
+	if err := c.rekey(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// rekey sets up the AEAD for the current epoch
+func (c *chunkCipher) rekey() error {
+	key := c.fileKey
+	if c.version >= ProtocolV2 {
+		info := binary.BigEndian.AppendUint64([]byte("p2p-client chunk key "), c.epoch)
+		var err error
+		key, err = hkdf.Key(sha256.New, c.fileKey, c.baseNonce, string(info), len(c.fileKey))
+		if err != nil {
+			return fmt.Errorf("failed to derive chunk key: %w", err)
+		}
+	}
+	if c.suite == CipherChaCha20 {
+		var err error
+		if c.aead, err = chacha20poly1305.New(key); err != nil {
+			return fmt.Errorf("failed to create cipher: %w", err)
+		}
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("failed to create cipher: %w", err)
+	}
+	c.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return nil
+}
+
+// Overhead returns the ciphertext expansion per chunk
+func (c *chunkCipher) Overhead() int {
+	return c.aead.Overhead()
+}
+
+// nonce derives the current chunk nonce: the base nonce with the counter in
+// its last 4 bytes. It is only valid until the next call.
+func (c *chunkCipher) nonce() []byte {
+	n := c.nonceBuf[:]
+	copy(n, c.baseNonce)
+	binary.BigEndian.PutUint32(n[len(n)-4:], c.counter)
+	return n
+}
+
+// additionalData is what the current chunk is authenticated with besides
+// its contents: from v19 its index, so it can't pass for another chunk
+func (c *chunkCipher) additionalData() []byte {
+	if c.version < ProtocolV19 {
+		return nil
+	}
+	return binary.BigEndian.AppendUint64(nil, c.index)
+}
+
+// seal encrypts the next chunk, appending it to dst
+func (c *chunkCipher) seal(dst, plaintext []byte) ([]byte, error) {
+	ciphertext := c.aead.Seal(dst, c.nonce(), plaintext, c.additionalData())
+	return ciphertext, c.advance(len(plaintext))
+}
+
+// reserve takes the key, nonce and additional data of the next chunk, of n
+// plaintext bytes, to seal it with elsewhere, e.g. on another goroutine.
+// Chunks must still be reserved in order.
+func (c *chunkCipher) reserve(n int) (cipher.AEAD, []byte, []byte, error) {
+	aead, nonce, ad := c.aead, slices.Clone(c.nonce()), c.additionalData()
+	return aead, nonce, ad, c.advance(n)
+}
+
+// open decrypts the next chunk, appending it to dst. Passing
+// ciphertext[:0] as dst decrypts in place.
+func (c *chunkCipher) open(dst, ciphertext []byte) ([]byte, error) {
+	plaintext, err := c.aead.Open(dst, c.nonce(), ciphertext, c.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("%w: chunk failed to decrypt: %w", ErrChecksumMismatch, err)
+	}
+	return plaintext, c.advance(len(plaintext))
+}
+
+// advance moves to the next nonce, rotating the key when due
+func (c *chunkCipher) advance(n int) error {
+	c.index++
+	c.epochBytes += int64(n)
+	if c.version < ProtocolV2 {
+		if c.counter == math.MaxUint32 {
+			return errTooManyChunks
+		}
+		c.counter++
+		return nil
+	}
+	if c.epochBytes >= RekeyInterval || c.counter == math.MaxUint32 {
+		c.epoch++
+		c.counter = 0
+		c.epochBytes = 0
+		return c.rekey()
+	}
+	c.counter++
+	return nil
+}
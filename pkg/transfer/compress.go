@@ -0,0 +1,48 @@
+package transfer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed chunks (protocol v13): a sender asked to compress runs each
+// chunk through zstd before encrypting it, and sends the result instead of
+// the chunk when it is smaller, setting compressFlag in the chunk length.
+// Chunks that don't shrink, such as already compressed media, go as they
+// are, so compression costs little beyond the CPU time on such files.
+
+// compressFlag marks a compressed chunk in the chunk length
+const compressFlag = 1 << 28
+
+// zstdEncoder compresses chunks; EncodeAll may be called concurrently
+var zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+	enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	return enc
+})
+
+// zstdDecoder decompresses chunks, refusing any larger than MaxChunkSize
+var zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+	dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MaxChunkSize))
+	return dec
+})
+
+// compressChunk compresses p into dst, which must have room for len(p)
+// bytes, and reports whether the result is smaller than p
+func compressChunk(dst, p []byte) ([]byte, bool) {
+	out := zstdEncoder().EncodeAll(p, dst[:0])
+	return out, len(out) < len(p)
+}
+
+// decompressChunk decompresses a chunk into dst, growing it as needed
+func decompressChunk(dst, p []byte) ([]byte, error) {
+	out, err := zstdDecoder().DecodeAll(p, dst[:0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress chunk: %w", err)
+	}
+	if len(out) > MaxChunkSize {
+		return nil, fmt.Errorf("chunk too large: %d bytes decompressed", len(out))
+	}
+	return out, nil
+}
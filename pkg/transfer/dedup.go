@@ -0,0 +1,202 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// A receiver that already holds a file with the content hash named in the
+// manifest links that copy into place and answers CodeAlreadyHave, so the
+// sender doesn't send it again. Copies are found in a HashIndex of files
+// received earlier, or by hashing files of the same size in the output
+// directory.
+
+// HashIndexFile is the name of the content hash index in the data directory
+const HashIndexFile = "hash-index.json"
+
+// indexEntry records the hashes of a file as of its size and mtime; a
+// changed file is hashed again
+type indexEntry struct {
+	Size    int64             `json:"size"`
+	ModTime time.Time         `json:"mod_time"`
+	Hashes  map[string]string `json:"hashes"` // algorithm to hex digest
+}
+
+// HashIndex maps the content hashes of received files to their paths
+type HashIndex struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*indexEntry // by absolute path
+}
+
+// OpenHashIndex loads the index stored at path, starting an empty one if
+// the file doesn't exist yet
+func OpenHashIndex(path string) (*HashIndex, error) {
+	idx := &HashIndex{path: path, entries: make(map[string]*indexEntry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hash index: %w", err)
+	}
+	if err := json.Unmarshal(data, &idx.entries); err != nil {
+		return nil, fmt.Errorf("invalid hash index %s: %w", path, err)
+	}
+	return idx, nil
+}
+
+// DefaultHashIndex opens the index in ~/.p2p-client
+func DefaultHashIndex() (*HashIndex, error) {
+	dir, err := util.DataDir()
+	if err != nil {
+		return nil, err
+	}
+	return OpenHashIndex(filepath.Join(dir, HashIndexFile))
+}
+
+// Add records that the file at path has hash under alg
+func (x *HashIndex) Add(path, alg, hash string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.record(path, info, alg, hash)
+	return x.save()
+}
+
+// record stores hash for path, dropping hashes of an older version
+func (x *HashIndex) record(path string, info os.FileInfo, alg, hash string) {
+	e := x.entries[path]
+	if e == nil || e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) {
+		e = &indexEntry{Size: info.Size(), ModTime: info.ModTime(), Hashes: make(map[string]string)}
+		x.entries[path] = e
+	}
+	e.Hashes[alg] = hash
+}
+
+// Find returns a file with the given size and content hash: one the index
+// knows of, or else one in dir, hashing files of that size there as needed.
+// It returns "" if there is none.
+func (x *HashIndex) Find(dir, alg, hash string, size int64) string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	defer x.save()
+
+	for path, e := range x.entries {
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(x.entries, path)
+			continue
+		}
+		if e.Hashes[alg] == hash && e.Size == size && info.Size() == size && info.ModTime().Equal(e.ModTime) {
+			return path
+		}
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Size() != size || strings.HasSuffix(f.Name(), PartSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		if e := x.entries[path]; e != nil && e.Size == size && e.ModTime.Equal(info.ModTime()) && e.Hashes[alg] != "" {
+			continue // known, and checked above
+		}
+		got, err := HashFile(path, alg)
+		if err != nil {
+			log.Debug("Cannot hash file for deduplication", "path", path, "error", err)
+			continue
+		}
+		x.record(path, info, alg, got)
+		if got == hash {
+			return path
+		}
+	}
+	return ""
+}
+
+// save writes the index out; callers hold mu
+func (x *HashIndex) save() error {
+	data, err := json.MarshalIndent(x.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode hash index: %w", err)
+	}
+	tmp := x.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write hash index: %w", err)
+	}
+	if err := os.Rename(tmp, x.path); err != nil {
+		return fmt.Errorf("failed to write hash index: %w", err)
+	}
+	return nil
+}
+
+// linkExisting puts the content of src at dest: a hard link where the
+// filesystem allows it, else a copy. dest is replaced only once complete.
+func linkExisting(src, dest string) error {
+	if a, err := os.Stat(src); err == nil {
+		if b, err := os.Stat(dest); err == nil && os.SameFile(a, b) {
+			return nil
+		}
+	}
+	tmp := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".dedup")
+	os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		if err := copyFile(src, tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// copyFile copies src to a new file dest with the same permissions
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
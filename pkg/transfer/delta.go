@@ -0,0 +1,521 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Delta transfers (protocol v3) follow rsync: when the receiver already has
+// a file with the same name, it sends checksums of that file's blocks, and
+// the sender answers with an op stream that copies matching blocks from the
+// old file and carries only the changed bytes. The op stream is encrypted
+// and chunked exactly like plain file data.
+
+const (
+	// minDeltaBasis is the smallest existing file worth diffing against
+	minDeltaBasis = 64 * 1024
+
+	minDeltaBlock = 2 * 1024
+	maxDeltaBlock = 1024 * 1024
+	// maxWideDeltaBlock is the largest block from v19
+	maxWideDeltaBlock = 64 * 1024 * 1024
+
+	// sigHeaderSize is the length of the block size and file size opening
+	// a signature frame, and sigSize that of each block's signature
+	sigHeaderSize = 12
+	sigSize       = 4 + strongSize
+	// maxWideSigBlocks bounds the blocks listed in a v19 signature frame,
+	// whose 64-bit length would otherwise let the receiver ask for any
+	// amount of memory
+	maxWideSigBlocks = 1 << 28
+
+	// maxLiteral bounds the data carried by one literal op
+	maxLiteral = 256 * 1024
+
+	strongSize = 16
+
+	opLiteral byte = 'L' // uint32 length, then data
+	opCopy    byte = 'C' // uint32 first block, uint32 block count; uint64 each from v19
+)
+
+// blockSignature identifies one block of the receiver's existing file
+type blockSignature struct {
+	weak   uint32
+	strong [strongSize]byte
+}
+
+// signatures describes the receiver's existing copy of a file
+type signatures struct {
+	blockSize int
+	size      int64
+	blocks    []blockSignature
+	wide      bool // 64-bit signature frame and copy ops, from v19
+}
+
+// deltaBlockSize picks a block size near the square root of the file size,
+// as rsync does, balancing signature size against match granularity
+func deltaBlockSize(size int64, version int) int {
+	bs := int(math.Sqrt(float64(size)))
+	bs = (bs + 1023) &^ 1023
+	return min(max(bs, minDeltaBlock), maxBlockSize(version))
+}
+
+// maxBlockSize returns the largest block protocol version allows
+func maxBlockSize(version int) int {
+	if version >= ProtocolV19 {
+		return maxWideDeltaBlock
+	}
+	return maxDeltaBlock
+}
+
+// maxSigBlocks returns how many blocks a signature frame of protocol
+// version may list
+func maxSigBlocks(version int) int64 {
+	if version >= ProtocolV19 {
+		return maxWideSigBlocks
+	}
+	return (math.MaxUint32 - sigHeaderSize) / sigSize
+}
+
+// weakSum is the rsync rolling checksum of a block
+func weakSum(block []byte) (a, b uint32) {
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+func strongSum(block []byte) (s [strongSize]byte) {
+	sum := sha256.Sum256(block)
+	copy(s[:], sum[:])
+	return s
+}
+
+// computeSignatures reads f, the receiver's existing file, block by block,
+// for a transfer over protocol version
+func computeSignatures(f *os.File, size int64, version int) (*signatures, error) {
+	sigs := &signatures{blockSize: deltaBlockSize(size, version), size: size, wide: version >= ProtocolV19}
+	if blocks := (size + int64(sigs.blockSize) - 1) / int64(sigs.blockSize); blocks > maxSigBlocks(version) {
+		return nil, fmt.Errorf("%w: existing copy of %s is too large to compare with the sender's over protocol v%d", ErrProtocolVersion, util.FormatSize(size), version)
+	}
+	buf := make([]byte, sigs.blockSize)
+	r := bufio.NewReaderSize(io.NewSectionReader(f, 0, size), 256*1024)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			a, b := weakSum(buf[:n])
+			sigs.blocks = append(sigs.blocks, blockSignature{weak: a | b<<16, strong: strongSum(buf[:n])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sigs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read existing file: %w", err)
+		}
+	}
+}
+
+// sendSignatures writes the signature frame; nil sigs means "no basis".
+// From v19 its length is a uint64.
+func sendSignatures(w io.Writer, sigs *signatures, version int) error {
+	var buf bytes.Buffer
+	if sigs != nil {
+		binary.Write(&buf, binary.BigEndian, uint32(sigs.blockSize))
+		binary.Write(&buf, binary.BigEndian, uint64(sigs.size))
+		for _, s := range sigs.blocks {
+			binary.Write(&buf, binary.BigEndian, s.weak)
+			buf.Write(s.strong[:])
+		}
+	}
+	send := util.SendWithLength
+	if version >= ProtocolV19 {
+		send = util.SendWithLength64
+	}
+	if err := send(w, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to send block signatures: %w", err)
+	}
+	return nil
+}
+
+// readSignatures reads the signature frame, returning nil if the receiver
+// has nothing to diff against
+func readSignatures(r io.Reader, version int) (*signatures, error) {
+	var data []byte
+	var err error
+	if version >= ProtocolV19 {
+		data, err = util.ReadWithLength64(r, sigHeaderSize+maxSigBlocks(version)*sigSize)
+	} else {
+		data, err = util.ReadWithLength(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block signatures: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if len(data) < sigHeaderSize || (len(data)-sigHeaderSize)%sigSize != 0 {
+		return nil, errors.New("invalid block signatures")
+	}
+	sigs := &signatures{
+		blockSize: int(binary.BigEndian.Uint32(data)),
+		size:      int64(binary.BigEndian.Uint64(data[4:])),
+		wide:      version >= ProtocolV19,
+	}
+	if sigs.blockSize < minDeltaBlock || sigs.blockSize > maxBlockSize(version) {
+		return nil, fmt.Errorf("invalid delta block size %d", sigs.blockSize)
+	}
+	// The encoders index blocks by offset, so there must be one per block
+	// of the declared size
+	blocks := (len(data) - sigHeaderSize) / sigSize
+	bs := int64(sigs.blockSize)
+	if sigs.size < 0 || sigs.size/bs+min(sigs.size%bs, 1) != int64(blocks) {
+		return nil, fmt.Errorf("%d block signatures don't cover %d bytes", blocks, sigs.size)
+	}
+	for p := data[sigHeaderSize:]; len(p) > 0; p = p[sigSize:] {
+		s := blockSignature{weak: binary.BigEndian.Uint32(p)}
+		copy(s.strong[:], p[4:])
+		sigs.blocks = append(sigs.blocks, s)
+	}
+	return sigs, nil
+}
+
+// deltaReader returns the op stream encode makes to turn the receiver's file
+// into the contents of src
+func deltaReader(src io.Reader, sigs *signatures, encode func(w io.Writer, src io.Reader, sigs *signatures) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriterSize(pw, 64*1024)
+		err := encode(w, src, sigs)
+		if err == nil {
+			err = w.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// opWriter writes an op stream, merging copies of consecutive blocks into
+// one op
+type opWriter struct {
+	w                io.Writer
+	wide             bool // 64-bit copy ops, from v19
+	hdr              [17]byte
+	runStart, runLen int
+}
+
+// flushRun writes the pending copy op, if any
+func (o *opWriter) flushRun() error {
+	if o.runLen == 0 {
+		return nil
+	}
+	hdr := append(o.hdr[:0], opCopy)
+	if o.wide {
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(o.runStart))
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(o.runLen))
+	} else {
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(o.runStart))
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(o.runLen))
+	}
+	o.runStart, o.runLen = -1, 0
+	_, err := o.w.Write(hdr)
+	return err
+}
+
+// copyBlock copies block i of the basis
+func (o *opWriter) copyBlock(i int) error {
+	if o.runLen > 0 && o.runStart+o.runLen == i {
+		o.runLen++
+		return nil
+	}
+	if err := o.flushRun(); err != nil {
+		return err
+	}
+	o.runStart, o.runLen = i, 1
+	return nil
+}
+
+// literal carries p, which must not exceed maxLiteral
+func (o *opWriter) literal(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := o.flushRun(); err != nil {
+		return err
+	}
+	o.hdr[0] = opLiteral
+	binary.BigEndian.PutUint32(o.hdr[1:], uint32(len(p)))
+	if _, err := o.w.Write(o.hdr[:5]); err != nil {
+		return err
+	}
+	_, err := o.w.Write(p)
+	return err
+}
+
+// encodeDelta slides a block-sized window over src, emitting copy ops for
+// blocks the receiver has and literal ops for everything else
+func encodeDelta(w io.Writer, src io.Reader, sigs *signatures) error {
+	bs := sigs.blockSize
+	index := make(map[uint32][]int, len(sigs.blocks))
+	for i, s := range sigs.blocks {
+		index[s.weak] = append(index[s.weak], i)
+	}
+	// The last block of the basis may be short; it can only match at the end
+	tailLen := int(sigs.size - int64(len(sigs.blocks)-1)*int64(bs))
+
+	ops := &opWriter{w: w, wide: sigs.wide, runStart: -1}
+	match := func(weak uint32, block []byte) int {
+		cands := index[weak]
+		if len(cands) == 0 {
+			return -1
+		}
+		strong := strongSum(block)
+		for _, i := range cands {
+			if sigs.blocks[i].strong == strong && (i < len(sigs.blocks)-1 || len(block) == tailLen) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// data holds the pending literal followed by the window
+	data := make([]byte, 0, 2*bs+maxLiteral)
+	lit, pos := 0, 0
+	eof := false
+	fill := func() error {
+		if eof || len(data)-pos >= bs {
+			return nil
+		}
+		if lit > 0 {
+			n := copy(data, data[lit:])
+			data = data[:n]
+			pos -= lit
+			lit = 0
+		}
+		n, err := io.ReadFull(src, data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+			return nil
+		}
+		return err
+	}
+
+	var a, b uint32
+	fresh := true
+	for {
+		if err := fill(); err != nil {
+			return err
+		}
+		if len(data)-pos < bs {
+			// Fewer than a block left: it may still match the basis tail
+			rest := data[pos:]
+			if len(rest) > 0 && len(rest) == tailLen {
+				ra, rb := weakSum(rest)
+				if i := match(ra|rb<<16, rest); i >= 0 {
+					if err := ops.literal(data[lit:pos]); err != nil {
+						return err
+					}
+					if err := ops.copyBlock(i); err != nil {
+						return err
+					}
+					return ops.flushRun()
+				}
+			}
+			for p := data[lit:]; len(p) > 0; {
+				n := min(len(p), maxLiteral)
+				if err := ops.literal(p[:n]); err != nil {
+					return err
+				}
+				p = p[n:]
+			}
+			return ops.flushRun()
+		}
+
+		window := data[pos : pos+bs]
+		if fresh {
+			a, b = weakSum(window)
+			fresh = false
+		}
+		if i := match(a|b<<16, window); i >= 0 {
+			if err := ops.literal(data[lit:pos]); err != nil {
+				return err
+			}
+			if err := ops.copyBlock(i); err != nil {
+				return err
+			}
+			pos += bs
+			lit = pos
+			fresh = true
+			continue
+		}
+
+		// Roll the window forward one byte
+		out := uint32(data[pos])
+		pos++
+		if pos+bs <= len(data) {
+			in := uint32(data[pos+bs-1])
+			a = (a - out + in) & 0xffff
+			b = (b - uint32(bs)*out + a) & 0xffff
+		} else {
+			fresh = true
+		}
+		if pos-lit >= maxLiteral {
+			if err := ops.literal(data[lit:pos]); err != nil {
+				return err
+			}
+			lit = pos
+		}
+	}
+}
+
+// encodeResume is encodeDelta for a receiver resuming from the start of
+// the file it kept (protocol v16): each whole block of src within the kept
+// part is checked against the block at the same place only, matching ones
+// are copied and the rest is sent, so a part corrupted on the receiver's disk
+// is mended rather than trusted. The part's short last block is sent again.
+func encodeResume(w io.Writer, src io.Reader, sigs *signatures) error {
+	ops := &opWriter{w: w, wide: sigs.wide, runStart: -1}
+	buf := make([]byte, max(sigs.blockSize, maxLiteral))
+	send := func(p []byte) error {
+		for len(p) > 0 {
+			n := min(len(p), maxLiteral)
+			if err := ops.literal(p[:n]); err != nil {
+				return err
+			}
+			p = p[n:]
+		}
+		return nil
+	}
+
+	mismatched := 0
+	whole := int(sigs.size / int64(sigs.blockSize))
+	for i := range whole {
+		block := buf[:sigs.blockSize]
+		n, err := io.ReadFull(src, block)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// The file shrank; the receipt check will tell
+			if err := send(block[:n]); err != nil {
+				return err
+			}
+			return ops.flushRun()
+		}
+		if err != nil {
+			return err
+		}
+		if strongSum(block) == sigs.blocks[i].strong {
+			err = ops.copyBlock(i)
+		} else {
+			mismatched++
+			err = send(block)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if mismatched > 0 {
+		log.Warn("Receiver's kept data doesn't match the file; sending those blocks again", "blocks", mismatched, "block_size", sigs.blockSize)
+	}
+
+	for {
+		n, err := io.ReadFull(src, buf[:maxLiteral])
+		if err := ops.literal(buf[:n]); err != nil {
+			return err
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ops.flushRun()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deltaWriter applies an op stream written to it, reconstructing the new
+// file from basis and the literal data
+type deltaWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+	once sync.Once
+	err  error
+}
+
+func newDeltaWriter(out io.Writer, basis io.ReaderAt, sigs *signatures) *deltaWriter {
+	pr, pw := io.Pipe()
+	d := &deltaWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := decodeDelta(out, bufio.NewReaderSize(pr, 64*1024), basis, sigs)
+		pr.CloseWithError(err)
+		d.done <- err
+	}()
+	return d
+}
+
+func (d *deltaWriter) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+// Close ends the op stream and waits for the reconstruction to finish
+func (d *deltaWriter) Close() error {
+	d.once.Do(func() {
+		d.pw.Close()
+		d.err = <-d.done
+	})
+	return d.err
+}
+
+func decodeDelta(out io.Writer, r io.Reader, basis io.ReaderAt, sigs *signatures) error {
+	var hdr [16]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:1]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch hdr[0] {
+		case opLiteral:
+			if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+				return fmt.Errorf("truncated delta op: %w", err)
+			}
+			n := int64(binary.BigEndian.Uint32(hdr[:4]))
+			if _, err := io.CopyN(out, r, n); err != nil {
+				return fmt.Errorf("failed to apply delta: %w", err)
+			}
+		case opCopy:
+			var first, count uint64
+			if sigs.wide {
+				if _, err := io.ReadFull(r, hdr[:16]); err != nil {
+					return fmt.Errorf("truncated delta op: %w", err)
+				}
+				first, count = binary.BigEndian.Uint64(hdr[:8]), binary.BigEndian.Uint64(hdr[8:])
+			} else {
+				if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+					return fmt.Errorf("truncated delta op: %w", err)
+				}
+				first, count = uint64(binary.BigEndian.Uint32(hdr[:4])), uint64(binary.BigEndian.Uint32(hdr[4:]))
+			}
+			if count == 0 || first > uint64(len(sigs.blocks)) || count > uint64(len(sigs.blocks))-first {
+				return fmt.Errorf("delta references blocks %d+%d beyond existing file", first, count)
+			}
+			off := int64(first) * int64(sigs.blockSize)
+			n := min(int64(count)*int64(sigs.blockSize), sigs.size-off)
+			if _, err := io.Copy(out, io.NewSectionReader(basis, off, n)); err != nil {
+				return fmt.Errorf("failed to copy from existing file: %w", err)
+			}
+		default:
+			return fmt.Errorf("unknown delta op %q", hdr[0])
+		}
+	}
+}
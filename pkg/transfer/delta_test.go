@@ -0,0 +1,43 @@
+package transfer
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestReadSignatures checks that a signature frame is refused unless it has
+// one block per block of the size it declares
+func TestReadSignatures(t *testing.T) {
+	for _, tt := range []struct {
+		size   int64
+		blocks int
+		ok     bool
+	}{
+		{0, 0, true},
+		{1, 1, true},
+		{minDeltaBlock, 1, true},
+		{minDeltaBlock + 1, 2, true},
+		{minDeltaBlock, 0, false},
+		{1, 0, false},
+		{minDeltaBlock + 1, 1, false},
+		{minDeltaBlock, 2, false},
+		{-1, 0, false},
+	} {
+		sigs := &signatures{blockSize: minDeltaBlock, size: tt.size, blocks: make([]blockSignature, tt.blocks)}
+		var buf bytes.Buffer
+		if err := sendSignatures(&buf, sigs, ProtocolVersion); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readSignatures(&buf, ProtocolVersion)
+		if (err == nil) != tt.ok {
+			t.Errorf("size %d with %d blocks: got error %v", tt.size, tt.blocks, err)
+		}
+		if err == nil {
+			// A resume against what was accepted must not index past the blocks
+			if err := encodeResume(io.Discard, bytes.NewReader(make([]byte, tt.size)), got); err != nil {
+				t.Errorf("size %d with %d blocks: resume: %v", tt.size, tt.blocks, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Error frames (protocol v24): a refusal is answered in the preflight and
+// a file that fails its checks in the final status, but an end that failed
+// while data flowed, a receiver whose disk filled up or a sender whose file
+// changed under it, used to just close the connection, and the other end
+// reported a failed read or write. Now it first sends an error frame with
+// a code and the message it logs. The sender writes a chunk length with
+// errorFlag set followed by the frame; the receiver writes ackError, the
+// frame's length as a uint32 and the frame among its acknowledgements,
+// before ackDone. Frames are sealed like the final status, each direction
+// under a nonce of its own.
+
+// errorFlag marks the sender's error frame in the chunk length
+const errorFlag = 1 << 26
+
+// ackError introduces the receiver's error frame among acknowledgements
+const ackError = ackChat - 1
+
+// maxErrorFrame bounds an error frame
+const maxErrorFrame = 8192
+
+// errorGrace is how long a sender whose write failed waits for the
+// receiver's error frame explaining it
+const errorGrace = 2 * time.Second
+
+// Error codes senders send, besides CodeRejected
+const (
+	CodeFileChanged = "file_changed"
+	CodeReadFailed  = "read_failed"
+)
+
+// errorFrame reports why one end gave up on a transfer
+type errorFrame struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// SenderError reports a transfer the sender gave up on while data flowed
+type SenderError struct {
+	Code    string
+	Message string
+}
+
+func (e *SenderError) Error() string {
+	return fmt.Sprintf("sender aborted the transfer (%s): %s", e.Code, e.Message)
+}
+
+// Is lets errors.Is match a SenderError against the sentinel for its code
+func (e *SenderError) Is(target error) bool {
+	switch e.Code {
+	case CodeFileChanged:
+		return target == ErrFileChanged
+	case CodeRejected:
+		return target == ErrRejected
+	}
+	return false
+}
+
+// reportable reports whether err is worth an error frame: not one the
+// other end sent us, nor a broken connection it already knows about
+func reportable(err error) bool {
+	var sender *SenderError
+	var delivery *DeliveryError
+	return err != nil && !errors.As(err, &sender) && !errors.As(err, &delivery) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// encodeError seals the error frame for err as frame n
+func encodeError(s *frameSealer, n byte, code string, err error) ([]byte, error) {
+	msg := err.Error()
+	if len(msg) > maxErrorFrame/2 {
+		msg = msg[:maxErrorFrame/2]
+	}
+	data, jerr := json.Marshal(errorFrame{Code: code, Message: msg})
+	if jerr != nil {
+		return nil, fmt.Errorf("failed to encode error frame: %w", jerr)
+	}
+	return s.seal(n, data), nil
+}
+
+// decodeError reads a sealed error frame of size bytes from r
+func decodeError(r io.Reader, s *frameSealer, n byte, size uint32) (*errorFrame, error) {
+	if size > maxErrorFrame {
+		return nil, fmt.Errorf("error frame too large: %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("failed to read error frame: %w", err)
+	}
+	data, err := s.open(n, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sealed error frame: %w", err)
+	}
+	var f errorFrame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid error frame: %w", err)
+	}
+	return &f, nil
+}
+
+// senderAbort tells the receiver why the sender is giving up
+func senderAbort(w io.Writer, s *frameSealer, err error) error {
+	code := CodeReadFailed
+	if errors.Is(err, ErrFileChanged) {
+		code = CodeFileChanged
+	}
+	data, err := encodeError(s, sealedSenderErrorFrame, code, err)
+	if err != nil {
+		return err
+	}
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(data))|errorFlag)
+	if _, err := w.Write(append(frame, data...)); err != nil {
+		return fmt.Errorf("failed to send error frame: %w", err)
+	}
+	return nil
+}
+
+// readSenderAbort reads the sender's error frame of size bytes
+func readSenderAbort(r io.Reader, s *frameSealer, size uint32) error {
+	f, err := decodeError(r, s, sealedSenderErrorFrame, size)
+	if err != nil {
+		return err
+	}
+	return &SenderError{Code: f.Code, Message: f.Message}
+}
+
+// receiverAbort tells the sender why the receiver is giving up
+func receiverAbort(w io.Writer, s *frameSealer, err error) error {
+	data, err := encodeError(s, sealedReceiverErrorFrame, statusCode(err), err)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint64(ackError)); err != nil {
+		return fmt.Errorf("failed to send error frame: %w", err)
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return fmt.Errorf("failed to send error frame: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to send error frame: %w", err)
+	}
+	return nil
+}
+
+// readReceiverAbort reads the receiver's error frame after ackError
+func readReceiverAbort(r io.Reader, s *frameSealer) error {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return fmt.Errorf("failed to read error frame: %w", err)
+	}
+	f, err := decodeError(r, s, sealedReceiverErrorFrame, size)
+	if err != nil {
+		return err
+	}
+	return &DeliveryError{Code: f.Code, Message: f.Message}
+}
@@ -0,0 +1,43 @@
+package transfer
+
+import "errors"
+
+// Errors returned by senders and receivers, matched with errors.Is. Refusals
+// reported by the remote side arrive as a *RemoteError, and failures after
+// the data was sent as a *DeliveryError; both match the sentinel for their
+// code.
+var (
+	// ErrRejected is returned when the receiver declines a transfer
+	ErrRejected = errors.New("transfer rejected")
+	// ErrInsufficientSpace is returned when the destination can't hold the file
+	ErrInsufficientSpace = errors.New("insufficient disk space")
+	// ErrSenderNotAllowed is returned when the sender's key isn't on the
+	// receiver's allowlist
+	ErrSenderNotAllowed = errors.New("sender not allowed")
+	// ErrQuotaExceeded is returned when a sender has used up its quota
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrAlreadyHave is reported by receivers that already hold the file's
+	// content; senders treat it as delivered
+	ErrAlreadyHave = errors.New("receiver already has the file")
+	// ErrChecksumMismatch is returned when received data fails its integrity
+	// check, or the receipt doesn't cover what was sent
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrProtocolVersion is returned when the peers can't agree on a protocol
+	// version able to carry the transfer
+	ErrProtocolVersion = errors.New("unsupported protocol version")
+	// ErrInvalidReceipt is returned when a delivery receipt isn't signed by
+	// the receiver's key
+	ErrInvalidReceipt = errors.New("invalid receipt")
+	// ErrReceiverStalled is returned when the receiver stops acknowledging
+	// chunks for longer than AckTimeout
+	ErrReceiverStalled = errors.New("receiver stalled")
+	// ErrModeRefused is returned when the operating mode of either side
+	// forbids the transfer
+	ErrModeRefused = errors.New("refused by operating mode")
+	// ErrDeliveryFailed is returned when the receiver got all the data but
+	// failed to verify or store the file
+	ErrDeliveryFailed = errors.New("delivery failed")
+	// ErrFileChanged is returned when the file being sent is modified before
+	// all of it was sent
+	ErrFileChanged = errors.New("file changed while sending")
+)
@@ -0,0 +1,305 @@
+package transfer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Archive extraction: a sender flags a file whose name marks it as an
+// archive in Manifest.Archive, and a receiver with ReceiveOptions.Extract
+// unpacks it into its output directory instead of storing it. Tar archives,
+// gzipped or not, are unpacked as they arrive, so the archive itself never
+// touches the disk; zip archives keep their index at the end, so they are
+// written to a temporary file first. Entries are unpacked into a staging
+// directory next to the output, which takes its place only once the
+// transfer has arrived whole and passed its hash check; a transfer that
+// breaks off or fails leaves nothing behind, and isn't resumed.
+//
+// Only regular files and directories are unpacked. Entries with absolute
+// paths or paths climbing out with "..", links and devices are skipped,
+// and file modes lose their setuid, setgid and sticky bits. An archive
+// that expands beyond the free disk space is refused.
+
+// Archive formats a manifest may flag
+const (
+	ArchiveTar   = "tar"
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// ErrExtract is returned when a received archive can't be unpacked
+var ErrExtract = errors.New("cannot extract archive")
+
+// archiveFormat returns the archive format the name of a file marks, or ""
+func archiveFormat(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return ArchiveTarGz
+	case strings.HasSuffix(lower, ".tar"):
+		return ArchiveTar
+	case strings.HasSuffix(lower, ".zip"):
+		return ArchiveZip
+	}
+	return ""
+}
+
+// extraction unpacks a received archive into outputDir
+type extraction struct {
+	format    string
+	outputDir string
+	staging   string // Directory entries are unpacked into
+	metadata  bool   // Restore modes and modification times from the archive
+	limit     int64  // Bytes the archive may expand to
+	written   int64
+
+	pw   *io.PipeWriter // Tar data on its way to the unpacking goroutine
+	done chan error     // Result of unpacking a tar
+	zip  *os.File       // Zip archive, unpacked once complete
+}
+
+// newExtraction prepares to unpack the archive m describes into outputDir
+func newExtraction(outputDir string, m *Manifest, metadata bool) (*extraction, error) {
+	if m.Archive != ArchiveTar && m.Archive != ArchiveTarGz && m.Archive != ArchiveZip {
+		return nil, fmt.Errorf("%w: unknown format %q", ErrExtract, m.Archive)
+	}
+	return &extraction{format: m.Archive, outputDir: outputDir, metadata: metadata, limit: -1}, nil
+}
+
+// sink returns the sink the archive m describes is written to. Its
+// concrete type is hidden so skip frames are written out as zeros.
+func (e *extraction) sink(m *Manifest) (io.Writer, func() error, func(bool) error, error) {
+	staging, err := os.MkdirTemp(e.outputDir, "."+filepath.Base(m.FileName)+".extract-*")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	e.staging = staging
+	if free, err := util.FreeSpace(e.outputDir); err == nil {
+		e.limit = int64(free)
+	}
+	if e.format == ArchiveZip {
+		f, err := os.CreateTemp(e.outputDir, filepath.Base(e.staging)+".zip-*")
+		if err != nil {
+			os.RemoveAll(e.staging)
+			return nil, nil, nil, fmt.Errorf("failed to create output file: %w", err)
+		}
+		e.zip = f
+		return struct{ io.Writer }{f}, e.discard, e.finish, nil
+	}
+	pr, pw := io.Pipe()
+	e.pw, e.done = pw, make(chan error, 1)
+	go func() {
+		err := e.untar(pr)
+		// Take whatever follows the archive, so the transfer isn't stalled
+		if err == nil {
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		e.done <- err
+	}()
+	return pw, e.discard, e.finish, nil
+}
+
+// discard removes everything unpacked
+func (e *extraction) discard() error {
+	return os.RemoveAll(e.staging)
+}
+
+// finish ends the extraction and, if the archive arrived whole, moves what
+// it holds into the output directory
+func (e *extraction) finish(complete bool) error {
+	var err error
+	if e.zip != nil {
+		err = e.zip.Close()
+		if err == nil && complete {
+			err = e.unzip(e.zip.Name())
+		}
+		os.Remove(e.zip.Name())
+	} else {
+		if complete {
+			e.pw.Close()
+		} else {
+			e.pw.CloseWithError(io.ErrUnexpectedEOF)
+		}
+		err = <-e.done
+	}
+	if err == nil && complete {
+		err = e.commit()
+	}
+	if err != nil || !complete {
+		os.RemoveAll(e.staging)
+	}
+	return err
+}
+
+// untar unpacks a tar archive, gzipped if the format says so, from r
+func (e *extraction) untar(r io.Reader) error {
+	if e.format == ArchiveTarGz {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrExtract, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrExtract, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = e.mkdir(hdr.Name)
+		case tar.TypeReg:
+			err = e.create(hdr.Name, hdr.FileInfo().Mode(), hdr.ModTime, tr)
+		case tar.TypeXGlobalHeader:
+		default:
+			log.Warn("Skipping archive entry that isn't a file or directory", "entry", hdr.Name, "type", string(hdr.Typeflag))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// unzip unpacks the zip archive at path
+func (e *extraction) unzip(path string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrExtract, err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = e.mkdir(f.Name)
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			if rc, err = f.Open(); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrExtract, f.Name, err)
+			}
+			err = e.create(f.Name, mode, f.Modified, rc)
+			rc.Close()
+		default:
+			log.Warn("Skipping archive entry that isn't a file or directory", "entry", f.Name, "mode", mode.String())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryPath returns where an archive entry goes in the staging directory,
+// or "" for one that would land outside it
+func (e *extraction) entryPath(name string) string {
+	name = filepath.FromSlash(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.TrimSuffix(name, string(filepath.Separator))
+	if !filepath.IsLocal(name) {
+		log.Warn("Skipping archive entry with an unsafe path", "entry", name)
+		return ""
+	}
+	return filepath.Join(e.staging, name)
+}
+
+// mkdir creates a directory entry
+func (e *extraction) mkdir(name string) error {
+	path := e.entryPath(name)
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("%w: %v", ErrExtract, err)
+	}
+	return nil
+}
+
+// create writes a file entry from r
+func (e *extraction) create(name string, mode fs.FileMode, modTime time.Time, r io.Reader) error {
+	path := e.entryPath(name)
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("%w: %v", ErrExtract, err)
+	}
+	perm := fs.FileMode(0644)
+	if e.metadata && mode.Perm() != 0 {
+		perm = mode.Perm()
+	}
+	// A second entry of the same name replaces the first, as tar does
+	os.Remove(path)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrExtract, err)
+	}
+	var src io.Reader = r
+	if e.limit >= 0 {
+		src = io.LimitReader(r, e.limit-e.written+1)
+	}
+	n, err := io.Copy(f, src)
+	e.written += n
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrExtract, name, err)
+	}
+	if e.limit >= 0 && e.written > e.limit {
+		return fmt.Errorf("%w: it expands beyond the %d bytes free", ErrExtract, e.limit)
+	}
+	if e.metadata && !modTime.IsZero() {
+		os.Chtimes(path, time.Time{}, modTime)
+	}
+	return nil
+}
+
+// commit moves what was unpacked into the output directory, merging
+// directories and replacing files of the same name
+func (e *extraction) commit() error {
+	entries := 0
+	err := filepath.WalkDir(e.staging, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == e.staging {
+			return err
+		}
+		rel, err := filepath.Rel(e.staging, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(e.outputDir, rel)
+		info, statErr := os.Lstat(target)
+		if d.IsDir() {
+			if statErr == nil && !info.IsDir() {
+				return fmt.Errorf("%w: %s exists and isn't a directory", ErrExtract, target)
+			}
+			return os.MkdirAll(target, 0755)
+		}
+		if statErr == nil && info.IsDir() {
+			return fmt.Errorf("%w: %s is a directory", ErrExtract, target)
+		}
+		entries++
+		return os.Rename(path, target)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move extracted files into place: %w", err)
+	}
+	syncDir(e.outputDir)
+	log.Info("Extracted archive", "dir", e.outputDir, "files", entries, "bytes", e.written)
+	return os.RemoveAll(e.staging)
+}
@@ -0,0 +1,89 @@
+package transfer
+
+import (
+	"crypto/rsa"
+	"io"
+	"slices"
+	"sync"
+)
+
+// fanoutBlock is how much of the source is handed to the readers at a time
+const fanoutBlock = 256 * 1024
+
+// Fanout reads a source once and feeds the same bytes to several readers,
+// so a file sent to many peers at once is read from disk a single time.
+// The readers advance in lockstep, so the slowest one sets the pace. A
+// reader that is closed, e.g. because its send failed, is dropped without
+// holding up the rest.
+type Fanout struct {
+	src     io.Reader
+	readers []*io.PipeReader
+	writers []*io.PipeWriter
+}
+
+// NewFanout creates a Fanout with n readers of src
+func NewFanout(src io.Reader, n int) *Fanout {
+	f := &Fanout{src: src}
+	for range n {
+		pr, pw := io.Pipe()
+		f.readers = append(f.readers, pr)
+		f.writers = append(f.writers, pw)
+	}
+	return f
+}
+
+// Reader returns the i'th copy of the source. Its consumer must close it
+// once done, whether or not it read everything.
+func (f *Fanout) Reader(i int) io.ReadCloser {
+	return f.readers[i]
+}
+
+// Run copies the source to every reader until the source is exhausted or
+// every reader has been closed. A read error is passed on to the readers.
+func (f *Fanout) Run() error {
+	buf := make([]byte, fanoutBlock)
+	active := slices.Clone(f.writers)
+	failed := make([]bool, len(active))
+	for len(active) > 0 {
+		n, err := f.src.Read(buf)
+		if n > 0 {
+			var wg sync.WaitGroup
+			for i, w := range active {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, werr := w.Write(buf[:n])
+					failed[i] = werr != nil
+				}()
+			}
+			wg.Wait()
+			kept := active[:0]
+			for i, w := range active {
+				if !failed[i] {
+					kept = append(kept, w)
+				}
+			}
+			active = kept
+		}
+		if err == io.EOF {
+			for _, w := range active {
+				w.Close()
+			}
+			return nil
+		}
+		if err != nil {
+			for _, w := range active {
+				w.CloseWithError(err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// SendManifest sends the contents of r described by manifest, e.g. one
+// Fanout reader with the manifest of the file behind it. manifest is not
+// modified, so one can be shared between sends. It is SendStream.
+func SendManifest(conn io.ReadWriter, manifest *Manifest, r io.Reader, receiverPubKey *rsa.PublicKey) error {
+	return SendStream(conn, manifest, r, receiverPubKey)
+}
@@ -0,0 +1,54 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Chunk framing. Every chunk goes out as a uint32 holding its ciphertext
+// length, with the bits above MaxChunkSize flagging skip, replayed, chat
+// and compressed frames, followed by the ciphertext. From v19 a data or
+// skip frame carries the chunk's index as a uint64 between the two,
+// counting from 0 on each connection. The index is also authenticated as
+// the chunk's additional data, so a chunk lost, repeated or reordered on
+// the way is caught by its number and asked for again. The end-of-file
+// marker, a length of 0, and chat frames carry no index.
+//
+// Size limits by protocol version:
+//
+//   - v1 encrypts every chunk under one key with a 32-bit counter, so a
+//     transfer holds at most 2^32-1 chunks: about 256 TiB at the default
+//     chunk size; see MaxFileSize
+//   - from v2 the key rotates every RekeyInterval, and a file may be as
+//     large as its int64 size allows
+//   - up to v18 delta and resume signatures travel in a frame with a 32-bit
+//     length, of blocks of 1 MiB at most, so an existing copy larger than
+//     about 200 TiB can't be diffed against. From v19 that frame has a
+//     64-bit length, copy ops number blocks with 64 bits and blocks grow to
+//     64 MiB, raising the limit to 16 PiB
+//
+// Other frames, such as the manifest, keys and receipts, keep their 32-bit
+// lengths and are refused above 4 GiB rather than truncated.
+
+// indexSize is the length of a chunk index
+const indexSize = 8
+
+// chunkHeader appends the header of a chunk frame to dst: length, flags
+// included, then from v19 the chunk's index
+func chunkHeader(dst []byte, version int, length uint32, index uint64) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, length)
+	if version >= ProtocolV19 {
+		dst = binary.BigEndian.AppendUint64(dst, index)
+	}
+	return dst
+}
+
+// MaxFileSize returns the largest file protocol version carries in chunks
+// of chunkSize bytes. Only v1, which runs out of nonces, has a limit short
+// of the largest int64.
+func MaxFileSize(version, chunkSize int) int64 {
+	if version < ProtocolV2 {
+		return math.MaxUint32 * int64(chunkSize)
+	}
+	return math.MaxInt64
+}
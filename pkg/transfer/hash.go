@@ -0,0 +1,193 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+	"os"
+	"runtime"
+	"sync"
+
+	"lukechampine.com/blake3"
+	"lukechampine.com/blake3/guts"
+)
+
+// Hash algorithms for manifests and delivery receipts. The sender offers
+// what it supports in the manifest and the receiver picks one in its
+// preflight answer; peers that offer or answer nothing use SHA-256.
+const (
+	HashSHA256 = "sha256"
+	HashBLAKE3 = "blake3"
+)
+
+// PreferredHashes lists the supported hash algorithms, fastest first.
+// BLAKE3 hashes a tree of 1 KiB chunks, so it spreads over every core.
+func PreferredHashes() []string {
+	return []string{HashBLAKE3, HashSHA256}
+}
+
+// negotiateHash picks the first algorithm of the sender's offer we support
+func negotiateHash(offered []string) string {
+	for _, h := range offered {
+		if h == HashBLAKE3 || h == HashSHA256 {
+			return h
+		}
+	}
+	return HashSHA256
+}
+
+// newHasher returns a streaming hasher for alg. BLAKE3 spreads each large
+// write over all cores; the chunks of a transfer are large enough for that
+// to pay off.
+func newHasher(alg string) (hash.Hash, error) {
+	switch alg {
+	case "", HashSHA256:
+		return sha256.New(), nil
+	case HashBLAKE3:
+		return blake3.New(32, nil), nil
+	}
+	return nil, fmt.Errorf("%w: unknown hash algorithm %q", ErrProtocolVersion, alg)
+}
+
+// HashWorkers is how many segments of a file HashFile reads and hashes at
+// once with BLAKE3
+var HashWorkers = runtime.GOMAXPROCS(0)
+
+// hashSegment is the span of a file each BLAKE3 worker hashes: a power of
+// two number of chunks, so every segment is a complete subtree
+const hashSegment = 4 << 20
+
+// HashFile returns the hex digest of a file's contents with alg. BLAKE3
+// files are split into segments hashed by HashWorkers workers in parallel,
+// giving the same digest as hashing the file in one pass.
+func HashFile(path, alg string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	if alg == HashBLAKE3 {
+		info, err := f.Stat()
+		if err != nil {
+			return "", fmt.Errorf("could not stat file: %w", err)
+		}
+		if info.Mode().IsRegular() {
+			sum, err := blake3File(f, info.Size(), max(HashWorkers, 1))
+			if err != nil {
+				return "", fmt.Errorf("failed to hash file: %w", err)
+			}
+			return hex.EncodeToString(sum), nil
+		}
+	}
+	h, err := newHasher(alg)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// blake3Tree merges the chaining values of consecutive BLAKE3 subtrees,
+// keeping at most one pending subtree per height
+type blake3Tree struct {
+	stack   [64][8]uint32
+	counter uint64 // chunks merged so far; bit i set means stack[i] is pending
+}
+
+// push adds the subtree covering the next 2^height chunks
+func (t *blake3Tree) push(cv [8]uint32, height int) {
+	i := height
+	for t.counter&(1<<i) != 0 {
+		cv = guts.ChainingValue(guts.ParentNode(t.stack[i], cv, &guts.IV, 0))
+		i++
+	}
+	t.stack[i] = cv
+	t.counter += 1 << height
+}
+
+// pushChunks hashes buf, a whole number of chunks, into the tree
+func (t *blake3Tree) pushChunks(buf []byte) {
+	for _, height := range guts.Eigentrees(t.counter, uint64(len(buf)/guts.ChunkSize)) {
+		n := (1 << height) * guts.ChunkSize
+		t.push(guts.ChainingValue(guts.CompressEigentree(buf[:n], &guts.IV, t.counter, 0)), height)
+		buf = buf[n:]
+	}
+}
+
+// sum finishes the tree with the file's last chunk and returns the digest
+func (t *blake3Tree) sum(last []byte) []byte {
+	n := guts.CompressChunk(last, &guts.IV, t.counter, 0)
+	for i := bits.TrailingZeros64(t.counter); i < bits.Len64(t.counter); i++ {
+		if t.counter&(1<<i) != 0 {
+			n = guts.ParentNode(t.stack[i], guts.ChainingValue(n), &guts.IV, 0)
+		}
+	}
+	n.Flags |= guts.FlagRoot
+	out := guts.WordsToBytes(guts.CompressNode(n))
+	return out[:32]
+}
+
+// blake3File hashes the first size bytes of f. Whole segments are hashed by
+// workers reading at their own offsets, then merged in order; the remainder
+// is hashed here. The last chunk is held back because it finishes the tree.
+func blake3File(f io.ReaderAt, size int64, workers int) ([]byte, error) {
+	last := size % guts.ChunkSize
+	if last == 0 && size > 0 {
+		last = guts.ChunkSize
+	}
+	body := size - last
+	segments := body / hashSegment
+	height := bits.TrailingZeros64(hashSegment / guts.ChunkSize)
+
+	cvs := make([][8]uint32, segments)
+	var (
+		wg       sync.WaitGroup
+		next     = make(chan int64)
+		mu       sync.Mutex
+		firstErr error
+	)
+	for range min(int64(workers), segments) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, hashSegment)
+			for i := range next {
+				if _, err := f.ReadAt(buf, i*hashSegment); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				counter := uint64(i) * (hashSegment / guts.ChunkSize)
+				cvs[i] = guts.ChainingValue(guts.CompressEigentree(buf, &guts.IV, counter, 0))
+			}
+		}()
+	}
+	for i := range segments {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	var t blake3Tree
+	for _, cv := range cvs {
+		t.push(cv, height)
+	}
+	tail := make([]byte, size-segments*hashSegment)
+	if _, err := f.ReadAt(tail, segments*hashSegment); err != nil && !(err == io.EOF && len(tail) == 0) {
+		return nil, err
+	}
+	t.pushChunks(tail[:len(tail)-int(last)])
+	return t.sum(tail[len(tail)-int(last):]), nil
+}
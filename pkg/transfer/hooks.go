@@ -0,0 +1,146 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Receive hooks vet each file once it has arrived and passed its hash
+// check, while it still sits under its temporary name. A hook accepts the
+// file by returning nil. When one rejects it, the file is moved to the
+// quarantine directory if one is set, or deleted, and the sender gets a
+// final status of CodeQuarantined or CodeHookRejected instead of a receipt.
+// Files only ever appear under their real name once every hook passed.
+
+// Final status codes for files turned down by a receive hook
+const (
+	CodeQuarantined  = "quarantined"
+	CodeHookRejected = "rejected_by_hook"
+)
+
+var (
+	// ErrQuarantined is returned when a receive hook rejected a file and it
+	// was kept in the quarantine directory
+	ErrQuarantined = errors.New("file quarantined by receive hook")
+	// ErrHookRejected is returned when a receive hook rejected a file and it
+	// was deleted
+	ErrHookRejected = errors.New("file rejected by receive hook")
+)
+
+// HookTimeout bounds how long a command hook may run
+var HookTimeout = 10 * time.Minute
+
+// Hook vets a received file at path, described by m. m.Sender is the
+// sender's key fingerprint and m.Hash the file's content hash. An error
+// rejects the file.
+type Hook func(path string, m *Manifest) error
+
+// CommandHook returns a Hook running command, split on spaces, with the
+// file's path as its last argument, or in place of any "{}" argument. The
+// file's name, size, hash and sender are in $P2P_FILE_NAME, $P2P_FILE_SIZE,
+// $P2P_FILE_HASH, $P2P_HASH_ALG, $P2P_SENDER and, if it proved one,
+// $P2P_SENDER_ID, and the sender's metadata in $P2P_META as a JSON object
+// and in one $P2P_META_<KEY> per entry. A non-zero exit rejects the file;
+// the last line of its output is given as the reason.
+func CommandHook(command string) (Hook, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty hook command")
+	}
+	return func(path string, m *Manifest) error {
+		argv := make([]string, 0, len(args)+1)
+		placed := false
+		for _, a := range args[1:] {
+			if a == "{}" {
+				a, placed = path, true
+			}
+			argv = append(argv, a)
+		}
+		if !placed {
+			argv = append(argv, path)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], argv...)
+		meta := []byte("{}")
+		if len(m.Meta) > 0 {
+			meta, _ = json.Marshal(m.Meta)
+		}
+		cmd.Env = append(os.Environ(),
+			"P2P_FILE_NAME="+m.FileName,
+			"P2P_FILE_SIZE="+strconv.FormatInt(m.FileSize, 10),
+			"P2P_FILE_HASH="+m.Hash,
+			"P2P_HASH_ALG="+m.HashAlg,
+			"P2P_SENDER="+m.Sender,
+			"P2P_SENDER_ID="+m.SenderID,
+			"P2P_TRANSFER_ID="+m.TransferID,
+			"P2P_META="+string(meta),
+		)
+		cmd.Env = append(cmd.Env, metaEnv(m.Meta)...)
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s timed out after %s", args[0], HookTimeout)
+		}
+		lines := strings.Split(string(bytes.TrimSpace(out)), "\n")
+		if reason := strings.TrimSpace(lines[len(lines)-1]); reason != "" {
+			return fmt.Errorf("%s: %w: %s", args[0], err, reason)
+		}
+		return fmt.Errorf("%s: %w", args[0], err)
+	}, nil
+}
+
+// runHooks runs hooks on the file at path in order. If one rejects it, the
+// file is moved into quarantine, or deleted when quarantine is "".
+func runHooks(hooks []Hook, quarantine, path string, m *Manifest) error {
+	log := log.With("transfer_id", m.TransferID)
+	for _, hook := range hooks {
+		err := hook(path, m)
+		if err == nil {
+			continue
+		}
+		if quarantine != "" {
+			kept, qerr := quarantineFile(quarantine, path, m)
+			if qerr == nil {
+				log.Warn("Receive hook rejected file; quarantined", "file", m.FileName, "path", kept, "reason", err)
+				return fmt.Errorf("%w: %w", ErrQuarantined, err)
+			}
+			log.Error("Failed to quarantine file, deleting it", "file", m.FileName, "error", qerr)
+		}
+		os.Remove(path)
+		log.Warn("Receive hook rejected file; deleted", "file", m.FileName, "reason", err)
+		return fmt.Errorf("%w: %w", ErrHookRejected, err)
+	}
+	return nil
+}
+
+// quarantineFile moves the file at path into dir under the name m gives it,
+// prefixed with the time so earlier copies are kept, and returns where it
+// went
+func quarantineFile(dir, path string, m *Manifest) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name, err := fileName(m)
+	if err != nil {
+		return "", err
+	}
+	kept := filepath.Join(dir, time.Now().Format("20060102T150405.000000000")+"-"+name)
+	if err := os.Rename(path, kept); err != nil {
+		return "", err
+	}
+	// Nothing in quarantine should be runnable
+	os.Chmod(kept, 0600)
+	return kept, nil
+}
@@ -0,0 +1,146 @@
+package transfer
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Sender identity (protocol v18): older senders follow the manifest with
+// their RSA public key and nothing else, so anyone can claim any key. A
+// sender that knows the receiver speaks v18 sends an identityFrame instead:
+// the same key, its Ed25519 identity key with the RSA key's binding, and
+// an identity signature over the handshake transcript, the manifest frame
+// and the RSA key. The transcript ties the signature to this connection,
+// so it can't be replayed on another. The receiver checks all of it, then
+// knows the sender by both fingerprints: Manifest.Sender as before, and
+// Manifest.SenderID, its peer ID. Receivers tell the two frames apart by
+// their first byte, since a DER key can't start with '{'.
+
+// ErrInvalidIdentity is returned when a sender's identity doesn't check out
+var ErrInvalidIdentity = errors.New("invalid sender identity")
+
+// Transcripter is implemented by connections whose handshake both ends
+// hashed, as netconn's are
+type Transcripter interface {
+	// Transcript returns the hash of the handshake, nil if there was none
+	Transcript() []byte
+}
+
+// identityFrame follows the manifest from v18 senders
+type identityFrame struct {
+	Key       []byte `json:"key"`       // PKCS1 RSA public key
+	ID        []byte `json:"id"`        // Ed25519 identity key
+	Binding   []byte `json:"binding"`   // RSA signature binding ID to Key
+	Signature []byte `json:"signature"` // ID's signature of identityDigest
+}
+
+// sendsIdentity reports whether the receiver at the other end of conn is
+// known to take an identity frame
+func sendsIdentity(conn any) bool {
+	pv, ok := conn.(PeerVersioner)
+	return ok && pv.PeerVersion() >= ProtocolV18
+}
+
+// transcript returns the handshake transcript of conn, if it has one
+func transcript(conn any) []byte {
+	if t, ok := conn.(Transcripter); ok {
+		return t.Transcript()
+	}
+	return nil
+}
+
+// identityDigest hashes what the identity signature covers. Each part is
+// length-prefixed so none can be shifted into another.
+func identityDigest(transcript, manifestFrame, rsaKey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("p2p-client sender identity\n"))
+	for _, part := range [][]byte{transcript, manifestFrame, rsaKey} {
+		binary.Write(h, binary.BigEndian, uint32(len(part)))
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// sendIdentity sends the frame identifying the sender after manifestFrame:
+// an identityFrame if the receiver takes one, else the bare RSA key. It
+// returns the RSA key sent.
+func sendIdentity(conn io.Writer, manifestFrame []byte) ([]byte, error) {
+	if !sendsIdentity(conn) {
+		pub, err := keys.LoadPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load sender public key: %w", err)
+		}
+		key := x509.MarshalPKCS1PublicKey(pub)
+		if err := util.SendWithLength(conn, key); err != nil {
+			return nil, fmt.Errorf("failed to send sender public key: %w", err)
+		}
+		return key, nil
+	}
+
+	priv, err := keys.LoadPrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sender private key: %w", err)
+	}
+	id, err := keys.LoadIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity key: %w", err)
+	}
+	idPub := id.Public().(ed25519.PublicKey)
+	binding, err := keys.BindIdentity(priv, idPub)
+	if err != nil {
+		return nil, err
+	}
+	frame := identityFrame{Key: x509.MarshalPKCS1PublicKey(&priv.PublicKey), ID: idPub, Binding: binding}
+	frame.Signature = ed25519.Sign(id, identityDigest(transcript(conn), manifestFrame, frame.Key))
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode sender identity: %w", err)
+	}
+	if err := util.SendWithLength(conn, data); err != nil {
+		return nil, fmt.Errorf("failed to send sender identity: %w", err)
+	}
+	return frame.Key, nil
+}
+
+// readIdentity reads the frame identifying the sender of manifestFrame and
+// returns its RSA key, and its peer ID if it proved one
+func readIdentity(conn io.Reader, manifestFrame []byte) (*rsa.PublicKey, []byte, string, error) {
+	data, err := util.ReadWithLength(conn)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to read sender public key: %w", err)
+	}
+	if len(data) == 0 || data[0] != '{' {
+		pub, err := x509.ParsePKCS1PublicKey(data)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("failed to parse sender public key")
+		}
+		return pub, data, "", nil
+	}
+
+	var frame identityFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return nil, nil, "", fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+	}
+	pub, err := x509.ParsePKCS1PublicKey(frame.Key)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("%w: bad RSA key", ErrInvalidIdentity)
+	}
+	id := ed25519.PublicKey(frame.ID)
+	if err := keys.VerifyBinding(pub, id, frame.Binding); err != nil {
+		return nil, nil, "", fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+	}
+	if !ed25519.Verify(id, identityDigest(transcript(conn), manifestFrame, frame.Key), frame.Signature) {
+		return nil, nil, "", fmt.Errorf("%w: bad signature", ErrInvalidIdentity)
+	}
+	return pub, frame.Key, keys.IdentityFingerprint(id), nil
+}
@@ -1,10 +1,14 @@
 package transfer
 
 import (
+	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"os"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/udit2303/p2p-client/pkg/util"
 )
 
 // Manifest defines metadata for a transfer
@@ -13,7 +17,46 @@ type Manifest struct {
 	FileSize    int64       `json:"file_size"`
 	FileMode    os.FileMode `json:"file_mode"`
 	LastModTime time.Time   `json:"last_mod_time"`
-	Hash        string      `json:"hash,omitempty"` // Optional checksum
+	Hash        string      `json:"hash,omitempty"`        // Optional checksum
+	HashAlg     string      `json:"hash_alg,omitempty"`    // Algorithm of Hash and the receipt, empty for SHA-256
+	Hashes      []string    `json:"hashes,omitempty"`      // Hash algorithms the sender offers, preferred first
+	Version     int         `json:"version,omitempty"`     // Highest protocol version the sender speaks
+	Kind        string      `json:"kind,omitempty"`        // Empty for files, KindText for text snippets
+	Ciphers     []string    `json:"ciphers,omitempty"`     // Cipher suites the sender offers, preferred first
+	Cipher      string      `json:"cipher,omitempty"`      // Suite the transfer used, set once negotiated
+	Owner       *Owner      `json:"owner,omitempty"`       // Sender's file owner, applied by receivers running as root
+	TransferID  string      `json:"transfer_id,omitempty"` // Random UUID the sender picks; both sides tag their logs and events with it
+	Archive     string      `json:"archive,omitempty"`     // ArchiveTar, ArchiveTarGz or ArchiveZip if the file is one, for receivers to unpack
+	LinkTarget  string      `json:"link_target,omitempty"` // Where a KindSyncLink points, slash-separated
+
+	// Meta holds key/value pairs the sender attaches, e.g. a ticket
+	// number, for the receiver's hooks and pipelines to route the file by;
+	// see ParseMeta. Older receivers ignore it.
+	Meta map[string]string `json:"meta,omitempty"`
+
+	// Sender is the fingerprint of the sender's key, filled in by the
+	// receiver before its checks run
+	Sender string `json:"-"`
+	// SenderID is the fingerprint of the sender's identity key, its peer
+	// ID, set only once the sender proved it holds that key (from v18)
+	SenderID string `json:"-"`
+	// resumeAt is how much of the file the receiver kept from an
+	// interrupted attempt, from v15; the sender sends only the rest
+	resumeAt int64
+	// verifyResume is set from v16, when the kept data is checked against
+	// the sender's file before it is trusted
+	verifyResume bool
+	// senderKey is the sender's public key, set by the receiver
+	senderKey *rsa.PublicKey
+	// reply is what the receiver answers a peer exchange with, from v17, or
+	// a listing request, from v20
+	reply []byte
+}
+
+// Owner identifies the user and group owning a file on the sender
+type Owner struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
 }
 
 // CreateManifest generates manifest from a local file
@@ -30,9 +73,89 @@ func CreateManifest(filePath string) (*Manifest, error) {
 		LastModTime: info.ModTime(),
 		// Hash: generate checksum here if needed
 	}
+	if info.Mode().IsRegular() {
+		manifest.Archive = archiveFormat(info.Name())
+	}
+	if uid, gid, ok := util.FileOwner(info); ok {
+		manifest.Owner = &Owner{UID: uid, GID: gid}
+	}
+	return manifest, nil
+}
+
+// HashContent puts the BLAKE3 digest of the file at path in Hash, letting a
+// receiver that already has the content skip the transfer. It does nothing
+// if DefaultSendOptions.NoContentHash is set.
+func (m *Manifest) HashContent(path string) error {
+	if DefaultSendOptions.NoContentHash {
+		return nil
+	}
+	hash, err := HashFile(path, HashBLAKE3)
+	if err != nil {
+		return err
+	}
+	m.Hash, m.HashAlg = hash, HashBLAKE3
+	return nil
+}
+
+// NewTransferID returns a random UUID for a transfer
+func NewTransferID() string {
+	return uuid.NewString()
+}
+
+// offer fills in the protocol version, cipher suites and hash algorithms
+// the sender offers, and DefaultSendOptions.Meta if m has no metadata of
+// its own
+func (m *Manifest) offer() {
+	if m.Meta == nil {
+		m.Meta = DefaultSendOptions.Meta
+	}
+	m.Version = ProtocolVersion
+	m.Hashes = PreferredHashes()
+	m.Ciphers = PreferredCiphers()
+	if DefaultSendOptions.Cipher != "" {
+		m.Ciphers = []string{DefaultSendOptions.Cipher}
+	}
+}
+
+// PreviewManifest returns the manifest SendFile would send for filePath,
+// with the file's BLAKE3 digest in Hash, without connecting to anyone
+func PreviewManifest(filePath string) (*Manifest, error) {
+	manifest, err := CreateManifest(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.FileMode.IsDir() {
+		return nil, fmt.Errorf("%s is a directory; only single files can be sent", filePath)
+	}
+	if manifest.Hash, err = HashFile(filePath, HashBLAKE3); err != nil {
+		return nil, err
+	}
+	manifest.HashAlg = HashBLAKE3
+	manifest.offer()
 	return manifest, nil
 }
 
+// restoreMetadata applies the sender's permissions and modification time
+// to a received file, and its owner when we run as root. Failures are only
+// logged: the data itself arrived intact.
+func restoreMetadata(path string, m *Manifest) {
+	if perm := m.FileMode.Perm(); perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			log.Warn("Failed to restore file mode", "path", path, "mode", perm, "error", err)
+		}
+	}
+	if !m.LastModTime.IsZero() {
+		if err := os.Chtimes(path, time.Time{}, m.LastModTime); err != nil {
+			log.Warn("Failed to restore modification time", "path", path, "error", err)
+		}
+	}
+	if m.Owner != nil && os.Geteuid() == 0 {
+		if err := os.Chown(path, m.Owner.UID, m.Owner.GID); err != nil {
+			log.Warn("Failed to restore file owner", "path", path, "uid", m.Owner.UID, "gid", m.Owner.GID, "error", err)
+		}
+	}
+}
+
 // SerializeManifest converts manifest to JSON
 func SerializeManifest(m *Manifest) ([]byte, error) {
 	return json.Marshal(m)
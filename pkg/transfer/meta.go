@@ -0,0 +1,80 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Limits on the metadata a sender attaches to a transfer
+const (
+	MaxMetaEntries  = 32
+	MaxMetaKeyLen   = 64
+	MaxMetaValueLen = 1024
+)
+
+// ErrInvalidMeta is returned for metadata breaking the rules of ParseMeta
+var ErrInvalidMeta = errors.New("invalid transfer metadata")
+
+// ParseMeta turns key=value pairs into transfer metadata. Keys are letters,
+// digits, '_', '-' and '.', and may appear once; values are free text.
+func ParseMeta(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	meta := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q is not key=value", ErrInvalidMeta, pair)
+		}
+		if _, dup := meta[key]; dup {
+			return nil, fmt.Errorf("%w: key %q given twice", ErrInvalidMeta, key)
+		}
+		meta[key] = value
+	}
+	if err := ValidateMeta(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// ValidateMeta checks metadata against the limits and key syntax receivers
+// enforce
+func ValidateMeta(meta map[string]string) error {
+	if len(meta) > MaxMetaEntries {
+		return fmt.Errorf("%w: %d entries, at most %d are allowed", ErrInvalidMeta, len(meta), MaxMetaEntries)
+	}
+	for key, value := range meta {
+		if key == "" || len(key) > MaxMetaKeyLen {
+			return fmt.Errorf("%w: key %q must be 1 to %d characters", ErrInvalidMeta, key, MaxMetaKeyLen)
+		}
+		for _, c := range key {
+			if !isMetaKeyChar(c) {
+				return fmt.Errorf("%w: key %q may only hold letters, digits, '_', '-' and '.'", ErrInvalidMeta, key)
+			}
+		}
+		if len(value) > MaxMetaValueLen || strings.ContainsAny(value, "\x00\n\r") {
+			return fmt.Errorf("%w: value of %q must be one line of at most %d bytes", ErrInvalidMeta, key, MaxMetaValueLen)
+		}
+	}
+	return nil
+}
+
+func isMetaKeyChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.'
+}
+
+// metaEnv returns metadata as environment variables for hooks, one
+// P2P_META_<KEY> per entry with the key upper-cased and '-' and '.' turned
+// into '_'
+func metaEnv(meta map[string]string) []string {
+	env := make([]string, 0, len(meta))
+	for key, value := range meta {
+		name := strings.NewReplacer("-", "_", ".", "_").Replace(strings.ToUpper(key))
+		env = append(env, "P2P_META_"+name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
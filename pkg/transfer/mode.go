@@ -0,0 +1,55 @@
+package transfer
+
+import "fmt"
+
+// Mode restricts the transfers a node takes part in, for kiosk-style
+// deployments. It is enforced here rather than by the commands, so every
+// transport and entry point obeys it.
+type Mode string
+
+// Operating modes
+const (
+	ModeNormal      Mode = ""             // Send and receive
+	ModeReceiveOnly Mode = "receive-only" // Never start an outgoing transfer
+	ModeSendOnly    Mode = "send-only"    // Refuse every incoming transfer before any data is written
+)
+
+// OperatingMode is the mode this process runs in
+var OperatingMode = ModeNormal
+
+// ParseMode parses a -mode value; empty and "normal" mean ModeNormal
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case ModeNormal, "normal":
+		return ModeNormal, nil
+	case ModeReceiveOnly, ModeSendOnly:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown mode %q, expected receive-only, send-only or normal", s)
+}
+
+// Sends reports whether the mode allows outgoing transfers
+func (m Mode) Sends() bool {
+	return m != ModeReceiveOnly
+}
+
+// Receives reports whether the mode allows incoming transfers
+func (m Mode) Receives() bool {
+	return m != ModeSendOnly
+}
+
+// checkSend fails when OperatingMode forbids sending
+func checkSend() error {
+	if !OperatingMode.Sends() {
+		return fmt.Errorf("%w: this node is %s", ErrModeRefused, OperatingMode)
+	}
+	return nil
+}
+
+// checkReceive fails when OperatingMode forbids receiving
+func checkReceive() error {
+	if !OperatingMode.Receives() {
+		return fmt.Errorf("%w: this node is %s", ErrModeRefused, OperatingMode)
+	}
+	return nil
+}
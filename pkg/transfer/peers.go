@@ -0,0 +1,77 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Peer exchange (protocol v17): instead of a file, a sender may send a set
+// of peer records, and the receiver answers with its own set in the final
+// status, so both sides learn the other's peers over one connection. This
+// package only carries the records; what they hold and whom to trust is up
+// to ReceiveOptions.OnPeers and the caller of ExchangePeers.
+
+// KindPeers marks a transfer carrying peer records
+const KindPeers = "peers"
+
+// MaxPeersSize is the largest set of peer records a receiver accepts
+const MaxPeersSize = 1 << 20
+
+// ExchangePeers sends records to the receiver and returns the records it
+// answered with, empty if it had none to share. The receiver must speak
+// protocol v17, which is checked before anything is sent.
+func ExchangePeers(conn io.ReadWriter, records []byte, receiverPubKey *rsa.PublicKey) ([]byte, error) {
+	if pv, ok := conn.(PeerVersioner); !ok || pv.PeerVersion() < ProtocolV17 {
+		return nil, fmt.Errorf("%w: receiver is too old to exchange peers", ErrProtocolVersion)
+	}
+	if len(records) > MaxPeersSize {
+		return nil, fmt.Errorf("peer records are %s, the limit is %s", formatBytes(float64(len(records))), formatBytes(MaxPeersSize))
+	}
+	manifest := &Manifest{
+		FileName:    KindPeers,
+		FileSize:    int64(len(records)),
+		FileMode:    0600,
+		LastModTime: time.Now(),
+		Kind:        KindPeers,
+	}
+	if err := sendStream(conn, manifest, bytes.NewReader(records), receiverPubKey, nil); err != nil {
+		return nil, err
+	}
+	return manifest.reply, nil
+}
+
+// checkPeers refuses peer records when the receiver takes none, or too
+// many to hold in memory
+func checkPeers(m *Manifest, onPeers func(m *Manifest, sender *rsa.PublicKey, records []byte) ([]byte, error)) error {
+	if onPeers == nil {
+		return fmt.Errorf("%w: this receiver doesn't exchange peers", ErrRejected)
+	}
+	if m.FileSize < 0 || m.FileSize > MaxPeersSize {
+		return fmt.Errorf("peer records of %d bytes exceed the %d byte limit", m.FileSize, MaxPeersSize)
+	}
+	return nil
+}
+
+// openPeers collects peer records and, once they have arrived in full,
+// hands them to onPeers; its answer goes back in the final status
+func openPeers(onPeers func(m *Manifest, sender *rsa.PublicKey, records []byte) ([]byte, error)) sinkOpener {
+	return func(m *Manifest) (io.Writer, func() error, func(bool) error, error) {
+		var buf bytes.Buffer
+		w := &limitedWriter{w: &buf, limit: MaxPeersSize, what: "peer records"}
+		closeFn := func(complete bool) error {
+			if !complete {
+				return nil
+			}
+			reply, err := onPeers(m, m.senderKey, buf.Bytes())
+			if err != nil {
+				return err
+			}
+			m.reply = reply
+			return nil
+		}
+		return w, func() error { return nil }, closeFn, nil
+	}
+}
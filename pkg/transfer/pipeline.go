@@ -0,0 +1,194 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Send pipeline: reading a chunk, sealing it and writing it to the
+// connection overlap, rather than taking turns on one goroutine. A reader
+// fills chunks from the source and hands them to Workers goroutines, which
+// compress and encrypt them; the sender writes them out in order. Chunk
+// nonces and key rotation depend on the order and sizes of the chunks, so
+// each worker takes its chunk's key and nonce in turn once the chunk is
+// compressed, then seals it in parallel with the others. At most twice as
+// many chunks as workers are in flight.
+
+// MaxSendWorkers caps the default number of sealing workers; beyond it the
+// connection rather than the CPU is the limit
+const MaxSendWorkers = 8
+
+// sendWorkers returns the number of sealing workers o asks for
+func (o SendOptions) sendWorkers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return min(runtime.GOMAXPROCS(0), MaxSendWorkers)
+}
+
+// sendChunk is a chunk on its way through the pipeline
+type sendChunk struct {
+	buf      *[]byte // Plaintext, from the buffer pool
+	n        int     // Bytes of buf in use
+	size     int     // Chunk size the reader asked for
+	skip     int64   // Length of a hole sent as a skip frame instead, if not 0
+	consumed int64   // Source bytes read up to the end of the chunk
+	index    uint64  // Position in the transfer, from 0
+
+	// Keys and nonces are taken in chunk order: the worker waits for turn,
+	// then closes next for the following chunk
+	turn, next chan struct{}
+
+	frame *[]byte // Sealed chunk, from the buffer pool
+	flag  uint32  // skipFlag or compressFlag, if either
+	err   error
+	done  chan struct{} // Closed once frame or err is set
+}
+
+// chunkReader is the pipeline's source: what chunks are read from, with
+// holes skipped where the file has them
+type chunkReader struct {
+	r      io.Reader
+	src    *countingReader
+	holes  *holeFinder
+	sparse bool        // Send runs of zeros as skip frames
+	source *sourceFile // Checked for changes after every chunk, if set
+	tuner  *chunkTuner
+}
+
+// pipelineStats adds up the time spent in each stage across goroutines
+type pipelineStats struct {
+	read, encrypt atomic.Int64
+}
+
+// startPipeline reads chunks from cr and seals them with cc on workers
+// goroutines, and returns them in order. The channel is closed after the
+// last chunk, or after a chunk carrying an error. Closing stop abandons the
+// pipeline.
+func startPipeline(cr *chunkReader, cc *chunkCipher, compress bool, workers int, stats *pipelineStats, stop <-chan struct{}) <-chan *sendChunk {
+	out := make(chan *sendChunk, workers)
+	work := make(chan *sendChunk, workers)
+	for range workers {
+		go func() {
+			for c := range work {
+				c.seal(cc, compress, stats, stop)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(out)
+		defer close(work)
+		turn := make(chan struct{})
+		close(turn)
+		for index := uint64(0); ; index++ {
+			started := time.Now()
+			c := &sendChunk{index: index, turn: turn, next: make(chan struct{}), done: make(chan struct{})}
+			turn = c.next
+			eof := cr.read(c)
+			stats.read.Add(int64(time.Since(started)))
+			if eof {
+				return
+			}
+			if c.err != nil {
+				close(c.done)
+			}
+			select {
+			case out <- c:
+			case <-stop:
+				putBuffer(c.buf)
+				return
+			}
+			if c.err != nil {
+				return
+			}
+			select {
+			case work <- c:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// read fills c with the next chunk, or reports the end of the source
+func (cr *chunkReader) read(c *sendChunk) (eof bool) {
+	// Skip a hole, or read a full chunk up to the next one; streams such as
+	// pipes may return short reads
+	c.size = cr.tuner.current()
+	limit := c.size
+	if cr.holes != nil {
+		if c.skip, limit, c.err = cr.holes.skip(c.size); c.err != nil {
+			return false
+		}
+	}
+	if c.skip == 0 {
+		c.buf = getBuffer(limit)
+		n, err := io.ReadFull(cr.r, *c.buf)
+		if err == io.EOF {
+			putBuffer(c.buf)
+			return true
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			putBuffer(c.buf)
+			c.buf, c.err = nil, fmt.Errorf("read error: %w", err)
+			return false
+		}
+		c.n = n
+		if cr.sparse && isZero((*c.buf)[:n]) {
+			c.skip = int64(n)
+		}
+	}
+	if cr.source != nil {
+		c.err = cr.source.check()
+	}
+	c.consumed = cr.src.n.Load()
+	return false
+}
+
+// seal compresses and encrypts c, once its turn for a key and nonce has
+// come; a run of zeros becomes a skip frame carrying only its length
+func (c *sendChunk) seal(cc *chunkCipher, compress bool, stats *pipelineStats, stop <-chan struct{}) {
+	started := time.Now()
+	defer close(c.done)
+	var plaintext []byte
+	var packed *[]byte
+	defer func() { putBuffer(packed) }()
+	switch {
+	case c.skip > 0:
+		plaintext = binary.BigEndian.AppendUint64(make([]byte, 0, skipPayloadSize), uint64(c.skip))
+		c.flag = skipFlag
+	case compress:
+		plaintext = (*c.buf)[:c.n]
+		packed = getBuffer(c.n)
+		if small, ok := compressChunk(*packed, plaintext); ok {
+			plaintext, c.flag = small, compressFlag
+		}
+	default:
+		plaintext = (*c.buf)[:c.n]
+	}
+
+	select {
+	case <-c.turn:
+	case <-stop:
+		putBuffer(c.buf)
+		return
+	}
+	aead, nonce, ad, err := cc.reserve(len(plaintext))
+	close(c.next)
+	if err != nil {
+		putBuffer(c.buf)
+		c.err = err
+		return
+	}
+	c.frame = getBuffer(len(plaintext) + aead.Overhead())
+	*c.frame = aead.Seal((*c.frame)[:0], nonce, plaintext, ad)
+	putBuffer(c.buf)
+	c.buf = nil
+	stats.encrypt.Add(int64(time.Since(started)))
+}
@@ -0,0 +1,225 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Preflight response codes, sent by the receiver after it has seen the
+// manifest and before any file data flows
+const (
+	CodeOK                = "ok"
+	CodeRejected          = "rejected"
+	CodeInsufficientSpace = "insufficient_space"
+	CodeQuotaExceeded     = "quota_exceeded"
+	CodeNotAllowed        = "not_allowed"
+	CodeAlreadyHave       = "already_have"
+	CodeSendOnly          = "send_only"
+)
+
+// preflightFrame is the receiver's answer to a manifest
+type preflightFrame struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+	Version int    `json:"version,omitempty"` // Protocol version to use
+	Cipher  string `json:"cipher,omitempty"`  // Cipher suite to use
+	Hash    string `json:"hash,omitempty"`    // Hash algorithm of the receipt
+	Offset  int64  `json:"offset,omitempty"`  // From v15, bytes already held to resume after
+	Binding []byte `json:"binding,omitempty"` // From v23, the receiver's MAC of the session; see binding.go
+}
+
+// RemoteError reports a transfer refused by the receiver
+type RemoteError struct {
+	Code    string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("receiver refused transfer (%s): %s", e.Code, e.Message)
+}
+
+// Is lets errors.Is match a RemoteError against the sentinel for its code
+func (e *RemoteError) Is(target error) bool {
+	switch e.Code {
+	case CodeInsufficientSpace:
+		return target == ErrInsufficientSpace
+	case CodeQuotaExceeded:
+		return target == ErrQuotaExceeded
+	case CodeNotAllowed:
+		return target == ErrSenderNotAllowed
+	case CodeAlreadyHave:
+		return target == ErrAlreadyHave
+	case CodeSendOnly:
+		return target == ErrModeRefused
+	case CodeRejected:
+		return target == ErrRejected
+	}
+	return false
+}
+
+// sendPreflight tells the sender whether the transfer may proceed, and
+// with which protocol version, cipher suite and hash algorithm, and from
+// which offset, with binding, the receiver's MAC of the session, if any
+func sendPreflight(w io.Writer, version int, suite, hashAlg string, offset int64, binding []byte, verdict error) error {
+	frame := preflightFrame{Code: CodeOK, Version: version, Cipher: suite, Hash: hashAlg, Offset: offset, Binding: binding}
+	if verdict != nil {
+		frame.Message = verdict.Error()
+		switch {
+		case errors.Is(verdict, ErrInsufficientSpace):
+			frame.Code = CodeInsufficientSpace
+		case errors.Is(verdict, ErrQuotaExceeded):
+			frame.Code = CodeQuotaExceeded
+		case errors.Is(verdict, ErrSenderNotAllowed):
+			frame.Code = CodeNotAllowed
+		case errors.Is(verdict, ErrAlreadyHave):
+			frame.Code = CodeAlreadyHave
+		case errors.Is(verdict, ErrModeRefused):
+			frame.Code = CodeSendOnly
+		default:
+			frame.Code = CodeRejected
+		}
+	}
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to encode preflight response: %w", err)
+	}
+	return util.SendWithLength(w, data)
+}
+
+// readPreflight waits for the receiver's answer and returns it, with the
+// protocol version to use, or a *RemoteError if the transfer was refused
+func readPreflight(r io.Reader) (*preflightFrame, error) {
+	data, err := util.ReadWithLength(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read preflight response: %w", err)
+	}
+	var frame preflightFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return nil, fmt.Errorf("invalid preflight response: %w", err)
+	}
+	if frame.Code != CodeOK {
+		return nil, &RemoteError{Code: frame.Code, Message: frame.Message}
+	}
+	if frame.Version > ProtocolVersion {
+		return nil, fmt.Errorf("%w: receiver chose version %d", ErrProtocolVersion, frame.Version)
+	}
+	if frame.Cipher == "" {
+		frame.Cipher = CipherAESGCM
+	}
+	if frame.Hash == "" {
+		frame.Hash = HashSHA256
+	}
+	frame.Version = negotiateVersion(frame.Version)
+	if frame.Offset < 0 || (frame.Offset > 0 && frame.Version < ProtocolV15) {
+		return nil, fmt.Errorf("invalid resume offset %d", frame.Offset)
+	}
+	return &frame, nil
+}
+
+// checkDiskSpace fails if dir can't hold size more bytes. Unknown sizes and
+// filesystems we can't query are let through.
+func checkDiskSpace(dir string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	free, err := util.FreeSpace(dir)
+	if err != nil {
+		log.Debug("Cannot determine free disk space", "dir", dir, "error", err)
+		return nil
+	}
+	if uint64(size) > free {
+		return fmt.Errorf("%w: need %s, %s available", ErrInsufficientSpace, formatBytes(float64(size)), formatBytes(float64(free)))
+	}
+	return nil
+}
+
+// Quota limits the total bytes accepted from each sender, identified by the
+// fingerprint of its public key
+type Quota struct {
+	limit int64
+
+	mu   sync.Mutex
+	used map[string]int64
+}
+
+// NewQuota creates a quota allowing limit bytes per sender
+func NewQuota(limit int64) *Quota {
+	return &Quota{limit: limit, used: make(map[string]int64)}
+}
+
+// Limit returns the bytes each sender may send
+func (q *Quota) Limit() int64 {
+	return q.limit
+}
+
+// Reserve claims size bytes of sender's quota. A transfer of unknown size
+// is refused, as its bytes can't be counted against the quota up front.
+func (q *Quota) Reserve(sender string, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("%w: transfers of unknown size aren't accepted under a quota", ErrQuotaExceeded)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used[sender]+size > q.limit {
+		remaining := max(q.limit-q.used[sender], 0)
+		return fmt.Errorf("%w: %s requested, %s remaining", ErrQuotaExceeded, formatBytes(float64(size)), formatBytes(float64(remaining)))
+	}
+	q.used[sender] += size
+	return nil
+}
+
+// Release returns bytes reserved for a transfer that didn't complete
+func (q *Quota) Release(sender string, size int64) {
+	if size < 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used[sender] -= size
+}
+
+// Allowlist restricts who may send to the key fingerprints and peer IDs it
+// holds
+type Allowlist struct {
+	fingerprints map[string]bool
+}
+
+// NewAllowlist creates an allowlist of key fingerprints. Case and colons
+// between hex pairs are ignored.
+func NewAllowlist(fingerprints ...string) *Allowlist {
+	a := &Allowlist{fingerprints: make(map[string]bool)}
+	for _, fp := range fingerprints {
+		a.fingerprints[normalizeFingerprint(fp)] = true
+	}
+	return a
+}
+
+// Len returns the number of fingerprints on the list
+func (a *Allowlist) Len() int {
+	return len(a.fingerprints)
+}
+
+// Check fails unless the sender, known by its key fingerprint and, if it
+// proved one, its peer ID, is on the list under either
+func (a *Allowlist) Check(sender string, ids ...string) error {
+	if a.fingerprints[normalizeFingerprint(sender)] {
+		return nil
+	}
+	for _, id := range ids {
+		if id != "" && a.fingerprints[normalizeFingerprint(id)] {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: key %s is not on the receiver's allowlist", ErrSenderNotAllowed, sender)
+}
+
+// normalizeFingerprint lowercases fp and drops separators
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
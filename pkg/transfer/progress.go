@@ -3,20 +3,37 @@ package transfer
 import (
 	"fmt"
 	"io"
+	"math"
 	"sync"
 	"time"
 )
 
+// SpeedWindow is roughly how far back the smoothed speed looks: an
+// exponential moving average that gives a change in rate about 63% of its
+// weight after this long
+var SpeedWindow = 3 * time.Second
+
+// speedSample is the shortest interval speed is measured over; updates
+// closer together are added up
+const speedSample = 100 * time.Millisecond
+
 // Progress represents the current state of a file transfer
 type Progress struct {
-	FileName    string
-	FileSize    int64
-	Transferred int64
-	Speed       float64   // bytes per second
-	ETA         float64   // estimated time remaining in seconds
-	StartTime   time.Time
-	LastUpdate  time.Time
-	mu          sync.Mutex
+	FileName     string
+	FileSize     int64
+	Transferred  int64
+	Speed        float64 // bytes per second, smoothed over about SpeedWindow
+	InstantSpeed float64 // bytes per second over the last sample
+	AverageSpeed float64 // bytes per second since the start
+	ETA          float64 // estimated time remaining in seconds, from Speed
+	StartTime    time.Time
+	LastUpdate   time.Time
+	mu           sync.Mutex
+
+	startBytes  int64 // Transferred at the start, e.g. kept from an interrupted attempt
+	sampleBytes int64 // Transferred at the last sample
+	sampleTime  time.Time
+	ema, weight float64 // Moving average from 0, and the weight of its samples
 }
 
 // ProgressCallback is a function type for progress updates
@@ -30,29 +47,59 @@ func NewProgress(fileName string, fileSize int64) *Progress {
 		FileSize:   fileSize,
 		StartTime:  now,
 		LastUpdate: now,
+		sampleTime: now,
 	}
 }
 
-// Update updates the progress with the number of bytes transferred
-func (p *Progress) Update(bytesTransferred int64) {
+// StartAt counts offset bytes as transferred from the start, e.g. those
+// kept from an interrupted attempt, without them adding to the speed
+func (p *Progress) StartAt(offset int64) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.Transferred, p.startBytes, p.sampleBytes = offset, offset, offset
+}
 
-	now := time.Now()
-	timeElapsed := now.Sub(p.LastUpdate).Seconds()
-	if timeElapsed > 0 {
-		// Calculate speed in bytes per second
-		p.Speed = float64(bytesTransferred) / timeElapsed
-		
-		// Calculate ETA if we're making progress
-		if p.Speed > 0 {
-			remainingBytes := p.FileSize - p.Transferred - bytesTransferred
-			p.ETA = float64(remainingBytes) / p.Speed
-		}
-	}
+// Update adds bytesTransferred to the progress, and reports whether a new
+// speed sample was taken, at most every 100ms, for callers to refresh what
+// they show
+func (p *Progress) Update(bytesTransferred int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.advance(time.Now(), p.Transferred+bytesTransferred)
+}
+
+// Set is Update for a total rather than an increment
+func (p *Progress) Set(transferred int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.advance(time.Now(), transferred)
+}
 
-	p.Transferred += bytesTransferred
+// advance moves the progress to transferred bytes at now; callers hold mu
+func (p *Progress) advance(now time.Time, transferred int64) bool {
+	p.Transferred = transferred
 	p.LastUpdate = now
+	elapsed := now.Sub(p.sampleTime)
+	if elapsed < speedSample {
+		return false
+	}
+	p.InstantSpeed = max(0, float64(transferred-p.sampleBytes)/elapsed.Seconds())
+	// Samples weigh in by how long they cover. The average starts from 0,
+	// and is divided by the weight of the samples so far so the first
+	// seconds aren't dragged towards it.
+	alpha := 1 - math.Exp(-elapsed.Seconds()/SpeedWindow.Seconds())
+	p.ema += alpha * (p.InstantSpeed - p.ema)
+	p.weight += alpha * (1 - p.weight)
+	p.Speed = p.ema / p.weight
+	if total := now.Sub(p.StartTime).Seconds(); total > 0 {
+		p.AverageSpeed = float64(transferred-p.startBytes) / total
+	}
+	p.ETA = 0
+	if p.Speed > 0 && p.FileSize > transferred {
+		p.ETA = float64(p.FileSize-transferred) / p.Speed
+	}
+	p.sampleBytes, p.sampleTime = transferred, now
+	return true
 }
 
 // Percent returns the completion percentage (0-100)
@@ -3,6 +3,9 @@ package transfer
 import (
 	"fmt"
 	"strings"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
 )
 
 // progressBar creates a simple progress bar string
@@ -37,3 +40,83 @@ func formatBytes(bytes float64) string {
 	return fmt.Sprintf("%.1f %ciB", 
 		float64(bytes)/float64(div), "KMGTPE"[exp])
 }
+
+// formatETA renders an ETA in seconds as mm:ss, or --:-- when unknown
+func formatETA(eta float64) string {
+	if eta <= 0 {
+		return "--:--"
+	}
+	d := time.Duration(eta) * time.Second
+	return fmt.Sprintf("%02d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// showProgress emits a progress event and, unless in JSON output mode,
+// prints a single-line progress bar. persisted is how much the receiver
+// reported durably on disk, or -1 if unknown.
+func showProgress(label, transferID string, p *Progress, persisted int64) {
+	fileName := p.FileName
+	percent := p.Percent()
+	fields := []any{
+		"direction", strings.ToLower(label),
+		"transfer_id", transferID,
+		"file", fileName,
+		"transferred", p.Transferred,
+		"size", p.FileSize,
+		"percent", percent,
+		"speed", p.Speed,
+		"instant_speed", p.InstantSpeed,
+		"average_speed", p.AverageSpeed,
+		"eta", p.ETA,
+	}
+	if persisted >= 0 {
+		fields = append(fields, "persisted", persisted)
+	}
+	util.Emit(util.EventProgress, fields...)
+	if util.JSONEvents() {
+		return
+	}
+	onDisk := ""
+	if persisted >= 0 {
+		onDisk = fmt.Sprintf(" - %s on disk", formatBytes(float64(persisted)))
+	}
+	fmt.Fprintf(util.ConsoleOutput(), "\r%s: %s [%s] %.1f%% - %s/s - ETA: %s%s",
+		label,
+		fileName,
+		progressBar(percent, 20),
+		percent,
+		formatBytes(p.Speed),
+		formatETA(p.ETA),
+		onDisk,
+	)
+}
+
+// showComplete emits a transfer_complete event and, unless in JSON output
+// mode, prints the final progress line
+func showComplete(label, transferID, fileName string, size int64, elapsed time.Duration) {
+	util.Emit(util.EventTransferComplete,
+		"direction", strings.ToLower(label),
+		"transfer_id", transferID,
+		"file", fileName,
+		"size", size,
+		"duration_ms", elapsed.Milliseconds(),
+	)
+	if util.JSONEvents() {
+		return
+	}
+	fmt.Fprintf(util.ConsoleOutput(), "\r%s: %s [%s] 100%% - Complete!%s\n",
+		label,
+		fileName,
+		progressBar(100, 20),
+		strings.Repeat(" ", 40), // Clear any remaining characters
+	)
+}
+
+// showStarted emits a transfer_started event in JSON output mode
+func showStarted(label, transferID, fileName string, size int64) {
+	util.Emit(util.EventTransferStarted,
+		"direction", strings.ToLower(label),
+		"transfer_id", transferID,
+		"file", fileName,
+		"size", size,
+	)
+}
@@ -0,0 +1,278 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/keys"
+)
+
+// Pulling (protocol v20): transfers are pushed by their sender, but a
+// receiver may also expose a directory for peers to browse and fetch from.
+// Such a peer sends a request in place of a file: a manifest of kind
+// KindList or KindGet naming the path it asks about, relative to the
+// exposed directory, and no data. A listing comes back in the final status,
+// like peer records. A file asked for with KindGet follows the final status
+// on the same connection as an ordinary transfer, with the two ends'
+// roles swapped, so it is sealed to the requester's key and signed by the
+// exposing node's identity like any other.
+//
+// Only senders on Exposed.Allow are answered, and only paths inside
+// Exposed.Dir: the directory is opened as an os.Root, so neither ".." nor
+// symbolic links lead out of it.
+
+// Kinds of pull requests
+const (
+	KindList = "list"
+	KindGet  = "get"
+)
+
+// MaxListingSize is the largest directory listing a receiver answers with
+const MaxListingSize = 4 << 20
+
+// Exposed is a directory a receiver lets peers browse and fetch from
+type Exposed struct {
+	Dir   string     // Directory exposed
+	Allow *Allowlist // Senders that may list and fetch; nil refuses all
+}
+
+// RemoteEntry is a file or directory in a listing of an exposed directory
+type RemoteEntry struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	Dir     bool        `json:"dir,omitempty"`
+}
+
+// ListRemote asks the receiver for the entries of the directory at path in
+// the directory it exposes, or for the entry of the file there. The
+// receiver must speak protocol v20, which is checked before anything is
+// sent.
+func ListRemote(conn io.ReadWriter, path string, receiverPubKey *rsa.PublicKey) ([]RemoteEntry, error) {
+	manifest, err := sendPullRequest(conn, KindList, path, receiverPubKey)
+	if err != nil {
+		return nil, err
+	}
+	var entries []RemoteEntry
+	if err := json.Unmarshal(manifest.reply, &entries); err != nil {
+		return nil, fmt.Errorf("invalid listing: %w", err)
+	}
+	return entries, nil
+}
+
+// GetRemote asks the receiver for the file at path in the directory it
+// exposes, then receives it as opts describe. Only a file sent with the
+// receiver's own key is taken.
+func GetRemote(conn io.ReadWriter, path string, receiverPubKey *rsa.PublicKey, opts ReceiveOptions) (*Manifest, error) {
+	if _, err := sendPullRequest(conn, KindGet, path, receiverPubKey); err != nil {
+		return nil, err
+	}
+	opts.AllowFrom = NewAllowlist(keys.PublicKeyFingerprint(receiverPubKey))
+	return Receive(conn, opts)
+}
+
+// sendPullRequest sends a request of kind for path, and returns its
+// manifest, holding the receiver's answer
+func sendPullRequest(conn io.ReadWriter, kind, path string, receiverPubKey *rsa.PublicKey) (*Manifest, error) {
+	if pv, ok := conn.(PeerVersioner); !ok || pv.PeerVersion() < ProtocolV20 {
+		return nil, fmt.Errorf("%w: receiver is too old to browse or fetch from", ErrProtocolVersion)
+	}
+	manifest := &Manifest{
+		FileName:    cleanPullPath(path),
+		FileMode:    0600,
+		LastModTime: time.Now(),
+		Kind:        kind,
+	}
+	if err := sendStream(conn, manifest, bytes.NewReader(nil), receiverPubKey, nil); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// cleanPullPath turns a requested path into one relative to the exposed
+// directory, "." for the directory itself
+func cleanPullPath(p string) string {
+	p = path.Clean("/" + filepath.ToSlash(p))[1:]
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// checkPull vets the pull request m from sender against what e exposes
+func checkPull(m *Manifest, sender string, e *Exposed) error {
+	if e == nil {
+		return fmt.Errorf("%w: this receiver exposes no directory", ErrRejected)
+	}
+	if e.Allow == nil {
+		return fmt.Errorf("%w: key %s may not browse this receiver", ErrSenderNotAllowed, sender)
+	}
+	if err := e.Allow.Check(sender, m.SenderID); err != nil {
+		log.Warn("Refusing pull request from sender not allowed to browse", "fingerprint", sender, "path", m.FileName)
+		return err
+	}
+	if m.FileSize != 0 {
+		return fmt.Errorf("pull request carries %d bytes of data", m.FileSize)
+	}
+	info, err := e.stat(m.FileName)
+	if err != nil {
+		return err
+	}
+	if m.Kind == KindGet && !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s is not a regular file", ErrRejected, m.FileName)
+	}
+	log.Info("Pull request", "kind", m.Kind, "path", m.FileName, "fingerprint", sender)
+	return nil
+}
+
+// stat returns the entry at the requested path p
+func (e *Exposed) stat(p string) (fs.FileInfo, error) {
+	root, err := os.OpenRoot(e.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open exposed directory: %w", err)
+	}
+	defer root.Close()
+	info, err := root.Stat(filepath.FromSlash(cleanPullPath(p)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrRejected, p, notFound(err))
+	}
+	return info, nil
+}
+
+// notFound hides why a path can't be opened, so the requester can't tell
+// what lies outside the exposed directory
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrPermission) {
+		return fs.ErrPermission
+	}
+	return fs.ErrNotExist
+}
+
+// list returns the listing of the requested path p
+func (e *Exposed) list(p string) ([]RemoteEntry, error) {
+	root, err := os.OpenRoot(e.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open exposed directory: %w", err)
+	}
+	defer root.Close()
+	name := filepath.FromSlash(cleanPullPath(p))
+	info, err := root.Stat(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrRejected, p, notFound(err))
+	}
+	if !info.IsDir() {
+		return []RemoteEntry{remoteEntry(info)}, nil
+	}
+	dir, err := root.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrRejected, p, notFound(err))
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", p, err)
+	}
+	sort.Strings(names)
+	entries := []RemoteEntry{}
+	for _, n := range names {
+		// Links leading out of the directory are left out
+		info, err := root.Stat(filepath.Join(name, n))
+		if err != nil || !(info.IsDir() || info.Mode().IsRegular()) {
+			continue
+		}
+		entries = append(entries, remoteEntry(info))
+	}
+	return entries, nil
+}
+
+// remoteEntry describes info in a listing
+func remoteEntry(info fs.FileInfo) RemoteEntry {
+	return RemoteEntry{Name: info.Name(), Size: info.Size(), Mode: info.Mode(), ModTime: info.ModTime(), Dir: info.IsDir()}
+}
+
+// openList answers a KindList request with its listing in the final status
+func openList(e *Exposed) sinkOpener {
+	return func(m *Manifest) (io.Writer, func() error, func(bool) error, error) {
+		closeFn := func(complete bool) error {
+			if !complete {
+				return nil
+			}
+			entries, err := e.list(m.FileName)
+			if err != nil {
+				return err
+			}
+			reply, err := json.Marshal(entries)
+			if err != nil {
+				return fmt.Errorf("failed to encode listing: %w", err)
+			}
+			if len(reply) > MaxListingSize {
+				return fmt.Errorf("%w: listing of %s exceeds %d bytes", ErrRejected, m.FileName, MaxListingSize)
+			}
+			m.reply = reply
+			return nil
+		}
+		w := &limitedWriter{w: io.Discard, limit: 0, what: "pull request"}
+		return w, func() error { return nil }, closeFn, nil
+	}
+}
+
+// pullConn is the connection of a pull request, turned around to send the
+// file asked for. The requester's version and the handshake transcript
+// carry over, so the file goes out as to any other receiver.
+type pullConn struct {
+	io.ReadWriter
+	version    int
+	transcript []byte
+}
+
+// PeerVersion implements PeerVersioner
+func (c *pullConn) PeerVersion() int {
+	return c.version
+}
+
+// Transcript implements Transcripter
+func (c *pullConn) Transcript() []byte {
+	return c.transcript
+}
+
+// sendPulled sends the file the KindGet request m asked for back over conn
+func sendPulled(conn io.ReadWriter, m *Manifest, e *Exposed) error {
+	root, err := os.OpenRoot(e.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to open exposed directory: %w", err)
+	}
+	defer root.Close()
+	f, err := root.Open(filepath.FromSlash(cleanPullPath(m.FileName)))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", m.FileName, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", m.FileName, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", m.FileName)
+	}
+	manifest := &Manifest{
+		FileName:    info.Name(),
+		FileSize:    info.Size(),
+		FileMode:    info.Mode(),
+		LastModTime: info.ModTime(),
+		Archive:     archiveFormat(info.Name()),
+	}
+	log.Info("Sending requested file", "path", m.FileName, "size", info.Size(), "transfer_id", m.TransferID)
+	source := &sourceFile{File: f, size: manifest.FileSize, modTime: manifest.LastModTime}
+	return sendStream(&pullConn{ReadWriter: conn, version: m.Version, transcript: transcript(conn)}, manifest, source, m.senderKey, nil)
+}
@@ -0,0 +1,38 @@
+package transfer
+
+import "time"
+
+// rateLimiter paces a sender's writes to a number of bytes per second. Time
+// spent waiting on the receiver isn't saved up for a burst: the pace only
+// looks back about a second.
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+// newRateLimiter returns a limiter for rate bytes per second, or nil for no
+// limit
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+// wait sleeps until n more bytes may be sent
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	due := l.start.Add(time.Duration(float64(l.sent) / float64(l.rate) * float64(time.Second)))
+	if now.Sub(due) > time.Second {
+		l.start, l.sent = now, 0
+		due = now
+	}
+	l.sent += int64(n)
+	if d := due.Sub(now); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,88 @@
+package transfer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Receipt is the receiver's signed proof that a file arrived intact
+type Receipt struct {
+	FileName   string    `json:"file_name"`
+	FileSize   int64     `json:"file_size"`
+	Hash       string    `json:"hash"`               // hex digest of the received content
+	HashAlg    string    `json:"hash_alg,omitempty"` // algorithm of Hash, empty for SHA-256
+	ReceivedAt time.Time `json:"received_at"`
+	Receiver   string    `json:"receiver"` // receiver public key fingerprint
+	TransferID string    `json:"transfer_id,omitempty"`
+	Signature  []byte    `json:"signature,omitempty"`
+}
+
+// digest hashes the receipt fields covered by the signature
+func (r *Receipt) digest() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+	b, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// Sign signs the receipt with the receiver's private key
+func (r *Receipt) Sign(priv *rsa.PrivateKey) error {
+	r.Receiver = keys.PublicKeyFingerprint(&priv.PublicKey)
+	d, err := r.digest()
+	if err != nil {
+		return fmt.Errorf("failed to encode receipt: %w", err)
+	}
+	sig, err := rsa.SignPSS(rand.Reader, priv, crypto.SHA256, d, nil)
+	if err != nil {
+		return fmt.Errorf("failed to sign receipt: %w", err)
+	}
+	r.Signature = sig
+	return nil
+}
+
+// Verify checks the receipt signature against the receiver's public key
+func (r *Receipt) Verify(pub *rsa.PublicKey) error {
+	if r.Receiver != keys.PublicKeyFingerprint(pub) {
+		return fmt.Errorf("%w: signed by unexpected key %s", ErrInvalidReceipt, r.Receiver)
+	}
+	d, err := r.digest()
+	if err != nil {
+		return fmt.Errorf("failed to encode receipt: %w", err)
+	}
+	if err := rsa.VerifyPSS(pub, crypto.SHA256, d, r.Signature, nil); err != nil {
+		return fmt.Errorf("%w: bad signature: %w", ErrInvalidReceipt, err)
+	}
+	return nil
+}
+
+// SaveReceipt stores a receipt under ~/.p2p-client/receipts and returns its path
+func SaveReceipt(r *Receipt) (string, error) {
+	dir, err := util.DataDir("receipts")
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%s.json", r.ReceivedAt.UTC().Format("20060102T150405Z"), filepath.Base(r.FileName))
+	path := filepath.Join(dir, name)
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode receipt: %w", err)
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return "", fmt.Errorf("failed to write receipt: %w", err)
+	}
+	return path, nil
+}
@@ -1,180 +1,1054 @@
 package transfer
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"strings"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/udit2303/p2p-client/pkg/keys"
 	"github.com/udit2303/p2p-client/pkg/util"
 )
 
+// sinkOpener prepares the destination for a transfer once its manifest is
+// known. It returns the writer, a discard func removing output that failed
+// verification, and a close func told whether all data arrived. Output left
+// by an interrupted transfer is kept.
+type sinkOpener func(m *Manifest) (w io.Writer, discard func() error, closeFn func(complete bool) error, err error)
+
+// ReceiveOptions customizes how an incoming transfer is accepted and stored
+type ReceiveOptions struct {
+	OutputDir  string                  // Directory the file is written to
+	Output     io.Writer               // If set, data is streamed here instead of OutputDir
+	Accept     func(m *Manifest) error // Called once the manifest arrives; an error rejects the transfer
+	Quota      *Quota                  // Optional per-sender limit on bytes received
+	AllowFrom  *Allowlist              // If set, only senders whose key is listed may send
+	NoDelta    bool                    // Always receive whole files, even when an older copy exists
+	NoMetadata bool                    // Keep local defaults instead of the sender's file mode, mtime and owner
+	Dedup      *HashIndex              // If set, content already held here is linked into OutputDir rather than received
+	Chat       *Chat                   // If set, exchange chat messages with the sender during the transfer
+	Extract    bool                    // Unpack archives flagged in the manifest into OutputDir instead of storing them
+	SyncDelete bool                    // Let a sender remove from a directory its syncs created what it no longer has
+
+	// Destination, if set, is called once a file is accepted to choose where
+	// it is written instead of OutputDir. It returns a file path, or an
+	// existing directory to put the file in under its own name; "" keeps
+	// the default and an error rejects the transfer.
+	Destination func(m *Manifest) (string, error)
+
+	// Hooks vet each received file before it takes its real name; see Hook.
+	// Files they reject go to Quarantine, or are deleted if it is "".
+	Hooks      []Hook
+	Quarantine string
+
+	// OnText receives text snippets sent with SendText when writing to
+	// OutputDir; if nil they are printed to the console
+	OnText func(m *Manifest, text string) error
+
+	// OnPeers takes the peer records sent with ExchangePeers by sender and
+	// returns the records to answer with. An error wrapping ErrRejected
+	// tells the sender it was refused. If nil, exchanges are refused.
+	OnPeers func(m *Manifest, sender *rsa.PublicKey, records []byte) ([]byte, error)
+
+	// Expose, if set, lets the senders it allows list and fetch the files
+	// in a directory; see pull.go
+	Expose *Exposed
+
+	// Storage, if set, is called for each accepted file to open a writer it
+	// is streamed to instead of OutputDir, e.g. an object store upload; a
+	// nil writer keeps the file on disk. See Aborter for how the writer is
+	// finished.
+	Storage func(m *Manifest) (io.WriteCloser, error)
+}
+
 // ReceiveFile receives a file and its manifest from the given connection
-func ReceiveFile(conn io.Reader, outputDir string) error {
-	// Create output directory if it doesn't exist
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+func ReceiveFile(conn io.ReadWriter, outputDir string) error {
+	_, err := Receive(conn, ReceiveOptions{OutputDir: outputDir})
+	return err
+}
+
+// ReceiveToWriter receives a transfer and writes its decrypted contents to w
+// instead of a file, e.g. to stream to stdout
+func ReceiveToWriter(conn io.ReadWriter, w io.Writer) (*Manifest, error) {
+	return Receive(conn, ReceiveOptions{Output: w})
+}
+
+// Receive receives a transfer as described by opts
+func Receive(conn io.ReadWriter, opts ReceiveOptions) (*Manifest, error) {
+	// Preflight checks run before the sender commits any data, so a refusal
+	// reaches it as a clear error rather than a broken connection
+	var reservedFor string
+	var reserved int64
+	// dest is where a file transfer is written; never let the sender pick a
+	// path outside OutputDir
+	var dest string
+	// A file transfer that breaks off is kept for its sender to resume
+	finish := func(string) {}
+	// stored is set for a file streamed to Storage rather than dest
+	var stored *storedFile
+	// extract is set for an archive unpacked into OutputDir rather than
+	// stored at dest
+	var extract *extraction
+	check := func(m *Manifest, sender string) error {
+		log := log.With("transfer_id", m.TransferID)
+		// Unknown senders are turned away before anything else is looked at
+		if opts.AllowFrom != nil {
+			if err := opts.AllowFrom.Check(sender, m.SenderID); err != nil {
+				log.Warn("Refusing transfer from sender not on the allowlist", "fingerprint", sender, "file", m.FileName)
+				return err
+			}
+		}
+		if opts.Output != nil && (m.Kind == KindSync || m.Kind == KindSyncIndex || isSyncEntry(m.Kind)) {
+			return errors.New("this receiver writes to a stream and can't take a synced directory")
+		}
+		if opts.Output != nil && m.Kind == KindPeers {
+			return fmt.Errorf("%w: this receiver writes to a stream and doesn't exchange peers", ErrRejected)
+		}
+		if opts.Output != nil && (m.Kind == KindList || m.Kind == KindGet) {
+			return fmt.Errorf("%w: this receiver writes to a stream and exposes no directory", ErrRejected)
+		}
+		if opts.Output == nil && m.Kind == "" {
+			if _, err := fileName(m); err != nil {
+				return err
+			}
+		}
+		if opts.Output == nil && m.Kind == "" && opts.Storage != nil {
+			w, err := opts.Storage(m)
+			if err != nil {
+				return err
+			}
+			if w != nil {
+				stored = &storedFile{w: w}
+			}
+		}
+		switch {
+		case opts.Output != nil, stored != nil:
+		case m.Kind == KindText:
+			if err := checkText(m); err != nil {
+				return err
+			}
+		case m.Kind == KindBench:
+		case m.Kind == KindPeers:
+			if err := checkPeers(m, opts.OnPeers); err != nil {
+				return err
+			}
+		case m.Kind == KindList, m.Kind == KindGet:
+			if err := checkPull(m, sender, opts.Expose); err != nil {
+				return err
+			}
+		case m.Kind == KindSyncIndex:
+			if err := checkSyncIndex(opts.OutputDir, m, sender, opts.SyncDelete); err != nil {
+				return err
+			}
+		case isSyncEntry(m.Kind):
+			if err := checkSyncEntry(opts.OutputDir, m); err != nil {
+				return err
+			}
+			claimSyncDir(opts.OutputDir, m, sender)
+		default:
+			// A synced file we hold unchanged needn't be sent
+			if m.Kind == KindSync {
+				path, err := syncDest(opts.OutputDir, m)
+				if err != nil {
+					return err
+				}
+				claimSyncDir(opts.OutputDir, m, sender)
+				if upToDate(path, m) {
+					log.Debug("Synced file is up to date", "file", m.FileName)
+					return ErrAlreadyHave
+				}
+			}
+			if err := checkDiskSpace(opts.OutputDir, m.FileSize); err != nil {
+				return err
+			}
+		}
+		if opts.Quota != nil {
+			if err := opts.Quota.Reserve(sender, m.FileSize); err != nil {
+				return err
+			}
+			reservedFor, reserved = sender, m.FileSize
+		}
+		if opts.Accept != nil {
+			if err := opts.Accept(m); err != nil {
+				return err
+			}
+		}
+		if opts.Output != nil || stored != nil || (m.Kind != "" && m.Kind != KindSync) {
+			return nil
+		}
+		if opts.Extract && m.Kind == "" && m.Archive != "" {
+			// Hooks vet whole files; an archive unpacked as it arrives never is one
+			if len(opts.Hooks) > 0 {
+				log.Info("Receive hooks are set; storing archive without extracting it", "file", m.FileName)
+			} else {
+				log.Info("Extracting archive", "file", m.FileName, "format", m.Archive, "dir", opts.OutputDir)
+				var err error
+				extract, err = newExtraction(opts.OutputDir, m, !opts.NoMetadata)
+				return err
+			}
+		}
+		name, err := fileName(m)
+		if err != nil {
+			return err
+		}
+		dest = filepath.Join(opts.OutputDir, name)
+		if m.Kind == KindSync {
+			// Synced files keep their place in the directory, ignoring
+			// Destination
+			dest, _ = syncDest(opts.OutputDir, m)
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return fmt.Errorf("failed to create destination directory: %w", err)
+			}
+		} else if opts.Destination != nil {
+			path, err := chooseDestination(opts.Destination, m)
+			if err != nil {
+				return err
+			}
+			if path != "" && path != dest {
+				if err := checkDiskSpace(filepath.Dir(path), m.FileSize); err != nil {
+					return err
+				}
+				log.Info("Saving to chosen destination", "file", m.FileName, "path", path)
+				dest = path
+			}
+		}
+		// Content we already hold is linked into place instead of sent
+		if opts.Dedup != nil && m.Hash != "" {
+			alg := negotiateHash([]string{m.HashAlg})
+			if src := opts.Dedup.Find(filepath.Dir(dest), alg, m.Hash, m.FileSize); src != "" {
+				if err := linkExisting(src, dest); err != nil {
+					log.Warn("Cannot reuse existing copy, receiving it again", "file", m.FileName, "existing", src, "error", err)
+					return nil
+				}
+				log.Info("Already have this file, linked existing copy", "file", m.FileName, "existing", src)
+				return ErrAlreadyHave
+			}
+		}
+		TakeOver(m)
+		if m.resumeAt = resumeOffset(m, dest+PartSuffix); m.resumeAt > 0 {
+			log.Info("Resuming interrupted transfer", "file", m.FileName, "offset", m.resumeAt)
+		}
+		finish = trackReceive(m, conn, dest+PartSuffix)
+		return nil
+	}
+
+	var m *Manifest
+	var err error
+	if opts.Output != nil {
+		// Hide the concrete type so skip frames are written out as zeros:
+		// stdout may be a terminal or pipe that can't seek
+		output := struct{ io.Writer }{opts.Output}
+		m, err = receive(conn, check, nil, opts.Chat, func(m *Manifest) (io.Writer, func() error, func(bool) error, error) {
+			return output, func() error { return nil }, func(bool) error { return nil }, nil
+		})
+	} else {
+		// Create output directory if it doesn't exist
+		if err := os.MkdirAll(opts.OutputDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create output directory: %w", err)
+		}
+		// An existing file of the same name is the basis for a delta
+		// transfer; the new version is assembled next to it and renamed over
+		// it only once complete
+		var basisFile *os.File
+		basis := func(m *Manifest) *os.File {
+			path, minSize := dest, int64(minDeltaBasis)
+			switch {
+			case m.verifyResume:
+				// The part kept from before is checked against the sender's file
+				path, minSize = dest+PartSuffix, 1
+			case opts.NoDelta || stored != nil || extract != nil || m.resumeAt > 0 || (m.Kind != "" && m.Kind != KindSync):
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return nil
+			}
+			if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() || info.Size() < minSize {
+				f.Close()
+				return nil
+			}
+			basisFile = f
+			return f
+		}
+		// Receive hooks vet files before they take their real name
+		vet := func(m *Manifest) func(path string) error {
+			if len(opts.Hooks) == 0 {
+				return nil
+			}
+			return func(path string) error { return runHooks(opts.Hooks, opts.Quarantine, path, m) }
+		}
+		m, err = receive(conn, check, basis, opts.Chat, func(m *Manifest) (io.Writer, func() error, func(bool) error, error) {
+			// Text snippets are shown rather than stored, benchmark data dropped
+			switch m.Kind {
+			case KindText:
+				return openText(opts.OnText)(m)
+			case KindBench:
+				return io.Discard, func() error { return nil }, func(bool) error { return nil }, nil
+			case KindSyncIndex:
+				return openSyncIndex(opts.OutputDir)(m)
+			case KindSyncDir, KindSyncLink, KindSyncFIFO:
+				return openSyncEntry(opts.OutputDir, !opts.NoMetadata)(m)
+			case KindPeers:
+				return openPeers(opts.OnPeers)(m)
+			case KindList:
+				return openList(opts.Expose)(m)
+			case KindGet:
+				return io.Discard, func() error { return nil }, func(bool) error { return nil }, nil
+			}
+			switch {
+			case stored != nil:
+				return stored.sink()
+			case extract != nil:
+				return extract.sink(m)
+			case basisFile != nil && m.verifyResume:
+				return openResumed(dest, vet(m))
+			case basisFile != nil:
+				return openReplacement(dest, vet(m))
+			}
+			return openPart(dest, m.resumeAt, vet(m))
+		})
+		keep := ""
+		if basisFile != nil {
+			basisFile.Close()
+		}
+		if (basisFile == nil || m.verifyResume) && stored == nil && extract == nil && resumable(err) {
+			keep = dest + PartSuffix
+		}
+		finish(keep)
+	}
+	if err != nil && reservedFor != "" {
+		opts.Quota.Release(reservedFor, reserved)
+	}
+	// A stored file refused after its writer was opened is aborted too
+	if err != nil && stored != nil {
+		stored.end(false)
+	}
+	if errors.Is(err, ErrAlreadyHave) {
+		return m, nil
+	}
+	// A file asked for follows the request, the other way
+	if err == nil && m.Kind == KindGet {
+		err = sendPulled(conn, m, opts.Expose)
+	}
+	if err == nil && opts.Output == nil && stored == nil && extract == nil && (m.Kind == "" || m.Kind == KindSync) {
+		path := dest
+		if !opts.NoMetadata {
+			restoreMetadata(path, m)
+		}
+		if opts.Dedup != nil {
+			if err := opts.Dedup.Add(path, m.HashAlg, m.Hash); err != nil {
+				log.Warn("Failed to index received file", "path", path, "error", err)
+			}
+		}
+	}
+	return m, err
+}
+
+// chooseDestination asks choose where to write the file m describes,
+// resolving a directory answer to the file's name inside it and creating
+// missing parent directories
+func chooseDestination(choose func(m *Manifest) (string, error), m *Manifest) (string, error) {
+	path, err := choose(m)
+	if err != nil || path == "" {
+		return "", err
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		name, err := fileName(m)
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(path, name)
+	}
+	if !plainName(filepath.Base(path)) {
+		return "", fmt.Errorf("invalid destination %q", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	return path, nil
+}
+
+// plainName reports whether name is a single element naming a file, not
+// "", ".", ".." or a path
+func plainName(name string) bool {
+	return name != "." && filepath.IsLocal(name) && filepath.Base(name) == name
+}
+
+// fileName returns the name a file from m is saved under: the last element
+// of the name its sender gave. Names whose last element isn't a plain name,
+// such as "..", are refused, as they would put the file, or its part file,
+// outside the directory it is received into.
+func fileName(m *Manifest) (string, error) {
+	name := filepath.Base(m.FileName)
+	if !plainName(name) {
+		return "", fmt.Errorf("%w: invalid file name %q", ErrRejected, m.FileName)
+	}
+	return name, nil
+}
+
+// receive runs the receiving side of the transfer protocol, writing
+// decrypted data to the sink returned by open. check vets the manifest and
+// the sender's key fingerprint before any data is accepted. basis, if not
+// nil, returns an existing copy of the file to receive only changes against.
+// chat, if not nil, exchanges messages with the sender.
+func receive(conn io.ReadWriter, check func(m *Manifest, sender string) error, basis func(m *Manifest) *os.File, chat *Chat, open sinkOpener) (*Manifest, error) {
+	sess := startSession("receive", conn)
+	m, err := receiveStream(sess, conn, check, basis, chat, open)
+	sess.end(err)
+	return m, err
+}
+
+// receiveStream is receive, logging to sess
+func receiveStream(sess *session, conn io.ReadWriter, check func(m *Manifest, sender string) error, basis func(m *Manifest) *os.File, chatOpts *Chat, open sinkOpener) (_ *Manifest, err error) {
+	// Read manifest, which may come sealed with the key and nonce
+	manifestFrame, err := util.ReadWithLength(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
 	}
-	// Read manifest
-	manifestBytes, err := util.ReadWithLength(conn)
+	manifestBytes, fileKey, nonce, sealer, err := openEnvelope(manifestFrame)
 	if err != nil {
-		return fmt.Errorf("failed to read manifest: %w", err)
+		return nil, err
 	}
+	sealed := sealer != nil
 
 	manifest, err := DeserializeManifest(manifestBytes)
 	if err != nil {
-		return fmt.Errorf("failed to parse manifest: %w", err)
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	// Older senders pick no ID; one made up here still ties our own logs
+	// together, but must stay out of the receipt they verify
+	senderID := manifest.TransferID
+	if manifest.TransferID == "" {
+		manifest.TransferID = NewTransferID()
+	}
+	sess.tag(manifest.TransferID)
+	log := sess.log
+	log.Debug("Manifest received", "file", manifest.FileName, "size", manifest.FileSize, "kind", manifest.Kind, "version", manifest.Version, "sealed", sealed)
+	if len(manifest.Meta) > 0 {
+		log.Info("Transfer metadata", "file", manifest.FileName, "meta", manifest.Meta)
 	}
 
-	// Read sender public key (not strictly necessary for decryption, but useful for identification)
-	senderPubBytes, err := util.ReadWithLength(conn)
+	// Read the sender's key, which identifies it, signed by its identity
+	// key from v18
+	senderKey, senderPubBytes, peerID, err := readIdentity(conn, manifestFrame)
 	if err != nil {
-		return fmt.Errorf("failed to read sender public key: %w", err)
+		return manifest, err
 	}
-	// Optionally parse sender public key
-	_, err = x509.ParsePKCS1PublicKey(senderPubBytes)
-	if err != nil {
-		return fmt.Errorf("failed to parse sender public key")
+	manifest.senderKey = senderKey
+
+	// Tell the sender whether to go ahead
+	sender := keys.Fingerprint(senderPubBytes)
+	manifest.Sender, manifest.SenderID = sender, peerID
+	log.Debug("Sender identified", "fingerprint", sender, "id", peerID)
+	verdict := checkReceive()
+	if verdict == nil {
+		verdict = ValidateMeta(manifest.Meta)
+	}
+	if verdict == nil {
+		verdict = check(manifest, sender)
+	}
+	// The sender's content hash, if any, is checked before the file is kept
+	expected, expectedAlg := manifest.Hash, negotiateHash([]string{manifest.HashAlg})
+	version := negotiateVersion(manifest.Version)
+	manifest.Cipher = negotiateCipher(manifest.Ciphers)
+	manifest.HashAlg = negotiateHash(manifest.Hashes)
+	if version < ProtocolV15 || verdict != nil {
+		manifest.resumeAt = 0
+	}
+	manifest.verifyResume = manifest.resumeAt > 0 && version >= ProtocolV16
+	// From v23 we vouch for the setup we saw, and the sender for its own
+	var digest, binding []byte
+	if binds(version, sealed) && verdict == nil {
+		digest = sessionDigest(transcript(conn), manifestFrame, senderPubBytes, version, manifest.Cipher, manifest.HashAlg, manifest.resumeAt)
+		if binding, err = bindingMAC(fileKey, nonce, digest, bindingReceiver); err != nil {
+			return manifest, err
+		}
+	}
+	if err := sendPreflight(conn, version, manifest.Cipher, manifest.HashAlg, manifest.resumeAt, binding, verdict); err != nil {
+		return manifest, fmt.Errorf("failed to send preflight response: %w", err)
+	}
+	if verdict != nil {
+		return manifest, fmt.Errorf("%w: %w", ErrRejected, verdict)
 	}
 
-	// Read encrypted session key and decrypt using our private key
-	encryptedKey, err := util.ReadWithLength(conn)
-	if err != nil {
-		return fmt.Errorf("failed to read encrypted file key: %w", err)
+	// Offer block signatures of our existing copy, if any
+	var sigs *signatures
+	var basisFile *os.File
+	if version >= ProtocolV3 {
+		if basis != nil {
+			basisFile = basis(manifest)
+		}
+		if basisFile != nil {
+			info, err := basisFile.Stat()
+			if err != nil {
+				return manifest, fmt.Errorf("failed to stat existing file: %w", err)
+			}
+			if sigs, err = computeSignatures(basisFile, info.Size(), version); err != nil {
+				return manifest, err
+			}
+			if manifest.resumeAt > 0 {
+				log.Info("Checking kept data with the sender", "file", manifest.FileName, "block_size", sigs.blockSize)
+			} else {
+				log.Info("Receiving changes against existing copy", "file", manifest.FileName, "block_size", sigs.blockSize)
+			}
+		}
+		if err := sendSignatures(conn, sigs, version); err != nil {
+			return manifest, err
+		}
 	}
+
+	// Read encrypted session key and decrypt using our private key, unless
+	// both came with a sealed manifest
 	priv, err := keys.LoadPrivateKey()
 	if err != nil {
-		return fmt.Errorf("failed to load private key: %w", err)
+		return manifest, fmt.Errorf("failed to load private key: %w", err)
 	}
-	fileKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, encryptedKey, nil)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt file key: %w", err)
+	if !sealed {
+		encryptedKey, err := util.ReadWithLength(conn)
+		if err != nil {
+			return manifest, fmt.Errorf("failed to read encrypted file key: %w", err)
+		}
+		fileKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, encryptedKey, nil)
+		if err != nil {
+			return manifest, fmt.Errorf("failed to decrypt file key: %w", err)
+		}
+		// Read base nonce (sent with length framing)
+		nonce, err = util.ReadWithLength(conn)
+		if err != nil {
+			return manifest, fmt.Errorf("failed to read nonce: %w", err)
+		}
 	}
+	if digest != nil {
+		if err := readBinding(conn, fileKey, nonce, digest); err != nil {
+			return manifest, err
+		}
+	}
+	// From v24 the sender learns why we give up while data flows, until
+	// ackDone
+	reporting := version >= ProtocolV24
+	defer func() {
+		if reporting && reportable(err) {
+			if sendErr := receiverAbort(conn, sealer, err); sendErr != nil {
+				log.Debug("Cannot report the failure to the sender", "error", sendErr)
+			}
+		}
+	}()
 	// Initialize decryption
-	block, err := aes.NewCipher(fileKey)
+	cc, err := newChunkCipher(version, manifest.Cipher, fileKey, nonce)
 	if err != nil {
-		return fmt.Errorf("failed to create cipher: %w", err)
+		return manifest, err
 	}
-	gcm, err := cipher.NewGCM(block)
+	chat, err := startChat(chatOpts, version, fileKey, nonce, false)
 	if err != nil {
-		return fmt.Errorf("failed to create GCM: %w", err)
+		return manifest, err
 	}
+	defer chat.end()
 
-	// Read base nonce (sent with length framing)
-	nonce, err := util.ReadWithLength(conn)
+	// Open the destination
+	file, discard, closeFn, err := open(manifest)
 	if err != nil {
-		return fmt.Errorf("failed to read nonce: %w", err)
-	}
-	if len(nonce) != gcm.NonceSize() {
-		return fmt.Errorf("invalid nonce size: expected %d, got %d", gcm.NonceSize(), len(nonce))
+		return manifest, err
 	}
+	complete := false
+	defer func() {
+		if !complete {
+			closeFn(false)
+		}
+	}()
 
-	// Create output file
-	outputPath := outputDir + "/" + manifest.FileName
-	file, err := os.Create(outputPath)
+	// Hash and count the reconstructed file for the delivery receipt
+	hasher, err := newHasher(manifest.HashAlg)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+		return manifest, err
+	}
+	counter := &countingWriter{w: io.MultiWriter(file, hasher), limit: manifest.FileSize}
+	// A resumed transfer carries on after the data kept from before, which
+	// the hash must cover too, unless it is rebuilt from it as a delta
+	if manifest.resumeAt > 0 && sigs == nil {
+		f, ok := file.(*os.File)
+		if !ok {
+			return manifest, errors.New("cannot resume a transfer into a stream")
+		}
+		if _, err := io.Copy(hasher, io.NewSectionReader(f, 0, manifest.resumeAt)); err != nil {
+			return manifest, fmt.Errorf("failed to read kept data: %w", err)
+		}
+		counter.n.Store(manifest.resumeAt)
+	}
+	var sink io.Writer = counter
+	var delta *deltaWriter
+	if sigs != nil {
+		delta = newDeltaWriter(counter, basisFile, sigs)
+		defer delta.Close()
+		sink = delta
+	}
+	holes := newHoleWriter(file, hasher, counter)
+	// From v7 the file is flushed to disk as it arrives and the sender told
+	// how much is durable
+	var syncer *fileSyncer
+	if version >= ProtocolV7 {
+		if syncer = newFileSyncer(file, counter); syncer != nil {
+			// Runs before closeFn, which the file must outlive
+			defer syncer.wait()
+		}
 	}
-	defer file.Close()
+	lastFrame := time.Now()
+
+	log.Debug("Negotiated transfer parameters", "version", version, "cipher", manifest.Cipher, "hash", manifest.HashAlg)
+	showStarted("Receiving", manifest.TransferID, manifest.FileName, manifest.FileSize)
 
 	// Initialize progress tracking
-	var totalReceived int64 = 0
-	lastUpdate := time.Now()
-	var lastBytes int64 = 0
-	var speed float64 = 0
-	var eta float64 = 0
+	progress := NewProgress(manifest.FileName, manifest.FileSize)
+	totalReceived := counter.n.Load()
+	progress.StartAt(totalReceived)
 
-	// Buffer for chunks
-	buffer := make([]byte, 64*1024) // Max possible chunk size
+	// Buffer for chunks, from the pool; grown on demand up to MaxChunkSize.
+	// Chunks are decrypted in place.
+	pooled := getBuffer(DefaultChunkSize + cc.Overhead())
+	defer func() { putBuffer(pooled) }()
+	buffer := *pooled
+	var chunks uint64
+	// From v8 a chunk that fails to decrypt is requested again; frames
+	// arriving until the sender's replay starts are dropped
+	resyncing := false
+	retries := 0
+	// Compressed chunks are inflated into a buffer of their own
+	var inflated []byte
+	// From v22 the sender's hash of the file follows the last chunk
+	var trailer *trailerFrame
 
-	var counter uint32 = 0
 	for {
 		// Read chunk length
 		var chunkLen uint32
 		if err := binary.Read(conn, binary.BigEndian, &chunkLen); err != nil {
-			return fmt.Errorf("failed to read chunk length: %w", err)
+			return manifest, fmt.Errorf("failed to read chunk length: %w", err)
+		}
+		if version >= ProtocolV9 && chunkLen&chatFlag != 0 {
+			if err := chat.read(conn, chunkLen&^chatFlag); err != nil {
+				return manifest, err
+			}
+			continue
+		}
+		// From v24 the sender may give up, saying why
+		if version >= ProtocolV24 && chunkLen&errorFlag != 0 {
+			return manifest, readSenderAbort(conn, sealer, chunkLen&^errorFlag)
+		}
+		// A replay sends the trailer again, unchanged
+		if version >= ProtocolV22 && chunkLen&trailerFlag != 0 && chunkLen&retransmitFlag == 0 {
+			if trailer, err = readTrailer(conn, chunkLen&^trailerFlag, fileKey, nonce); err != nil {
+				return manifest, err
+			}
+			continue
+		}
+		if version >= ProtocolV8 {
+			replayed := chunkLen&retransmitFlag != 0
+			chunkLen &^= retransmitFlag
+			if resyncing && !replayed {
+				if n := chunkLen &^ (skipFlag | compressFlag); n > 0 {
+					if n > uint32(MaxChunkSize+cc.Overhead()) {
+						return manifest, fmt.Errorf("chunk too large: %d bytes", n)
+					}
+					skipped := int64(n)
+					if version >= ProtocolV19 {
+						skipped += indexSize
+					}
+					if _, err := io.CopyN(io.Discard, conn, skipped); err != nil {
+						return manifest, fmt.Errorf("failed to read chunk: %w", err)
+					}
+				}
+				continue
+			}
+			if replayed {
+				resyncing = false
+			}
 		}
 
 		// Check for EOF marker
 		if chunkLen == 0 {
 			break
 		}
+		// From v19 the chunk's index follows its length
+		var index uint64
+		if version >= ProtocolV19 {
+			if err := binary.Read(conn, binary.BigEndian, &index); err != nil {
+				return manifest, fmt.Errorf("failed to read chunk index: %w", err)
+			}
+		}
+		skip := version >= ProtocolV6 && chunkLen&skipFlag != 0
+		if skip {
+			if delta != nil {
+				return manifest, fmt.Errorf("unexpected skip frame in delta transfer")
+			}
+			chunkLen &^= skipFlag
+		}
+		compressed := version >= ProtocolV13 && chunkLen&compressFlag != 0
+		chunkLen &^= compressFlag
+		if int(chunkLen) > cap(buffer) {
+			if int(chunkLen) > MaxChunkSize+cc.Overhead() {
+				return manifest, fmt.Errorf("chunk too large: %d bytes", chunkLen)
+			}
+			putBuffer(pooled)
+			pooled = getBuffer(int(chunkLen))
+			buffer = *pooled
+		}
 
 		// Read the encrypted chunk
 		if _, err := io.ReadFull(conn, buffer[:chunkLen]); err != nil {
-			e := os.Remove(outputPath)
-			if e != nil {
-				return fmt.Errorf("deleting file failed: %w", e)
-			}
-			return fmt.Errorf("deleting file, failed to read chunk: %w", err)
+			return manifest, fmt.Errorf("failed to read chunk: %w", err)
 		}
 
-		// Derive per-chunk nonce matching sender's scheme
-		chunkNonce := make([]byte, len(nonce))
-		copy(chunkNonce, nonce)
-		binary.BigEndian.PutUint32(chunkNonce[len(chunkNonce)-4:], counter)
-
-		// Decrypt the chunk
-		plaintext, err := gcm.Open(nil, chunkNonce, buffer[:chunkLen], nil)
+		// Decrypt the chunk with the nonce and key matching the sender's,
+		// unless it isn't the one due
+		var plaintext []byte
+		var err error
+		if version >= ProtocolV19 && index != chunks {
+			err = fmt.Errorf("%w: chunk %d arrived in place of chunk %d", ErrChecksumMismatch, index+1, chunks+1)
+		} else {
+			plaintext, err = cc.open(buffer[:0], buffer[:chunkLen])
+		}
+		if err != nil && version >= ProtocolV8 && retries < maxRetransmits {
+			retries++
+			log.Warn("Chunk failed to decrypt or is out of order, asking for it again", "chunk", chunks+1, "attempt", retries, "error", err)
+			if err := sendNack(conn, chunks); err != nil {
+				return manifest, err
+			}
+			resyncing = true
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("decryption failed: %w", err)
+			return manifest, err
+		}
+		retries = 0
+		if compressed {
+			if inflated, err = decompressChunk(inflated, plaintext); err != nil {
+				return manifest, err
+			}
+			plaintext = inflated
 		}
 
-		// Write the decrypted data to file
-		if _, err := file.Write(plaintext); err != nil {
-			return fmt.Errorf("failed to write to file: %w", err)
+		// Write the decrypted data to file, or leave a hole for a run of zeros
+		if skip {
+			n, err := parseSkip(plaintext)
+			if err != nil {
+				return manifest, err
+			}
+			if err := holes.skip(n); err != nil {
+				return manifest, fmt.Errorf("failed to write to file: %w", err)
+			}
+		} else if _, err := sink.Write(plaintext); err != nil {
+			return manifest, fmt.Errorf("failed to write to file: %w", err)
+		}
+		chunks++
+		if version >= ProtocolV5 {
+			if err := sendAck(conn, chunks); err != nil {
+				return manifest, err
+			}
+			if err := sendChatAcks(conn, chat); err != nil {
+				return manifest, err
+			}
+		}
+		if syncer != nil && time.Since(lastFrame) >= ProgressInterval {
+			syncer.start()
+			if err := sendProgress(conn, counter.n.Load(), syncer.persisted.Load()); err != nil {
+				return manifest, err
+			}
+			lastFrame = time.Now()
 		}
 
 		// Update progress
-		totalReceived += int64(len(plaintext))
-		now := time.Now()
-		if now.Sub(lastUpdate) > 100*time.Millisecond {
-			delta := totalReceived - lastBytes
-			deltaTime := now.Sub(lastUpdate).Seconds()
-			if deltaTime > 0 {
-				speed = float64(delta) / deltaTime
-				if speed > 0 {
-					eta = float64(manifest.FileSize-totalReceived) / speed
-				}
+		totalReceived = counter.n.Load()
+		if progress.Set(totalReceived) {
+			showProgress("Receiving", manifest.TransferID, progress, -1)
+		}
+	}
+	if syncer != nil {
+		if err := syncer.flush(); err != nil {
+			return manifest, err
+		}
+		if err := sendProgress(conn, counter.n.Load(), syncer.persisted.Load()); err != nil {
+			return manifest, err
+		}
+	}
+	if version >= ProtocolV5 {
+		// The sender reads no more frames after ackDone
+		if err := sendChatAcks(conn, chat); err != nil {
+			return manifest, err
+		}
+		chat.end()
+		reporting = false
+		if err := sendAck(conn, ackDone); err != nil {
+			return manifest, err
+		}
+	}
+	// From v11 the sender waits for the outcome of storing the file
+	failed := func(err error) (*Manifest, error) {
+		if version >= ProtocolV11 {
+			if sendErr := sendStatus(conn, sealer, manifest, nil, err); sendErr != nil {
+				log.Debug("Cannot report the failure to the sender", "error", sendErr)
+			}
+		}
+		return manifest, err
+	}
+	if delta != nil {
+		if err := delta.Close(); err != nil {
+			return failed(err)
+		}
+	}
+	if err := holes.finish(); err != nil {
+		return failed(err)
+	}
+	totalReceived = counter.n.Load()
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	var mismatch error
+	switch {
+	case version >= ProtocolV22 && trailer == nil:
+		mismatch = fmt.Errorf("%w: no trailer after the data", ErrChecksumMismatch)
+	case trailer != nil && (trailer.Hash != hash || trailer.Size != totalReceived):
+		mismatch = fmt.Errorf("%w: received %d bytes with %s hash %s, sender read %d bytes with hash %s",
+			ErrChecksumMismatch, totalReceived, manifest.HashAlg, hash, trailer.Size, trailer.Hash)
+	case expected != "" && expectedAlg == manifest.HashAlg && hash != expected:
+		mismatch = fmt.Errorf("%w: received %s hash %s, manifest says %s", ErrChecksumMismatch, manifest.HashAlg, hash, expected)
+	}
+	if mismatch != nil {
+		complete = true
+		closeFn(false)
+		discard()
+		return failed(mismatch)
+	}
+	complete = true
+	if err := closeFn(true); err != nil {
+		return failed(err)
+	}
+
+	// Send a signed receipt so the sender has proof of delivery
+	receipt := &Receipt{
+		FileName:   manifest.FileName,
+		FileSize:   totalReceived,
+		Hash:       hash,
+		ReceivedAt: time.Now(),
+		TransferID: senderID,
+	}
+	// Receipts for older senders must keep their fields, or the signature
+	// they check would not match
+	if manifest.HashAlg != HashSHA256 {
+		receipt.HashAlg = manifest.HashAlg
+	}
+	manifest.Hash = receipt.Hash
+	if err := receipt.Sign(priv); err != nil {
+		return failed(err)
+	}
+	if version >= ProtocolV11 {
+		if err := sendStatus(conn, sealer, manifest, receipt, nil); err != nil {
+			return manifest, err
+		}
+	} else {
+		receiptBytes, err := json.Marshal(receipt)
+		if err != nil {
+			return manifest, fmt.Errorf("failed to encode receipt: %w", err)
+		}
+		if err := util.SendWithLength(conn, sealer.seal(sealedReceiptFrame, receiptBytes)); err != nil {
+			return manifest, fmt.Errorf("failed to send receipt: %w", err)
+		}
+	}
+	log.Debug("Receipt sent", "hash", receipt.Hash, "hash_alg", manifest.HashAlg)
+	log.Debug("Transfer timings", "bytes", totalReceived, "chunks", chunks, "elapsed", progress.Elapsed().String())
+
+	// Print final progress
+	showComplete("Receiving", manifest.TransferID, manifest.FileName, totalReceived, progress.Elapsed())
+	if !util.JSONEvents() && (manifest.Kind == "" || manifest.Kind == KindSync) {
+		fmt.Fprintln(util.ConsoleOutput(), "File received successfully:", manifest.FileName)
+	}
+	return manifest, nil
+}
+
+// PartSuffix marks a file still being received. It is renamed to its final
+// name only once complete and verified; an interrupted transfer leaves it
+// behind to resume from.
+const PartSuffix = ".part"
+
+// openPart writes outputPath as outputPath.part and, once the transfer is
+// complete, flushes it to disk and renames it into place. Renaming also
+// leaves alone any other file an existing outputPath is a hard link to. A
+// non-zero offset keeps that much of an existing .part file and appends to
+// it. vet, if not nil, may turn the complete file down before it is renamed.
+func openPart(outputPath string, offset int64, vet func(path string) error) (io.Writer, func() error, func(bool) error, error) {
+	partPath := outputPath + PartSuffix
+	var file *os.File
+	var err error
+	if offset > 0 {
+		if file, err = os.OpenFile(partPath, os.O_RDWR, 0); err == nil {
+			if err = file.Truncate(offset); err == nil {
+				_, err = file.Seek(offset, io.SeekStart)
+			}
+			if err != nil {
+				file.Close()
+			}
+		}
+	} else {
+		file, err = os.Create(partPath)
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	discard := func() error { return os.Remove(partPath) }
+	closeFn := func(complete bool) error {
+		if !complete {
+			return file.Close()
+		}
+		err := file.Sync()
+		if e := file.Close(); err == nil {
+			err = e
+		}
+		if err == nil && vet != nil {
+			if err := vet(partPath); err != nil {
+				return err
 			}
-			lastUpdate = now
-			lastBytes = totalReceived
-			percent := float64(totalReceived) / float64(manifest.FileSize) * 100
+		}
+		if err == nil {
+			err = os.Rename(partPath, outputPath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to finish output file: %w", err)
+		}
+		syncDir(filepath.Dir(outputPath))
+		return nil
+	}
+	return file, discard, closeFn, nil
+}
 
-			// Format ETA with duration rounding
-			etaDuration := time.Duration(eta) * time.Second
-			etaStr := "--:--"
-			if eta > 0 {
-				etaStr = fmt.Sprintf("%02d:%02d", int(etaDuration.Minutes()), int(etaDuration.Seconds())%60)
+// syncDir flushes a directory, making a rename in it durable. Not every
+// platform can, so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// openReplacement writes a new version of outputPath next to it, so the old
+// copy stays readable as the delta basis, and renames it into place once the
+// transfer is complete. vet, if not nil, may turn the new version down
+// before it replaces the old.
+func openReplacement(outputPath string, vet func(path string) error) (io.Writer, func() error, func(bool) error, error) {
+	file, err := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".delta-*")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	if info, err := os.Stat(outputPath); err == nil {
+		file.Chmod(info.Mode().Perm())
+	}
+	tempPath := file.Name()
+	discard := func() error { return os.Remove(tempPath) }
+	closeFn := func(complete bool) error {
+		var err error
+		if complete {
+			err = file.Sync()
+		}
+		if e := file.Close(); err == nil {
+			err = e
+		}
+		if complete && err == nil && vet != nil {
+			if err := vet(tempPath); err != nil {
+				return err
 			}
+		}
+		if complete && err == nil {
+			err = os.Rename(tempPath, outputPath)
+		}
+		if !complete || err != nil {
+			os.Remove(tempPath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replace existing file: %w", err)
+		}
+		return nil
+	}
+	return file, discard, closeFn, nil
+}
 
-			fmt.Printf("\rReceiving: %s [%s] %.1f%% - %s/s - ETA: %s",
-				manifest.FileName,
-				progressBar(percent, 20),
-				percent,
-				formatBytes(speed),
-				etaStr,
-			)
+// openResumed is openReplacement for a resumed transfer rebuilt from the
+// .part file kept before (protocol v16): it replaces the part once complete,
+// and if this attempt breaks off too, what it rebuilt becomes the part to
+// resume from next time when it got further
+func openResumed(outputPath string, vet func(path string) error) (io.Writer, func() error, func(bool) error, error) {
+	partPath := outputPath + PartSuffix
+	file, err := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".resume-*")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	if info, err := os.Stat(partPath); err == nil {
+		file.Chmod(info.Mode().Perm())
+	}
+	tempPath := file.Name()
+	discard := func() error {
+		os.Remove(partPath)
+		return os.Remove(tempPath)
+	}
+	closeFn := func(complete bool) error {
+		var err error
+		if complete {
+			err = file.Sync()
+		}
+		if e := file.Close(); err == nil {
+			err = e
 		}
+		if !complete {
+			kept, err1 := os.Stat(partPath)
+			rebuilt, err2 := os.Stat(tempPath)
+			if err1 != nil || err2 != nil || rebuilt.Size() <= kept.Size() || os.Rename(tempPath, partPath) != nil {
+				os.Remove(tempPath)
+			}
+			return err
+		}
+		if err == nil && vet != nil {
+			if err := vet(tempPath); err != nil {
+				return err
+			}
+		}
+		if err == nil {
+			err = os.Rename(tempPath, outputPath)
+		}
+		if err != nil {
+			os.Remove(tempPath)
+			return fmt.Errorf("failed to finish output file: %w", err)
+		}
+		os.Remove(partPath)
+		syncDir(filepath.Dir(outputPath))
+		return nil
+	}
+	return file, discard, closeFn, nil
+}
+
+// countingWriter counts the bytes written through it, refusing any beyond
+// limit unless it is negative
+type countingWriter struct {
+	w     io.Writer
+	n     atomic.Int64
+	limit int64
+}
 
-		// Increment counter to match sender's per-chunk nonce
-		counter++
+// fits fails if n more bytes would go past the limit. The free space and
+// quota checks went by the size the sender declared, so it mustn't send more.
+func (c *countingWriter) fits(n int64) error {
+	if c.limit >= 0 && n > c.limit-c.n.Load() {
+		return fmt.Errorf("sender sent more than the %d bytes it declared", c.limit)
 	}
-	// Print final progress
-	fmt.Printf("\rReceiving: %s [%s] 100%% - Complete!%s\n",
-		manifest.FileName,
-		progressBar(100, 20),
-		strings.Repeat(" ", 20), // Clear any remaining characters
-	)
-	fmt.Println("File received successfully:", manifest.FileName)
 	return nil
 }
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if err := c.fits(int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,280 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Resuming (protocol v15): when a file transfer breaks off, the receiver
+// keeps its .part file and remembers it under the transfer's ID. A sender
+// that reconnects with the same ID, e.g. after its address changed, is told
+// in the preflight answer how many bytes are already held, and sends only
+// the rest. The receiver hashes the kept prefix so the receipt still covers
+// the whole file, and a sender whose file changed meanwhile fails the
+// receipt check instead of leaving a mixed copy. Only the same sender may
+// resume, and only with a manifest matching the one that was interrupted.
+// From v16 the kept part isn't trusted either: the receiver sends block
+// signatures of it as for a delta transfer, and the sender sends again the
+// blocks that don't match (see encodeResume).
+//
+// The receiver also writes what it knows about each transfer to a state
+// file next to the .part file as soon as the transfer starts, so a receiver
+// that crashed or was restarted can still be resumed: the manifest, the
+// sender, the protocol version and hash the sender offered, and, once the
+// transfer is interrupted, how much had arrived. Chunks are written in
+// order, so what arrived is a prefix of the file rather than a set of
+// chunks. Data the crash kept from reaching the disk can't be told from
+// data that did, so a transfer resumed from the state file alone is only
+// resumed from v16, whose block check sends again whatever was lost.
+
+// ResumeTimeout is how long an interrupted transfer may be resumed
+var ResumeTimeout = time.Hour
+
+// StateSuffix is added to the name of a .part file for the file holding
+// the state of its transfer
+const StateSuffix = ".state"
+
+// resumeState is what is kept on disk about a transfer being received, for
+// it to be resumed after a restart
+type resumeState struct {
+	TransferID  string    `json:"transfer_id"`
+	Sender      string    `json:"sender"`              // Fingerprint of the sender's key
+	SenderID    string    `json:"sender_id,omitempty"` // Sender's peer ID, from v18
+	Manifest    *Manifest `json:"manifest"`
+	Version     int       `json:"version"`  // Protocol version negotiated with the sender
+	HashAlg     string    `json:"hash_alg"` // Hash algorithm negotiated for the receipt
+	Received    int64     `json:"received"` // Bytes held when the transfer was interrupted, 0 until then
+	Started     time.Time `json:"started"`
+	Interrupted time.Time `json:"interrupted,omitzero"`
+}
+
+// saveState writes st to the state file of the .part file at part
+func saveState(part string, st *resumeState) {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		log.Warn("Failed to encode transfer state", "transfer_id", st.TransferID, "error", err)
+		return
+	}
+	path := part + StateSuffix
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Warn("Failed to save transfer state; it can't be resumed after a restart", "transfer_id", st.TransferID, "error", err)
+	}
+}
+
+// loadState reads the state file of the .part file at part, if there is one
+func loadState(part string) *resumeState {
+	data, err := os.ReadFile(part + StateSuffix)
+	if err != nil {
+		return nil
+	}
+	var st resumeState
+	if err := json.Unmarshal(data, &st); err != nil || st.Manifest == nil {
+		log.Warn("Ignoring unreadable transfer state", "path", part+StateSuffix, "error", err)
+		return nil
+	}
+	return &st
+}
+
+// removeState deletes the state file of the .part file at part
+func removeState(part string) {
+	os.Remove(part + StateSuffix)
+}
+
+// partial is an interrupted transfer a sender may resume
+type partial struct {
+	path     string // The .part file
+	sender   string
+	name     string
+	size     int64
+	hash     string
+	modified time.Time
+	at       time.Time // When it was interrupted
+}
+
+var partials = struct {
+	sync.Mutex
+	byID map[string]partial
+}{byID: make(map[string]partial)}
+
+// keepPartial remembers the .part file at path of the interrupted transfer
+// m so its sender can resume it
+func keepPartial(m *Manifest, path string) {
+	if m.TransferID == "" || m.FileSize <= 0 {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 || info.Size() >= m.FileSize {
+		return
+	}
+	partials.Lock()
+	defer partials.Unlock()
+	now := time.Now()
+	for id, p := range partials.byID {
+		if now.Sub(p.at) > ResumeTimeout {
+			delete(partials.byID, id)
+		}
+	}
+	partials.byID[m.TransferID] = partial{
+		path:     path,
+		sender:   m.Sender,
+		name:     m.FileName,
+		size:     m.FileSize,
+		hash:     m.Hash,
+		modified: m.LastModTime,
+		at:       now,
+	}
+	if st := loadState(path); st != nil && st.TransferID == m.TransferID {
+		st.Received, st.Interrupted = info.Size(), now
+		saveState(path, st)
+	}
+	log.Info("Keeping interrupted transfer to resume", "transfer_id", m.TransferID, "file", m.FileName, "received", info.Size())
+}
+
+// receiving holds the file transfers being received, by transfer ID, so a
+// sender that reconnects can take over from a connection that hasn't
+// noticed it is dead
+var receiving = struct {
+	sync.Mutex
+	byID map[string]*activeReceive
+}{byID: make(map[string]*activeReceive)}
+
+// activeReceive is a file transfer being received
+type activeReceive struct {
+	sender string
+	conn   any           // Closed when the sender reconnects
+	done   chan struct{} // Closed once the transfer has ended
+}
+
+// TakeOver ends a receive of m still running on an older connection from
+// the same sender, waiting briefly for it to keep what it received, and
+// reports whether there was one. m must have been through the receiver's
+// checks, which fill in its Sender.
+func TakeOver(m *Manifest) bool {
+	receiving.Lock()
+	a := receiving.byID[m.TransferID]
+	receiving.Unlock()
+	if a == nil || m.TransferID == "" || a.sender != m.Sender {
+		return false
+	}
+	log.Info("Sender reconnected; dropping its previous connection", "transfer_id", m.TransferID, "file", m.FileName)
+	if c, ok := a.conn.(io.Closer); ok {
+		c.Close()
+	}
+	select {
+	case <-a.done:
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+// trackReceive records that m is being received over conn into the .part
+// file at part, and saves its state there. The returned func ends it,
+// keeping the .part file at keep, if not "", to resume; otherwise the state
+// is deleted.
+func trackReceive(m *Manifest, conn any, part string) func(keep string) {
+	if m.TransferID == "" {
+		return func(string) {}
+	}
+	a := &activeReceive{sender: m.Sender, conn: conn, done: make(chan struct{})}
+	receiving.Lock()
+	receiving.byID[m.TransferID] = a
+	receiving.Unlock()
+	if m.FileSize > 0 {
+		saveState(part, &resumeState{
+			TransferID: m.TransferID,
+			Sender:     m.Sender,
+			SenderID:   m.SenderID,
+			Manifest:   m,
+			Version:    negotiateVersion(m.Version),
+			HashAlg:    negotiateHash(m.Hashes),
+			Started:    time.Now(),
+		})
+	}
+	return func(keep string) {
+		if keep != "" {
+			keepPartial(m, keep)
+		} else {
+			removeState(part)
+		}
+		receiving.Lock()
+		if receiving.byID[m.TransferID] == a {
+			delete(receiving.byID, m.TransferID)
+		}
+		receiving.Unlock()
+		close(a.done)
+	}
+}
+
+// resumable reports whether a receive that failed with err may be resumed,
+// rather than having been turned down or failed its checks
+func resumable(err error) bool {
+	return err != nil && !errors.Is(err, ErrRejected) && !errors.Is(err, ErrChecksumMismatch) &&
+		!errors.Is(err, ErrQuarantined) && !errors.Is(err, ErrHookRejected)
+}
+
+// resumeOffset returns how many bytes of m, to be written to path, were
+// kept from an interrupted attempt, or 0 to start over. An entry is only
+// used once. Attempts from before this process started are found through
+// their state file.
+func resumeOffset(m *Manifest, path string) int64 {
+	partials.Lock()
+	p, ok := partials.byID[m.TransferID]
+	delete(partials.byID, m.TransferID)
+	partials.Unlock()
+	if !ok {
+		p, ok = restorePartial(m, path)
+	}
+	if !ok || m.TransferID == "" || time.Since(p.at) > ResumeTimeout {
+		return 0
+	}
+	if p.path != path || p.sender != m.Sender || p.name != m.FileName || p.size != m.FileSize ||
+		p.hash != m.Hash || !p.modified.Equal(m.LastModTime) {
+		return 0
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() >= m.FileSize {
+		return 0
+	}
+	return info.Size()
+}
+
+// restorePartial rebuilds the interrupted attempt at receiving m into the
+// .part file at path from its state file, left by an earlier run of the
+// receiver. It is dated by the last write to the .part file, as a crash
+// leaves no record of when the attempt ended.
+func restorePartial(m *Manifest, path string) (partial, bool) {
+	st := loadState(path)
+	if st == nil || m.TransferID == "" || st.TransferID != m.TransferID {
+		return partial{}, false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		removeState(path)
+		return partial{}, false
+	}
+	if negotiateVersion(m.Version) < ProtocolV16 {
+		log.Info("Not resuming transfer from before a restart: the sender can't check what was kept", "transfer_id", m.TransferID, "file", m.FileName)
+		return partial{}, false
+	}
+	log.Info("Found transfer interrupted before a restart", "transfer_id", m.TransferID, "file", m.FileName,
+		"received", info.Size(), "started", st.Started.Format(time.RFC3339))
+	return partial{
+		path:     path,
+		sender:   st.Sender,
+		name:     st.Manifest.FileName,
+		size:     st.Manifest.FileSize,
+		hash:     st.Manifest.Hash,
+		modified: st.Manifest.LastModTime,
+		at:       info.ModTime(),
+	}, true
+}
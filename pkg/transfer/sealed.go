@@ -0,0 +1,136 @@
+package transfer
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Sealed manifests (protocol v10): a plaintext manifest shows file names and
+// sizes to anyone on the path. When the sender knows before the transfer
+// that the receiver speaks v10, it opens with a sealedEnvelope in place of
+// the manifest, carrying the file key and base nonce that would otherwise
+// follow the preflight. The version has to be known up front, since the
+// manifest is what negotiates it; netconn learns it in its handshake and
+// exposes it through PeerVersioner. Other senders keep the plaintext
+// manifest, and receivers take either.
+
+// sealedEnvelope is the first frame of a transfer with a sealed manifest
+type sealedEnvelope struct {
+	Key      []byte `json:"key"`      // File key, RSA-OAEP encrypted to the receiver
+	Nonce    []byte `json:"nonce"`    // Base nonce of the chunk cipher
+	Manifest []byte `json:"manifest"` // Manifest sealed with manifestAEAD
+}
+
+// PeerVersioner is implemented by connections that learned the receiver's
+// protocol version before the transfer starts
+type PeerVersioner interface {
+	// PeerVersion returns the receiver's protocol version, 0 if unknown
+	PeerVersion() int
+}
+
+// sealsManifest reports whether the receiver at the other end of conn is
+// known to take a sealed manifest
+func sealsManifest(conn any) bool {
+	pv, ok := conn.(PeerVersioner)
+	return ok && pv.PeerVersion() >= ProtocolV10
+}
+
+// Frames sealed with the manifest key, each under its own nonce
+const (
+	sealedManifestFrame = iota
+	sealedReceiptFrame
+	sealedSenderErrorFrame
+	sealedReceiverErrorFrame
+)
+
+// frameSealer seals the frames that name the file, the manifest and the
+// receipt, on transfers with a sealed manifest. A nil frameSealer leaves
+// them in the clear.
+type frameSealer struct {
+	aead cipher.AEAD
+}
+
+// newFrameSealer derives the sealing key from the file key and base nonce.
+// The file key is fresh for each transfer, so each frame nonce is used once.
+func newFrameSealer(fileKey, nonce []byte) (*frameSealer, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nonce, "p2p-client manifest", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive manifest key: %w", err)
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &frameSealer{aead: aead}, nil
+}
+
+// seal seals data as frame n
+func (s *frameSealer) seal(n byte, data []byte) []byte {
+	if s == nil {
+		return data
+	}
+	return s.aead.Seal(nil, frameNonce(n), data, nil)
+}
+
+// open opens frame n
+func (s *frameSealer) open(n byte, data []byte) ([]byte, error) {
+	if s == nil {
+		return data, nil
+	}
+	return s.aead.Open(nil, frameNonce(n), data, nil)
+}
+
+func frameNonce(n byte) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	nonce[len(nonce)-1] = n
+	return nonce
+}
+
+// sealManifest builds the envelope carrying manifestBytes, fileKey and nonce
+func sealManifest(s *frameSealer, manifestBytes, fileKey, nonce []byte, receiverPubKey *rsa.PublicKey) ([]byte, error) {
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, receiverPubKey, fileKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt file key: %w", err)
+	}
+	return json.Marshal(sealedEnvelope{
+		Key:      encryptedKey,
+		Nonce:    nonce,
+		Manifest: s.seal(sealedManifestFrame, manifestBytes),
+	})
+}
+
+// openEnvelope returns the manifest, file key and nonce in frame, with the
+// sealer for the rest of the transfer, if it is a sealedEnvelope. For a
+// plaintext manifest it returns frame itself and a nil sealer.
+func openEnvelope(frame []byte) (manifestBytes, fileKey, nonce []byte, s *frameSealer, err error) {
+	var env sealedEnvelope
+	if json.Unmarshal(frame, &env) != nil || env.Manifest == nil {
+		return frame, nil, nil, nil, nil
+	}
+	priv, err := keys.LoadPrivateKey()
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to load private key: %w", err)
+	}
+	fileKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, env.Key, nil)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to decrypt file key: %w", err)
+	}
+	if len(env.Nonce) != nonceSize {
+		return nil, nil, nil, nil, fmt.Errorf("invalid nonce length %d", len(env.Nonce))
+	}
+	if s, err = newFrameSealer(fileKey, env.Nonce); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if manifestBytes, err = s.open(sealedManifestFrame, env.Manifest); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to open sealed manifest: %w", err)
+	}
+	return manifestBytes, fileKey, env.Nonce, s, nil
+}
@@ -1,23 +1,27 @@
 package transfer
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/udit2303/p2p-client/pkg/keys"
 	"github.com/udit2303/p2p-client/pkg/util"
 )
 
+var (
+	log = util.DefaultLogger()
+)
+
 func encryptFile(filePath string, key []byte) ([]byte, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -39,21 +43,52 @@ func encryptFile(filePath string, key []byte) ([]byte, error) {
 
 // SendFile sends a file with its manifest over the given connection
 // receiverPubKey must be the receiver's RSA public key used to encrypt the session key.
-func SendFile(conn io.Writer, filePath string, receiverPubKey *rsa.PublicKey) error {
-	// Create progress tracker
-	info, err := os.Stat(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
-	}
-	progress := NewProgress(info.Name(), info.Size())
-	defer fmt.Println() // Ensure we end the progress line
+func SendFile(conn io.ReadWriter, filePath string, receiverPubKey *rsa.PublicKey) error {
 	// Create manifest
 	manifest, err := CreateManifest(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to create manifest: %w", err)
 	}
+	if err := hashAhead(conn, manifest, filePath); err != nil {
+		return err
+	}
+
+	// Open the file
+	file, err := openSource(filePath, manifest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return sendStream(conn, manifest, file, receiverPubKey, nil)
+}
+
+// sendStream sends manifest followed by the encrypted contents of r.
+// manifest.FileSize may be -1 when the length of r isn't known in advance.
+// If stats is not nil, the time spent in each stage is added to it.
+func sendStream(conn io.ReadWriter, manifest *Manifest, r io.Reader, receiverPubKey *rsa.PublicKey, stats *StageTimings) (err error) {
+	if err := checkSend(); err != nil {
+		return err
+	}
+	sess := startSession("send", conn)
+	defer func() { sess.end(err) }()
+	if manifest.TransferID == "" {
+		manifest.TransferID = DefaultSendOptions.TransferID
+	}
+	if manifest.TransferID == "" {
+		manifest.TransferID = NewTransferID()
+	}
+	sess.tag(manifest.TransferID)
+	log := sess.log
+
+	// Create progress tracker
+	progress := NewProgress(manifest.FileName, manifest.FileSize)
 
 	// Serialize manifest
+	manifest.offer()
+	if err := ValidateMeta(manifest.Meta); err != nil {
+		return err
+	}
 	manifestBytes, err := SerializeManifest(manifest)
 	if err != nil {
 		return fmt.Errorf("failed to serialize manifest: %w", err)
@@ -63,137 +98,447 @@ func SendFile(conn io.Writer, filePath string, receiverPubKey *rsa.PublicKey) er
 	if err != nil {
 		return fmt.Errorf("failed to generate file key: %w", err)
 	}
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
 
-	// Send manifest length first
+	// Send the manifest, sealed together with the key and nonce when the
+	// receiver is known to take that
+	var sealer *frameSealer
+	sealed := sealsManifest(conn)
+	if sealed {
+		if sealer, err = newFrameSealer(fileKey, nonce); err != nil {
+			return err
+		}
+		if manifestBytes, err = sealManifest(sealer, manifestBytes, fileKey, nonce, receiverPubKey); err != nil {
+			return err
+		}
+	}
 	if err := util.SendWithLength(conn, manifestBytes); err != nil {
 		return fmt.Errorf("failed to send manifest: %w", err)
 	}
 
-	// Load sender public key and send it so receiver can identify sender
-	senderPub, err := keys.LoadPublicKey()
+	// Identify ourselves, proving it to receivers that take that
+	senderKey, err := sendIdentity(conn, manifestBytes)
 	if err != nil {
-		return fmt.Errorf("failed to load sender public key: %w", err)
-	}
-	senderPubBytes := x509.MarshalPKCS1PublicKey(senderPub)
-	if err := util.SendWithLength(conn, senderPubBytes); err != nil {
-		return fmt.Errorf("failed to send sender public key: %w", err)
+		return err
 	}
 
-	// Encrypt the session (file) key with receiver's public key and send it
-	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, receiverPubKey, fileKey, nil)
+	// The receiver checks the manifest (space, quota, approval) before we send data
+	preflight, err := readPreflight(conn)
+	if errors.Is(err, ErrAlreadyHave) {
+		// A sync counts the files it didn't need to send
+		if manifest.Kind == KindSync || isSyncEntry(manifest.Kind) {
+			log.Debug("Receiver's copy is up to date", "file", manifest.FileName)
+			return err
+		}
+		log.Info("Receiver already has this file, nothing to send", "file", manifest.FileName)
+		if !DefaultSendOptions.HideProgress {
+			showComplete("Sending", manifest.TransferID, manifest.FileName, 0, progress.Elapsed())
+		}
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to encrypt file key: %w", err)
+		return err
 	}
-	if err := util.SendWithLength(conn, encryptedKey); err != nil {
-		return fmt.Errorf("failed to send encrypted file key: %w", err)
+	version, suite, hashAlg, offset := preflight.Version, preflight.Cipher, preflight.Hash, preflight.Offset
+	// From v23 the receiver vouches for the setup it saw, and we for ours
+	var digest []byte
+	if binds(version, sealed) || (sealed && expectsBinding(conn)) {
+		digest = sessionDigest(transcript(conn), manifestBytes, senderKey, version, suite, hashAlg, offset)
+		if err := checkBinding(fileKey, nonce, digest, bindingReceiver, preflight.Binding); err != nil {
+			return err
+		}
 	}
-
-	// Open the file
-	file, err := os.Open(filePath)
+	manifest.Cipher = suite
+	hasher, err := newHasher(hashAlg)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return err
+	}
+	if manifest.Kind == KindBench && version < ProtocolV4 {
+		return fmt.Errorf("%w: receiver is too old for benchmarks", ErrProtocolVersion)
+	}
+	if (manifest.Kind == KindSync || manifest.Kind == KindSyncIndex) && version < ProtocolV14 {
+		return fmt.Errorf("%w: receiver is too old to sync directories", ErrProtocolVersion)
+	}
+	if isSyncEntry(manifest.Kind) && version < ProtocolV21 {
+		return fmt.Errorf("%w: receiver is too old for directories, links and named pipes in a sync", ErrProtocolVersion)
+	}
+	if manifest.Kind == KindPeers && version < ProtocolV17 {
+		return fmt.Errorf("%w: receiver is too old to exchange peers", ErrProtocolVersion)
+	}
+	if (manifest.Kind == KindList || manifest.Kind == KindGet) && version < ProtocolV20 {
+		return fmt.Errorf("%w: receiver is too old to browse or fetch from", ErrProtocolVersion)
+	}
+	// Adaptive chunks may shrink to the smallest size
+	chunkSize := DefaultSendOptions.chunkSize()
+	if DefaultSendOptions.AdaptiveChunks {
+		chunkSize = MinChunkSize
+	}
+	if limit := MaxFileSize(version, chunkSize); manifest.FileSize > limit {
+		return fmt.Errorf("%w: %s is more than protocol v%d carries in chunks of %s (%s)", ErrProtocolVersion,
+			util.FormatSize(manifest.FileSize), version, util.FormatSize(int64(chunkSize)), util.FormatSize(limit))
+	}
+	var sigs *signatures
+	if version >= ProtocolV3 {
+		if sigs, err = readSignatures(conn, version); err != nil {
+			return err
+		}
+	}
+
+	// Encrypt the session (file) key with receiver's public key and send it,
+	// unless it went with the sealed manifest
+	if !sealed {
+		encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, receiverPubKey, fileKey, nil)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt file key: %w", err)
+		}
+		if err := util.SendWithLength(conn, encryptedKey); err != nil {
+			return fmt.Errorf("failed to send encrypted file key: %w", err)
+		}
 	}
-	defer file.Close()
 
 	// Initialize encryption
-	block, err := aes.NewCipher(fileKey)
+	cc, err := newChunkCipher(version, suite, fileKey, nonce)
 	if err != nil {
-		return fmt.Errorf("failed to create cipher: %w", err)
+		return err
 	}
-	gcm, err := cipher.NewGCM(block)
+	chat, err := startChat(DefaultSendOptions.Chat, version, fileKey, nonce, true)
 	if err != nil {
-		return fmt.Errorf("failed to create GCM: %w", err)
+		return err
 	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return fmt.Errorf("failed to generate nonce: %w", err)
+	defer chat.end()
+
+	log.Debug("Negotiated transfer parameters", "version", version, "cipher", suite, "hash", hashAlg, "sealed_manifest", sealed, "peer", keys.PublicKeyFingerprint(receiverPubKey))
+	showStarted("Sending", manifest.TransferID, manifest.FileName, manifest.FileSize)
+
+	// Send base nonce (per-chunk nonces and keys are derived from it)
+	if !sealed {
+		if err := util.SendWithLength(conn, nonce); err != nil {
+			return fmt.Errorf("failed to send nonce: %w", err)
+		}
+	}
+	if digest != nil {
+		if err := sendBinding(conn, fileKey, nonce, digest); err != nil {
+			return err
+		}
 	}
 
-	// Send base nonce (will derive per-chunk nonces by incrementing counter)
-	if err := util.SendWithLength(conn, nonce); err != nil {
-		return fmt.Errorf("failed to send nonce: %w", err)
+	// Hash the plaintext as it is read, to check the receiver's receipt
+	src := &countingReader{r: io.TeeReader(r, hasher)}
+	file := r
+	source, _ := r.(*sourceFile)
+	if source != nil {
+		file = source.File
 	}
+	r = src
 
-	// Buffer for reading chunks (64KB - GCM overhead)
-	chunkSize := 64*1024 - 28 // 64KB - 28 bytes for GCM overhead
-	buffer := make([]byte, chunkSize)
+	// The receiver kept the start of the file from an interrupted attempt.
+	// It is still read, as the receipt covers the whole file; from v16 the
+	// receiver sends block signatures of what it kept, and blocks that don't
+	// match are sent again.
+	if offset > 0 {
+		if offset > manifest.FileSize || (manifest.Kind != "" && manifest.Kind != KindSync) ||
+			(sigs != nil && (version < ProtocolV16 || sigs.size != offset)) {
+			return fmt.Errorf("receiver asked to resume at invalid offset %d", offset)
+		}
+		if sigs == nil {
+			if _, err := io.CopyN(io.Discard, src, offset); err != nil {
+				return fmt.Errorf("failed to skip to resume offset: %w", err)
+			}
+		}
+		log.Info("Resuming interrupted transfer", "file", manifest.FileName, "offset", offset, "verify", sigs != nil)
+	}
 
-	var counter uint32 = 0
-	lastUpdate := time.Now()
-	var lastBytes int64 = 0
-	for {
-		// Read chunk
-		n, err := file.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
+	// The receiver has an older copy: send only the differences
+	if sigs != nil {
+		encode := encodeResume
+		if offset == 0 {
+			log.Info("Sending changes against receiver's existing copy", "file", manifest.FileName, "block_size", sigs.blockSize)
+			encode = encodeDelta
+		}
+		delta := deltaReader(src, sigs, encode)
+		defer delta.Close()
+		r = delta
+	}
+
+	tuner := newChunkTuner(DefaultSendOptions)
+	if stats == nil {
+		stats = &StageTimings{}
+	}
+
+	// From v6 runs of zeros are skipped rather than sent; a delta stream
+	// has no zeros worth skipping
+	sparse := version >= ProtocolV6 && sigs == nil && (manifest.Kind == "" || manifest.Kind == KindSync)
+	var holes *holeFinder
+	if sparse {
+		holes = newHoleFinder(file, src, hasher)
+	}
+
+	// From v5 the receiver acknowledges chunks as it writes them
+	var acks *ackWindow
+	if version >= ProtocolV5 {
+		acks = newAckWindow(conn, DefaultSendOptions.AckWindow, version, chat, sealer, log)
+		acks.confirmed = offset
+		defer acks.reportIncomplete()
+	}
+	// A receiver that stops reading blocks our writes once the socket
+	// buffers fill, before the window does; bound those writes too
+	deadliner, _ := conn.(interface{ SetWriteDeadline(time.Time) error })
+	if acks == nil {
+		deadliner = nil
+	}
+	// From v13 chunks may go compressed
+	compress := DefaultSendOptions.Compress && version >= ProtocolV13
+	throttle := newRateLimiter(DefaultSendOptions.RateLimit)
+	progress.StartAt(offset)
+
+	// From v24 the receiver learns why we give up on the file
+	abort := func(err error) error {
+		if version >= ProtocolV24 {
+			if sendErr := senderAbort(conn, sealer, err); sendErr != nil {
+				log.Debug("Cannot report the failure to the receiver", "error", sendErr)
 			}
-			return fmt.Errorf("read error: %w", err)
 		}
+		return err
+	}
 
-		// Derive per-chunk nonce: copy base nonce and put counter in last 4 bytes
-		chunkNonce := make([]byte, len(nonce))
-		copy(chunkNonce, nonce)
-		// Place counter in last 4 bytes (works when nonce size >= 4)
-		binary.BigEndian.PutUint32(chunkNonce[len(chunkNonce)-4:], counter)
+	// Chunks are read and sealed ahead on other goroutines; see pipeline.go
+	stop := make(chan struct{})
+	defer close(stop)
+	var timings pipelineStats
+	var header []byte
+	cr := &chunkReader{r: r, src: src, holes: holes, sparse: sparse, source: source, tuner: tuner}
+	for c := range startPipeline(cr, cc, compress, DefaultSendOptions.sendWorkers(), &timings, stop) {
+		<-c.done
+		if c.err != nil {
+			return abort(c.err)
+		}
+		ciphertext := *c.frame
+		if acks != nil {
+			if err := acks.wait(); err != nil {
+				putBuffer(c.frame)
+				return err
+			}
+		}
 
-		// Encrypt chunk with per-chunk nonce
-		ciphertext := gcm.Seal(nil, chunkNonce, buffer[:n], nil)
+		header = chunkHeader(header[:0], version, uint32(len(ciphertext))|c.flag, c.index)
 
-		// Send chunk length
-		if err := binary.Write(conn, binary.BigEndian, uint32(len(ciphertext))); err != nil {
-			return fmt.Errorf("failed to send chunk size: %w", err)
+		// Pacing isn't counted as time spent writing
+		throttle.wait(len(header) + len(ciphertext))
+		sealed := time.Now()
+
+		if deadliner != nil {
+			deadliner.SetWriteDeadline(time.Now().Add(AckTimeout))
+		}
+		if err := sendChatFrames(conn, chat); err != nil {
+			return acks.failure(stalled(err))
+		}
+
+		// Send chunk length, and index from v19
+		if _, err := conn.Write(header); err != nil {
+			return acks.failure(stalled(fmt.Errorf("failed to send chunk size: %w", err)))
 		}
 
 		// Send encrypted chunk
 		if _, err := conn.Write(ciphertext); err != nil {
-			return fmt.Errorf("failed to send chunk: %w", err)
-		}
-
-		// Update progress
-		progress.Transferred += int64(n)
-		now := time.Now()
-		if now.Sub(lastUpdate) > 100*time.Millisecond {
-			delta := progress.Transferred - lastBytes
-			deltaTime := now.Sub(lastUpdate).Seconds()
-			if deltaTime > 0 {
-				progress.Speed = float64(delta) / deltaTime
-				if progress.Speed > 0 {
-					progress.ETA = float64(progress.FileSize-progress.Transferred) / progress.Speed
-				}
-			}
-			lastUpdate = now
-			lastBytes = progress.Transferred
-			// Format ETA with duration rounding
-			duration := time.Duration(progress.ETA) * time.Second
-			etaStr := "--:--"
-			if progress.ETA > 0 {
-				etaStr = fmt.Sprintf("%02d:%02d", int(duration.Minutes()), int(duration.Seconds())%60)
-			}
+			return acks.failure(stalled(fmt.Errorf("failed to send chunk: %w", err)))
+		}
+		stats.Write += time.Since(sealed)
+		stats.Chunks++
+		// The ack window keeps the chunk to replay until it is acknowledged
+		if acks != nil {
+			acks.record(c.consumed, uint32(len(ciphertext))|c.flag, c.frame)
+		} else {
+			putBuffer(c.frame)
+		}
+
+		// Update progress by file bytes consumed, which differs from the
+		// bytes sent in delta transfers, or by the bytes the receiver
+		// confirmed when it acknowledges chunks
+		transferred := c.consumed
+		persisted := int64(-1)
+		if acks != nil {
+			transferred = acks.confirmed
+			persisted = acks.persisted.Load()
+		}
+		if progress.Set(transferred) && !DefaultSendOptions.HideProgress {
+			showProgress("Sending", manifest.TransferID, progress, persisted)
+		}
 
-			fmt.Printf("\rSending: %s [%s] %.1f%% - %s/s - ETA: %s",
-				progress.FileName,
-				progressBar(progress.Percent(), 20),
-				progress.Percent(),
-				formatBytes(progress.Speed),
-				etaStr,
-			)
+		tuner.done(c.size)
+	}
+	stats.Read += time.Duration(timings.read.Load())
+	stats.Encrypt += time.Duration(timings.encrypt.Load())
+	progress.Transferred = src.n.Load()
+	// A write since the last chunk was read may have changed what was sent
+	if source != nil {
+		if err := source.check(); err != nil {
+			return abort(err)
 		}
+	}
+	if deadliner != nil {
+		deadliner.SetWriteDeadline(time.Time{})
+	}
+	// The receiver reads no more frames after the end-of-file marker
+	if err := sendChatFrames(conn, chat); err != nil {
+		return acks.failure(err)
+	}
+	chat.end()
 
-		// Increment counter for next chunk
-		counter++
+	// From v22 the hash of what was read follows the data
+	if version >= ProtocolV22 {
+		trailer, err := sealTrailer(fileKey, nonce, hex.EncodeToString(hasher.Sum(nil)), src.n.Load())
+		if err != nil {
+			return err
+		}
+		if acks != nil {
+			acks.trailer = trailer
+		}
+		if _, err := conn.Write(trailer); err != nil {
+			return acks.failure(fmt.Errorf("failed to send trailer: %w", err))
+		}
 	}
 
 	// Send a zero-length chunk to signal end of file
 	if err := binary.Write(conn, binary.BigEndian, uint32(0)); err != nil {
-		return fmt.Errorf("failed to send EOF marker: %w", err)
+		return acks.failure(fmt.Errorf("failed to send EOF marker: %w", err))
+	}
+	if acks != nil {
+		if err := acks.finish(); err != nil {
+			return err
+		}
 	}
 	// Print final progress
-	fmt.Printf("\rSending: %s [%s] 100%% - Complete!%s\n",
-		progress.FileName,
-		progressBar(100, 20),
-		strings.Repeat(" ", 20), // Clear any remaining characters
-	)
+	if !DefaultSendOptions.HideProgress {
+		showComplete("Sending", manifest.TransferID, progress.FileName, progress.Transferred, progress.Elapsed())
+	}
+	log.Debug("Transfer timings", "bytes", progress.Transferred, "chunks", stats.Chunks,
+		"read", stats.Read.String(), "encrypt", stats.Encrypt.String(), "write", stats.Write.String(), "elapsed", progress.Elapsed().String())
 
+	// Wait for the receiver's signed receipt; benchmarks leave no record
+	if err := checkReceipt(log, conn, sealer, manifest, version, hashAlg, hex.EncodeToString(hasher.Sum(nil)), progress.Transferred, receiverPubKey); err != nil {
+		return err
+	}
 	return nil
 }
+
+// stalled marks a write that timed out waiting for the receiver
+func stalled(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrReceiverStalled, err)
+	}
+	return err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// checkReceipt reads the receiver's receipt for the transfer m, from v11
+// within its final status, opening it with sealer when the manifest was
+// sealed, verifies it covers what was sent with hashAlg, and keeps it as
+// proof of delivery; benchmarks, peer exchanges and pull requests leave no
+// record. A
+// receiver that failed to verify or store the file is reported as a
+// *DeliveryError.
+func checkReceipt(log *util.Logger, conn io.Reader, sealer *frameSealer, m *Manifest, version int, hashAlg, hash string, size int64, receiverPubKey *rsa.PublicKey) error {
+	receipt, err := readReceipt(conn, sealer, m, version)
+	if err != nil {
+		return err
+	}
+	if err := receipt.Verify(receiverPubKey); err != nil {
+		return err
+	}
+	if negotiateHash([]string{receipt.HashAlg}) != hashAlg || receipt.Hash != hash || receipt.FileSize != size {
+		return fmt.Errorf("%w: receiver got %d bytes with hash %s, sent %d bytes with hash %s",
+			ErrChecksumMismatch, receipt.FileSize, receipt.Hash, size, hash)
+	}
+	log.Debug("Receipt verified", "hash", receipt.Hash, "hash_alg", hashAlg, "receiver", receipt.Receiver)
+	if m.Kind == KindBench || m.Kind == KindPeers || m.Kind == KindList || m.Kind == KindGet || isSyncEntry(m.Kind) {
+		return nil
+	}
+	path, err := SaveReceipt(receipt)
+	if err != nil {
+		return fmt.Errorf("failed to store receipt: %w", err)
+	}
+	log.Info("Delivery receipt stored", "path", path, "hash", receipt.Hash)
+	return nil
+}
+
+// readReceipt reads the receipt frame of the transfer m, or from v11 the
+// final status
+func readReceipt(conn io.Reader, sealer *frameSealer, m *Manifest, version int) (*Receipt, error) {
+	if version >= ProtocolV11 {
+		return readStatus(conn, sealer, m)
+	}
+	receiptBytes, err := util.ReadWithLength(conn)
+	if errors.Is(err, io.EOF) {
+		// Older receivers hang up without a receipt when the data fails to
+		// match the manifest's content hash
+		return nil, fmt.Errorf("receiver did not confirm delivery; it may have failed to verify the data: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read receipt: %w", err)
+	}
+	if receiptBytes, err = sealer.open(sealedReceiptFrame, receiptBytes); err != nil {
+		return nil, fmt.Errorf("failed to open sealed receipt: %w", err)
+	}
+	var receipt Receipt
+	if err := json.Unmarshal(receiptBytes, &receipt); err != nil {
+		return nil, fmt.Errorf("failed to parse receipt: %w", err)
+	}
+	return &receipt, nil
+}
+
+// SendReader sends the contents of r under the given name. size may be -1
+// if unknown, e.g. when streaming from stdin.
+func SendReader(conn io.ReadWriter, name string, size int64, r io.Reader, receiverPubKey *rsa.PublicKey) error {
+	return sendStream(conn, streamManifest(name, size), r, receiverPubKey, nil)
+}
+
+// SendStream sends the contents of r described by manifest, so generated
+// content, tar streams or database dumps needn't be written to disk first.
+// manifest.FileName is required; FileSize may be -1 if unknown, a zero
+// FileMode is sent as 0644 and a zero LastModTime as now. If the content's
+// hash is known up front, setting Hash and HashAlg lets the receiver verify
+// it and skip content it already holds. manifest is not modified.
+func SendStream(conn io.ReadWriter, manifest *Manifest, r io.Reader, receiverPubKey *rsa.PublicKey) error {
+	if manifest.FileName == "" {
+		return errors.New("manifest has no file name")
+	}
+	m := *manifest
+	if m.FileMode == 0 {
+		m.FileMode = 0644
+	}
+	if m.LastModTime.IsZero() {
+		m.LastModTime = time.Now()
+	}
+	return sendStream(conn, &m, r, receiverPubKey, nil)
+}
+
+// streamManifest describes data sent by SendReader
+func streamManifest(name string, size int64) *Manifest {
+	return &Manifest{
+		FileName:    name,
+		FileSize:    size,
+		FileMode:    0644,
+		LastModTime: time.Now(),
+	}
+}
+
+// PreviewStream returns the manifest SendReader would send
+func PreviewStream(name string, size int64) *Manifest {
+	m := streamManifest(name, size)
+	m.offer()
+	return m
+}
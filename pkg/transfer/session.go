@@ -0,0 +1,84 @@
+package transfer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// SessionLogs makes every transfer also write its log, debug records
+// included, as JSON lines to ~/.p2p-client/logs/<session id>.json, for
+// post-mortem debugging
+var SessionLogs bool
+
+// session is the log of one transfer, kept in its own file when
+// SessionLogs is set
+type session struct {
+	id       string
+	log      *util.Logger
+	file     *os.File
+	started  time.Time
+	transfer string // Transfer ID, once known
+}
+
+// newSessionID returns a unique id that sorts by start time
+func newSessionID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// startSession begins logging a transfer in direction ("send" or
+// "receive") over conn. Without SessionLogs its logger is the package's.
+func startSession(direction string, conn any) *session {
+	s := &session{id: newSessionID(), log: log, started: time.Now()}
+	if !SessionLogs {
+		return s
+	}
+	dir, err := util.DataDir("logs")
+	if err != nil {
+		log.Warn("Cannot write session log", "error", err)
+		return s
+	}
+	path := filepath.Join(dir, s.id+".json")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Warn("Cannot write session log", "error", fmt.Errorf("failed to create %s: %w", path, err))
+		return s
+	}
+	s.file = f
+	s.log = log.Tee(util.NewJSONLogger(f, util.DebugLevel).With("session", s.id))
+	log.Info("Writing session log", "path", path)
+
+	args := []any{"direction", direction}
+	if c, ok := conn.(net.Conn); ok {
+		args = append(args, "local", c.LocalAddr().String(), "remote", c.RemoteAddr().String())
+	}
+	s.log.Debug("Session started", args...)
+	return s
+}
+
+// tag adds the transfer ID to everything logged from now on
+func (s *session) tag(transferID string) {
+	s.transfer = transferID
+	s.log = s.log.With("transfer_id", transferID)
+}
+
+// end records how the transfer finished and closes the session log
+func (s *session) end(err error) {
+	if s.file == nil {
+		return
+	}
+	if err != nil {
+		s.log.Debug("Session failed", "duration", time.Since(s.started).String(), "error", err)
+	} else {
+		s.log.Debug("Session finished", "duration", time.Since(s.started).String())
+	}
+	s.file.Close()
+}
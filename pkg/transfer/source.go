@@ -0,0 +1,46 @@
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Source changes: a file is encrypted and sent as it is read, so writing to
+// it meanwhile would leave the receiver with a mix of old and new content,
+// caught at best by the hash check at the very end. The sender notes the
+// size and modification time the manifest describes, checks them again with
+// every chunk it reads and before the end-of-file marker, and fails with
+// ErrFileChanged as soon as they differ. Replacing the file, as editors do,
+// doesn't change the copy already open, which is still sent whole.
+
+// sourceFile is a file being sent with the size and modification time its
+// manifest describes
+type sourceFile struct {
+	*os.File
+	size    int64
+	modTime time.Time
+}
+
+// openSource opens the file at path that m describes
+func openSource(path string, m *Manifest) (*sourceFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return &sourceFile{File: f, size: m.FileSize, modTime: m.LastModTime}, nil
+}
+
+// check returns ErrFileChanged if the file no longer has the size and
+// modification time it was described with
+func (s *sourceFile) check() error {
+	info, err := s.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to check file: %w", err)
+	}
+	if info.Size() != s.size || !info.ModTime().Equal(s.modTime) {
+		return fmt.Errorf("%w: %s is now %d bytes, modified %s (was %d bytes, modified %s)", ErrFileChanged,
+			s.Name(), info.Size(), info.ModTime().Format(time.RFC3339Nano), s.size, s.modTime.Format(time.RFC3339Nano))
+	}
+	return nil
+}
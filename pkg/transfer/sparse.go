@@ -0,0 +1,188 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Sparse transfers (protocol v6): runs of zeros travel as skip frames
+// instead of data. A skip frame is a chunk whose length has skipFlag set;
+// its encrypted payload is the number of zero bytes as a uint64, and it is
+// acknowledged like any other chunk. The sender finds holes with
+// SEEK_DATA/SEEK_HOLE where the OS supports them, and otherwise notices
+// chunks that are entirely zero. A receiver writing to a file seeks past the
+// run, leaving a hole; other sinks get the zeros written out.
+
+// skipFlag marks a skip frame in the chunk length
+const skipFlag = 1 << 31
+
+// skipPayloadSize is the plaintext size of a skip frame
+const skipPayloadSize = 8
+
+var zeroBlock [64 * 1024]byte
+
+// writeZeros writes n zero bytes to w
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		k := min(n, int64(len(zeroBlock)))
+		if _, err := w.Write(zeroBlock[:k]); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
+
+// isZero reports whether p holds only zero bytes
+func isZero(p []byte) bool {
+	for len(p) > 0 {
+		k := min(len(p), len(zeroBlock))
+		if !bytes.Equal(p[:k], zeroBlock[:k]) {
+			return false
+		}
+		p = p[k:]
+	}
+	return true
+}
+
+// holeFinder skips the holes of a sparse file without reading them. The
+// file must be read sequentially through src from its start, so that the
+// bytes src has counted are the file offset.
+type holeFinder struct {
+	f        *os.File
+	src      *countingReader
+	hasher   io.Writer // sees the skipped zeros, as it sees the data read around them
+	nextHole int64     // end of the data extent the file offset is in
+}
+
+// newHoleFinder returns a holeFinder for r if it is a regular file at the
+// offset src has counted, or nil
+func newHoleFinder(r io.Reader, src *countingReader, hasher io.Writer) *holeFinder {
+	f, ok := r.(*os.File)
+	if !ok {
+		return nil
+	}
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	if off, err := f.Seek(0, io.SeekCurrent); err != nil || off != src.n.Load() {
+		return nil
+	}
+	return &holeFinder{f: f, src: src, hasher: hasher}
+}
+
+// skip moves past the hole at the current offset, if any, and returns its
+// size. limit bounds the data the next read may return so it stops at the
+// following hole. Once hole lookups fail, h gives up and reports no holes.
+func (h *holeFinder) skip(chunkSize int) (skipped int64, limit int, err error) {
+	if h.f == nil {
+		return 0, chunkSize, nil
+	}
+	off := h.src.n.Load()
+	if off < h.nextHole {
+		return 0, int(min(int64(chunkSize), h.nextHole-off)), nil
+	}
+
+	data, err := util.SeekData(h.f, off)
+	if err != nil {
+		return 0, chunkSize, h.unsupported(off, err)
+	}
+	hole, err := util.SeekHole(h.f, data)
+	if err != nil {
+		return 0, chunkSize, h.unsupported(data, err)
+	}
+	if _, err := h.f.Seek(data, io.SeekStart); err != nil {
+		return 0, 0, fmt.Errorf("failed to seek: %w", err)
+	}
+	h.nextHole = hole
+
+	if skipped = data - off; skipped > 0 {
+		if err := writeZeros(h.hasher, skipped); err != nil {
+			return 0, 0, err
+		}
+		h.src.n.Add(skipped)
+		return skipped, 0, nil
+	}
+	if hole <= off {
+		// At the end of the file; let the read report it
+		return 0, chunkSize, nil
+	}
+	return 0, int(min(int64(chunkSize), hole-off)), nil
+}
+
+// unsupported disables hole lookups after one failed, restoring the file
+// offset so reading carries on where it was
+func (h *holeFinder) unsupported(off int64, err error) error {
+	if !errors.Is(err, errors.ErrUnsupported) {
+		log.Debug("Cannot look up holes, falling back to zero detection", "error", err)
+	}
+	f := h.f
+	h.f = nil
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek: %w", err)
+	}
+	return nil
+}
+
+// parseSkip decodes the payload of a skip frame
+func parseSkip(p []byte) (int64, error) {
+	if len(p) != skipPayloadSize {
+		return 0, fmt.Errorf("invalid skip frame of %d bytes", len(p))
+	}
+	n := binary.BigEndian.Uint64(p)
+	if n == 0 || n > 1<<62 {
+		return 0, fmt.Errorf("invalid skip of %d bytes", n)
+	}
+	return int64(n), nil
+}
+
+// holeWriter applies skip frames on the receiver. A sink that is a plain
+// file gets a hole by seeking past the run; anything else gets the zeros.
+type holeWriter struct {
+	f       *os.File        // the destination file, or nil
+	hasher  io.Writer       // must see the zeros whether or not they are written
+	counter *countingWriter // counts the zeros as received bytes
+	holes   bool            // a hole was left that Truncate may need to extend
+}
+
+func newHoleWriter(sink io.Writer, hasher io.Writer, counter *countingWriter) *holeWriter {
+	f, _ := sink.(*os.File)
+	return &holeWriter{f: f, hasher: hasher, counter: counter}
+}
+
+// skip adds n zero bytes to the output
+func (h *holeWriter) skip(n int64) error {
+	if h.f == nil {
+		return writeZeros(h.counter, n)
+	}
+	if err := h.counter.fits(n); err != nil {
+		return err
+	}
+	if _, err := h.f.Seek(n, io.SeekCurrent); err != nil {
+		return fmt.Errorf("failed to seek: %w", err)
+	}
+	if err := writeZeros(h.hasher, n); err != nil {
+		return err
+	}
+	h.counter.n.Add(n)
+	h.holes = true
+	return nil
+}
+
+// finish extends the file over a trailing hole, which seeking alone leaves
+// out
+func (h *holeWriter) finish() error {
+	if !h.holes {
+		return nil
+	}
+	if err := h.f.Truncate(h.counter.n.Load()); err != nil {
+		return fmt.Errorf("failed to extend sparse file: %w", err)
+	}
+	return nil
+}
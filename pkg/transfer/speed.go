@@ -0,0 +1,105 @@
+package transfer
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Micro-benchmarks of the work a transfer does besides moving bytes over
+// the network, to tell which of them limits a slow transfer
+
+// HasAESHardware reports whether this CPU accelerates AES-GCM, which makes
+// it the preferred cipher
+func HasAESHardware() bool {
+	return hasAESHardware()
+}
+
+// CipherSpeed measures how many bytes per second suite encrypts on this
+// machine in chunks of chunkSize, running for about d
+func CipherSpeed(suite string, chunkSize int, d time.Duration) (float64, error) {
+	key := make([]byte, 32)
+	nonce := make([]byte, nonceSize)
+	rand.Read(key)
+	rand.Read(nonce)
+	c, err := newChunkCipher(ProtocolVersion, suite, key, nonce)
+	if err != nil {
+		return 0, err
+	}
+	chunk := make([]byte, chunkSize)
+	rand.Read(chunk)
+	out := make([]byte, 0, chunkSize+c.Overhead())
+	return measure(d, func() (int, error) {
+		_, err := c.seal(out, chunk)
+		return len(chunk), err
+	})
+}
+
+// HashSpeed measures how many bytes per second alg hashes a stream of
+// chunks on this machine, as a receiver does, running for about d
+func HashSpeed(alg string, d time.Duration) (float64, error) {
+	h, err := newHasher(alg)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1<<20)
+	rand.Read(buf)
+	return measure(d, func() (int, error) {
+		return h.Write(buf)
+	})
+}
+
+// DiskSpeed writes size bytes to a scratch file in dir, syncs it and reads
+// it back, returning bytes per second for each. The read is likely served
+// from the page cache, so it is an upper bound.
+func DiskSpeed(dir string, size int64) (write, read float64, err error) {
+	f, err := os.CreateTemp(dir, ".p2p-speed-*")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create scratch file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	buf := make([]byte, 1<<20)
+	rand.Read(buf)
+	start := time.Now()
+	for n := int64(0); n < size; n += int64(len(buf)) {
+		if _, err := f.Write(buf[:min(int64(len(buf)), size-n)]); err != nil {
+			return 0, 0, fmt.Errorf("failed to write scratch file: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return 0, 0, fmt.Errorf("failed to sync scratch file: %w", err)
+	}
+	write = float64(size) / time.Since(start).Seconds()
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	start = time.Now()
+	n, err := io.CopyBuffer(io.Discard, f, buf)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read scratch file: %w", err)
+	}
+	read = float64(n) / time.Since(start).Seconds()
+	return write, read, nil
+}
+
+// measure calls step until d has passed and returns the bytes per second
+// it processed
+func measure(d time.Duration, step func() (int, error)) (float64, error) {
+	var total int64
+	start := time.Now()
+	for {
+		n, err := step()
+		if err != nil {
+			return 0, err
+		}
+		total += int64(n)
+		if elapsed := time.Since(start); elapsed >= d {
+			return float64(total) / elapsed.Seconds(), nil
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Final status (protocol v11): once the sender's end-of-file marker has
+// been read and the file checked and stored, the receiver answers with a
+// status frame in place of the bare receipt. It carries the hash of what
+// arrived and the signed receipt, or an error code when the file failed
+// its hash check or couldn't be stored, so the sender learns the outcome
+// instead of a closed connection. It is sealed like the receipt it
+// replaces.
+
+// Final status codes, besides CodeOK, CodeInsufficientSpace and the receive
+// hook codes
+const (
+	CodeChecksumMismatch = "checksum_mismatch"
+	CodeWriteFailed      = "write_failed"
+)
+
+// statusFrame is the receiver's last frame of a transfer
+type statusFrame struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message,omitempty"`
+	Hash    string   `json:"hash,omitempty"`
+	HashAlg string   `json:"hash_alg,omitempty"`
+	Receipt *Receipt `json:"receipt,omitempty"`
+	// Reply holds the receiver's peer records answering a peer exchange,
+	// from v17, or the listing answering a KindList request, from v20. It
+	// keeps the name it was introduced under on the wire.
+	Reply []byte `json:"peers,omitempty"`
+}
+
+// DeliveryError reports a transfer the receiver failed to verify or store,
+// once its data all arrived or, from v24, while it flowed
+type DeliveryError struct {
+	Code    string
+	Message string
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("receiver could not complete the transfer (%s): %s", e.Code, e.Message)
+}
+
+// Is lets errors.Is match a DeliveryError against ErrDeliveryFailed and the
+// sentinel for its code
+func (e *DeliveryError) Is(target error) bool {
+	switch e.Code {
+	case CodeChecksumMismatch:
+		return target == ErrChecksumMismatch || target == ErrDeliveryFailed
+	case CodeInsufficientSpace:
+		return target == ErrInsufficientSpace || target == ErrDeliveryFailed
+	case CodeQuarantined:
+		return target == ErrQuarantined || target == ErrDeliveryFailed
+	case CodeHookRejected:
+		return target == ErrHookRejected || target == ErrDeliveryFailed
+	case CodeRejected:
+		return target == ErrRejected || target == ErrDeliveryFailed
+	}
+	return target == ErrDeliveryFailed
+}
+
+// sendStatus sends the final status of the transfer m: the receipt when
+// failure is nil, or the code for failure
+func sendStatus(w io.Writer, s *frameSealer, m *Manifest, receipt *Receipt, failure error) error {
+	frame := statusFrame{Code: CodeOK}
+	if failure != nil {
+		frame.Code, frame.Message = statusCode(failure), failure.Error()
+	} else {
+		frame.Hash, frame.HashAlg, frame.Receipt, frame.Reply = receipt.Hash, m.HashAlg, receipt, m.reply
+	}
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to encode final status: %w", err)
+	}
+	if err := util.SendWithLength(w, s.seal(sealedReceiptFrame, data)); err != nil {
+		return fmt.Errorf("failed to send final status: %w", err)
+	}
+	return nil
+}
+
+// statusCode returns the code reporting the receiver's failure
+func statusCode(failure error) string {
+	switch {
+	case errors.Is(failure, ErrChecksumMismatch):
+		return CodeChecksumMismatch
+	case errors.Is(failure, ErrInsufficientSpace), errors.Is(failure, syscall.ENOSPC):
+		return CodeInsufficientSpace
+	case errors.Is(failure, ErrQuarantined):
+		return CodeQuarantined
+	case errors.Is(failure, ErrHookRejected):
+		return CodeHookRejected
+	case errors.Is(failure, ErrRejected):
+		return CodeRejected
+	}
+	return CodeWriteFailed
+}
+
+// readStatus reads the final status of the transfer m and returns the
+// receipt it carries, or a *DeliveryError for a failed transfer. Peer
+// records answering an exchange, or a listing, are kept in m.
+func readStatus(r io.Reader, s *frameSealer, m *Manifest) (*Receipt, error) {
+	data, err := util.ReadWithLength(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read final status: %w", err)
+	}
+	if data, err = s.open(sealedReceiptFrame, data); err != nil {
+		return nil, fmt.Errorf("failed to open sealed final status: %w", err)
+	}
+	var frame statusFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return nil, fmt.Errorf("invalid final status: %w", err)
+	}
+	if frame.Code != CodeOK {
+		return nil, &DeliveryError{Code: frame.Code, Message: frame.Message}
+	}
+	if frame.Receipt == nil || frame.Receipt.Hash != frame.Hash {
+		return nil, fmt.Errorf("%w: final status doesn't match its receipt", ErrInvalidReceipt)
+	}
+	m.reply = frame.Reply
+	return frame.Receipt, nil
+}
@@ -0,0 +1,48 @@
+package transfer
+
+import (
+	"io"
+	"sync"
+)
+
+// Storage: rather than the output directory, a receiver may stream files
+// elsewhere, e.g. to an object store, through ReceiveOptions.Storage. The
+// writer it returns gets the file's data as it arrives, decrypted and in
+// order with holes written out as zeros, and is closed once the file has
+// arrived whole and passed its hash check, which is when it should keep
+// the file. A file that broke off or failed its check is aborted instead.
+// Such files aren't resumed, patched from an older copy, linked from copies
+// already held or vetted by receive hooks, which all work on local files.
+
+// Aborter is implemented by storage writers that can discard what was
+// written, e.g. by cancelling an upload. Writers without it are closed
+// whether or not the file arrived whole.
+type Aborter interface {
+	Abort() error
+}
+
+// storedFile is a file received into Storage
+type storedFile struct {
+	w    io.WriteCloser
+	once sync.Once
+	err  error
+}
+
+// end closes or aborts the file, once
+func (f *storedFile) end(complete bool) error {
+	f.once.Do(func() {
+		a, ok := f.w.(Aborter)
+		if !complete && ok {
+			f.err = a.Abort()
+			return
+		}
+		f.err = f.w.Close()
+	})
+	return f.err
+}
+
+// sink returns the sink writing to the file. The writer's concrete type is
+// hidden so skip frames are written out as zeros.
+func (f *storedFile) sink() (io.Writer, func() error, func(bool) error, error) {
+	return struct{ io.Writer }{f.w}, func() error { return f.end(false) }, f.end, nil
+}
@@ -0,0 +1,624 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Directory sync (protocol v14) mirrors a directory one way. Each regular
+// file under it is sent as KindSync, named by its slash-separated path under
+// the directory's own name ("photos/2024/a.jpg") and carrying its size,
+// modification time and content hash. The receiver keeps it at that path
+// under its output directory. When its copy has the same size and either
+// the same modification time or the same hash, it answers CodeAlreadyHave
+// before any data flows, so only new and changed files are sent, and a
+// changed file goes as a delta against the old copy. A KindSyncIndex
+// transfer may end the run, listing every path the sender has; the receiver
+// then removes the files under the directory that aren't on it, if it lets
+// senders delete (ReceiveOptions.SyncDelete) and the directory was created
+// by this sender's syncs.
+//
+// From v21, empty directories, symbolic links and named pipes go along as
+// KindSyncDir, KindSyncLink and KindSyncFIFO entries: manifests without
+// data that the receiver recreates. Which of them a sync takes is up to
+// its SyncPolicy; sockets and devices are never taken. A link is only
+// recreated if its target is relative and stays inside the directory, and
+// the receiver writes nothing through a link, so a synced link can't lead
+// a later file out of its output directory.
+const (
+	// KindSync marks a file of a synced directory
+	KindSync = "sync"
+	// KindSyncIndex marks the list of every file in a synced directory
+	KindSyncIndex = "sync_index"
+	// KindSyncDir marks an empty directory of a synced directory
+	KindSyncDir = "sync_dir"
+	// KindSyncLink marks a symbolic link of a synced directory, pointing
+	// to Manifest.LinkTarget
+	KindSyncLink = "sync_link"
+	// KindSyncFIFO marks a named pipe of a synced directory
+	KindSyncFIFO = "sync_fifo"
+)
+
+// MaxSyncIndexSize is the largest path list a receiver accepts
+const MaxSyncIndexSize = 16 << 20
+
+// syncOwnersFile, under the data directory, records which sender created
+// each synced directory by its absolute path; only that sender may have it
+// pruned
+const syncOwnersFile = "sync-owners.json"
+
+// syncOwnersMu serializes updates of syncOwnersFile
+var syncOwnersMu sync.Mutex
+
+// Policies for the symbolic links of a synced directory
+const (
+	LinksPreserve = "preserve" // Recreate links that stay inside the directory
+	LinksFollow   = "follow"   // Send what each link points to in its place
+	LinksSkip     = "skip"     // Leave links out
+)
+
+// SyncPolicy decides which entries of a directory that aren't regular
+// files SyncFiles takes
+type SyncPolicy struct {
+	Links     string // LinksPreserve (the default if empty), LinksFollow or LinksSkip
+	EmptyDirs bool   // Take empty directories
+	FIFOs     bool   // Take named pipes
+}
+
+// SyncEntry is an entry of a directory to sync
+type SyncEntry struct {
+	Path   string // Slash-separated path relative to the directory
+	Kind   string // KindSync for a regular file, or KindSyncDir, KindSyncLink or KindSyncFIFO
+	Target string // Target of a KindSyncLink, slash-separated
+}
+
+// isSyncEntry reports whether kind is a synced entry that isn't a file
+func isSyncEntry(kind string) bool {
+	return kind == KindSyncDir || kind == KindSyncLink || kind == KindSyncFIFO
+}
+
+// SyncFiles lists the entries under root that policy takes, with paths
+// relative to it. Files still being received are left out, and so is
+// anything that can't be read or synced, with a warning.
+func SyncFiles(root string, policy SyncPolicy) ([]SyncEntry, error) {
+	if policy.Links == "" {
+		policy.Links = LinksPreserve
+	}
+	if policy.Links != LinksPreserve && policy.Links != LinksFollow && policy.Links != LinksSkip {
+		return nil, fmt.Errorf("unknown link policy %q", policy.Links)
+	}
+	w := &syncWalk{policy: policy, filled: map[string]bool{}}
+	if err := w.walk(root, "", nil); err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", root, err)
+	}
+	if policy.EmptyDirs {
+		for _, dir := range w.dirs {
+			if !w.filled[dir] {
+				w.entries = append(w.entries, SyncEntry{Path: dir, Kind: KindSyncDir})
+			}
+		}
+	}
+	return w.entries, nil
+}
+
+// syncWalk collects the entries of a directory to sync
+type syncWalk struct {
+	policy  SyncPolicy
+	entries []SyncEntry
+	dirs    []string        // Every directory seen
+	filled  map[string]bool // Directories holding an entry taken
+}
+
+// walk lists dir, found at rel in the synced directory. chain holds the
+// real paths of the directories entered through links on the way there.
+func (w *syncWalk) walk(dir, rel string, chain []string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && rel == "" {
+				return err
+			}
+			log.Warn("Skipping what can't be read", "path", p, "error", err)
+			return nil
+		}
+		if p == dir {
+			return nil
+		}
+		r, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(rel, filepath.ToSlash(r))
+		t := d.Type()
+		switch {
+		case t.IsDir():
+			w.dirs = append(w.dirs, name)
+		case t.IsRegular():
+			if !strings.HasSuffix(p, PartSuffix) && !strings.HasSuffix(p, PartSuffix+StateSuffix) {
+				w.take(SyncEntry{Path: name, Kind: KindSync})
+			}
+		case t&fs.ModeSymlink != 0:
+			w.link(p, name, chain)
+		case t&fs.ModeNamedPipe != 0 && w.policy.FIFOs:
+			w.take(SyncEntry{Path: name, Kind: KindSyncFIFO})
+		case t&fs.ModeNamedPipe != 0:
+			log.Debug("Skipping named pipe", "path", p)
+		default:
+			log.Warn("Skipping what is neither file, directory, link nor named pipe", "path", p, "type", t.String())
+		}
+		return nil
+	})
+}
+
+// take adds e, marking the directories it lies in as not empty
+func (w *syncWalk) take(e SyncEntry) {
+	w.entries = append(w.entries, e)
+	for dir := path.Dir(e.Path); dir != "."; dir = path.Dir(dir) {
+		w.filled[dir] = true
+	}
+}
+
+// link takes the symbolic link at p, found at name, as the policy says
+func (w *syncWalk) link(p, name string, chain []string) {
+	switch w.policy.Links {
+	case LinksSkip:
+		log.Debug("Skipping symbolic link", "path", p)
+	case LinksPreserve:
+		target, err := os.Readlink(p)
+		if err != nil || !linkInside(name, filepath.ToSlash(target)) {
+			log.Warn("Skipping symbolic link that leads out of the directory", "path", p, "target", target)
+			return
+		}
+		w.take(SyncEntry{Path: name, Kind: KindSyncLink, Target: filepath.ToSlash(target)})
+	case LinksFollow:
+		info, err := os.Stat(p)
+		if err != nil {
+			log.Warn("Skipping broken symbolic link", "path", p, "error", err)
+			return
+		}
+		if info.Mode().IsRegular() {
+			w.take(SyncEntry{Path: name, Kind: KindSync})
+			return
+		}
+		if !info.IsDir() {
+			log.Warn("Skipping symbolic link to what is neither file nor directory", "path", p)
+			return
+		}
+		target, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			log.Warn("Skipping broken symbolic link", "path", p, "error", err)
+			return
+		}
+		// A link to a directory it lies in, or to one entered on the way,
+		// would be walked forever
+		here, err := filepath.EvalSymlinks(filepath.Dir(p))
+		if err != nil {
+			log.Warn("Skipping symbolic link", "path", p, "error", err)
+			return
+		}
+		for _, dir := range append(chain, here) {
+			if within(dir, target) {
+				log.Warn("Skipping symbolic link that loops back", "path", p, "target", target)
+				return
+			}
+		}
+		w.dirs = append(w.dirs, name)
+		w.walk(target, name, append(chain, target))
+	}
+}
+
+// within reports whether p is dir or lies under it
+func within(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
+// linkInside reports whether a link at name, a slash-separated path in a
+// synced directory, to target stays inside that directory
+func linkInside(name, target string) bool {
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(filepath.FromSlash(target)) || filepath.VolumeName(filepath.FromSlash(target)) != "" {
+		return false
+	}
+	resolved := path.Join(path.Dir(name), target)
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
+
+// syncName is the name a synced directory is kept under by receivers
+func syncName(root string) string {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	return filepath.Base(root)
+}
+
+// SendSyncEntry sends e, an entry from SyncFiles, as part of a sync of
+// root. The error matches ErrAlreadyHave when the receiver's copy is up to
+// date, and ErrProtocolVersion for an entry that isn't a regular file when
+// the receiver is older than v21.
+func SendSyncEntry(conn io.ReadWriter, root string, e SyncEntry, receiverPubKey *rsa.PublicKey) error {
+	path := filepath.Join(root, filepath.FromSlash(e.Path))
+	if e.Kind == KindSync {
+		return sendSyncFile(conn, root, e.Path, path, receiverPubKey)
+	}
+	if !isSyncEntry(e.Kind) {
+		return fmt.Errorf("unknown sync entry kind %q", e.Kind)
+	}
+	if pv, ok := conn.(PeerVersioner); !ok || pv.PeerVersion() < ProtocolV21 {
+		return fmt.Errorf("%w: receiver is too old for directories, links and named pipes in a sync", ErrProtocolVersion)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("could not stat file: %w", err)
+	}
+	manifest := &Manifest{
+		FileName:    syncName(root) + "/" + e.Path,
+		FileMode:    info.Mode(),
+		LastModTime: info.ModTime(),
+		Kind:        e.Kind,
+		LinkTarget:  e.Target,
+	}
+	if uid, gid, ok := util.FileOwner(info); ok {
+		manifest.Owner = &Owner{UID: uid, GID: gid}
+	}
+	return sendStream(conn, manifest, bytes.NewReader(nil), receiverPubKey, nil)
+}
+
+// sendSyncFile sends the regular file at path, rel in the synced root
+func sendSyncFile(conn io.ReadWriter, root, rel, path string, receiverPubKey *rsa.PublicKey) error {
+	manifest, err := CreateManifest(path)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if !manifest.FileMode.IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	manifest.FileName = syncName(root) + "/" + rel
+	manifest.Kind = KindSync
+	if err := hashAhead(conn, manifest, path); err != nil {
+		return err
+	}
+	file, err := openSource(path, manifest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return sendStream(conn, manifest, file, receiverPubKey, nil)
+}
+
+// SendSyncIndex sends the paths of every entry in root, as listed by
+// SyncFiles, so the receiver removes the ones it holds that aren't listed
+func SendSyncIndex(conn io.ReadWriter, root string, files []string, receiverPubKey *rsa.PublicKey) error {
+	if files == nil {
+		files = []string{}
+	}
+	data, err := json.Marshal(files)
+	if err != nil {
+		return fmt.Errorf("failed to encode sync index: %w", err)
+	}
+	if len(data) > MaxSyncIndexSize {
+		return fmt.Errorf("sync index is %s, the limit is %s", formatBytes(float64(len(data))), formatBytes(MaxSyncIndexSize))
+	}
+	manifest := &Manifest{
+		FileName:    syncName(root),
+		FileSize:    int64(len(data)),
+		FileMode:    0600,
+		LastModTime: time.Now(),
+		Kind:        KindSyncIndex,
+	}
+	return sendStream(conn, manifest, bytes.NewReader(data), receiverPubKey, nil)
+}
+
+// syncDest returns where a synced file or entry is kept under outputDir,
+// refusing paths that would leave it, directly or through a link
+func syncDest(outputDir string, m *Manifest) (string, error) {
+	name := filepath.FromSlash(m.FileName)
+	// A name such as "dir/.." would be the output directory itself
+	if !filepath.IsLocal(name) || !strings.Contains(m.FileName, "/") || filepath.Clean(name) != name {
+		return "", fmt.Errorf("invalid sync path %q", m.FileName)
+	}
+	dir := filepath.Clean(outputDir)
+	dest := filepath.Join(dir, name)
+	for p := filepath.Dir(dest); p != dir && p != filepath.Dir(p); p = filepath.Dir(p) {
+		if info, err := os.Lstat(p); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("sync path %s lies beyond the symbolic link %s", m.FileName, p)
+		}
+	}
+	return dest, nil
+}
+
+// checkSyncEntry vets a directory, link or named pipe of a synced
+// directory, answering ErrAlreadyHave if it is in place already
+func checkSyncEntry(outputDir string, m *Manifest) error {
+	if m.FileSize != 0 {
+		return fmt.Errorf("%s entry carries %d bytes of data", m.Kind, m.FileSize)
+	}
+	dest, err := syncDest(outputDir, m)
+	if err != nil {
+		return err
+	}
+	if m.Kind == KindSyncLink {
+		_, rel, _ := strings.Cut(m.FileName, "/")
+		if !linkInside(rel, m.LinkTarget) {
+			return fmt.Errorf("synced link %s to %s leads out of the directory", m.FileName, m.LinkTarget)
+		}
+	}
+	info, err := os.Lstat(dest)
+	if err != nil {
+		return nil
+	}
+	switch m.Kind {
+	case KindSyncDir:
+		if info.IsDir() {
+			return ErrAlreadyHave
+		}
+	case KindSyncLink:
+		if target, err := os.Readlink(dest); err == nil && filepath.ToSlash(target) == m.LinkTarget {
+			return ErrAlreadyHave
+		}
+	case KindSyncFIFO:
+		if info.Mode()&fs.ModeNamedPipe != 0 {
+			return ErrAlreadyHave
+		}
+	}
+	return nil
+}
+
+// openSyncEntry creates the directory, link or named pipe of a synced
+// directory m describes once its manifest is through
+func openSyncEntry(outputDir string, metadata bool) sinkOpener {
+	return func(m *Manifest) (io.Writer, func() error, func(bool) error, error) {
+		closeFn := func(complete bool) error {
+			if !complete {
+				return nil
+			}
+			dest, err := syncDest(outputDir, m)
+			if err != nil {
+				return err
+			}
+			return createSyncEntry(dest, m, metadata)
+		}
+		w := &limitedWriter{w: io.Discard, limit: 0, what: "sync entry"}
+		return w, func() error { return nil }, closeFn, nil
+	}
+}
+
+// createSyncEntry creates the entry m describes at dest, in place of
+// whatever else is there short of a directory with files in it
+func createSyncEntry(dest string, m *Manifest, metadata bool) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	if info, err := os.Lstat(dest); err == nil && !(m.Kind == KindSyncDir && info.IsDir()) {
+		if err := os.Remove(dest); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", dest, err)
+		}
+	}
+	var err error
+	switch m.Kind {
+	case KindSyncDir:
+		err = os.MkdirAll(dest, 0755)
+	case KindSyncLink:
+		err = os.Symlink(filepath.FromSlash(m.LinkTarget), dest)
+	case KindSyncFIFO:
+		err = util.Mkfifo(dest, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dest, err)
+	}
+	// Modes and times of a link would land on its target
+	if metadata && m.Kind != KindSyncLink {
+		restoreMetadata(dest, m)
+	}
+	log.Info("Synced entry created", "path", dest, "kind", m.Kind)
+	return nil
+}
+
+// checkSyncIndex rejects path lists that are too large or don't name a
+// directory directly under the output directory, and, for a directory that
+// exists, those from senders that may not prune it: all of them unless
+// allowDelete is set, and any but the one whose sync created it
+func checkSyncIndex(outputDir string, m *Manifest, sender string, allowDelete bool) error {
+	if m.FileSize < 0 || m.FileSize > MaxSyncIndexSize {
+		return fmt.Errorf("sync index of %d bytes exceeds the %d byte limit", m.FileSize, MaxSyncIndexSize)
+	}
+	if !plainName(m.FileName) || strings.ContainsAny(m.FileName, `/\`) {
+		return fmt.Errorf("invalid sync directory %q", m.FileName)
+	}
+	// Nothing to prune
+	if _, err := os.Lstat(filepath.Join(outputDir, m.FileName)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if !allowDelete {
+		return fmt.Errorf("%w: this receiver doesn't let senders delete synced files", ErrRejected)
+	}
+	if !ownsSyncDir(outputDir, m, sender) {
+		return fmt.Errorf("%w: %s wasn't created by this sender's syncs", ErrRejected, m.FileName)
+	}
+	return nil
+}
+
+// syncOwners reads syncOwnersFile, returning the owners of synced
+// directories and the file's path
+func syncOwners() (map[string]string, string, error) {
+	dir, err := util.DataDir()
+	if err != nil {
+		return nil, "", err
+	}
+	path := filepath.Join(dir, syncOwnersFile)
+	owners := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return owners, path, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal(data, &owners); err != nil {
+		return nil, "", fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return owners, path, nil
+}
+
+// syncRoot returns the absolute path of the synced directory under
+// outputDir that m belongs to, "" if its name has none
+func syncRoot(outputDir string, m *Manifest) string {
+	root, _, _ := strings.Cut(m.FileName, "/")
+	if !plainName(root) {
+		return ""
+	}
+	dir, err := filepath.Abs(filepath.Join(outputDir, root))
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+// claimSyncDir records sender as the owner of the synced directory m
+// belongs to if it doesn't exist yet, so this sync is what creates it
+func claimSyncDir(outputDir string, m *Manifest, sender string) {
+	dir := syncRoot(outputDir, m)
+	if dir == "" {
+		return
+	}
+	if _, err := os.Lstat(dir); !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	syncOwnersMu.Lock()
+	defer syncOwnersMu.Unlock()
+	owners, path, err := syncOwners()
+	if err == nil {
+		owners[dir] = sender
+		var data []byte
+		if data, err = json.MarshalIndent(owners, "", "  "); err == nil {
+			err = os.WriteFile(path, data, 0600)
+		}
+	}
+	if err != nil {
+		log.Warn("Cannot record who created a synced directory; it won't be pruned", "dir", dir, "error", err)
+	}
+}
+
+// ownsSyncDir reports whether sender's syncs created the synced directory
+// under outputDir that m belongs to
+func ownsSyncDir(outputDir string, m *Manifest, sender string) bool {
+	dir := syncRoot(outputDir, m)
+	if dir == "" {
+		return false
+	}
+	syncOwnersMu.Lock()
+	defer syncOwnersMu.Unlock()
+	owners, _, err := syncOwners()
+	if err != nil {
+		log.Warn("Cannot read who created synced directories", "error", err)
+		return false
+	}
+	return owners[dir] == sender
+}
+
+// upToDate reports whether the file at path is the one m describes: the
+// same size, and the same modification time or content hash
+func upToDate(path string, m *Manifest) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != m.FileSize {
+		return false
+	}
+	if info.ModTime().Equal(m.LastModTime) {
+		return true
+	}
+	if m.Hash == "" {
+		return false
+	}
+	if hash, err := HashFile(path, negotiateHash([]string{m.HashAlg})); err != nil || hash != m.Hash {
+		return false
+	}
+	// Same content; take the sender's time so the next sync needn't hash it
+	if err := os.Chtimes(path, time.Time{}, m.LastModTime); err != nil {
+		log.Warn("Failed to restore modification time", "path", path, "error", err)
+	}
+	return true
+}
+
+// openSyncIndex collects a sync index and, once it has arrived in full,
+// prunes the synced directory under outputDir to the files it lists
+func openSyncIndex(outputDir string) sinkOpener {
+	return func(m *Manifest) (io.Writer, func() error, func(bool) error, error) {
+		var buf bytes.Buffer
+		w := &limitedWriter{w: &buf, limit: MaxSyncIndexSize, what: "sync index"}
+		closeFn := func(complete bool) error {
+			if !complete {
+				return nil
+			}
+			var files []string
+			if err := json.Unmarshal(buf.Bytes(), &files); err != nil {
+				return fmt.Errorf("invalid sync index: %w", err)
+			}
+			return pruneSync(filepath.Join(outputDir, m.FileName), files)
+		}
+		return w, func() error { return nil }, closeFn, nil
+	}
+}
+
+// pruneSync removes the files, links and named pipes under dir that aren't
+// in keep, slash-separated paths relative to dir, then the directories left
+// empty that aren't in it either
+func pruneSync(dir string, keep []string) error {
+	want := make(map[string]bool, len(keep))
+	for _, p := range keep {
+		want[filepath.FromSlash(p)] = true
+	}
+	var dirs []string
+	removed := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if path != dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		// Partial copies of listed files, and their state, are kept to
+		// resume from
+		if want[rel] || want[strings.TrimSuffix(rel, PartSuffix)] || want[strings.TrimSuffix(rel, PartSuffix+StateSuffix)] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		log.Info("Removed file the sender no longer has", "path", path)
+		removed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Deepest first, so parents empty out in turn; only empty ones go
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if rel, err := filepath.Rel(dir, dirs[i]); err == nil && want[rel] {
+			continue
+		}
+		os.Remove(dirs[i])
+	}
+	log.Info("Synced directory pruned", "dir", dir, "kept", len(keep), "removed", removed)
+	return nil
+}
@@ -0,0 +1,86 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// KindText marks a transfer carrying a text snippet rather than a file.
+// Receivers that predate it store the snippet as a file named TextFileName.
+const KindText = "text"
+
+// TextFileName is the manifest name used for text snippets
+const TextFileName = "snippet.txt"
+
+// MaxTextSize is the largest text snippet a receiver accepts
+const MaxTextSize = 1 << 20
+
+// SendText sends a short text snippet, e.g. a link or token, to be shown or
+// copied to the clipboard on the receiving side
+func SendText(conn io.ReadWriter, text string, receiverPubKey *rsa.PublicKey) error {
+	if len(text) > MaxTextSize {
+		return fmt.Errorf("text is %s, the limit is %s", formatBytes(float64(len(text))), formatBytes(MaxTextSize))
+	}
+	manifest := &Manifest{
+		FileName:    TextFileName,
+		FileSize:    int64(len(text)),
+		FileMode:    0600,
+		LastModTime: time.Now(),
+		Kind:        KindText,
+	}
+	return sendStream(conn, manifest, strings.NewReader(text), receiverPubKey, nil)
+}
+
+// checkText rejects snippets too large to hold in memory
+func checkText(m *Manifest) error {
+	if m.FileSize < 0 || m.FileSize > MaxTextSize {
+		return fmt.Errorf("text snippet of %d bytes exceeds the %d byte limit", m.FileSize, MaxTextSize)
+	}
+	return nil
+}
+
+// openText collects a snippet in memory and hands it to onText once it has
+// arrived in full. Without onText it is printed to the console.
+func openText(onText func(m *Manifest, text string) error) sinkOpener {
+	return func(m *Manifest) (io.Writer, func() error, func(bool) error, error) {
+		var buf bytes.Buffer
+		w := &limitedWriter{w: &buf, limit: MaxTextSize, what: "text snippet"}
+		closeFn := func(complete bool) error {
+			if !complete {
+				return nil
+			}
+			text := buf.String()
+			util.Emit(util.EventTextReceived, "size", len(text), "text", text)
+			if onText != nil {
+				return onText(m, text)
+			}
+			if !util.JSONEvents() {
+				fmt.Fprintln(util.ConsoleOutput(), strings.TrimSuffix(text, "\n"))
+			}
+			return nil
+		}
+		return w, func() error { return nil }, closeFn, nil
+	}
+}
+
+// limitedWriter fails once more than limit bytes of what have been written
+type limitedWriter struct {
+	w       io.Writer
+	limit   int64
+	what    string
+	written int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.written+int64(len(p)) > l.limit {
+		return 0, fmt.Errorf("%s exceeds %d bytes", l.what, l.limit)
+	}
+	l.written += int64(len(p))
+	return l.w.Write(p)
+}
@@ -0,0 +1,105 @@
+package transfer
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Trailers (protocol v22): the sender hashes the file as it reads it to
+// send, and ends the data with a trailer frame carrying that hash and the
+// byte count, right before the end-of-file marker. The receiver checks them
+// against what it wrote before the file takes its real name, so a file is
+// verified end to end without the sender reading it twice to put its hash
+// in the manifest first. The sender writes a chunk length with trailerFlag
+// set followed by the sealed trailer, under a key of its own derived from
+// the file key, and replays it with the chunks after a retransmission
+// request.
+
+// trailerFlag marks the trailer frame in the chunk length
+const trailerFlag = 1 << 27
+
+// maxTrailerSize bounds the sealed trailer
+const maxTrailerSize = 1024
+
+// DefaultHashAheadLimit is the largest file hashed before it is sent to a
+// receiver that checks the trailer
+const DefaultHashAheadLimit = 1 << 30
+
+// trailerFrame is what follows the last chunk
+type trailerFrame struct {
+	Hash string `json:"hash"` // Hex digest of the file, with the negotiated algorithm
+	Size int64  `json:"size"` // Bytes of the file read, kept data included
+}
+
+// trailerAEAD derives the trailer key from the file key and base nonce.
+// Each transfer has one trailer, sent again as it was on a replay, so its
+// nonce is fixed.
+func trailerAEAD(fileKey, nonce []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nonce, "p2p-client trailer", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive trailer key: %w", err)
+	}
+	return chacha20poly1305.New(key)
+}
+
+// sealTrailer returns the trailer frame for a file of size bytes hashing to
+// hash, chunk length included
+func sealTrailer(fileKey, nonce []byte, hash string, size int64) ([]byte, error) {
+	aead, err := trailerAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(trailerFrame{Hash: hash, Size: size})
+	if err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nil, make([]byte, aead.NonceSize()), data, nil)
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(sealed))|trailerFlag)
+	return append(frame, sealed...), nil
+}
+
+// readTrailer reads and opens a trailer of n sealed bytes from r
+func readTrailer(r io.Reader, n uint32, fileKey, nonce []byte) (*trailerFrame, error) {
+	if n > maxTrailerSize {
+		return nil, fmt.Errorf("trailer too large: %d bytes", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("failed to read trailer: %w", err)
+	}
+	aead, err := trailerAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	data, err := aead.Open(nil, make([]byte, aead.NonceSize()), buf, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: trailer failed to decrypt: %w", ErrChecksumMismatch, err)
+	}
+	var t trailerFrame
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("invalid trailer: %w", err)
+	}
+	return &t, nil
+}
+
+// hashAhead puts the file's content hash in m before it is sent, as
+// HashContent does, unless the file is larger than
+// DefaultSendOptions.HashAheadLimit and the receiver at the other end of
+// conn checks the trailer: then the file is only read once, as it is sent,
+// at the cost of the receiver spotting a copy it already holds
+func hashAhead(conn any, m *Manifest, path string) error {
+	if limit := DefaultSendOptions.HashAheadLimit; limit > 0 && m.FileSize > limit {
+		if pv, ok := conn.(PeerVersioner); ok && pv.PeerVersion() >= ProtocolV22 {
+			log.Debug("Hashing file as it is sent", "file", m.FileName, "size", m.FileSize)
+			return nil
+		}
+	}
+	return m.HashContent(path)
+}
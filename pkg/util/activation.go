@@ -0,0 +1,57 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Socket activation: a service manager such as systemd may create the
+// listening sockets itself and start the daemon on the first connection,
+// passing them as file descriptors from 3 on. $LISTEN_PID names the process
+// they are meant for, $LISTEN_FDS how many there are and $LISTEN_FDNAMES,
+// colon-separated, the name of each (the socket unit's FileDescriptorName).
+
+// listenFDsStart is the first descriptor passed by the service manager
+const listenFDsStart = 3
+
+// ActivationListeners returns the stream sockets passed by the service
+// manager by name, or nil if it passed none. The variables describing them
+// are cleared so child processes don't take them for their own.
+func ActivationListeners() (map[string][]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string][]net.Listener)
+	for i := range n {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, lns := range listeners {
+				for _, ln := range lns {
+					ln.Close()
+				}
+			}
+			return nil, fmt.Errorf("passed socket %d (%s) is not a stream listener: %w", i, name, err)
+		}
+		listeners[name] = append(listeners[name], ln)
+	}
+	return listeners, nil
+}
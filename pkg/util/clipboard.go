@@ -0,0 +1,62 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// ErrNoClipboard is returned when no clipboard tool is available
+var ErrNoClipboard = errors.New("no clipboard tool found (install wl-clipboard, xclip or xsel)")
+
+// clipboardTools lists the copy and paste commands to try on this platform
+func clipboardTools() (copyCmds, pasteCmds [][]string) {
+	switch runtime.GOOS {
+	case "darwin":
+		return [][]string{{"pbcopy"}}, [][]string{{"pbpaste"}}
+	case "windows":
+		return [][]string{{"clip"}}, [][]string{{"powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw"}}
+	}
+	copyCmds = [][]string{{"xclip", "-selection", "clipboard"}, {"xsel", "--clipboard", "--input"}}
+	pasteCmds = [][]string{{"xclip", "-selection", "clipboard", "-o"}, {"xsel", "--clipboard", "--output"}}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		copyCmds = append([][]string{{"wl-copy"}}, copyCmds...)
+		pasteCmds = append([][]string{{"wl-paste", "--no-newline"}}, pasteCmds...)
+	}
+	return copyCmds, pasteCmds
+}
+
+// WriteClipboard copies text to the system clipboard
+func WriteClipboard(text string) error {
+	copyCmds, _ := clipboardTools()
+	for _, args := range copyCmds {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+	return ErrNoClipboard
+}
+
+// ReadClipboard returns the text on the system clipboard
+func ReadClipboard() (string, error) {
+	_, pasteCmds := clipboardTools()
+	for _, args := range pasteCmds {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		var out bytes.Buffer
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout = &out
+		if err := cmd.Run(); err != nil {
+			return "", err
+		}
+		return out.String(), nil
+	}
+	return "", ErrNoClipboard
+}
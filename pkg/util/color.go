@@ -0,0 +1,50 @@
+package util
+
+import (
+	"os"
+	"sync"
+)
+
+var (
+	colorMu       sync.Mutex
+	colorDisabled bool
+)
+
+// DisableColor turns off ANSI colors for loggers created afterwards,
+// e.g. for a --no-color flag
+func DisableColor() {
+	colorMu.Lock()
+	colorDisabled = true
+	colorMu.Unlock()
+}
+
+// ColorEnabled reports whether ANSI colors should be written to f: colors
+// are off when disabled explicitly, when NO_COLOR is set (https://no-color.org),
+// when f is not a terminal, or when the console can't interpret escapes.
+func ColorEnabled(f *os.File) bool {
+	colorMu.Lock()
+	disabled := colorDisabled
+	colorMu.Unlock()
+	if disabled {
+		return false
+	}
+	if v, ok := os.LookupEnv("NO_COLOR"); ok && v != "" {
+		return false
+	}
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	if !isTerminal(f) {
+		return false
+	}
+	return enableVirtualTerminal(f)
+}
+
+// isTerminal reports whether f is attached to a character device
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
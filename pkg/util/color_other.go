@@ -0,0 +1,10 @@
+//go:build !windows
+
+package util
+
+import "os"
+
+// enableVirtualTerminal is a no-op; Unix terminals understand ANSI escapes
+func enableVirtualTerminal(f *os.File) bool {
+	return true
+}
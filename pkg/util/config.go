@@ -1 +1,66 @@
 package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// appDirName is the per-user directory holding client state
+const appDirName = ".p2p-client"
+
+// ProfileEnv names the environment variable selecting the profile when
+// none is given on the command line
+const ProfileEnv = "P2P_PROFILE"
+
+// profile is the name of the profile in use, "" for the default one
+var profile string
+
+// validProfile matches the names a profile may have
+var validProfile = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// SetProfile switches to the named profile: a separate identity with its
+// own state, kept in ~/.p2p-client/profiles/<name> instead of
+// ~/.p2p-client. "" selects the default profile.
+func SetProfile(name string) error {
+	if name != "" && !validProfile.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	profile = name
+	return nil
+}
+
+// Profile returns the name of the profile in use, "" for the default one
+func Profile() string {
+	return profile
+}
+
+// ProfilesDir returns the directory holding a directory for each profile,
+// without creating it
+func ProfilesDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate home directory: %w", err)
+	}
+	return filepath.Join(home, appDirName, "profiles"), nil
+}
+
+// DataDir returns the per-user state directory (~/.p2p-client, or the
+// profile's directory under it), creating it if needed. sub names an
+// optional subdirectory.
+func DataDir(sub ...string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate home directory: %w", err)
+	}
+	base := filepath.Join(home, appDirName)
+	if profile != "" {
+		base = filepath.Join(base, "profiles", profile)
+	}
+	dir := filepath.Join(append([]string{base}, sub...)...)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	consoleMu      sync.Mutex
+	stdoutReserved bool
+	stdinReserved  bool
+)
+
+// ReserveStdout marks stdout as carrying data (e.g. a received stream), so
+// prompts and progress bars must not be written to it
+func ReserveStdout() {
+	consoleMu.Lock()
+	stdoutReserved = true
+	consoleMu.Unlock()
+}
+
+// ReserveStdin marks stdin as carrying data (e.g. a stream being sent), so
+// interactive input must come from the terminal instead
+func ReserveStdin() {
+	consoleMu.Lock()
+	stdinReserved = true
+	consoleMu.Unlock()
+}
+
+// ConsoleOutput returns the stream human-facing output (prompts, progress
+// bars) should be written to. It is stderr whenever stdout is reserved for
+// data or JSON events.
+func ConsoleOutput() io.Writer {
+	consoleMu.Lock()
+	reserved := stdoutReserved
+	consoleMu.Unlock()
+	if reserved || JSONEvents() {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// PromptInput returns the stream interactive answers should be read from.
+// When stdin carries data it falls back to the controlling terminal.
+// The caller must close the returned reader.
+func PromptInput() (io.ReadCloser, error) {
+	consoleMu.Lock()
+	reserved := stdinReserved
+	consoleMu.Unlock()
+	if !reserved {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return openTTY()
+}
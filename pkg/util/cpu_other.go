@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package util
+
+import (
+	"errors"
+	"time"
+)
+
+// CPUTime is not supported on this platform
+func CPUTime() (time.Duration, error) {
+	return 0, errors.ErrUnsupported
+}
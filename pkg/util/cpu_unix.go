@@ -0,0 +1,18 @@
+//go:build unix
+
+package util
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// CPUTime returns the user plus system CPU time used by this process
+func CPUTime() (time.Duration, error) {
+	var ru unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &ru); err != nil {
+		return 0, err
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
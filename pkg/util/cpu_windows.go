@@ -0,0 +1,22 @@
+//go:build windows
+
+package util
+
+import (
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// CPUTime returns the user plus kernel CPU time used by this process
+func CPUTime() (time.Duration, error) {
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(windows.CurrentProcess(), &creation, &exit, &kernel, &user); err != nil {
+		return 0, err
+	}
+	// Filetimes count 100ns intervals
+	k := int64(kernel.HighDateTime)<<32 | int64(kernel.LowDateTime)
+	u := int64(user.HighDateTime)<<32 | int64(user.LowDateTime)
+	ticks := k + u
+	return time.Duration(ticks * 100), nil
+}
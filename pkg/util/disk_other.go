@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package util
+
+import "errors"
+
+// FreeSpace is not supported on this platform
+func FreeSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,110 @@
+package util
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event types emitted in JSON output mode
+const (
+	EventPeerDiscovered   = "peer_discovered"
+	EventPeerStatus       = "peer_status"
+	EventTransferStarted  = "transfer_started"
+	EventTransferRequest  = "transfer_requested"
+	EventTransferStatus   = "transfer_status"
+	EventProgress         = "progress"
+	EventTransferComplete = "transfer_complete"
+	EventTextReceived     = "text_received"
+	EventChatMessage      = "chat_message"
+	EventRendezvousCode   = "rendezvous_code"
+	EventListing          = "listing"
+	EventError            = "error"
+)
+
+// Event is a single machine-readable status record
+type Event struct {
+	Type string         `json:"type"`
+	Time time.Time      `json:"time"`
+	Data map[string]any `json:"data,omitempty"`
+}
+
+var (
+	eventMu     sync.Mutex
+	eventOut    io.Writer
+	subscribers = map[int]func(Event){}
+	nextSubID   int
+)
+
+// EnableJSONEvents switches the process into JSON output mode: events are
+// written to w as one JSON object per line
+func EnableJSONEvents(w io.Writer) {
+	eventMu.Lock()
+	eventOut = w
+	eventMu.Unlock()
+}
+
+// JSONEvents reports whether JSON output mode is enabled
+func JSONEvents() bool {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	return eventOut != nil
+}
+
+// Subscribe registers fn to receive every emitted event, regardless of
+// JSON output mode. fn must not block. The returned func unsubscribes.
+func Subscribe(fn func(Event)) func() {
+	eventMu.Lock()
+	id := nextSubID
+	nextSubID++
+	subscribers[id] = fn
+	eventMu.Unlock()
+	return func() {
+		eventMu.Lock()
+		delete(subscribers, id)
+		eventMu.Unlock()
+	}
+}
+
+// Emit publishes an event built from key-value pairs to subscribers and,
+// in JSON output mode, to the event stream
+func Emit(eventType string, args ...interface{}) {
+	eventMu.Lock()
+	out := eventOut
+	subs := make([]func(Event), 0, len(subscribers))
+	for _, fn := range subscribers {
+		subs = append(subs, fn)
+	}
+	eventMu.Unlock()
+	if out == nil && len(subs) == 0 {
+		return
+	}
+
+	ev := Event{Type: eventType, Time: time.Now()}
+	if len(args) > 0 {
+		ev.Data = make(map[string]any, len(args)/2)
+		attrs := toAttrSlice(args)
+		for i := 0; i < len(attrs); i += 2 {
+			v := attrs[i+1]
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			ev.Data[attrs[i].(string)] = v
+		}
+	}
+
+	for _, fn := range subs {
+		fn(ev)
+	}
+	if out == nil {
+		return
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	out.Write(append(b, '\n'))
+}
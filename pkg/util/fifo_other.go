@@ -0,0 +1,13 @@
+//go:build !unix
+
+package util
+
+import (
+	"errors"
+	"os"
+)
+
+// Mkfifo is not supported on this platform
+func Mkfifo(path string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkfifo", Path: path, Err: errors.ErrUnsupported}
+}
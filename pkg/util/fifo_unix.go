@@ -0,0 +1,16 @@
+//go:build unix
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// Mkfifo creates a named pipe at path
+func Mkfifo(path string, perm os.FileMode) error {
+	if err := syscall.Mkfifo(path, uint32(perm.Perm())); err != nil {
+		return &os.PathError{Op: "mkfifo", Path: path, Err: err}
+	}
+	return nil
+}
@@ -10,7 +10,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
-	"time"
+	"sync"
 )
 
 // ANSI color codes
@@ -28,6 +28,14 @@ const (
 
 // colorize adds ANSI color codes to the message based on level
 func colorize(level slog.Level, msg string) string {
+	return colorizeIf(true, level, msg)
+}
+
+// colorizeIf colorizes msg only when enabled is set
+func colorizeIf(enabled bool, level slog.Level, msg string) string {
+	if !enabled {
+		return msg
+	}
 	switch level {
 	case slog.LevelError:
 		return colorRed + msg + colorReset
@@ -62,12 +70,20 @@ func NewLogger(output io.Writer, level slog.Level) *Logger {
 			handler: slog.NewTextHandler(output, &slog.HandlerOptions{
 				Level: level,
 			}),
-			level: level,
+			level:  level,
+			output: output,
+			color:  ColorEnabled(output.(*os.File)),
 		}
 		return &Logger{logger: slog.New(handler)}
 	}
 
 	// Otherwise, use JSON handler for other outputs (files, etc.)
+	return NewJSONLogger(output, level)
+}
+
+// NewJSONLogger creates a logger that always writes JSON records, even when
+// output is a terminal stream
+func NewJSONLogger(output io.Writer, level slog.Level) *Logger {
 	handler := slog.NewJSONHandler(output, &slog.HandlerOptions{
 		Level:     level,
 		AddSource: true,
@@ -90,6 +106,9 @@ func NewLogger(output io.Writer, level slog.Level) *Logger {
 type consoleHandler struct {
 	handler slog.Handler
 	level   slog.Level
+	output  io.Writer
+	color   bool
+	attrs   []slog.Attr // Added with With, printed before the record's own
 }
 
 func (h *consoleHandler) Enabled(ctx context.Context, level slog.Level) bool {
@@ -101,17 +120,17 @@ func (h *consoleHandler) Handle(ctx context.Context, r slog.Record) error {
 	levelStr := r.Level.String()
 	switch r.Level {
 	case slog.LevelError:
-		levelStr = colorize(r.Level, "ERROR")
+		levelStr = colorizeIf(h.color, r.Level, "ERROR")
 	case slog.LevelWarn:
-		levelStr = colorize(r.Level, "WARN ")
+		levelStr = colorizeIf(h.color, r.Level, "WARN ")
 	case slog.LevelInfo:
-		levelStr = colorize(r.Level, "INFO ")
+		levelStr = colorizeIf(h.color, r.Level, "INFO ")
 	case slog.LevelDebug:
-		levelStr = colorize(r.Level, "DEBUG")
+		levelStr = colorizeIf(h.color, r.Level, "DEBUG")
 	}
 
 	// Format the time
-	timeStr := colorize(slog.LevelInfo, r.Time.Format("15:04:05.000"))
+	timeStr := colorizeIf(h.color, slog.LevelInfo, r.Time.Format("15:04:05.000"))
 
 	// Build the message parts
 	var msgParts []string
@@ -124,21 +143,25 @@ func (h *consoleHandler) Handle(ctx context.Context, r slog.Record) error {
 	))
 
 	// Add attributes if any
-	r.Attrs(func(attr slog.Attr) bool {
+	addAttr := func(attr slog.Attr) bool {
 		attrStr := fmt.Sprintf("%s=%v", attr.Key, attr.Value)
 		switch {
 		case attr.Key == "error":
-			msgParts = append(msgParts, colorize(slog.LevelError, attrStr))
+			msgParts = append(msgParts, colorizeIf(h.color, slog.LevelError, attrStr))
 		case attr.Key == "file" || attr.Key == "path":
-			msgParts = append(msgParts, colorize(slog.LevelDebug, attrStr))
+			msgParts = append(msgParts, colorizeIf(h.color, slog.LevelDebug, attrStr))
 		default:
-			msgParts = append(msgParts, colorize(slog.LevelInfo, attrStr))
+			msgParts = append(msgParts, colorizeIf(h.color, slog.LevelInfo, attrStr))
 		}
 		return true
-	})
+	}
+	for _, attr := range h.attrs {
+		addAttr(attr)
+	}
+	r.Attrs(addAttr)
 
 	// Join all parts and print
-	fmt.Fprintln(os.Stdout, strings.Join(msgParts, " "))
+	fmt.Fprintln(h.output, strings.Join(msgParts, " "))
 	return nil
 }
 
@@ -146,6 +169,9 @@ func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
 	return &consoleHandler{
 		handler: h.handler.WithAttrs(attrs),
 		level:   h.level,
+		output:  h.output,
+		color:   h.color,
+		attrs:   append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...),
 	}
 }
 
@@ -153,12 +179,119 @@ func (h *consoleHandler) WithGroup(name string) slog.Handler {
 	return &consoleHandler{
 		handler: h.handler.WithGroup(name),
 		level:   h.level,
+		output:  h.output,
+		color:   h.color,
+		attrs:   h.attrs,
+	}
+}
+
+var (
+	defaultMu      sync.RWMutex
+	defaultHandler = NewLogger(os.Stdout, InfoLevel).logger.Handler()
+)
+
+// defaultProxy forwards records to the current default handler, so loggers
+// created at package init pick up later changes made with SetDefaultLogger
+type defaultProxy struct {
+	apply func(slog.Handler) slog.Handler
+}
+
+func (h *defaultProxy) target() slog.Handler {
+	defaultMu.RLock()
+	t := defaultHandler
+	defaultMu.RUnlock()
+	if h.apply != nil {
+		t = h.apply(t)
 	}
+	return t
+}
+
+func (h *defaultProxy) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.target().Enabled(ctx, level)
+}
+
+func (h *defaultProxy) Handle(ctx context.Context, r slog.Record) error {
+	return h.target().Handle(ctx, r)
+}
+
+func (h *defaultProxy) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prev := h.apply
+	return &defaultProxy{apply: func(t slog.Handler) slog.Handler {
+		if prev != nil {
+			t = prev(t)
+		}
+		return t.WithAttrs(attrs)
+	}}
+}
+
+func (h *defaultProxy) WithGroup(name string) slog.Handler {
+	prev := h.apply
+	return &defaultProxy{apply: func(t slog.Handler) slog.Handler {
+		if prev != nil {
+			t = prev(t)
+		}
+		return t.WithGroup(name)
+	}}
 }
 
 // DefaultLogger creates a new logger with default settings
 func DefaultLogger() *Logger {
-	return NewLogger(os.Stdout, InfoLevel)
+	return &Logger{logger: slog.New(&defaultProxy{})}
+}
+
+// SetDefaultLogger replaces the output of every logger obtained from
+// DefaultLogger. l must not itself be derived from DefaultLogger.
+func SetDefaultLogger(l *Logger) {
+	defaultMu.Lock()
+	defaultHandler = l.logger.Handler()
+	defaultMu.Unlock()
+}
+
+// Tee returns a logger writing each record both to l and to other, each
+// filtering by its own level
+func (l *Logger) Tee(other *Logger) *Logger {
+	return &Logger{logger: slog.New(teeHandler{l.logger.Handler(), other.logger.Handler()})}
+}
+
+// teeHandler passes records on to several handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
 }
 
 // With adds attributes to the logger
@@ -220,34 +353,6 @@ func toAttrSlice(args []interface{}) []any {
 	return attrs
 }
 
-// RetryWithBackoff retries a function with exponential backoff
-func RetryWithBackoff(ctx context.Context, maxRetries int, initialBackoff time.Duration, fn func() error) error {
-	var err error
-	backoff := initialBackoff
-
-	for i := 0; i < maxRetries; i++ {
-		err = fn()
-		if err == nil {
-			return nil
-		}
-
-		if i == maxRetries-1 {
-			break
-		}
-
-		timer := time.NewTimer(backoff)
-		select {
-		case <-ctx.Done():
-			timer.Stop()
-			return ctx.Err()
-		case <-timer.C:
-			backoff *= 2
-		}
-	}
-
-	return fmt.Errorf("after %d attempts, last error: %w", maxRetries, err)
-}
-
 // GetCallerInfo returns the file and line number of the caller
 func GetCallerInfo(skip int) (string, int) {
 	_, file, line, ok := runtime.Caller(skip + 1)
@@ -4,13 +4,128 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
+)
+
+// Binding: on a machine with several network interfaces (wired, Wi-Fi, a
+// VPN), discovery and transfers can be pinned to one of them with Bind.
+// mDNS then announces and browses on that interface only, the TCP server
+// listens on its address, and outgoing connections leave from it.
 
-	"github.com/pion/stun"
+const (
+	// IfaceEnv names the environment variable holding the default interface
+	IfaceEnv = "P2P_IFACE"
+	// BindEnv names the environment variable holding the default address
+	BindEnv = "P2P_BIND"
 )
 
-// GetLocalIPs returns all non-loopback IPv4 addresses on active interfaces.
+var binding struct {
+	sync.Mutex
+	iface *net.Interface
+	ip    net.IP
+}
+
+// Bind pins the network to the interface called iface and/or the local
+// address addr, given as an IP or as a subnet like 192.168.1.0/24 to pick
+// this machine's address in. With only addr, the interface holding it is
+// used. Both empty lifts the binding.
+func Bind(iface, addr string) error {
+	var ifi *net.Interface
+	var ip net.IP
+	if iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(iface); err != nil {
+			return fmt.Errorf("no network interface %q: %w", iface, err)
+		}
+	}
+	if iface != "" || addr != "" {
+		var err error
+		if ifi, ip, err = findAddress(ifi, addr); err != nil {
+			return err
+		}
+	}
+	binding.Lock()
+	binding.iface, binding.ip = ifi, ip
+	binding.Unlock()
+	return nil
+}
+
+// findAddress returns the IPv4 address matching addr, an IP, a subnet or
+// "" for any, on ifi, or on any interface if ifi is nil, and its interface
+func findAddress(ifi *net.Interface, addr string) (*net.Interface, net.IP, error) {
+	var want func(net.IP) bool
+	switch {
+	case addr == "":
+		want = func(net.IP) bool { return true }
+	case strings.Contains(addr, "/"):
+		_, subnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid subnet %q: %w", addr, err)
+		}
+		want = subnet.Contains
+	default:
+		target := net.ParseIP(addr)
+		if target == nil {
+			return nil, nil, fmt.Errorf("invalid address %q", addr)
+		}
+		want = target.Equal
+	}
+	ifaces := []net.Interface{}
+	if ifi != nil {
+		ifaces = append(ifaces, *ifi)
+	} else {
+		var err error
+		if ifaces, err = net.Interfaces(); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, candidate := range ifaces {
+		addrs, err := candidate.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil || !want(ipnet.IP) {
+				continue
+			}
+			return &candidate, ipnet.IP.To4(), nil
+		}
+	}
+	switch {
+	case ifi != nil && addr != "":
+		return nil, nil, fmt.Errorf("interface %s has no address %s", ifi.Name, addr)
+	case ifi != nil:
+		return nil, nil, fmt.Errorf("interface %s has no IPv4 address", ifi.Name)
+	}
+	return nil, nil, fmt.Errorf("no network interface has address %s", addr)
+}
+
+// BoundInterfaces returns the interface set with Bind, or nil for all
+func BoundInterfaces() []net.Interface {
+	binding.Lock()
+	defer binding.Unlock()
+	if binding.iface == nil {
+		return nil
+	}
+	return []net.Interface{*binding.iface}
+}
+
+// BoundIP returns the local address set with Bind, or nil for any
+func BoundIP() net.IP {
+	binding.Lock()
+	defer binding.Unlock()
+	return binding.ip
+}
+
+// GetLocalIPs returns all non-loopback IPv4 addresses on active interfaces,
+// or only the address set with Bind.
 func GetLocalIPs() ([]string, error) {
+	if ip := BoundIP(); ip != nil {
+		return []string{ip.String()}, nil
+	}
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, err
@@ -48,51 +163,17 @@ func GetLocalIPs() ([]string, error) {
 	return ips, nil
 }
 
-// GetPublicIP discovers the public IPv4 address using a STUN Binding Request.
-// It returns the observed public IP and port (as seen by the STUN server).
+// GetPublicIP discovers the public IPv4 address by sending STUN Binding
+// Requests to all of STUNServers at once and taking the first answer. It
+// returns the observed public IP and port (as seen by the STUN server).
 func GetPublicIP(timeout time.Duration) (string, int, error) {
-	server := "stun.l.google.com:19302"
-	d := &net.Dialer{Timeout: timeout}
-	conn, err := d.Dial("udp4", server)
+	mappings, _, err := probeSTUN(STUNServers, 1, timeout)
 	if err != nil {
-		return "", 0, fmt.Errorf("stun dial failed: %w", err)
-	}
-	defer conn.Close()
-
-	c, err := stun.NewClient(conn)
-	if err != nil {
-		return "", 0, fmt.Errorf("stun client create failed: %w", err)
-	}
-	defer c.Close()
-
-	var pubIP string
-	var pubPort int
-	var reqErr error
-
-	// Set overall deadline
-	_ = conn.SetDeadline(time.Now().Add(timeout))
-
-	err = c.Do(stun.MustBuild(stun.TransactionID, stun.BindingRequest), func(res stun.Event) {
-		if res.Error != nil {
-			reqErr = res.Error
-			return
-		}
-		var xorAddr stun.XORMappedAddress
-		if getErr := xorAddr.GetFrom(res.Message); getErr != nil {
-			reqErr = getErr
-			return
-		}
-		pubIP = xorAddr.IP.String()
-		pubPort = xorAddr.Port
-	})
-	if err != nil {
-		return "", 0, fmt.Errorf("stun transaction failed: %w", err)
-	}
-	if reqErr != nil {
-		return "", 0, reqErr
+		return "", 0, err
 	}
-	if pubIP == "" {
+	addr := mappings[0].addr
+	if addr.IP == nil {
 		return "", 0, errors.New("stun returned empty IP")
 	}
-	return pubIP, pubPort, nil
+	return addr.IP.String(), addr.Port, nil
 }
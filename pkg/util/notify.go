@@ -0,0 +1,53 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// ErrNoNotifier is returned when no desktop notification tool is available
+var ErrNoNotifier = errors.New("no desktop notification tool found (install libnotify's notify-send)")
+
+// windowsNotify shows a balloon from the notification area, reading its
+// title and text from the environment so they need no quoting
+const windowsNotify = `Add-Type -AssemblyName System.Windows.Forms;` +
+	`$n = New-Object System.Windows.Forms.NotifyIcon;` +
+	`$n.Icon = [System.Drawing.SystemIcons]::Information;` +
+	`$n.Visible = $true;` +
+	`$n.ShowBalloonTip(10000, $env:P2P_NOTIFY_TITLE, $env:P2P_NOTIFY_BODY, 'Info');` +
+	`Start-Sleep -Seconds 10; $n.Dispose()`
+
+// notifyCommand returns the command showing a notification on this
+// platform
+func notifyCommand(title, body string) []string {
+	switch runtime.GOOS {
+	case "darwin":
+		quote := func(s string) string {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+		return []string{"osascript", "-e", "display notification " + quote(body) + " with title " + quote(title)}
+	case "windows":
+		return []string{"powershell", "-NoProfile", "-NonInteractive", "-Command", windowsNotify}
+	}
+	// A file name starting with "-" mustn't pass for an option
+	return []string{"notify-send", "--app-name=p2p", "--", title, body}
+}
+
+// Notify shows a desktop notification. It doesn't wait for the
+// notification to go away.
+func Notify(title, body string) error {
+	args := notifyCommand(title, body)
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return ErrNoNotifier
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "P2P_NOTIFY_TITLE="+title, "P2P_NOTIFY_BODY="+body)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
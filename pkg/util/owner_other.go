@@ -0,0 +1,10 @@
+//go:build !unix
+
+package util
+
+import "os"
+
+// FileOwner is not supported on this platform
+func FileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
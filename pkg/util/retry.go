@@ -0,0 +1,103 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how Retry spaces out and bounds attempts
+type RetryPolicy struct {
+	MaxAttempts    int                  // Maximum number of attempts (0 means unlimited until Deadline)
+	InitialBackoff time.Duration        // Delay before the second attempt
+	MaxBackoff     time.Duration        // Cap on the delay between attempts (0 means no cap)
+	Multiplier     float64              // Backoff growth factor (defaults to 2)
+	Jitter         float64              // Fraction of the delay randomized, 0..1 (0.5 means ±50%)
+	Deadline       time.Duration        // Overall time budget across attempts (0 means none)
+	RetryOn        func(err error) bool // Returns false for errors that must not be retried
+}
+
+// DefaultRetryPolicy returns a policy suited to reconnecting to a peer
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.5,
+	}
+}
+
+// delay applies the policy's jitter to backoff
+func (p RetryPolicy) delay(backoff time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return backoff
+	}
+	jitter := p.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	// Spread uniformly over [backoff*(1-jitter), backoff*(1+jitter)]
+	f := 1 - jitter + rand.Float64()*2*jitter
+	return time.Duration(float64(backoff) * f)
+}
+
+// Retry calls fn until it succeeds, the policy is exhausted, the error is not
+// retryable, or ctx is cancelled
+func Retry(ctx context.Context, policy RetryPolicy, fn func() error) error {
+	if policy.Multiplier <= 0 {
+		policy.Multiplier = 2
+	}
+	if policy.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Deadline)
+		defer cancel()
+	}
+
+	var err error
+	backoff := policy.InitialBackoff
+	attempt := 0
+	for {
+		attempt++
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if policy.RetryOn != nil && !policy.RetryOn(err) {
+			return err
+		}
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			break
+		}
+
+		wait := policy.delay(backoff)
+		if dl, ok := ctx.Deadline(); ok && time.Until(dl) < wait {
+			// Not enough budget left for another attempt
+			break
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("retry aborted after %d attempts: %w (last error: %v)", attempt, ctx.Err(), err)
+		case <-timer.C:
+		}
+
+		backoff = time.Duration(float64(backoff) * policy.Multiplier)
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+
+	return fmt.Errorf("after %d attempts, last error: %w", attempt, err)
+}
+
+// RetryWithBackoff retries a function with exponential backoff
+func RetryWithBackoff(ctx context.Context, maxRetries int, initialBackoff time.Duration, fn func() error) error {
+	policy := DefaultRetryPolicy()
+	policy.MaxAttempts = max(maxRetries, 1)
+	policy.InitialBackoff = initialBackoff
+	return Retry(ctx, policy, fn)
+}
@@ -0,0 +1,124 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NextSchedule returns the first time at or after now that spec names, in
+// local time. spec is a time of day ("02:00", the next one to come), a date
+// and time ("2006-01-02 15:04"), an RFC 3339 timestamp, or a five-field cron
+// expression ("30 2 * * 1-5": minute, hour, day of month, month, day of
+// week), whose fields take *, lists, ranges and /steps.
+func NextSchedule(spec string, now time.Time) (time.Time, error) {
+	spec = strings.TrimSpace(spec)
+	if t, err := time.ParseInLocation("15:04", spec, time.Local); err == nil {
+		next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+		if next.Before(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		return next, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", spec, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, spec); err == nil {
+		return t, nil
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return time.Time{}, fmt.Errorf("invalid schedule %q, expected HH:MM, \"YYYY-MM-DD HH:MM\" or a cron expression", spec)
+	}
+	return nextCron(fields, now)
+}
+
+// cronLimits are the value ranges of the five cron fields
+var cronLimits = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// nextCron returns the first minute at or after now matching the cron
+// fields. As in cron, when both the day of month and the day of week are
+// restricted a day matching either will do.
+func nextCron(fields []string, now time.Time) (time.Time, error) {
+	var sets [5]map[int]bool
+	for i, f := range fields {
+		set, err := parseCronField(f, cronLimits[i][0], cronLimits[i][1])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid cron field %q: %w", f, err)
+		}
+		sets[i] = set
+	}
+	// Sunday may be written as 7
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	anyDom, anyDow := fields[2] == "*", fields[4] == "*"
+
+	t := now.Truncate(time.Minute)
+	if t.Before(now) {
+		t = t.Add(time.Minute)
+	}
+	// Every valid expression matches within a few years
+	for end := t.AddDate(5, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if !sets[3][int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		dom, dow := sets[2][t.Day()], sets[4][int(t.Weekday())]
+		dayOK := dom && dow
+		if !anyDom && !anyDow {
+			dayOK = dom || dow
+		}
+		if !dayOK {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if sets[1][t.Hour()] && sets[0][t.Minute()] {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cron expression %q never matches", strings.Join(fields, " "))
+}
+
+// parseCronField parses one cron field of values from lo to hi
+func parseCronField(f string, lo, hi int) (map[int]bool, error) {
+	if lo == 0 && hi == 6 {
+		hi = 7 // day of week
+	}
+	set := make(map[int]bool)
+	for _, part := range strings.Split(f, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return nil, fmt.Errorf("invalid value %q", a)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return nil, fmt.Errorf("invalid value %q", b)
+				}
+			} else if hasStep {
+				to = hi
+			}
+			if from < lo || to > hi || from > to {
+				return nil, fmt.Errorf("%q is outside %d-%d", rng, lo, hi)
+			}
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
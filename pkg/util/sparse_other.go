@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd
+
+package util
+
+import (
+	"errors"
+	"os"
+)
+
+// SeekData is not supported on this platform
+func SeekData(f *os.File, off int64) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// SeekHole is not supported on this platform
+func SeekHole(f *os.File, off int64) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd
+
+package util
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// SeekData moves f to the first byte at or after off that is not in a
+// hole, or to the end of the file if only holes remain, and returns the new
+// offset
+func SeekData(f *os.File, off int64) (int64, error) {
+	pos, err := f.Seek(off, unix.SEEK_DATA)
+	if errors.Is(err, unix.ENXIO) {
+		return f.Seek(0, io.SeekEnd)
+	}
+	return pos, err
+}
+
+// SeekHole moves f to the start of the first hole at or after off and
+// returns the new offset. The end of the file counts as a hole.
+func SeekHole(f *os.File, off int64) (int64, error) {
+	pos, err := f.Seek(off, unix.SEEK_HOLE)
+	if errors.Is(err, unix.ENXIO) {
+		return f.Seek(0, io.SeekEnd)
+	}
+	return pos, err
+}
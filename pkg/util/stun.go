@@ -0,0 +1,194 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// STUNEnv sets the STUN servers, comma-separated, when no -stun flag is given
+const STUNEnv = "P2P_STUN"
+
+// DefaultSTUNServers are used when neither -stun nor $P2P_STUN is set
+var DefaultSTUNServers = []string{
+	"stun.l.google.com:19302",
+	"stun1.l.google.com:19302",
+	"stun.cloudflare.com:3478",
+	"stun.stunprotocol.org:3478",
+}
+
+// STUNServers are the host:port STUN servers used to find the public address
+// and the NAT type, and given to WebRTC for ICE
+var STUNServers = DefaultSTUNServers
+
+// SetSTUNServers replaces STUNServers with a comma-separated list of
+// [stun:]host[:port] entries, the port defaulting to 3478. An empty list
+// keeps the defaults.
+func SetSTUNServers(list string) error {
+	if strings.TrimSpace(list) == "" {
+		STUNServers = DefaultSTUNServers
+		return nil
+	}
+	var servers []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimPrefix(strings.TrimSpace(s), "stun:")
+		if s == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "3478")
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				return fmt.Errorf("invalid STUN server %q, expected host:port", s)
+			}
+		}
+		servers = append(servers, s)
+	}
+	if len(servers) == 0 {
+		return errors.New("no STUN servers given")
+	}
+	STUNServers = servers
+	return nil
+}
+
+// STUNServersFromEnv applies $P2P_STUN, if set
+func STUNServersFromEnv() error {
+	if v := os.Getenv(STUNEnv); v != "" {
+		return SetSTUNServers(v)
+	}
+	return nil
+}
+
+// NAT types told apart by DetectNAT
+const (
+	NATOpen      = "open"      // Public address, no NAT
+	NATCone      = "cone"      // Same mapping towards every server; hole punching works
+	NATSymmetric = "symmetric" // A new mapping per server; direct WebRTC needs a TURN relay
+	NATUnknown   = "unknown"   // Fewer than two servers answered
+)
+
+// NATInfo is what the STUN servers saw of this host
+type NATInfo struct {
+	IP   string // Public IPv4 address
+	Port int    // Public port of the probing socket
+	Type string // One of the NAT* types
+}
+
+// stunMapping is the address one server saw the probing socket at
+type stunMapping struct {
+	server string
+	addr   *net.UDPAddr
+}
+
+// probeSTUN sends a binding request to every server at once from a single
+// socket and collects the mapped addresses in the order they come back. It
+// returns after want distinct servers answered, or after timeout with what
+// it has.
+func probeSTUN(servers []string, want int, timeout time.Duration) ([]stunMapping, *net.UDPAddr, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, nil, fmt.Errorf("stun listen failed: %w", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	conn.SetDeadline(deadline)
+
+	// Resolve in parallel too, so one slow DNS name doesn't hold up the rest
+	pending := make(map[[stun.TransactionIDSize]byte]string)
+	type resolved struct {
+		server string
+		addr   *net.UDPAddr
+		err    error
+	}
+	results := make(chan resolved, len(servers))
+	for _, s := range servers {
+		go func() {
+			addr, err := net.ResolveUDPAddr("udp4", s)
+			results <- resolved{s, addr, err}
+		}()
+	}
+	var lastErr error
+	for range servers {
+		r := <-results
+		if r.err != nil {
+			lastErr = fmt.Errorf("stun resolve %s failed: %w", r.server, r.err)
+			continue
+		}
+		msg := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		if _, err := conn.WriteTo(msg.Raw, r.addr); err != nil {
+			lastErr = fmt.Errorf("stun request to %s failed: %w", r.server, err)
+			continue
+		}
+		pending[msg.TransactionID] = r.server
+	}
+	if len(pending) == 0 {
+		return nil, nil, lastErr
+	}
+
+	var mappings []stunMapping
+	buf := make([]byte, 1500)
+	for len(mappings) < want && len(pending) > 0 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if len(mappings) == 0 {
+				return nil, nil, fmt.Errorf("no STUN server answered: %w", err)
+			}
+			break
+		}
+		if !stun.IsMessage(buf[:n]) {
+			continue
+		}
+		res := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+		if err := res.Decode(); err != nil {
+			continue
+		}
+		server, ok := pending[res.TransactionID]
+		if !ok {
+			continue
+		}
+		delete(pending, res.TransactionID)
+		var xorAddr stun.XORMappedAddress
+		if err := xorAddr.GetFrom(res); err != nil {
+			lastErr = fmt.Errorf("stun answer from %s: %w", server, err)
+			continue
+		}
+		mappings = append(mappings, stunMapping{server, &net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port}})
+	}
+	if len(mappings) == 0 {
+		return nil, nil, lastErr
+	}
+	return mappings, conn.LocalAddr().(*net.UDPAddr), nil
+}
+
+// DetectNAT finds the public address with STUNServers and tells what kind
+// of NAT is in the way by comparing the mappings two servers saw for the
+// same socket.
+func DetectNAT(timeout time.Duration) (NATInfo, error) {
+	mappings, local, err := probeSTUN(STUNServers, 2, timeout)
+	if err != nil {
+		return NATInfo{Type: NATUnknown}, err
+	}
+	first := mappings[0].addr
+	info := NATInfo{IP: first.IP.String(), Port: first.Port, Type: NATUnknown}
+	if ips, err := GetLocalIPs(); err == nil {
+		for _, ip := range ips {
+			if ip == info.IP && first.Port == local.Port {
+				info.Type = NATOpen
+				return info, nil
+			}
+		}
+	}
+	if len(mappings) < 2 {
+		return info, nil
+	}
+	if mappings[1].addr.String() == first.String() {
+		info.Type = NATCone
+	} else {
+		info.Type = NATSymmetric
+	}
+	return info, nil
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package util
+
+import (
+	"io"
+	"os"
+)
+
+// openTTY opens the controlling terminal for reading
+func openTTY() (io.ReadCloser, error) {
+	return os.Open("/dev/tty")
+}
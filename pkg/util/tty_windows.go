@@ -0,0 +1,13 @@
+//go:build windows
+
+package util
+
+import (
+	"io"
+	"os"
+)
+
+// openTTY opens the console input buffer for reading
+func openTTY() (io.ReadCloser, error) {
+	return os.Open("CONIN$")
+}
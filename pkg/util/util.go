@@ -2,12 +2,24 @@ package util
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"strconv"
+	"strings"
 )
 
-// Send length-prefixed data
+// ErrFrameTooLarge is returned for a frame longer than its length prefix
+// can describe, or than the reader allows
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Send length-prefixed data. The length is a uint32, so data must be under
+// 4 GiB; see SendWithLength64 for larger frames.
 func SendWithLength(w io.Writer, data []byte) error {
+	if uint64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("%w: %d bytes, at most %d fit a 32-bit length", ErrFrameTooLarge, len(data), uint32(math.MaxUint32))
+	}
 	length := uint32(len(data))
 	if err := binary.Write(w, binary.BigEndian, length); err != nil {
 		return fmt.Errorf("failed to send length: %w", err)
@@ -27,3 +39,68 @@ func ReadWithLength(r io.Reader) ([]byte, error) {
 	_, err := io.ReadFull(r, buf)
 	return buf, err
 }
+
+// SendWithLength64 sends data prefixed with its length as a uint64
+func SendWithLength64(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint64(len(data))); err != nil {
+		return fmt.Errorf("failed to send length: %w", err)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// ReadWithLength64 reads data sent by SendWithLength64, refusing frames
+// longer than limit before allocating them
+func ReadWithLength64(r io.Reader, limit int64) ([]byte, error) {
+	var length uint64
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("failed to read length: %w", err)
+	}
+	if length > uint64(limit) {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d allowed", ErrFrameTooLarge, length, limit)
+	}
+	buf := make([]byte, length)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+// ParseSize parses a byte size such as "65536", "64K", "4M" or "1GiB"
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "IB"), "B")
+	mult := int64(1)
+	if n := len(str); n > 0 {
+		switch str[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			str = str[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// FormatSize renders a byte count for humans, e.g. "1.5 MiB"
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
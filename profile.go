@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/udit2303/p2p-client/pkg/discovery"
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Profiles let one machine take part in separate networks under separate
+// identities. `p2p -profile work <command>`, or P2P_PROFILE=work, keeps the
+// keys, node name, address book, groups, receipts and all other state in
+// ~/.p2p-client/profiles/work instead of the working directory and
+// ~/.p2p-client, and takes default settings from the profile's
+// profile.env.
+
+// profileConfig is the file in a profile's directory holding its
+// settings: environment variables such as P2P_DISCOVERY_CODE, one
+// NAME=value per line, which the real environment overrides
+const profileConfig = "profile.env"
+
+// takeProfile removes a -profile flag given before the command from args
+// and returns its value
+func takeProfile(args []string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", args, nil
+	}
+	name, value, hasValue := strings.Cut(strings.TrimLeft(args[0], "-"), "=")
+	if name != "profile" || !strings.HasPrefix(args[0], "-") {
+		return "", args, nil
+	}
+	if hasValue {
+		return value, args[1:], nil
+	}
+	if len(args) < 2 {
+		return "", nil, errors.New("-profile needs a profile name")
+	}
+	return args[1], args[2:], nil
+}
+
+// useProfile switches to the named profile, "" keeping the default one
+func useProfile(name string) error {
+	if name == "" {
+		if legacy := keys.LegacyFiles(); len(legacy) > 0 {
+			log.Warn("Key files in the working directory are no longer used; move them yourself to keep this node's identity", "files", legacy, "to", filepath.Dir(keys.PrivateKeyPath))
+		}
+		return nil
+	}
+	if err := util.SetProfile(name); err != nil {
+		return err
+	}
+	dir, err := util.DataDir()
+	if err != nil {
+		return err
+	}
+	keys.UseDir(dir)
+	env, err := readProfileConfig(filepath.Join(dir, profileConfig))
+	if err != nil {
+		return err
+	}
+	for k, v := range env {
+		if _, set := os.LookupEnv(k); !set {
+			os.Setenv(k, v)
+		}
+	}
+	return nil
+}
+
+// readProfileConfig reads the settings in path, none if it doesn't exist
+func readProfileConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile settings: %w", err)
+	}
+	defer f.Close()
+	env := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" || strings.ContainsAny(k, " \t") || k == util.ProfileEnv {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value", path, n)
+		}
+		env[k] = strings.TrimSpace(v)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read profile settings: %w", err)
+	}
+	return env, nil
+}
+
+// profileInfo describes a profile for profile list
+type profileInfo struct {
+	Name    string `json:"name"`
+	Node    string `json:"node,omitempty"`
+	Dir     string `json:"dir"`
+	Current bool   `json:"current,omitempty"`
+}
+
+// runProfile implements `profile create|list`: managing the profiles this
+// machine has, each a separate identity
+func runProfile(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: p2p profile create <name> [-discovery-code code] [-allow-from list]")
+		fmt.Fprintln(os.Stderr, "       p2p profile list [-json]")
+		fmt.Fprintln(os.Stderr, "Use a profile with p2p -profile <name> <command>, or $"+util.ProfileEnv+".")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	switch args[0] {
+	case "create", "add":
+		fs := flag.NewFlagSet("profile create", flag.ExitOnError)
+		code := fs.String("discovery-code", "", "Secret code the profile's nodes are discovered under (default: a new random one)")
+		allowFrom := fs.String("allow-from", "", "Default -allow-from of the profile's receivers")
+		pos := parseInterspersed(fs, args[1:])
+		if len(pos) != 1 {
+			usage()
+			return 2
+		}
+		if err := createProfile(pos[0], *code, *allowFrom); err != nil {
+			log.Error("Cannot create profile", "error", err)
+			return 1
+		}
+	case "list", "ls":
+		fs := flag.NewFlagSet("profile list", flag.ExitOnError)
+		jsonOut := fs.Bool("json", false, "Print the profiles as JSON")
+		fs.Parse(args[1:])
+		profiles, err := listProfiles()
+		if err != nil {
+			log.Error("Cannot list profiles", "error", err)
+			return 1
+		}
+		if *jsonOut {
+			json.NewEncoder(os.Stdout).Encode(profiles)
+			return 0
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "\tNAME\tNODE\tDIR")
+		for _, p := range profiles {
+			mark := ""
+			if p.Current {
+				mark = "*"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", mark, p.Name, p.Node, p.Dir)
+		}
+		tw.Flush()
+	default:
+		usage()
+		return 2
+	}
+	return 0
+}
+
+// createProfile creates the named profile with its own keys and settings
+func createProfile(name, code, allowFrom string) error {
+	if name == "" {
+		return errors.New("empty profile name")
+	}
+	if err := util.SetProfile(name); err != nil {
+		return err
+	}
+	root, err := util.ProfilesDir()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+		return fmt.Errorf("profile %q already exists", name)
+	}
+	dir, err := util.DataDir()
+	if err != nil {
+		return err
+	}
+	keys.UseDir(dir)
+	if code == "" {
+		code = discovery.NewSecret()
+	}
+	settings := fmt.Sprintf("# Settings of profile %s, as environment variables\n%s=%s\n", name, codeEnv, code)
+	if allowFrom != "" {
+		settings += allowFromEnv + "=" + allowFrom + "\n"
+	}
+	if err := os.WriteFile(filepath.Join(dir, profileConfig), []byte(settings), 0600); err != nil {
+		return fmt.Errorf("failed to save profile settings: %w", err)
+	}
+	node, err := keys.NodeName()
+	if err != nil {
+		return err
+	}
+	pub, err := keys.LoadPublicKey()
+	if err != nil {
+		return err
+	}
+	id, err := keys.LoadIdentity()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created profile %s in %s\n", name, dir)
+	fmt.Printf("  node:        %s\n", node)
+	fmt.Printf("  fingerprint: %s\n", keys.PublicKeyFingerprint(pub))
+	fmt.Printf("  id:          %s\n", keys.IdentityFingerprint(id.Public().(ed25519.PublicKey)))
+	fmt.Printf("  code:        %s\n", code)
+	fmt.Printf("Use it with: p2p -profile %s <command>\n", name)
+	return nil
+}
+
+// listProfiles returns the profiles created on this machine
+func listProfiles() ([]profileInfo, error) {
+	root, err := util.ProfilesDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	profiles := []profileInfo{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		p := profileInfo{Name: e.Name(), Dir: filepath.Join(root, e.Name()), Current: e.Name() == util.Profile()}
+		if data, err := os.ReadFile(filepath.Join(p.Dir, filepath.Base(keys.NodeNamePath))); err == nil {
+			p.Node = strings.TrimSpace(string(data))
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
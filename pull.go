@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/udit2303/p2p-client/pkg/discovery"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// Usage of -expose and -expose-to, shared by receive and daemon
+const (
+	exposeUsage   = "Let the peers listed in -expose-to browse this directory with ls and fetch files from it with get"
+	exposeToUsage = "Who may browse -expose: comma-separated key fingerprints, saved peer names, or \"trusted\" for every peer saved with a fingerprint"
+)
+
+// remoteUsage describes the <peer>:<path> argument of ls and get
+const remoteUsage = "<peer> is ip:port, a saved peer, or a node name discovered over mDNS; <path> is relative to the directory it exposes with -expose."
+
+// splitRemote splits a <peer>:<path> argument. An ip:port peer takes the
+// port with it, so 10.0.0.5:8000:docs/a.txt is docs/a.txt on 10.0.0.5:8000.
+func splitRemote(arg string) (peer, path string, err error) {
+	start := 0
+	if strings.HasPrefix(arg, "[") {
+		// [v6 address]:port:path
+		if start = strings.Index(arg, "]"); start < 0 {
+			return "", "", fmt.Errorf("invalid address in %q", arg)
+		}
+	}
+	i := strings.Index(arg[start:], ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("%q is not <peer>:<path>", arg)
+	}
+	i += start
+	peer, path = arg[:i], arg[i+1:]
+	port, rest, ok := strings.Cut(path, ":")
+	if isPort(port) && (ok || start > 0) {
+		peer, path = peer+":"+port, rest
+	}
+	if peer == "" {
+		return "", "", fmt.Errorf("%q names no peer", arg)
+	}
+	return peer, path, nil
+}
+
+// isPort reports whether s is a port number
+func isPort(s string) bool {
+	if s == "" || len(s) > 5 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// pullFlags are the flags ls and get share
+type pullFlags struct {
+	search    *string
+	proxyURL  *string
+	discovery *string
+	lf        *logFlags
+	tf        *timeoutFlags
+	bf        *bindFlags
+	tcf       *tcpFlags
+}
+
+// addPullFlags registers the flags ls and get share on fs
+func addPullFlags(fs *flag.FlagSet) *pullFlags {
+	return &pullFlags{
+		search:    fs.String("search", defaultCode(), searchUsage),
+		proxyURL:  fs.String("proxy", "", "Proxy for outgoing connections: socks5://[user:pass@]host:port or http://host:port (default $ALL_PROXY)"),
+		discovery: fs.String("discovery", os.Getenv(discovery.Env), discoveryUsage),
+		lf:        addLogFlags(fs),
+		tf:        addTimeoutFlags(fs),
+		bf:        addBindFlags(fs),
+		tcf:       addTCPFlags(fs),
+	}
+}
+
+// apply applies the flags and resolves the peer of a <peer>:<path>
+// argument, returning the exit code on failure. stdoutData moves logs to
+// stderr, as for lf.apply.
+func (f *pullFlags) apply(ctx context.Context, arg string, stdoutData bool) (dial netconn.Dialer, fingerprint, path string, code int) {
+	f.lf.apply(stdoutData)
+	if err := f.tf.apply(); err != nil {
+		log.Error("Invalid timeout", "error", err)
+		return nil, "", "", 2
+	}
+	if err := f.bf.apply(); err != nil {
+		log.Error("Invalid -iface or -bind", "error", err)
+		return nil, "", "", 2
+	}
+	if err := f.tcf.apply(); err != nil {
+		log.Error("Invalid TCP option", "error", err)
+		return nil, "", "", 2
+	}
+	if err := applyDiscovery(*f.discovery); err != nil {
+		log.Error("Invalid -discovery", "value", *f.discovery, "error", err)
+		return nil, "", "", 2
+	}
+	if err := netconn.SetProxy(*f.proxyURL); err != nil {
+		log.Error("Invalid -proxy", "value", *f.proxyURL, "error", err)
+		return nil, "", "", 2
+	}
+	peer, path, err := splitRemote(arg)
+	if err != nil {
+		log.Error("Invalid remote path", "error", err)
+		return nil, "", "", 2
+	}
+	usePasscodeOf(*f.search)
+	host, port, fingerprint, err := resolveTarget(peer, *f.search, -1)
+	if err != nil {
+		log.Error("Cannot resolve peer", "error", err)
+		util.Emit(util.EventError, "stage", "discovery", "error", err)
+		return nil, "", "", exitCode(err)
+	}
+	return netconn.TCPDialer(ctx, host, port), fingerprint, path, 0
+}
+
+// runLs implements `ls <peer>:[path]`: lists a directory the peer exposes
+func runLs(args []string) int {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	pf := addPullFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: p2p ls <peer>:[path] [flags]")
+		fmt.Fprintln(fs.Output(), remoteUsage)
+		fs.PrintDefaults()
+	}
+	pos := parseInterspersed(fs, args)
+	if len(pos) != 1 {
+		fs.Usage()
+		return 2
+	}
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	dial, fingerprint, path, code := pf.apply(ctx, pos[0], true)
+	if code != 0 {
+		return code
+	}
+	entries, err := netconn.ListVia(dial, fingerprint, path)
+	if err != nil {
+		log.Error("Listing failed", "error", err)
+		return exitCode(err)
+	}
+	if util.JSONEvents() {
+		util.Emit(util.EventListing, "path", path, "entries", entries)
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, e := range entries {
+		size, name := util.FormatSize(e.Size), e.Name
+		if e.Dir {
+			size, name = "-", name+"/"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Mode, size, e.ModTime.Format("2006-01-02 15:04"), name)
+	}
+	tw.Flush()
+	return 0
+}
+
+// runGet implements `get <peer>:<path>`: fetches a file the peer exposes
+func runGet(args []string) int {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	outDir := fs.String("out", ".", "Directory to save the file in")
+	noPreserve := fs.Bool("no-preserve", false, "Don't restore the file's mode and modification time")
+	pf := addPullFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: p2p get <peer>:<path> [flags]")
+		fmt.Fprintln(fs.Output(), remoteUsage)
+		fs.PrintDefaults()
+	}
+	pos := parseInterspersed(fs, args)
+	if len(pos) != 1 {
+		fs.Usage()
+		return 2
+	}
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	dial, fingerprint, path, code := pf.apply(ctx, pos[0], false)
+	if code != 0 {
+		return code
+	}
+	opts := transfer.ReceiveOptions{OutputDir: *outDir, NoMetadata: *noPreserve}
+	if _, err := netconn.GetVia(dial, fingerprint, path, opts); err != nil {
+		util.Emit(util.EventError, "stage", "get", "path", path, "error", err)
+		log.Error("Fetch failed", "error", err)
+		return exitCode(err)
+	}
+	return 0
+}
+
+// parseExpose turns -expose and -expose-to into the directory exposed to
+// ls and get, nil if -expose is unset. -expose-to takes what -allow-from
+// does; without it nobody may browse.
+func parseExpose(dir, to string) (*transfer.Exposed, error) {
+	if dir == "" {
+		if to != "" {
+			return nil, errors.New("-expose-to needs -expose")
+		}
+		return nil, nil
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	if to == "" {
+		return nil, errors.New("-expose needs -expose-to, listing who may browse")
+	}
+	allow, err := parseAllowFrom(to)
+	if err != nil {
+		return nil, err
+	}
+	return &transfer.Exposed{Dir: dir, Allow: allow}, nil
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// serviceName is the default name the daemon is installed under
+const serviceName = "p2p"
+
+// serviceConfigTemplate starts a daemon config file written on install
+const serviceConfigTemplate = `# p2p daemon settings: one flag of "p2p daemon -h" per line, e.g.
+#
+#   discovery-code <a long random secret>
+#   out /srv/p2p/inbox
+#   auto-accept
+#   quota 10G
+#   allow-from trusted
+#   hook clamscan --no-summary {}
+#   audit
+#
+# auto-accept, quota, allow-from, hook and quarantine are read again on
+# reload (SIGHUP); the rest take a restart.
+`
+
+// serviceSpec describes the daemon service to install
+type serviceSpec struct {
+	name   string
+	user   bool // A per-user service rather than a system one
+	socket bool // Let systemd own the listening sockets
+	exe    string
+	config string
+	port   int
+	ui     string
+	args   []string // Extra daemon flags
+	runAs  string   // Account a system service runs under, "" for root
+}
+
+// serviceFile is a file the service is installed as
+type serviceFile struct {
+	path    string
+	content string
+}
+
+// runService implements `service install|uninstall|print`: running the
+// daemon under systemd, launchd or the Windows service manager
+func runService(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: p2p service install|uninstall|print [-user] [-socket] [-name name] [-port n] [-ui addr] [-config file] [-- daemon flags]")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("service "+action, flag.ExitOnError)
+	name := fs.String("name", serviceName, "Name of the service")
+	userFlag := fs.Bool("user", false, "Install a service for the current user instead of a system one (systemd and launchd)")
+	socket := fs.Bool("socket", false, "Let systemd open the transfer and web UI ports and start the daemon on the first connection")
+	port := fs.Int("port", 8000, "Port the daemon listens on")
+	ui := fs.String("ui", "127.0.0.1:7070", "Address to serve the web UI and API on (empty to disable)")
+	config := fs.String("config", "", "Daemon config file, created if missing (default: /etc/p2p/daemon.conf, or ~/.config/p2p/daemon.conf with -user)")
+	lf := addLogFlags(fs)
+	fs.Parse(args[1:])
+
+	lf.apply(false)
+	if action != "install" && action != "uninstall" && action != "print" {
+		usage()
+		return 2
+	}
+	if *socket && runtime.GOOS != "linux" {
+		log.Error("-socket needs systemd")
+		return 2
+	}
+	if *userFlag && runtime.GOOS == "windows" {
+		log.Error("-user is not supported for Windows services")
+		return 2
+	}
+	s := serviceSpec{name: *name, user: *userFlag, socket: *socket, port: *port, ui: *ui, config: *config, args: fs.Args()}
+	if err := s.fill(); err != nil {
+		log.Error("Cannot describe the service", "error", err)
+		return 1
+	}
+
+	var err error
+	switch action {
+	case "print":
+		err = s.print()
+	case "install":
+		err = s.install()
+	case "uninstall":
+		err = s.uninstall()
+	}
+	if err != nil {
+		log.Error("Service "+action+" failed", "service", s.name, "error", err)
+		return 1
+	}
+	return 0
+}
+
+// fill sets the binary, config file and account the service runs with
+func (s *serviceSpec) fill() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot find this binary: %w", err)
+	}
+	if s.exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return fmt.Errorf("cannot find this binary: %w", err)
+	}
+	if s.config == "" {
+		switch {
+		case s.user:
+			dir, err := os.UserConfigDir()
+			if err != nil {
+				return err
+			}
+			s.config = filepath.Join(dir, "p2p", "daemon.conf")
+		case runtime.GOOS == "windows":
+			s.config = filepath.Join(os.Getenv("ProgramData"), "p2p", "daemon.conf")
+		default:
+			s.config = "/etc/p2p/daemon.conf"
+		}
+	}
+	if s.config, err = filepath.Abs(s.config); err != nil {
+		return err
+	}
+	// A system service installed through sudo runs as the user who asked,
+	// keeping their keys and address book
+	if !s.user && runtime.GOOS != "windows" {
+		if u := os.Getenv("SUDO_USER"); u != "" && u != "root" {
+			s.runAs = u
+		}
+	}
+	return nil
+}
+
+// daemonArgs returns the daemon command line the service runs, without the
+// binary
+func (s serviceSpec) daemonArgs() []string {
+	args := []string{"daemon", "-config", s.config, "-port", strconv.Itoa(s.port), "-ui", s.ui}
+	if p := util.Profile(); p != "" {
+		args = append([]string{"-profile", p}, args...)
+	}
+	return append(args, s.args...)
+}
+
+// files returns the files the service is installed as on this system
+func (s serviceSpec) files() ([]serviceFile, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return s.systemdUnits()
+	case "darwin":
+		return s.launchdPlist()
+	case "windows":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("services are not supported on %s", runtime.GOOS)
+	}
+}
+
+// unitDir returns where systemd units are installed
+func (s serviceSpec) unitDir() (string, error) {
+	if !s.user {
+		return "/etc/systemd/system", nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "systemd", "user"), nil
+}
+
+// systemdUnits returns the service unit and, with socket activation, the
+// socket units for the transfer port and the web UI
+func (s serviceSpec) systemdUnits() ([]serviceFile, error) {
+	dir, err := s.unitDir()
+	if err != nil {
+		return nil, err
+	}
+	var sockets []string
+	var files []serviceFile
+	if s.socket {
+		sockets = append(sockets, s.name+".socket")
+		files = append(files, serviceFile{filepath.Join(dir, s.name+".socket"), fmt.Sprintf(`[Unit]
+Description=p2p-client transfer port
+
+[Socket]
+ListenStream=%d
+FileDescriptorName=transfer
+Service=%s.service
+
+[Install]
+WantedBy=sockets.target
+`, s.port, s.name)})
+		if s.ui != "" {
+			sockets = append(sockets, s.name+"-ui.socket")
+			files = append(files, serviceFile{filepath.Join(dir, s.name+"-ui.socket"), fmt.Sprintf(`[Unit]
+Description=p2p-client web UI
+
+[Socket]
+ListenStream=%s
+FileDescriptorName=ui
+Service=%s.service
+
+[Install]
+WantedBy=sockets.target
+`, s.ui, s.name)})
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=p2p-client daemon\nAfter=network-online.target\nWants=network-online.target\n")
+	if len(sockets) > 0 {
+		fmt.Fprintf(&b, "Requires=%s\n", strings.Join(sockets, " "))
+	}
+	fmt.Fprintf(&b, "\n[Service]\nExecStart=%s\nExecReload=/bin/kill -HUP $MAINPID\n", systemdCommand(s.exe, s.daemonArgs()))
+	// Secrets such as P2P_PASSCODE go in an environment file beside the config
+	fmt.Fprintf(&b, "EnvironmentFile=-%s\n", filepath.Join(filepath.Dir(s.config), "env"))
+	if s.runAs != "" {
+		fmt.Fprintf(&b, "User=%s\n", s.runAs)
+	}
+	if len(sockets) > 0 {
+		fmt.Fprintf(&b, "Sockets=%s\n", strings.Join(sockets, " "))
+	}
+	target := "multi-user.target"
+	if s.user {
+		target = "default.target"
+	}
+	fmt.Fprintf(&b, "Restart=on-failure\nRestartSec=5\n\n[Install]\nWantedBy=%s\n", target)
+	files = append(files, serviceFile{filepath.Join(dir, s.name+".service"), b.String()})
+	return files, nil
+}
+
+// systemdCommand joins a command line for ExecStart, quoting arguments
+// with spaces or quotes
+func systemdCommand(exe string, args []string) string {
+	parts := make([]string, 0, len(args)+1)
+	for _, a := range append([]string{exe}, args...) {
+		if a == "" || strings.ContainsAny(a, " \t\"'\\$%;") {
+			a = strconv.Quote(strings.ReplaceAll(strings.ReplaceAll(a, "%", "%%"), "$", "$$"))
+		}
+		parts = append(parts, a)
+	}
+	return strings.Join(parts, " ")
+}
+
+// launchdLabel returns the launchd label of the service
+func (s serviceSpec) launchdLabel() string {
+	return "com.github.udit2303." + s.name
+}
+
+// launchdPlist returns the launch agent (with -user) or daemon property list
+func (s serviceSpec) launchdPlist() ([]serviceFile, error) {
+	dir := "/Library/LaunchDaemons"
+	if s.user {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, "Library", "LaunchAgents")
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+`, html.EscapeString(s.launchdLabel()))
+	for _, a := range append([]string{s.exe}, s.daemonArgs()...) {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", html.EscapeString(a))
+	}
+	b.WriteString("\t</array>\n")
+	if s.runAs != "" {
+		fmt.Fprintf(&b, "\t<key>UserName</key>\n\t<string>%s</string>\n", html.EscapeString(s.runAs))
+	}
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n\t<key>KeepAlive</key>\n\t<true/>\n</dict>\n</plist>\n")
+	return []serviceFile{{filepath.Join(dir, s.launchdLabel()+".plist"), b.String()}}, nil
+}
+
+// print writes the files install would create to stdout
+func (s serviceSpec) print() error {
+	if runtime.GOOS == "windows" {
+		fmt.Println(systemdCommand(s.exe, s.daemonArgs()))
+		return nil
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fmt.Printf("# %s\n%s\n", f.path, f.content)
+	}
+	return nil
+}
+
+// install writes the service files and the config file, then enables and
+// starts the service
+func (s serviceSpec) install() error {
+	if err := s.writeConfig(); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		if err := installWindowsService(s); err != nil {
+			return err
+		}
+		log.Info("Service installed and started", "service", s.name, "config", s.config)
+		return nil
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(f.path, []byte(f.content), 0644); err != nil {
+			return err
+		}
+		log.Info("Wrote service file", "path", f.path)
+	}
+	if runtime.GOOS == "darwin" {
+		err = runManager("launchctl", "load", "-w", files[0].path)
+	} else {
+		if err = s.systemctl("daemon-reload"); err == nil {
+			err = s.systemctl(append([]string{"enable", "--now"}, s.units(files)...)...)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("Service installed and started", "service", s.name, "config", s.config, "user", s.runAs)
+	return nil
+}
+
+// uninstall stops and disables the service and removes its files. The
+// config file is kept.
+func (s serviceSpec) uninstall() error {
+	if runtime.GOOS == "windows" {
+		if err := uninstallWindowsService(s.name); err != nil {
+			return err
+		}
+		log.Info("Service removed", "service", s.name)
+		return nil
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	// Units installed with -socket are removed even when it isn't given now
+	if runtime.GOOS == "linux" && !s.socket {
+		s.socket = true
+		if files, err = s.files(); err != nil {
+			return err
+		}
+	}
+	var installed []serviceFile
+	for _, f := range files {
+		if _, err := os.Stat(f.path); err == nil {
+			installed = append(installed, f)
+		}
+	}
+	if len(installed) == 0 {
+		return fmt.Errorf("service %s is not installed", s.name)
+	}
+	if runtime.GOOS == "darwin" {
+		if err := runManager("launchctl", "unload", "-w", installed[0].path); err != nil {
+			log.Warn("Failed to stop the service", "error", err)
+		}
+	} else if err := s.systemctl(append([]string{"disable", "--now"}, s.units(installed)...)...); err != nil {
+		log.Warn("Failed to stop the service", "error", err)
+	}
+	for _, f := range installed {
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		log.Info("Removed service file", "path", f.path)
+	}
+	if runtime.GOOS == "linux" {
+		return s.systemctl("daemon-reload")
+	}
+	return nil
+}
+
+// writeConfig creates the daemon config file from the template unless it
+// exists, owned by the account the service runs as
+func (s serviceSpec) writeConfig() error {
+	if _, err := os.Stat(s.config); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.config), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.config, []byte(serviceConfigTemplate), 0644); err != nil {
+		return err
+	}
+	log.Info("Wrote daemon config file", "path", s.config)
+	if s.runAs != "" {
+		if u, err := user.Lookup(s.runAs); err == nil {
+			uid, _ := strconv.Atoi(u.Uid)
+			gid, _ := strconv.Atoi(u.Gid)
+			os.Chown(s.config, uid, gid)
+		}
+	}
+	return nil
+}
+
+// units returns the names of the systemd units among files. With socket
+// activation only the sockets are enabled; they start the service.
+func (s serviceSpec) units(files []serviceFile) []string {
+	var units, sockets []string
+	for _, f := range files {
+		unit := filepath.Base(f.path)
+		units = append(units, unit)
+		if strings.HasSuffix(unit, ".socket") {
+			sockets = append(sockets, unit)
+		}
+	}
+	if len(sockets) > 0 {
+		return sockets
+	}
+	return units
+}
+
+// systemctl runs systemctl on the system or user instance
+func (s serviceSpec) systemctl(args ...string) error {
+	if s.user {
+		args = append([]string{"--user"}, args...)
+	}
+	return runManager("systemctl", args...)
+}
+
+// runManager runs a service manager command, passing its output through
+func runManager(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// activationSockets returns the transfer and web UI listeners passed by
+// the service manager, or nil when it passed none. The transfer socket is
+// the one named "transfer", or the only one not named "ui".
+func activationSockets() (transfer, ui net.Listener, err error) {
+	byName, err := util.ActivationListeners()
+	if err != nil || byName == nil {
+		return nil, nil, err
+	}
+	if lns := byName["ui"]; len(lns) > 0 {
+		ui = lns[0]
+		delete(byName, "ui")
+	}
+	lns := byName["transfer"]
+	if lns == nil && len(byName) == 1 {
+		for _, l := range byName {
+			lns = l
+		}
+	}
+	if len(lns) != 1 || len(byName) > 1 {
+		for _, l := range byName {
+			for _, ln := range l {
+				ln.Close()
+			}
+		}
+		if ui != nil {
+			ui.Close()
+		}
+		return nil, nil, errors.New(`expected one transfer socket, named "transfer", and optionally one named "ui"`)
+	}
+	log.Info("Using sockets passed by the service manager", "transfer", lns[0].Addr().String(), "ui", ui != nil)
+	return lns[0], ui, nil
+}
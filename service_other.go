@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// runAsService reports false: only Windows starts the daemon as a service
+// process of its own kind
+func runAsService(name string, run func() int) (int, bool) {
+	return 0, false
+}
+
+// installWindowsService is only available on Windows
+func installWindowsService(s serviceSpec) error {
+	return errors.New("Windows services can only be installed on Windows")
+}
+
+// uninstallWindowsService is only available on Windows
+func uninstallWindowsService(name string) error {
+	return errors.New("Windows services can only be removed on Windows")
+}
@@ -0,0 +1,116 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// runAsService runs run as the service name when the Windows service
+// manager started this process, returning its exit code, and reports
+// whether it did
+func runAsService(name string, run func() int) (int, bool) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return 0, false
+	}
+	h := &serviceHandler{run: run}
+	if err := svc.Run(name, h); err != nil {
+		log.Error("Service failed", "service", name, "error", err)
+		return 1, true
+	}
+	return h.code, true
+}
+
+// serviceHandler passes the service manager's stop and reload requests on
+// as the signals the daemon handles
+type serviceHandler struct {
+	run  func() int
+	code int
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan int, 1)
+	go func() { done <- h.run() }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange}
+	for {
+		select {
+		case h.code = <-done:
+			status <- svc.Status{State: svc.StopPending}
+			return h.code != 0, uint32(h.code)
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				signalNonBlocking(shutdownSignals, syscall.SIGTERM)
+			case svc.ParamChange:
+				signalNonBlocking(reloadSignals, syscall.SIGHUP)
+			}
+		}
+	}
+}
+
+// signalNonBlocking delivers sig on ch unless one is already pending
+func signalNonBlocking(ch chan os.Signal, sig os.Signal) {
+	select {
+	case ch <- sig:
+	default:
+	}
+}
+
+// installWindowsService registers the daemon with the service manager,
+// starting with Windows and restarting when it fails, and starts it
+func installWindowsService(s serviceSpec) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("cannot connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	if existing, err := m.OpenService(s.name); err == nil {
+		existing.Close()
+		return fmt.Errorf("service %s already exists", s.name)
+	}
+	service, err := m.CreateService(s.name, s.exe, mgr.Config{
+		DisplayName: "p2p-client daemon",
+		Description: "Receives and sends files for p2p-client",
+		StartType:   mgr.StartAutomatic,
+	}, s.daemonArgs()...)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 5 * time.Second}
+	if err := service.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, 24*60*60); err != nil {
+		log.Warn("Failed to set the service to restart on failure", "error", err)
+	}
+	return service.Start()
+}
+
+// uninstallWindowsService stops the service and removes it
+func uninstallWindowsService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("cannot connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	service, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer service.Close()
+	if _, err := service.Control(svc.Stop); err != nil && !errors.Is(err, windows.ERROR_SERVICE_NOT_ACTIVE) {
+		log.Warn("Failed to stop the service", "error", err)
+	}
+	return service.Delete()
+}
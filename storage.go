@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/addrbook"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/objstore"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+)
+
+const storageUsage = "Stream received files to this object storage URL instead of -out: s3://bucket/prefix, or gs://bucket/prefix for Google Cloud Storage; ?endpoint=URL for MinIO and other S3-compatible servers. Credentials come from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY"
+
+// storeCheckTimeout bounds checking a store's bucket at startup
+const storeCheckTimeout = 15 * time.Second
+
+// receiveStorage returns the hook streaming a receiving node's files to
+// object storage: those of a sender saved with its own -storage go there,
+// the rest to the store at url, or to disk if url is "". With ask, each
+// file is confirmed on the console first unless the sender is saved as
+// auto-accepted. It returns nil if no store is configured at all, leaving
+// the free disk space in the node's announced limits.
+func receiveStorage(url string, ask bool) (func(remote string, m *transfer.Manifest) (io.WriteCloser, error), error) {
+	stores := &storeCache{stores: map[string]*objstore.Store{}}
+	if url != "" {
+		s, err := stores.get(url)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), storeCheckTimeout)
+		defer cancel()
+		if err := s.Check(ctx); err != nil {
+			return nil, err
+		}
+		log.Info("Streaming received files to object storage", "storage", url)
+	} else if !peerStorage() {
+		return nil, nil
+	}
+	return func(remote string, m *transfer.Manifest) (io.WriteCloser, error) {
+		u, prompt := url, ask
+		if e := savedSender(m); e != nil {
+			if e.Storage != "" {
+				u = e.Storage
+			}
+			if e.AutoAccept != nil {
+				prompt = !*e.AutoAccept
+			}
+		}
+		if u == "" {
+			return nil, nil
+		}
+		s, err := stores.get(u)
+		if err != nil {
+			return nil, err
+		}
+		obj := s.Create(m.FileName, m.FileSize)
+		if prompt {
+			if err := netconn.ConfirmStore(remote, m, obj.Location()); err != nil {
+				return nil, err
+			}
+		}
+		log.Info("Storing file in object storage", "transfer_id", m.TransferID, "file", m.FileName, "location", obj.Location())
+		return &storedObject{Object: obj, transferID: m.TransferID}, nil
+	}, nil
+}
+
+// peerStorage reports whether any saved peer has its own store
+func peerStorage() bool {
+	book, err := addrbook.Open()
+	if err != nil {
+		return false
+	}
+	for _, e := range book.List() {
+		if e.Storage != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// storeCache opens each store once
+type storeCache struct {
+	mu     sync.Mutex
+	stores map[string]*objstore.Store
+}
+
+func (c *storeCache) get(url string) (*objstore.Store, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.stores[url]; ok {
+		return s, nil
+	}
+	s, err := objstore.Open(url)
+	if errors.Is(err, objstore.ErrNoCredentials) {
+		return nil, fmt.Errorf("cannot store files in %s: %w", url, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.stores[url] = s
+	return s, nil
+}
+
+// storedObject logs an object once it is kept
+type storedObject struct {
+	*objstore.Object
+	transferID string
+}
+
+func (o *storedObject) Close() error {
+	if err := o.Object.Close(); err != nil {
+		return fmt.Errorf("failed to store file: %w", err)
+	}
+	log.Info("File stored", "transfer_id", o.transferID, "location", o.Location())
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/udit2303/p2p-client/pkg/discovery"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/transfer"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// runSync implements `sync <dir> -to <peer>`: mirrors dir one way to the
+// peer, sending only the files it lacks or holds in another version
+func runSync(args []string) int {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	to := fs.String("to", "", "Peer to sync to: ip:port, a saved peer, or a node name discovered over mDNS")
+	search := fs.String("search", defaultCode(), searchUsage)
+	deleteRemoved := fs.Bool("delete", false, "Remove files from the peer's copy that are no longer in <dir>")
+	links := fs.String("links", transfer.LinksPreserve, "Symbolic links: \"preserve\" those that stay inside <dir>, \"follow\" them to send what they point to, or \"skip\" them")
+	emptyDirs := fs.Bool("empty-dirs", true, "Recreate empty directories on the peer")
+	fifos := fs.Bool("fifos", true, "Recreate named pipes on the peer")
+	chunkSize := fs.String("chunk-size", "", "Chunk size, e.g. 256K or 4M, or \"auto\" to adapt to the link")
+	proxyURL := fs.String("proxy", "", "Proxy for outgoing connections: socks5://[user:pass@]host:port or http://host:port (default $ALL_PROXY)")
+	discoveryFlag := fs.String("discovery", os.Getenv(discovery.Env), discoveryUsage)
+	modeFlag := fs.String("mode", os.Getenv(modeEnv), modeUsage)
+	lf := addLogFlags(fs)
+	tf := addTimeoutFlags(fs)
+	bf := addBindFlags(fs)
+	tcf := addTCPFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: p2p sync <dir> -to <ip:port|name> [flags]")
+		fmt.Fprintln(fs.Output(), "Mirrors <dir> into <out>/<dir name> on the peer, sending only new and changed files.")
+		fs.PrintDefaults()
+	}
+	pos := parseInterspersed(fs, args)
+	if len(pos) != 1 || *to == "" {
+		fs.Usage()
+		return 2
+	}
+	dir := pos[0]
+
+	lf.apply(false)
+	if err := tf.apply(); err != nil {
+		log.Error("Invalid timeout", "error", err)
+		return 2
+	}
+	if err := bf.apply(); err != nil {
+		log.Error("Invalid -iface or -bind", "error", err)
+		return 2
+	}
+	if err := tcf.apply(); err != nil {
+		log.Error("Invalid TCP option", "error", err)
+		return 2
+	}
+	if err := applyDiscovery(*discoveryFlag); err != nil {
+		log.Error("Invalid -discovery", "value", *discoveryFlag, "error", err)
+		return 2
+	}
+	if err := applyMode(*modeFlag); err != nil {
+		log.Error("Invalid -mode", "value", *modeFlag, "error", err)
+		return 2
+	}
+	if !transfer.OperatingMode.Sends() {
+		log.Error("This node is receive-only and doesn't send")
+		return 1
+	}
+	if err := netconn.SetProxy(*proxyURL); err != nil {
+		log.Error("Invalid -proxy", "value", *proxyURL, "error", err)
+		return 2
+	}
+	if err := applyChunkSize(*chunkSize); err != nil {
+		log.Error("Invalid -chunk-size", "value", *chunkSize, "error", err)
+		return 2
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		log.Error("Not a directory", "dir", dir)
+		return 2
+	}
+	entries, err := transfer.SyncFiles(dir, transfer.SyncPolicy{Links: *links, EmptyDirs: *emptyDirs, FIFOs: *fifos})
+	if err != nil {
+		log.Error("Cannot list directory", "error", err)
+		return 1
+	}
+
+	// Pin the peer once so later files can't be redirected to another node
+	usePasscodeOf(*search)
+	host, port, fingerprint, err := resolveTarget(*to, *search, -1)
+	if err != nil {
+		log.Error("Cannot resolve peer", "error", err)
+		util.Emit(util.EventError, "stage", "discovery", "error", err)
+		return exitCode(err)
+	}
+	log.Info("Syncing directory", "dir", dir, "entries", len(entries), "address", fmt.Sprintf("%s:%d", host, port))
+
+	// Ask for the passcode once rather than on every file
+	code, err := netconn.PasscodeSource()
+	if err != nil {
+		log.Error("Cannot read passcode", "error", err)
+		return 1
+	}
+	netconn.PasscodeSource = func() (string, error) { return code, nil }
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	dial := netconn.TCPDialer(ctx, host, port)
+
+	var sent, unchanged, skipped, failed int
+	var lastErr error
+	oldPeer := false
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return exitCancelled
+		}
+		if oldPeer && e.Kind != transfer.KindSync {
+			skipped++
+			continue
+		}
+		err := netconn.SendSyncEntryVia(dial, fingerprint, dir, e)
+		switch {
+		case errors.Is(err, transfer.ErrAlreadyHave):
+			unchanged++
+		case e.Kind != transfer.KindSync && errors.Is(err, transfer.ErrProtocolVersion):
+			// Files still go to a peer that only takes files
+			log.Warn("Peer is too old for empty directories, links and named pipes; leaving them out", "error", err)
+			oldPeer = true
+			skipped++
+		case err != nil:
+			log.Error("Failed to sync file", "file", e.Path, "error", err)
+			util.Emit(util.EventError, "stage", "sync", "file", e.Path, "error", err)
+			failed++
+			lastErr = err
+			// The rest would fail the same way
+			if errors.Is(err, netconn.ErrAuthFailed) || errors.Is(err, netconn.ErrKeyMismatch) || errors.Is(err, transfer.ErrProtocolVersion) {
+				return exitCode(err)
+			}
+		default:
+			sent++
+		}
+	}
+	// Only prune a copy that is otherwise complete
+	if *deleteRemoved && failed == 0 && ctx.Err() == nil {
+		paths := make([]string, len(entries))
+		for i, e := range entries {
+			paths[i] = e.Path
+		}
+		if err := netconn.SendSyncIndexVia(dial, fingerprint, dir, paths); err != nil {
+			log.Error("Failed to remove deleted files on the peer", "error", err)
+			util.Emit(util.EventError, "stage", "sync", "error", err)
+			return exitCode(err)
+		}
+	}
+	if ctx.Err() != nil {
+		return exitCancelled
+	}
+	log.Info("Sync finished", "sent", sent, "unchanged", unchanged, "skipped", skipped, "failed", failed)
+	if lastErr != nil {
+		return exitCode(lastErr)
+	}
+	return 0
+}
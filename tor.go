@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+const (
+	torUsage   = "Make outgoing connections through Tor's SOCKS port ($" + netconn.TorSOCKSEnv + ", default " + netconn.DefaultTorSOCKS + "), hiding this machine's IP address from the receiver; .onion addresses always go through Tor"
+	onionUsage = "Publish an onion service for the listening port through Tor's control port ($" + netconn.TorControlEnv + ", default " + netconn.DefaultTorControl + "), so senders reach this node over Tor without learning its IP address"
+)
+
+// publishOnion publishes the node listening on port as an onion service
+// for as long as ctx lasts, under the same address every run
+func publishOnion(ctx context.Context, port int) error {
+	host := "127.0.0.1"
+	if ip := util.BoundIP(); ip != nil {
+		host = ip.String()
+	}
+	addr, err := netconn.PublishOnion(ctx, net.JoinHostPort(host, strconv.Itoa(port)), port, "")
+	if err != nil {
+		return err
+	}
+	log.Info("Onion service published; senders reach this node at its onion address", "address", addr)
+	return nil
+}
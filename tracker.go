@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/discovery"
+)
+
+// runTracker implements `tracker [flags]`: an HTTP service where nodes
+// using -discovery tracker:<url> announce themselves and find each other
+func runTracker(args []string) int {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	listen := fs.String("listen", ":4600", "Address to listen on")
+	ttl := fs.Duration("ttl", discovery.TrackerTTL, "How long a node stays listed after its last announcement")
+	lf := addLogFlags(fs)
+	fs.Parse(args)
+
+	lf.apply(false)
+	discovery.TrackerTTL = *ttl
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Error("Failed to listen", "address", *listen, "error", err)
+		return 1
+	}
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	srv := &http.Server{Handler: discovery.NewTrackerServer(), ReadHeaderTimeout: 10 * time.Second}
+	context.AfterFunc(ctx, func() { srv.Close() })
+
+	log.Info("Tracker listening", "address", ln.Addr().String())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error("Tracker stopped", "error", err)
+		return 1
+	}
+	return 0
+}
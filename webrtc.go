@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/rendezvous"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// runWebRTC implements `webrtc send|receive`: a transfer over a WebRTC data
+// channel, signaled by pasting the offer and answer or through a rendezvous
+// server
+func runWebRTC(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: p2p webrtc send [flags] <file>")
+		fmt.Fprintln(os.Stderr, "       p2p webrtc receive [flags]")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	var (
+		fs   *flag.FlagSet
+		file string
+	)
+	switch args[0] {
+	case "send":
+		fs = flag.NewFlagSet("webrtc send", flag.ExitOnError)
+	case "receive", "recv":
+		fs = flag.NewFlagSet("webrtc receive", flag.ExitOnError)
+	default:
+		usage()
+		return 2
+	}
+	sending := args[0] == "send"
+	var wormhole *bool
+	var retries *int
+	var code, outDir *string
+	if sending {
+		wormhole = fs.Bool("wormhole", false, "Signal through the rendezvous server: print a code for the receiver and trickle ICE candidates")
+		retries = fs.Int("retries", netconn.WebRTCRetries, "Times to signal a new connection and resume when it drops, 0 to give up at once (needs -wormhole)")
+	} else {
+		outDir = fs.String("out", "public", "Output directory for the received file")
+		code = fs.String("code", "", "Signal through the rendezvous server with the code the sender printed")
+	}
+	rendezvousAddr := fs.String("rendezvous", "", "Rendezvous server host:port used with -wormhole and -code (default $"+rendezvous.ServerEnv+")")
+	timeout := fs.Duration("timeout", netconn.WebRTCTimeout, "Give up if the transfer isn't done this long after signaling")
+	idleTimeout := fs.Duration("idle-timeout", netconn.DefaultIdleTimeout, "Give up when the peer sends or takes nothing for this long, 0 to wait forever")
+	turn := fs.String("turn", "", "Comma-separated TURN servers, e.g. turn:user:pass@host:3478?transport=tcp")
+	stunFlag := fs.String("stun", os.Getenv(util.STUNEnv), "Comma-separated STUN servers (host:port) (default $"+util.STUNEnv+", or public Google and Cloudflare servers)")
+	proxyURL := fs.String("proxy", "", "Proxy for TURN over TCP: socks5://[user:pass@]host:port or http://host:port (default $ALL_PROXY)")
+	chunkSize := fs.String("chunk-size", "", "Chunk size for sending, e.g. 256K or 4M, or \"auto\" to adapt to the link")
+	lf := addLogFlags(fs)
+	pos := parseInterspersed(fs, args[1:])
+	if sending && len(pos) != 1 || !sending && len(pos) != 0 {
+		usage()
+		return 2
+	}
+	if sending {
+		file = pos[0]
+	}
+
+	lf.apply(false)
+	if *timeout <= 0 || *idleTimeout < 0 {
+		log.Error("-timeout must be positive and -idle-timeout can't be negative")
+		return 2
+	}
+	netconn.WebRTCTimeout = *timeout
+	if sending {
+		if *retries < 0 {
+			log.Error("-retries can't be negative")
+			return 2
+		}
+		netconn.WebRTCRetries = *retries
+	}
+	netconn.IdleTimeout = *idleTimeout
+	if *turn != "" {
+		netconn.TURNServers = strings.Split(*turn, ",")
+	}
+	if err := util.SetSTUNServers(*stunFlag); err != nil {
+		log.Error("Invalid -stun", "value", *stunFlag, "error", err)
+		return 2
+	}
+	if err := netconn.SetProxy(*proxyURL); err != nil {
+		log.Error("Invalid -proxy", "value", *proxyURL, "error", err)
+		return 2
+	}
+	if err := applyChunkSize(*chunkSize); err != nil {
+		log.Error("Invalid -chunk-size", "value", *chunkSize, "error", err)
+		return 2
+	}
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	warnSymmetricNAT()
+	if sending {
+		return sendWebRTC(ctx, file, *wormhole, *rendezvousAddr)
+	}
+	return receiveWebRTC(ctx, *outDir, *code, *rendezvousAddr)
+}
+
+// warnSymmetricNAT warns when this machine is behind a symmetric NAT and no
+// TURN relay is set: the address STUN saw is not the one the peer would
+// reach, so WebRTC only connects through a relay
+func warnSymmetricNAT() {
+	if len(netconn.TURNServers) > 0 {
+		return
+	}
+	if nat, err := util.DetectNAT(3 * time.Second); err == nil && nat.Type == util.NATSymmetric {
+		log.Warn("Symmetric NAT detected; a direct WebRTC connection will likely fail unless the peer has a public address. Add a -turn relay")
+	}
+}
+
+// sendWebRTC sends file over WebRTC, signaling through the rendezvous
+// server with wormhole and by copy and paste otherwise, and returns the exit
+// code
+func sendWebRTC(ctx context.Context, file string, wormhole bool, rendezvousAddr string) int {
+	if _, err := os.Stat(file); err != nil {
+		log.Error("File does not exist", "path", file)
+		util.Emit(util.EventError, "stage", "startup", "error", "file does not exist", "path", file)
+		return 1
+	}
+	var sig netconn.Signaler
+	if wormhole {
+		session, err := offerSignaling(ctx, rendezvousAddr)
+		if err != nil {
+			log.Error("Rendezvous failed", "error", err)
+			util.Emit(util.EventError, "stage", "rendezvous", "error", err)
+			return exitCode(err)
+		}
+		defer session.Close()
+		sig = session
+	}
+	if err := netconn.StartWebRTCSender(file, sig); err != nil {
+		log.Error("WebRTC send failed", "error", err)
+		util.Emit(util.EventError, "stage", "webrtc_send", "error", err)
+		return exitCode(err)
+	}
+	return 0
+}
+
+// receiveWebRTC receives a file over WebRTC into outDir, signaling through
+// the rendezvous server with a code and by copy and paste otherwise, and
+// returns the exit code
+func receiveWebRTC(ctx context.Context, outDir, code, rendezvousAddr string) int {
+	var sig netconn.Signaler
+	if code != "" {
+		session, err := joinSignaling(ctx, rendezvousAddr, code)
+		if err != nil {
+			log.Error("Rendezvous failed", "error", err)
+			util.Emit(util.EventError, "stage", "rendezvous", "error", err)
+			return exitCode(err)
+		}
+		defer session.Close()
+		sig = session
+	}
+	if err := netconn.StartWebRTCReceiver(outDir, sig); err != nil {
+		log.Error("WebRTC receive failed", "error", err)
+		util.Emit(util.EventError, "stage", "webrtc_receive", "error", err)
+		return exitCode(err)
+	}
+	return 0
+}
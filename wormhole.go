@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/udit2303/p2p-client/pkg/keys"
+	"github.com/udit2303/p2p-client/pkg/netconn"
+	"github.com/udit2303/p2p-client/pkg/rendezvous"
+	"github.com/udit2303/p2p-client/pkg/util"
+)
+
+// runRendezvous implements `rendezvous [flags]`: a server that pairs
+// senders and receivers by code and relays between them
+func runRendezvous(args []string) int {
+	fs := flag.NewFlagSet("rendezvous", flag.ExitOnError)
+	listen := fs.String("listen", ":4500", "Address to listen on")
+	claimTimeout := fs.Duration("claim-timeout", rendezvous.ClaimTimeout, "How long a code waits for its receiver")
+	lf := addLogFlags(fs)
+	fs.Parse(args)
+
+	lf.apply(false)
+	rendezvous.ClaimTimeout = *claimTimeout
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Error("Failed to listen", "address", *listen, "error", err)
+		return 1
+	}
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	context.AfterFunc(ctx, func() { ln.Close() })
+
+	log.Info("Rendezvous server listening", "address", ln.Addr().String())
+	if err := rendezvous.NewServer().Serve(ln); err != nil {
+		log.Error("Rendezvous server stopped", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// sendWormhole sends src to whoever enters the code printed here
+func sendWormhole(server, src string) int {
+	server, err := rendezvous.ServerAddr(server)
+	if err != nil {
+		log.Error("Cannot send with a code", "error", err)
+		return 2
+	}
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	pending, err := rendezvous.Offer(ctx, server)
+	if err != nil {
+		log.Error("Cannot get a code", "error", err)
+		util.Emit(util.EventError, "stage", "rendezvous", "error", err)
+		return 1
+	}
+	defer pending.Close()
+	util.Emit(util.EventRendezvousCode, "code", pending.Code)
+	if !util.JSONEvents() {
+		fmt.Fprintf(util.ConsoleOutput(), "On the other machine run:\n\n    p2p receive -code %s\n\n", pending.Code)
+	}
+
+	session, err := pending.Wait(ctx)
+	if err != nil {
+		log.Error("Rendezvous failed", "error", err)
+		util.Emit(util.EventError, "stage", "rendezvous", "error", err)
+		return exitCode(err)
+	}
+	defer session.Close()
+	conn, fingerprint, err := session.DialTransfer(ctx)
+	if err != nil {
+		log.Error("Rendezvous failed", "error", err)
+		util.Emit(util.EventError, "stage", "rendezvous", "error", err)
+		return exitCode(err)
+	}
+	if err := netconn.SendFileOver(conn, src, fingerprint); err != nil {
+		log.Error("Send failed", "error", err)
+		util.Emit(util.EventError, "stage", "send", "error", err)
+		return exitCode(err)
+	}
+	return 0
+}
+
+// receiveCode receives one transfer from the sender that printed code
+func receiveCode(ctx context.Context, server, code string, cfg netconn.ServerConfig) int {
+	server, err := rendezvous.ServerAddr(server)
+	if err != nil {
+		log.Error("Cannot receive with a code", "error", err)
+		return 2
+	}
+	pub, err := keys.LoadPublicKey()
+	if err != nil {
+		log.Error("Failed to load public key", "error", err)
+		return 1
+	}
+
+	session, err := rendezvous.Join(ctx, server, code)
+	if err != nil {
+		log.Error("Rendezvous failed", "error", err)
+		util.Emit(util.EventError, "stage", "rendezvous", "error", err)
+		return exitCode(err)
+	}
+	defer session.Close()
+	conn, err := session.AcceptTransfer(ctx, keys.PublicKeyFingerprint(pub))
+	if err != nil {
+		log.Error("Rendezvous failed", "error", err)
+		util.Emit(util.EventError, "stage", "rendezvous", "error", err)
+		return exitCode(err)
+	}
+
+	// ServeConn returns early without calling OnReceived if the sender
+	// never gets as far as the transfer
+	result := errors.New("sender disconnected before the transfer")
+	cfg.OnReceived = func(err error) { result = err }
+	stopServe := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopServe()
+	netconn.ServeConn(conn, cfg)
+	if result != nil {
+		log.Error("Receive failed", "error", result)
+		return exitCode(result)
+	}
+	return 0
+}
+
+// offerSignaling claims a code for a WebRTC send and waits for the receiver
+// to enter it; the session then carries the offer, answer and candidates
+func offerSignaling(ctx context.Context, server string) (*rendezvous.Session, error) {
+	server, err := rendezvous.ServerAddr(server)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := rendezvous.Offer(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	util.Emit(util.EventRendezvousCode, "code", pending.Code)
+	if !util.JSONEvents() {
+		fmt.Fprintf(util.ConsoleOutput(), "On the other machine run:\n\n    p2p webrtc receive -code %s\n\n", pending.Code)
+	}
+	session, err := pending.Wait(ctx)
+	if err != nil {
+		pending.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// joinSignaling joins the WebRTC send that printed code
+func joinSignaling(ctx context.Context, server, code string) (*rendezvous.Session, error) {
+	server, err := rendezvous.ServerAddr(server)
+	if err != nil {
+		return nil, err
+	}
+	return rendezvous.Join(ctx, server, code)
+}